@@ -45,6 +45,54 @@ func (m *ConcurrentMap) Set(key string, value string) bool{
 	return ok
 }
 
+// Sets the given value under the specified key if no value was associated with it.
+func (m *ConcurrentMap) SetIfAbsent(key string, value string) bool {
+	// Get map shard.
+	shard := m.GetShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	_, ok := shard.items[key]
+	if !ok {
+		shard.items[key] = value
+	}
+	return !ok
+}
+
+// Replaces the value under the specified key with newValue, only if the key
+// exists and currently holds expected. Reports whether the swap took place.
+func (m *ConcurrentMap) CompareAndSwap(key string, expected string, newValue string) bool {
+	shard := m.GetShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	val, ok := shard.items[key]
+	if !ok || val != expected {
+		return false
+	}
+	shard.items[key] = newValue
+	return true
+}
+
+// Callback to return new element to be inserted into the map, and whether
+// to store it at all; e.g. an update returns exist.
+// It is called while lock is held, therefore it MUST NOT
+// try to access other keys in same map, as it can lead to deadlock since
+// Go sync.RWLock is not reentrant.
+type UpsertCb func(exist bool, valueInMap string, newValue string) (string, bool)
+
+// Insert or Update - updates existing element or inserts a new one using UpsertCb.
+// Returns the value previously under key, and whether a new one was stored.
+func (m *ConcurrentMap) Upsert(key string, value string, cb UpsertCb) (string, bool) {
+	shard := m.GetShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	v, ok := shard.items[key]
+	res, store := cb(ok, v, value)
+	if store {
+		shard.items[key] = res
+	}
+	return v, store
+}
+
 // Retrieves an element from map under given key.
 func (m ConcurrentMap) Get(key string) (string, bool) {
 	// Get shard
@@ -137,6 +185,26 @@ func (m ConcurrentMap) IterBuffered() <-chan Tuple {
 	return ch
 }
 
+// A copy of the map at one point in time: every shard is read-locked at
+// once, and only while it is copied, so writers wait no longer than that.
+func (m ConcurrentMap) Snapshot() map[string]string {
+	for _, shard := range m {
+		shard.RLock()
+	}
+	n := 0
+	for _, shard := range m {
+		n += len(shard.items)
+	}
+	tmp := make(map[string]string, n)
+	for _, shard := range m {
+		for key, val := range shard.items {
+			tmp[key] = val
+		}
+		shard.RUnlock()
+	}
+	return tmp
+}
+
 //Reviles ConcurrentMap "private" variables to json marshal.
 func (m ConcurrentMap) MarshalJSON() ([]byte, error) {
 	// Create a temporary map, which will hold all item spread across shards.
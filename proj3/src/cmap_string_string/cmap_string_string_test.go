@@ -0,0 +1,95 @@
+package cmap_string_string
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSetIfAbsent(t *testing.T) {
+	m := New()
+	if !m.SetIfAbsent("a", "1") {
+		t.Fatalf("SetIfAbsent of a new key failed")
+	}
+	if m.SetIfAbsent("a", "2") {
+		t.Fatalf("SetIfAbsent of an existing key succeeded")
+	}
+	if v, _ := m.Get("a"); v != "1" {
+		t.Fatalf("a is %q, expected 1", v)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	m := New()
+	if m.CompareAndSwap("a", "", "1") {
+		t.Fatalf("CompareAndSwap of a missing key succeeded")
+	}
+	if m.Has("a") {
+		t.Fatalf("CompareAndSwap of a missing key inserted it")
+	}
+	m.Set("a", "1")
+	if m.CompareAndSwap("a", "0", "2") {
+		t.Fatalf("CompareAndSwap with a wrong expected value succeeded")
+	}
+	if !m.CompareAndSwap("a", "1", "2") {
+		t.Fatalf("CompareAndSwap with the right expected value failed")
+	}
+	if v, _ := m.Get("a"); v != "2" {
+		t.Fatalf("a is %q, expected 2", v)
+	}
+
+	// concurrent increments through CompareAndSwap lose none
+	m.Set("n", "0")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for {
+					v, _ := m.Get("n")
+					n, _ := strconv.Atoi(v)
+					if m.CompareAndSwap("n", v, strconv.Itoa(n+1)) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := m.Get("n"); v != "800" {
+		t.Fatalf("n is %q after 800 increments", v)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	m := New()
+	update := func(exist bool, valueInMap string, newValue string) (string, bool) {
+		return newValue, exist
+	}
+	if _, ok := m.Upsert("a", "1", update); ok || m.Has("a") {
+		t.Fatalf("an update of a missing key stored it")
+	}
+	m.Set("a", "1")
+	if old, ok := m.Upsert("a", "2", update); !ok || old != "1" {
+		t.Fatalf("Upsert -> %q %v, expected 1 true", old, ok)
+	}
+
+	appendCb := func(exist bool, valueInMap string, newValue string) (string, bool) {
+		return valueInMap + newValue, true
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Upsert("s", "x", appendCb)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := m.Get("s"); len(v) != 800 {
+		t.Fatalf("s holds %d of 800 appends", len(v))
+	}
+}
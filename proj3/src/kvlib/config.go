@@ -1,9 +1,7 @@
 package kvlib
 
 import(
-  "os"
   "fmt"
-  "strconv"
   "time"
   "math/rand"
 )
@@ -41,49 +39,9 @@ func (a Duration_slice) Less(i, j int) bool { return a[i] < a[j] }
 func GenLongStr()(string){
   dummy:="TEST kv long str ......"
   for i:=0; i<10;i++ {
-	dummy=dummy+ string(i%26+65)
+	dummy=dummy+ string(rune(i%26+65))
   }
   r := rand.New(rand.NewSource(time.Now().UnixNano()))
-  dummy=fmt.Sprintf("rand%lf", r.Float64())+dummy+fmt.Sprintf("rand%lf", r.Float64())+":"
+  dummy=fmt.Sprintf("rand%f", r.Float64())+dummy+fmt.Sprintf("rand%f", r.Float64())+":"
   return dummy
 }
-
-func Det_role() int {
-	arg_num := len(os.Args)
-	for i := 0 ; i < arg_num ;i++{
-		switch os.Args[i] {
-			case "-p":
-				return PRIMARY
-			case "-b":
-				return BACKUP
-		}
-	}
-  fmt.Println("Unknown; please specify role as command line parameter.")
-  panic(os.Args)
-	return 0
-}
-func Find_port(role int, conf map[string]string) (int,int,int){
-	p,err := strconv.Atoi(conf["port"])
-		if err != nil {
-			fmt.Println("Failed to parse port:"+conf["port"]);
-			panic(err)
-		}
-	bp,err := strconv.Atoi(conf["back_port"])
-		if err != nil {
-			fmt.Println("Failed to parse back_port:"+conf["back_port"]);
-			panic(err)
-		}
-		if (bp == 0 ){
-      fmt.Println("Invalid back_port:");
-			panic(conf["back_port"])
-		}
-
-	if conf["primary"] != conf["backup"]{
-		return p,p,p
-	}
-
-	if role==PRIMARY{
-		return p,p,bp
-	}
-	return bp,p,bp
-}
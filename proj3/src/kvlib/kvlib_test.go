@@ -2,7 +2,10 @@ package kvlib
 
 import(
   "fmt"
-  "time"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
   "testing"
 )
 func Test1(t *testing.T) {
@@ -15,3 +18,102 @@ func Test1(t *testing.T) {
     return
   }
 }
+
+func writeSettings(t *testing.T, dir string, name string, text string) string {
+  fn := filepath.Join(dir, name)
+  if err := ioutil.WriteFile(fn, []byte(text), 0644); err != nil {
+    t.Fatal(err)
+  }
+  return fn
+}
+
+func TestSettings(t *testing.T) {
+  dir,err := ioutil.TempDir("", "kvlib")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+
+  fmt.Printf("Test: Settings of Project 3, on one host ...\n")
+  fn := writeSettings(t, dir, "same.conf", `{"primary":"127.0.0.1","backup":"127.0.0.1","port":"8088","back_port":"8089","htime":"10"}`)
+  c,err := LoadConfig(fn)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if c.Addr(PRIMARY)!="127.0.0.1:8088" || c.Addr(BACKUP)!="127.0.0.1:8089" {
+    t.Fatalf("addresses %s, %s", c.Addr(PRIMARY), c.Addr(BACKUP))
+  }
+  if c.URL(BACKUP)!="http://127.0.0.1:8089" || c.HTimeMs!=10 {
+    t.Fatalf("backup %s, htime %d", c.URL(BACKUP), c.HTimeMs)
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Settings of Project 3, on two hosts ...\n")
+  fn = writeSettings(t, dir, "two.conf", `{"primary":"10.0.0.1","backup":"10.0.0.2","port":"8088","back_port":"8089"}`)
+  c,err = LoadConfig(fn)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if c.Addr(PRIMARY)!="10.0.0.1:8088" || c.Addr(BACKUP)!="10.0.0.2:8088" {
+    t.Fatalf("addresses %s, %s", c.Addr(PRIMARY), c.Addr(BACKUP))
+  }
+  if c.HTime()!=DefaultConfig().HTime() {
+    t.Fatalf("htime %v", c.HTime())
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Settings of nodes, overridden ...\n")
+  fn = writeSettings(t, dir, "nodes.conf", `{"nodes":[{"host":"127.0.0.1","port":8088},{"host":"127.0.0.1","port":8089}],"htime":10}`)
+  os.Setenv("KV_HTIME", "20")
+  c,err = LoadConfig(fn)
+  os.Unsetenv("KV_HTIME")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if c.HTimeMs!=20 || c.Node(BACKUP).Port!=8089 {
+    t.Fatalf("htime %d, backup %v", c.HTimeMs, c.Node(BACKUP))
+  }
+  c,err = loadConfig(fn, []string{"htime=30"})
+  if err != nil || c.HTimeMs!=30 {
+    t.Fatalf("-set htime=30: %v, %v", c, err)
+  }
+  if _,err := loadConfig(fn, []string{"nosuch=1"}); err == nil {
+    t.Fatalf("-set of no setting accepted")
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Bad settings are refused ...\n")
+  for _,text := range []string{
+    `{"nodes":[{"host":"127.0.0.1","port":8088}]}`,
+    `{"nodes":[{"host":"127.0.0.1","port":8088},{"host":"127.0.0.1","port":8088}]}`,
+    `{"nodes":[{"host":"127.0.0.1","port":8088},{"host":"","port":8089}]}`,
+    `{"nodes":[{"host":"127.0.0.1","port":8088},{"host":"127.0.0.1","port":70000}]}`,
+    `{"primary":"127.0.0.1","backup":"127.0.0.1","port":"8088","back_port":"x"}`,
+    `{"nodes":[{"host":"127.0.0.1","port":8088},{"host":"127.0.0.1","port":8089}],"htime":0}`,
+  }{
+    fn = writeSettings(t, dir, "bad.conf", text)
+    if _,err := LoadConfig(fn); err == nil {
+      t.Fatalf("%s accepted", text)
+    }
+  }
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Tester settings with cases by number ...\n")
+  fn = writeSettings(t, dir, "test.conf", `{"primary":"127.0.0.1:8088","backup":"127.0.0.1:8089","concur_num":"2000","total":"2","pre":"test/","with_err_msg":"false","fmt":"false","0":"a.test","1":"b.test"}`)
+  tc,err := LoadTesterConfig(fn)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if tc.ConcurNum!=2000 || tc.Total!=2 || tc.WithErrMsg || tc.Case(1)!="test/b.test" {
+    t.Fatalf("tester settings %+v", tc)
+  }
+  tc.Fmt = true
+  if tc.Case(1)!="test/1.test" {
+    t.Fatalf("case 1 %s", tc.Case(1))
+  }
+  fn = writeSettings(t, dir, "short.conf", `{"primary":"127.0.0.1:8088","backup":"127.0.0.1:8089","total":"3","fmt":"false","0":"a.test"}`)
+  if _,err := LoadTesterConfig(fn); err == nil || !strings.Contains(err.Error(), "cases") {
+    t.Fatalf("too few cases: %v", err)
+  }
+  fmt.Printf("  ... Passed\n")
+}
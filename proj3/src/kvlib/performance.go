@@ -195,7 +195,7 @@ func testInsert(total_insert int, primary string){
   for {
     select{
       case f:=<-ch :
-        fmt.Println("failed: %d\n", f)
+        fmt.Printf("failed: %d\n", f)
          count_fail ++
       case res:=<-r :
          fmt.Println(res)
@@ -228,7 +228,7 @@ func testGet(total_get int, primary string){
   for {
     select{
       case f:=<-ch :
-        fmt.Println("failed: %d\n", f)
+        fmt.Printf("failed: %d\n", f)
          count_fail ++
       case <-r :
          //fmt.Println(res)
@@ -0,0 +1,425 @@
+package kvlib
+
+import(
+  "bytes"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "reflect"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//The settings of the primary and the backup, conf/settings.conf:
+//
+//  {
+//    "nodes": [
+//      {"host": "127.0.0.1", "port": 8088},
+//      {"host": "127.0.0.1", "port": 8089}
+//    ],
+//    "htime": 10
+//  }
+//
+//Node 0 is the primary and node 1 the backup, as in bin/start_server -p
+//and -b. A setting that is left out has its default; numbers may be
+//written as strings too. The flat format of Project 3 is read as well:
+//the hosts primary and backup, both on port, unless they are the same
+//host, where the backup is on back_port.
+//
+//A setting is overridden by the environment variable KV_ and its name in
+//capitals, e.g. KV_HTIME=20, then by -set name=value (see ConfigFlags);
+//the value of nodes is then a JSON list.
+
+const DefaultSettingsFile = "conf/settings.conf"
+
+type NodeConfig struct {
+  Host string `json:"host"`
+  Port int `json:"port"`
+}
+
+type Config struct {
+  Nodes []NodeConfig `json:"nodes"` // the primary, then the backup
+  HTimeMs int `json:"htime"` // the period of the housekeeper
+
+  File string `json:"-"` // where it was read from
+}
+
+func DefaultConfig() *Config {
+  return &Config{HTimeMs:5}
+}
+
+//the settings of the file fn, with the overrides of the environment
+func LoadConfig(fn string) (*Config,error){
+  return loadConfig(fn, nil)
+}
+
+func loadConfig(fn string, sets []string) (*Config,error){
+  data,err := ioutil.ReadFile(fn)
+  if err!=nil {
+    return nil,err
+  }
+  raw,err := readSettings(data, fn)
+  if err!=nil {
+    return nil,err
+  }
+  fields := settingFields(reflect.TypeOf(Config{}))
+  for name,f := range fields {
+    if v,ok := os.LookupEnv("KV_"+strings.ToUpper(name)); ok {
+      raw[name] = textSetting(f.Type, v)
+    }
+  }
+  for _,s := range sets {
+    i := strings.Index(s, "=")
+    if i<0 {
+      return nil,fmt.Errorf("-set %s: not name=value", s)
+    }
+    f,ok := fields[s[:i]]
+    if !ok {
+      return nil,fmt.Errorf("-set %s: no setting %q", s, s[:i])
+    }
+    raw[s[:i]] = textSetting(f.Type, s[i+1:])
+  }
+  cfg := DefaultConfig()
+  errs := decodeSettings(reflect.ValueOf(cfg).Elem(), raw, "")
+  if len(errs)==0 {
+    errs = cfg.check()
+  }
+  if len(errs)>0 {
+    return nil,fmt.Errorf("%s: %s", fn, strings.Join(errs, "; "))
+  }
+  cfg.File = fn
+  return cfg,nil
+}
+
+//the settings of a file, with the flat format of Project 3 made into nodes
+func readSettings(data []byte, name string) (map[string]json.RawMessage,error){
+  var raw map[string]json.RawMessage
+  if err := json.Unmarshal(data, &raw); err!=nil {
+    return nil,fmt.Errorf("%s: %v", name, err)
+  }
+  if _,ok := raw["nodes"]; ok {
+    return raw,nil
+  }
+  if _,ok := raw["primary"]; !ok {
+    return raw,nil // no node, as check says
+  }
+  var flat struct {
+    Primary string `json:"primary"`
+    Backup string `json:"backup"`
+    Port int `json:"port"`
+    BackPort int `json:"back_port"`
+  }
+  keys := map[string]json.RawMessage{}
+  for _,k := range []string{"primary", "backup", "port", "back_port"} {
+    keys[k] = raw[k]
+    delete(raw, k)
+  }
+  if errs := decodeSettings(reflect.ValueOf(&flat).Elem(), keys, ""); len(errs)>0 {
+    return nil,fmt.Errorf("%s: %s", name, strings.Join(errs, "; "))
+  }
+  backPort := flat.Port
+  if flat.Primary==flat.Backup {
+    backPort = flat.BackPort
+  }
+  enc,_ := json.Marshal([]NodeConfig{{flat.Primary, flat.Port}, {flat.Backup, backPort}})
+  raw["nodes"] = enc
+  return raw,nil
+}
+
+type settingField struct {
+  Index int
+  Type reflect.Type
+}
+
+//the fields of a struct of settings, by their names in JSON
+func settingFields(t reflect.Type) map[string]settingField {
+  fields := map[string]settingField{}
+  for i := 0; i<t.NumField(); i++ {
+    name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+    if name!="" && name!="-" {
+      fields[name] = settingField{i, t.Field(i).Type}
+    }
+  }
+  return fields
+}
+
+//a value given as text, as the JSON of a field of type t
+func textSetting(t reflect.Type, v string) json.RawMessage {
+  if t.Kind()==reflect.String {
+    enc,_ := json.Marshal(v)
+    return enc
+  }
+  return json.RawMessage(v)
+}
+
+//set the fields of the struct v to raw, by name; numbers and booleans
+//may be strings, and a string a number or a boolean
+func decodeSettings(v reflect.Value, raw map[string]json.RawMessage, prefix string) []string {
+  var errs []string
+  fields := settingFields(v.Type())
+  var names []string
+  for name := range raw {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _,name := range names {
+    data := bytes.TrimSpace(raw[name])
+    if len(data)==0 {
+      continue
+    }
+    f,ok := fields[name]
+    if !ok {
+      errs = append(errs, fmt.Sprintf("%sunknown setting %q", prefix, name))
+      continue
+    }
+    fv := v.Field(f.Index)
+    var err error
+    switch fv.Kind() {
+      case reflect.String:
+        var s string
+        if err = json.Unmarshal(data, &s); err!=nil && data[0]!='"' && data[0]!='[' && data[0]!='{' {
+          s,err = string(data),nil
+        }
+        fv.SetString(s)
+      case reflect.Int:
+        var n int
+        if err = json.Unmarshal(unquote(data), &n); err!=nil {
+          err = fmt.Errorf("%s is not an integer", data)
+        }
+        fv.SetInt(int64(n))
+      case reflect.Bool:
+        var b bool
+        if err = json.Unmarshal(unquote(data), &b); err!=nil {
+          err = fmt.Errorf("%s is not true or false", data)
+        }
+        fv.SetBool(b)
+      case reflect.Slice:
+        if fv.Type().Elem().Kind()!=reflect.Struct {
+          if err = json.Unmarshal(data, fv.Addr().Interface()); err!=nil {
+            err = fmt.Errorf("%s is not a list of %s", data, fv.Type().Elem())
+          }
+          break
+        }
+        var elems []map[string]json.RawMessage
+        if err = json.Unmarshal(data, &elems); err!=nil {
+          err = fmt.Errorf("not a list of objects")
+          break
+        }
+        s := reflect.MakeSlice(fv.Type(), len(elems), len(elems))
+        for i,e := range elems {
+          errs = append(errs, decodeSettings(s.Index(i), e, fmt.Sprintf("%s%s[%d].", prefix, name, i))...)
+        }
+        fv.Set(s)
+    }
+    if err!=nil {
+      errs = append(errs, fmt.Sprintf("%s%s: %v", prefix, name, err))
+    }
+  }
+  return errs
+}
+
+//the JSON in a string, or data
+func unquote(data []byte) []byte {
+  var s string
+  if json.Unmarshal(data, &s)==nil {
+    return []byte(s)
+  }
+  return data
+}
+
+//what is wrong with the settings
+func (c *Config) check() []string {
+  var errs []string
+  add := func(format string, args ...interface{}) {
+    errs = append(errs, fmt.Sprintf(format, args...))
+  }
+  if len(c.Nodes)!=2 {
+    add("nodes: the primary and the backup, not %d nodes", len(c.Nodes))
+  }
+  used := map[string]int{}
+  for i,n := range c.Nodes {
+    if n.Host=="" {
+      add("nodes[%d]: no host", i)
+    }
+    if n.Port<=0 || n.Port>=65536 {
+      add("nodes[%d].port: %d is not a port", i, n.Port)
+      continue
+    }
+    if other,ok := used[n.addr()]; ok {
+      add("nodes[%d]: %s is nodes[%d] already", i, n.addr(), other)
+    }
+    used[n.addr()] = i
+  }
+  if c.HTimeMs<=0 {
+    add("htime: %d is not a positive number of milliseconds", c.HTimeMs)
+  }
+  return errs
+}
+
+func (n NodeConfig) addr() string {
+  return n.Host+":"+strconv.Itoa(n.Port)
+}
+
+//the node of role, PRIMARY or BACKUP
+func (c *Config) Node(role int) NodeConfig {
+  if role==BACKUP {
+    return c.Nodes[1]
+  }
+  return c.Nodes[0]
+}
+
+//host:port of the node of role
+func (c *Config) Addr(role int) string {
+  return c.Node(role).addr()
+}
+
+//the base URL of the node of role
+func (c *Config) URL(role int) string {
+  return "http://"+c.Addr(role)
+}
+
+func (c *Config) HTime() time.Duration {
+  return time.Duration(c.HTimeMs)*time.Millisecond
+}
+
+//The settings of bin/test, conf/test.conf. The servers may be those of
+//another project, so they are given here rather than taken from the
+//settings.
+type TesterConfig struct {
+  Primary string `json:"primary"` // host:port
+  Backup string `json:"backup"` // host:port
+  ConcurNum int `json:"concur_num"` // of the performance test
+  Total int `json:"total"`
+  Pre string `json:"pre"` // the directory of the cases
+  Fmt bool `json:"fmt"` // case i is i.test, else cases[i]
+  Cases []string `json:"cases"`
+  WithErrMsg bool `json:"with_err_msg"` // print the output of each case
+}
+
+func DefaultTesterConfig() *TesterConfig {
+  return &TesterConfig{ConcurNum:125}
+}
+
+var legacyCaseKey = regexp.MustCompile(`^\d+$`)
+
+//the tester settings of fn, where case i may be given as "i" too
+func LoadTesterConfig(fn string) (*TesterConfig,error){
+  data,err := ioutil.ReadFile(fn)
+  if err!=nil {
+    return nil,err
+  }
+  var raw map[string]json.RawMessage
+  if err := json.Unmarshal(data, &raw); err!=nil {
+    return nil,fmt.Errorf("%s: %v", fn, err)
+  }
+  tc := DefaultTesterConfig()
+  var cases []string
+  for k,v := range raw {
+    if !legacyCaseKey.MatchString(k) {
+      continue
+    }
+    i,_ := strconv.Atoi(k)
+    for len(cases)<=i {
+      cases = append(cases, "")
+    }
+    if json.Unmarshal(v, &cases[i])!=nil {
+      return nil,fmt.Errorf("%s: case %s: %s is not a string", fn, k, v)
+    }
+    delete(raw, k)
+  }
+  errs := decodeSettings(reflect.ValueOf(tc).Elem(), raw, "")
+  if len(cases)>0 && len(tc.Cases)==0 {
+    tc.Cases = cases
+  }
+  if len(errs)==0 {
+    if tc.Primary=="" || tc.Backup=="" {
+      errs = append(errs, "primary and backup: the host:port of both servers")
+    }
+    if tc.Total<0 || tc.ConcurNum<0 {
+      errs = append(errs, "total and concur_num should not be negative")
+    }
+    if !tc.Fmt && len(tc.Cases)<tc.Total {
+      errs = append(errs, fmt.Sprintf("cases: %d of total %d", len(tc.Cases), tc.Total))
+    }
+  }
+  if len(errs)>0 {
+    return nil,fmt.Errorf("%s: %s", fn, strings.Join(errs, "; "))
+  }
+  return tc,nil
+}
+
+//the file of case i, from 0
+func (tc *TesterConfig) Case(i int) string {
+  if tc.Fmt {
+    return tc.Pre+strconv.Itoa(i)+".test"
+  }
+  return tc.Pre+tc.Cases[i]
+}
+
+//The flags of the settings of a command: -conf file, by default $KV_CONF
+//or conf/settings.conf, and -set name=value, which may be repeated.
+type ConfigFlags struct {
+  File string
+  Sets []string
+}
+
+type setFlags struct {
+  sets *[]string
+}
+
+func (s setFlags) String() string {
+  if s.sets==nil {
+    return ""
+  }
+  return strings.Join(*s.sets, " ")
+}
+
+func (s setFlags) Set(v string) error {
+  *s.sets = append(*s.sets, v)
+  return nil
+}
+
+func NewConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+  cf := &ConfigFlags{}
+  file := os.Getenv("KV_CONF")
+  if file=="" {
+    file = DefaultSettingsFile
+  }
+  fs.StringVar(&cf.File, "conf", file, "the settings of the primary and the backup")
+  fs.Var(setFlags{&cf.Sets}, "set", "override a setting, as name=value; may be repeated")
+  return cf
+}
+
+//the settings of the file, with the overrides of the environment, then of
+//-set
+func (cf *ConfigFlags) Load() (*Config,error){
+  return loadConfig(cf.File, cf.Sets)
+}
+
+//the settings of a command with the flags -p or -b and those of the
+//settings; exits on wrong flags or settings
+func RoleFlags() (int,*Config) {
+  cf := NewConfigFlags(flag.CommandLine)
+  p := flag.Bool("p", false, "the primary")
+  b := flag.Bool("b", false, "the backup")
+  flag.Parse()
+  if *p==*b {
+    fmt.Fprintln(os.Stderr, "Please give the role, -p or -b.")
+    flag.Usage()
+    os.Exit(2)
+  }
+  conf,err := cf.Load()
+  if err!=nil {
+    fmt.Fprintln(os.Stderr, err)
+    os.Exit(1)
+  }
+  if *b {
+    return BACKUP,conf
+  }
+  return PRIMARY,conf
+}
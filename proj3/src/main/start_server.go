@@ -11,7 +11,9 @@ import (
   "strconv"
   "os"
   "os/exec"
+  "io"
   "io/ioutil"
+  "sort"
   "encoding/json"
   // our lib
   DB "cmap_string_string"
@@ -23,8 +25,8 @@ import (
 const check_HTTP_method = false //should be true for safety reasons
 
 func find_URL() (string,string,string){
-	prim := "http://"+conf["primary"]+":"+strconv.Itoa(primaryPort)+"/kvman/"
-	back := "http://"+conf["backup"]+":"+strconv.Itoa(backupPort)+"/kvman/"
+	prim := conf.URL(PRIMARY)+"/kvman/"
+	back := conf.URL(BACKUP)+"/kvman/"
 	if role==PRIMARY{
 		return back,prim,back
 	}
@@ -32,13 +34,13 @@ func find_URL() (string,string,string){
 }
 // GLOBAL VARS
 var(
- role = Det_role() //PRIMARY, SECONDARY
+ role int //PRIMARY, SECONDARY; set by main, from -p or -b
  stage = COLD_START // COLD_START=0 WARM_START=1 BOOTSTRAP=2 SYNC=3; SHUTTING_DOWN=-1
- conf = ReadJson("conf/settings.conf")
- listenPort, primaryPort, backupPort = Find_port(role, conf)
- peerURL, primaryURL, backupURL = find_URL()
+ conf *Config // set by main, as are the ports and URLs below
+ listenPort int
+ peerURL, primaryURL, backupURL string
  db = DB.New()
- htime = time.Millisecond*5 // default
+ htime time.Duration
  )
 
 var peerSyncErrorSignal=make(chan int) //should we use buffered channel? or let all error'd process block and respond simultaneously?
@@ -110,16 +112,14 @@ func housekeeper(){
 				//send sync_start request "/kvman/peerstartsync?hash="
 				//if success, go to SYNC; else, continue
 				//if any error, start over
-				resp1, err := http.Get(peerURL+"dump")
+				//streamed as JSON lines, read as they come
+				resp1, err := http.Get(peerURL+"dump?format=jsonl")
 				if err!=nil {continue}
-				defer resp1.Body.Close()
-				body1, err2 := ioutil.ReadAll(resp1.Body)
-				if err2!=nil {continue}
-
 				db = DB.New()//this is important; could improve performance though
-				errM:=db.UnmarshalJSON([]byte(body1))
+				errM:=readDump(resp1)
+				resp1.Body.Close()
 				if errM!=nil {
-					fmt.Println("Unmarshall failure:"+string(body1))
+					fmt.Println("Dump failure:",errM)
 					continue
 				}
 				str,_:=db.MarshalJSON();
@@ -177,7 +177,7 @@ var fastTransport http.RoundTripper = &http.Transport{
 var fastClient = http.Client{
         Transport: fastTransport,
     }
-var backup_furl = "http://"+conf["backup"]+":"+strconv.Itoa(backupPort)+"/kv/upsert"
+var backup_furl string
 func fastSync(key string, value string, del bool) bool{
 	var url = backup_furl+
 		"?key="+url.QueryEscape(key)+
@@ -241,7 +241,7 @@ func naive_kvInsertHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	key:= r.FormValue("key")
 	value:= r.FormValue("value")
-	if !db.Has(key) && db.Set(key,value){
+	if db.SetIfAbsent(key,value){
 		fmt.Fprintf(w, "%s",TrueResponseStr)
 		return
 	}
@@ -254,7 +254,10 @@ func naive_kvUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	key:= r.FormValue("key")
 	value:= r.FormValue("value")
-	if db.Has(key) && db.Set(key,value){
+	_,ok:=db.Upsert(key,value,func(exist bool, valueInMap string, newValue string) (string,bool){
+		return newValue,exist // an update, never an insert
+	})
+	if ok{
 		fmt.Fprintf(w, "%s",TrueResponseStr)
 		return
 	}
@@ -316,7 +319,7 @@ func primary_kvInsertHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	key:= r.FormValue("key")
 	value:= r.FormValue("value")
-	if !db.Has(key) && db.Set(key,value){
+	if db.SetIfAbsent(key,value){
 		ret:= fastSync(key,value,false)
 		if ret{
 			fmt.Fprintf(w, "%s",TrueResponseStr)
@@ -339,17 +342,17 @@ func primary_kvUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	key:= r.FormValue("key")
 	value:= r.FormValue("value")
-	if db.Has(key){
-		recover,_:=db.Get(key)
-		if(db.Set(key,value)){
-			ret:= fastSync(key,value,false)
-			if ret{
-					fmt.Fprintf(w, "%s",TrueResponseStr)
-					return
-			}
+	recover,ok:=db.Upsert(key,value,func(exist bool, valueInMap string, newValue string) (string,bool){
+		return newValue,exist // an update, never an insert
+	})
+	if ok{
+		ret:= fastSync(key,value,false)
+		if ret{
+				fmt.Fprintf(w, "%s",TrueResponseStr)
+				return
 		}
-		//recover
-		db.Set(key,recover)
+		//recover, unless someone else has updated it meanwhile
+		db.CompareAndSwap(key,value,recover)
 	}
 	fmt.Fprintf(w, "%s",FalseResponseStr)
 }
@@ -402,12 +405,37 @@ func kvmanDumpHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Bad Method: Please use GET")
 		return
 	}
-	var str,err=db.MarshalJSON();
-	if err==nil{
-		fmt.Fprintf(w, "%s",str)
+	p,err:=ParseDumpParams(r)
+	if err!=nil{
+		fmt.Fprintf(w, "Bad Request: %s",err)
 		return
 	}
-	fmt.Fprintf(w, "DB marshalling error %s",err)
+	snap:=db.Snapshot()
+	keys:=make([]string,0,len(snap))
+	for k:=range snap{
+		keys=append(keys,k)
+	}
+	sort.Strings(keys)
+	WriteDump(w,p,keys,func(k string)(string,bool){
+		v,ok:=snap[k]
+		return v,ok
+	})
+}
+//load a dump of format=jsonl into db
+func readDump(resp *http.Response) error {
+	dec:=json.NewDecoder(resp.Body)
+	for {
+		var line struct{
+			Key string `json:"key"`
+			Value string `json:"value"`
+		}
+		if err:=dec.Decode(&line); err==io.EOF{
+			return nil
+		}else if err!=nil{
+			return err
+		}
+		db.Set(line.Key,line.Value)
+	}
 }
 func kvmanShutdownHandler(w http.ResponseWriter, r *http.Request) {
 	if check_HTTP_method && r.Method != "GET" {
@@ -503,6 +531,12 @@ var kvPrimaryHandlers = map[string]func(http.ResponseWriter, *http.Request){
 }
 
 func main(){
+	role,conf = RoleFlags()
+	listenPort = conf.Node(role).Port
+	peerURL, primaryURL, backupURL = find_URL()
+	backup_furl = conf.URL(BACKUP)+"/kv/upsert"
+	htime = conf.HTime()
+
 	fmt.Println("Initialized with conf:");
 	fmt.Println(conf);
 
@@ -546,11 +580,6 @@ func main(){
     }
 
 	}
-  h,err := strconv.Atoi(conf["htime"])
-  if err == nil {
-    htime = time.Duration(h) * time.Millisecond
-  }
-
 	go housekeeper()
 
 	log.Fatal(s.ListenAndServe())
@@ -1,23 +1,16 @@
 package main
 
-// stop_server -p|-b
+// stop_server -p|-b [-conf settings.conf] [-set name=value]...
 
 import(
   "net/http"
   "fmt"
-  "strconv"
   . "kvlib"
   )
 
 func main(){
-  conf := ReadJson("conf/settings.conf")
-  role := Det_role()
-  port,_,_ := Find_port(role, conf)
-  ipaddr := conf["primary"]
-  if role==BACKUP {
-    ipaddr = conf["backup"]
-  }
-  resp, err := http.Get("http://" +ipaddr+ ":" + strconv.Itoa(port) + "/kvman/shutdown")
+  role,conf := RoleFlags()
+  resp, err := http.Get(conf.URL(role) + "/kvman/shutdown")
   if err != nil{
     fmt.Println(err)
   }else{
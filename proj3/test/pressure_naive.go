@@ -15,8 +15,11 @@ import(
 
 
 func main(){
-  conf := ReadJson("conf/settings.conf")
-  rootURL :="http://"+conf["primary"]+":"+conf["port"]+"/"
+  conf,err := LoadConfig(DefaultSettingsFile)
+  if err != nil {
+    panic(err)
+  }
+  rootURL := conf.URL(PRIMARY)+"/"
   kvURL := rootURL+"kv/"
   //kvmanURL := rootURL+"kvman/"
 
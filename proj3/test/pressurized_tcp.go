@@ -13,14 +13,20 @@ import(
   )
 
 
-var conf = ReadJson("conf/settings.conf")
-
 var(
- //rootURL="http://"+conf["primary"]+":"+conf["port"]+"/"
+ //rootURL=conf.URL(PRIMARY)+"/"
  //kvURL=rootURL+"kv/"
  //kvmanURL=rootURL+"kvman/"
- host=conf["primary"]+":"+conf["port"]
+ host=primaryAddr()
 )
+
+func primaryAddr() string {
+  conf,err := LoadConfig(DefaultSettingsFile)
+  if err != nil {
+    panic(err)
+  }
+  return conf.Addr(PRIMARY)
+}
 /*
 func naive_HTTP(url string, data_enc string, post bool) (string, error) {
 	if post{
@@ -494,10 +494,14 @@ func main() {
     if len(os.Args)>1 && os.Args[1]!="-direct" {
       confname = os.Args[1];
     }
-    conf := ReadJson(confname);
-    primary := "http://" + conf["primary"]
-    backup := "http://" + conf["backup"]
-    tot,_ := strconv.Atoi(conf["total"])
+    tc,err := LoadTesterConfig(confname)
+    if err != nil {
+      fmt.Println(err)
+      os.Exit(2)
+    }
+    primary := "http://" + tc.Primary
+    backup := "http://" + tc.Backup
+    tot := tc.Total
     cnt := tot
 
     jump := false
@@ -509,13 +513,8 @@ func main() {
     }
 
     for i := 0; i < tot; i++ {
-      testname := conf["pre"]+strconv.Itoa(i)+".test"
-
-      if conf["fmt"] != "true"{ //no need to specify each test case name
-        testname = conf["pre"]+conf[strconv.Itoa(i)]
-      }
-        res, fail := TestUnit(primary, backup, testname)
-        if conf["with_err_msg"]=="true"{
+        res, fail := TestUnit(primary, backup, tc.Case(i))
+        if tc.WithErrMsg{
           fmt.Printf("%s", res)
           if fail == 0 {
               fmt.Printf("\nTest case %d: success!\n\n", i)
@@ -545,12 +544,7 @@ func main() {
     }
 
     time.Sleep(500*time.Millisecond)
-    N,err := strconv.Atoi(conf["concur_num"])
-    if err != nil {
-      N = 125
-    }
-
-    TestPerformance(N, kvURL)
+    TestPerformance(tc.ConcurNum, kvURL)
 
     if !jump{
       StopServer("-p")
@@ -4,6 +4,10 @@ ROOT_DIR=`pwd`;
 prog_src=(
 src/main/start_server
 src/main/stop_server
+src/main/kvbackup
+src/main/kvchaos
+src/main/kvbench
+src/main/kvctl
 test/test
 )
 echo "start compiling ...";
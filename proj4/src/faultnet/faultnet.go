@@ -0,0 +1,356 @@
+package faultnet
+
+//
+// Deterministic fault injection for the RPCs between paxos peers and from
+// kvpaxos clerks. Faults act where a connection is dialed, on the link
+// from the dialing peer to the address dialed, and work the same over
+// unix sockets and tcp, under TLS or not:
+//
+//   drop        the request is never delivered; the dial fails
+//   drop_reply  the request is served, but its reply is lost
+//   duplicate   the request is delivered a second time, reply ignored
+//   delay_ms,
+//   jitter_ms   each way, a message waits delay plus up to jitter
+//   reorder,
+//   hold_ms     a message is held back hold_ms more, so later ones overtake
+//
+// and a partition, as sets of peers: a link between two sets is cut, while
+// a peer in no set reaches everyone. Every link draws its faults from a
+// random stream of its own, seeded by the seed and the link, so the n-th
+// message on a link meets the same faults in every run, however the links
+// interleave.
+//
+// All the peers of a process share Default; a process running a single
+// node decides only the faults of the links from that node.
+//
+
+import(
+  "encoding/json"
+  "errors"
+  "hash/fnv"
+  "io"
+  "math/rand"
+  "net"
+  "strings"
+  "sync"
+  "time"
+)
+
+var (
+  ErrDropped=errors.New("faultnet: message dropped")
+  ErrPartitioned=errors.New("faultnet: link partitioned")
+)
+
+// any peer, in the from or to of a link
+const Any="*"
+
+// the faults of a link; probabilities are in [0,1]
+type Link struct {
+  Drop float64 `json:"drop,omitempty"`
+  DropReply float64 `json:"drop_reply,omitempty"`
+  Duplicate float64 `json:"duplicate,omitempty"`
+  DelayMs int `json:"delay_ms,omitempty"`
+  JitterMs int `json:"jitter_ms,omitempty"`
+  Reorder float64 `json:"reorder,omitempty"`
+  HoldMs int `json:"hold_ms,omitempty"` // DefaultHoldMs if 0
+}
+
+const DefaultHoldMs=50
+
+func (l Link) zero() bool {
+  return l==Link{}
+}
+
+type Faults struct {
+  Seed int64 `json:"seed"`
+  Default Link `json:"default"` // of links not in Links
+  Links map[string]Link `json:"links,omitempty"` // by "from>to", either may be Any
+  Partition [][]string `json:"partition,omitempty"`
+}
+
+func LinkName(from string, to string) string {
+  return from+">"+to
+}
+
+// the faults of the link from>to: the most specific entry of f.Links, or
+// f.Default
+func (f *Faults) link(from string, to string) Link {
+  for _,k:=range []string{LinkName(from,to),LinkName(from,Any),LinkName(Any,to)} {
+    if l,found:=f.Links[k]; found {
+      return l
+    }
+  }
+  return f.Default
+}
+
+func (f *Faults) cut(from string, to string) bool {
+  a,b:=-1,-1
+  for i,set:=range f.Partition {
+    for _,p:=range set {
+      if p==from {
+        a=i
+      }
+      if p==to {
+        b=i
+      }
+    }
+  }
+  return a>=0 && b>=0 && a!=b
+}
+
+func (f *Faults) check() error {
+  for k,l:=range f.Links {
+    if strings.Count(k,">")!=1 {
+      return errors.New("faultnet: a link is named from>to, not "+k)
+    }
+    if err:=l.check(); err!=nil {
+      return err
+    }
+  }
+  return f.Default.check()
+}
+
+func (l Link) check() error {
+  for _,p:=range []float64{l.Drop,l.DropReply,l.Duplicate,l.Reorder} {
+    if p<0 || p>1 {
+      return errors.New("faultnet: a probability is out of [0,1]")
+    }
+  }
+  if l.DelayMs<0 || l.JitterMs<0 || l.HoldMs<0 {
+    return errors.New("faultnet: a delay is negative")
+  }
+  return nil
+}
+
+// what happened on a link
+type Stats struct {
+  Dialed int64 `json:"dialed"`
+  Partitioned int64 `json:"partitioned"`
+  Dropped int64 `json:"dropped"`
+  RepliesDropped int64 `json:"replies_dropped"`
+  Duplicated int64 `json:"duplicated"`
+  Reordered int64 `json:"reordered"`
+}
+
+type Network struct {
+  mu sync.Mutex
+  f Faults
+  rngs map[string]*rand.Rand // by link
+  stats map[string]*Stats // by link
+}
+
+func New(f Faults) (*Network,error){
+  n:=&Network{}
+  return n,n.Set(f)
+}
+
+// the network of the process, used by paxos.Dial; no faults at first
+var Default,_=New(Faults{})
+
+// replace the faults; the random streams start over from the seed
+func (n *Network) Set(f Faults) error {
+  if err:=f.check(); err!=nil {
+    return err
+  }
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  n.f=f
+  n.rngs=make(map[string]*rand.Rand)
+  n.stats=make(map[string]*Stats)
+  return nil
+}
+
+// cut the links between the sets, leaving the other faults
+func (n *Network) Partition(sets ...[]string){
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  n.f.Partition=sets
+}
+
+// end the partition, leaving the other faults
+func (n *Network) Heal(){
+  n.Partition()
+}
+
+func (n *Network) Faults() Faults {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  return n.f
+}
+
+func (n *Network) Stats() map[string]Stats {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  r:=make(map[string]Stats)
+  for k,s:=range n.stats {
+    r[k]=*s
+  }
+  return r
+}
+
+// the fate of a message, drawn all at once so that a link always takes the
+// same number of draws
+type fate struct {
+  drop bool
+  dropReply bool
+  duplicate bool
+  sendDelay time.Duration
+  replyDelay time.Duration
+}
+
+func (n *Network) decide(from string, to string) (fate,error){
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  name:=LinkName(from,to)
+  st:=n.stats[name]
+  if st==nil {
+    st=new(Stats)
+    n.stats[name]=st
+  }
+  st.Dialed++
+  if n.f.cut(from,to) {
+    st.Partitioned++
+    return fate{},ErrPartitioned
+  }
+  l:=n.f.link(from,to)
+  if l.zero() {
+    return fate{},nil
+  }
+  rng:=n.rngs[name]
+  if rng==nil {
+    h:=fnv.New64a()
+    io.WriteString(h,name)
+    rng=rand.New(rand.NewSource(n.f.Seed^int64(h.Sum64())))
+    n.rngs[name]=rng
+  }
+  var ft fate
+  ft.drop=rng.Float64()<l.Drop
+  ft.dropReply=rng.Float64()<l.DropReply
+  ft.duplicate=rng.Float64()<l.Duplicate
+  reorder:=rng.Float64()<l.Reorder
+  delay:=func() time.Duration {
+    d:=time.Duration(l.DelayMs)*time.Millisecond
+    if l.JitterMs>0 {
+      d+=time.Duration(rng.Int63n(int64(l.JitterMs)*int64(time.Millisecond)))
+    }
+    return d
+  }
+  ft.sendDelay,ft.replyDelay=delay(),delay()
+  if reorder {
+    hold:=l.HoldMs
+    if hold==0 {
+      hold=DefaultHoldMs
+    }
+    ft.sendDelay+=time.Duration(hold)*time.Millisecond
+    st.Reordered++
+  }
+  if ft.drop {
+    // nothing else happens to it
+    st.Dropped++
+    ft.dropReply,ft.duplicate=false,false
+  }
+  if ft.dropReply {
+    st.RepliesDropped++
+  }
+  if ft.duplicate {
+    st.Duplicated++
+  }
+  return ft,nil
+}
+
+// dial to through dial, with the faults of the link from>to; from is ""
+// for a client that is not a peer
+func (n *Network) Dial(from string, to string, dial func() (net.Conn, error)) (net.Conn,error){
+  ft,err:=n.decide(from,to)
+  if err!=nil {
+    return nil,err
+  }
+  if ft==(fate{}) {
+    return dial()
+  }
+  time.Sleep(ft.sendDelay)
+  if ft.drop {
+    return nil,ErrDropped
+  }
+  c,err:=dial()
+  if err!=nil {
+    return nil,err
+  }
+  fc:=&conn{Conn:c,fate:ft,dial:dial}
+  return fc,nil
+}
+
+// a connection meeting the faults of its fate; the request is what the
+// client writes before its first read, as in an RPC
+type conn struct {
+  net.Conn
+  fate fate
+  dial func() (net.Conn,error)
+  mu sync.Mutex
+  request []byte // kept for a duplicate
+  replied bool // the first read took place
+}
+
+func (c *conn) Write(b []byte) (int,error){
+  c.mu.Lock()
+  if c.fate.duplicate && !c.replied {
+    c.request=append(c.request,b...)
+  }
+  c.mu.Unlock()
+  return c.Conn.Write(b)
+}
+
+func (c *conn) Read(b []byte) (int,error){
+  c.mu.Lock()
+  first:=!c.replied
+  c.replied=true
+  c.mu.Unlock()
+  if !first {
+    return c.Conn.Read(b)
+  }
+  if c.fate.duplicate {
+    go c.redeliver(c.request)
+  }
+  n,err:=c.Conn.Read(b)
+  time.Sleep(c.fate.replyDelay)
+  if c.fate.dropReply && err==nil {
+    // served; the reply is thrown away
+    c.Conn.Close()
+    return 0,ErrDropped
+  }
+  return n,err
+}
+
+// deliver the request again, on a connection of its own
+func (c *conn) redeliver(request []byte){
+  d,err:=c.dial()
+  if err!=nil {
+    return
+  }
+  defer d.Close()
+  d.SetDeadline(time.Now().Add(10*time.Second))
+  if _,err:=d.Write(request); err!=nil {
+    return
+  }
+  // the first bytes of the reply tell it was served
+  d.Read(make([]byte,512))
+}
+
+// the faults and the stats, as shown by /kvman/faults
+type Report struct {
+  Faults Faults `json:"faults"`
+  Stats map[string]Stats `json:"stats"`
+}
+
+func (n *Network) Report() Report {
+  return Report{n.Faults(),n.Stats()}
+}
+
+// set the faults from JSON, as posted to /kvman/faults
+func (n *Network) SetJSON(b []byte) error {
+  var f Faults
+  if err:=json.Unmarshal(b,&f); err!=nil {
+    return err
+  }
+  return n.Set(f)
+}
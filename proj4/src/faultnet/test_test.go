@@ -0,0 +1,93 @@
+package faultnet
+
+import "testing"
+import "strconv"
+import "net"
+import "time"
+import "fmt"
+
+func TestDecide(t *testing.T) {
+  fmt.Printf("Test: Fault injection is deterministic ...\n")
+
+  fates := func(seed int64) map[string]Stats {
+    n, err := New(Faults{Seed: seed,
+      Default: Link{Drop: 0.3, DropReply: 0.3, Duplicate: 0.3, Reorder: 0.3, HoldMs: 1}})
+    if err != nil {
+      t.Fatalf("New: %v", err)
+    }
+    for i := 0; i < 200; i++ {
+      c, err := n.Dial("a", strconv.Itoa(i%2), func() (net.Conn, error) {
+        c1, c2 := net.Pipe()
+        c2.Close()
+        return c1, nil
+      })
+      if err == nil {
+        c.Close()
+      }
+    }
+    return n.Stats()
+  }
+  a, b := fates(1), fates(1)
+  if a["a>0"] != b["a>0"] || a["a>1"] != b["a>1"] {
+    t.Fatalf("one seed, two fates: %v %v", a, b)
+  }
+  if s := a["a>0"]; s.Dropped == 0 || s.RepliesDropped == 0 || s.Duplicated == 0 || s.Reordered == 0 || s.Dialed != 100 {
+    t.Fatalf("faults missing: %+v", s)
+  }
+  if c := fates(2); c["a>0"] == a["a>0"] {
+    t.Fatalf("two seeds, one fate: %v", c)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Links, partitions and wrong faults ...\n")
+
+  n, err := New(Faults{Seed: 1, Default: Link{Duplicate: 1},
+    Links: map[string]Link{"a>b": {Drop: 1}, "a>*": {DropReply: 1}, "*>b": {DelayMs: 3}, "c>d": {Reorder: 1}},
+    Partition: [][]string{{"p"}, {"q", "r"}}})
+  if err != nil {
+    t.Fatalf("New: %v", err)
+  }
+  for _, d := range []struct {
+    from, to string
+    want fate
+  }{
+    {"a", "b", fate{drop: true}}, // a>b over a>* and *>b
+    {"a", "c", fate{dropReply: true}}, // a>* over *>c
+    {"c", "b", fate{sendDelay: 3 * time.Millisecond, replyDelay: 3 * time.Millisecond}},
+    {"c", "d", fate{sendDelay: DefaultHoldMs * time.Millisecond}},
+    {"q", "r", fate{duplicate: true}}, // one side of the partition
+    {"s", "p", fate{duplicate: true}}, // in no set
+  } {
+    if ft, err := n.decide(d.from, d.to); err != nil || ft != d.want {
+      t.Fatalf("decide(%s, %s) -> %+v, %v, expected %+v", d.from, d.to, ft, err, d.want)
+    }
+  }
+  if _, err := n.decide("p", "r"); err != ErrPartitioned {
+    t.Fatalf("decide across the partition -> %v", err)
+  }
+  st := n.Stats()
+  if st["a>b"] != (Stats{Dialed: 1, Dropped: 1}) || st["c>d"] != (Stats{Dialed: 1, Reordered: 1}) ||
+    st["p>r"] != (Stats{Dialed: 1, Partitioned: 1}) || st["q>r"] != (Stats{Dialed: 1, Duplicated: 1}) {
+    t.Fatalf("stats %+v", st)
+  }
+  n.Heal()
+  if _, err := n.decide("p", "r"); err != nil {
+    t.Fatalf("decide after Heal -> %v", err)
+  }
+  for _, f := range []Faults{
+    {Default: Link{Drop: 2}},
+    {Default: Link{JitterMs: -1}},
+    {Links: map[string]Link{"ab": {}}},
+    {Links: map[string]Link{"a>b": {Reorder: -0.5}}},
+  } {
+    if err := n.Set(f); err == nil {
+      t.Fatalf("Set(%+v) succeeded", f)
+    }
+  }
+  if f := n.Faults(); f.Partition != nil || f.Links["a>b"] != (Link{Drop: 1}) {
+    t.Fatalf("a wrong Set changed the faults to %+v", f)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
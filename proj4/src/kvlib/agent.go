@@ -0,0 +1,471 @@
+package kvlib
+
+import(
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "syscall"
+  "time"
+)
+
+//The agent of a node, run by bin/test nXX: it starts the server of its node,
+//stops or kills it, keeps track of the process until it has exited and
+//of how it exited, and writes what it prints to a log. The main tester
+//drives it over HTTP:
+//
+//  GET  /agent/health     the status of the agent and its server
+//  POST /agent/start      start the server, and wait until its port accepts
+//  POST /agent/stop       stop it with the stop command, or kill it if it
+//                         does not exit in time
+//  POST /agent/kill       kill it
+//  GET  /agent/logs?tail=n  the last n lines of its log
+//  POST /agent/shutdown   kill it, and end the agent
+//
+//Each answers with an AgentStatus in JSON, with success "false" and a
+//message if the request failed.
+
+type AgentConfig struct {
+  Node int // from 1
+  Command []string // of the server, e.g. bin/start_server n01
+  StopCommand []string // a graceful stop, e.g. bin/stop_server n01; a kill if empty
+  Server string // host:port of the server, up once it accepts; "" not to wait
+  Log string // the file of the output of the server; none if ""
+  StartTimeout time.Duration
+  StopTimeout time.Duration // before a stop kills
+}
+
+//how a process ended
+type ExitStatus struct {
+  Pid int `json:"pid"`
+  Code int `json:"code"` // -1 if ended by a signal
+  Signal string `json:"signal,omitempty"`
+  Expected bool `json:"expected"` // stopped or killed by the agent
+  At time.Time `json:"at"`
+  UptimeS float64 `json:"uptime_s"`
+}
+
+func (e *ExitStatus) String() string {
+  s := fmt.Sprintf("pid %d ", e.Pid)
+  if e.Signal!="" {
+    s += "ended by signal: "+e.Signal
+  }else{
+    s += fmt.Sprintf("exited with %d", e.Code)
+  }
+  if !e.Expected {
+    s += ", unexpectedly"
+  }
+  return s
+}
+
+type AgentStatus struct {
+  Success string `json:"success"`
+  Message string `json:"message,omitempty"`
+  Node int `json:"node"`
+  Running bool `json:"running"`
+  Pid int `json:"pid,omitempty"`
+  Serving bool `json:"serving"` // the port of the server accepts
+  Starts int `json:"starts"`
+  Exit *ExitStatus `json:"exit,omitempty"` // of the last process that ended
+  Log string `json:"log,omitempty"`
+}
+
+type agentProc struct {
+  cmd *exec.Cmd
+  started time.Time
+  expected bool // the agent is ending it
+  done chan struct{} // closed once it has exited
+}
+
+type Agent struct {
+  cfg AgentConfig
+  mu sync.Mutex
+  proc *agentProc // nil once it has exited
+  starts int
+  exit *ExitStatus
+  shutdown chan struct{}
+}
+
+func NewAgent(cfg AgentConfig) *Agent {
+  if cfg.StartTimeout<=0 {
+    cfg.StartTimeout = 10*time.Second
+  }
+  if cfg.StopTimeout<=0 {
+    cfg.StopTimeout = 5*time.Second
+  }
+  return &Agent{cfg:cfg, shutdown:make(chan struct{})}
+}
+
+//closed once /agent/shutdown was asked
+func (a *Agent) Done() <-chan struct{} {
+  return a.shutdown
+}
+
+func (a *Agent) serving() bool {
+  if a.cfg.Server=="" {
+    return false
+  }
+  c,err := net.DialTimeout("tcp", a.cfg.Server, 200*time.Millisecond)
+  if err!=nil {
+    return false
+  }
+  c.Close()
+  return true
+}
+
+func (a *Agent) Status() AgentStatus {
+  a.mu.Lock()
+  st := AgentStatus{Success:"true", Node:a.cfg.Node, Starts:a.starts, Exit:a.exit, Log:a.cfg.Log}
+  if a.proc!=nil {
+    st.Running = true
+    st.Pid = a.proc.cmd.Process.Pid
+  }
+  a.mu.Unlock()
+  st.Serving = a.serving()
+  return st
+}
+
+//start the server; an error if it runs already, or if it exits or does
+//not accept before StartTimeout
+func (a *Agent) Start() (AgentStatus,error) {
+  a.mu.Lock()
+  if a.proc!=nil {
+    pid := a.proc.cmd.Process.Pid
+    a.mu.Unlock()
+    return a.Status(),fmt.Errorf("server %d runs already, pid %d", a.cfg.Node, pid)
+  }
+  cmd := exec.Command(a.cfg.Command[0], a.cfg.Command[1:]...)
+  var out *os.File
+  if a.cfg.Log!="" {
+    var err error
+    out,err = os.OpenFile(a.cfg.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err!=nil {
+      a.mu.Unlock()
+      return a.Status(),err
+    }
+    cmd.Stdout,cmd.Stderr = out,out
+    //before the process, which may write at once
+    fmt.Fprintf(out, "=== %s: %s, start %d\n", time.Now().Format(time.RFC3339), strings.Join(a.cfg.Command, " "), a.starts+1)
+  }
+  err := cmd.Start()
+  if out!=nil {
+    if err!=nil {
+      fmt.Fprintf(out, "=== %v\n", err)
+    }
+    out.Close() // the process has its own
+  }
+  if err!=nil {
+    a.mu.Unlock()
+    return a.Status(),err
+  }
+  p := &agentProc{cmd:cmd, started:time.Now(), done:make(chan struct{})}
+  a.proc = p
+  a.starts++
+  a.mu.Unlock()
+  go a.wait(p)
+
+  if a.cfg.Server=="" {
+    return a.Status(),nil
+  }
+  deadline := time.Now().Add(a.cfg.StartTimeout)
+  for !a.serving() {
+    select {
+      case <-p.done:
+        st := a.Status()
+        return st,fmt.Errorf("server %d ended before it served: %v", a.cfg.Node, st.Exit)
+      case <-time.After(50*time.Millisecond):
+    }
+    if time.Now().After(deadline) {
+      return a.Status(),fmt.Errorf("server %d does not accept at %s after %v", a.cfg.Node, a.cfg.Server, a.cfg.StartTimeout)
+    }
+  }
+  return a.Status(),nil
+}
+
+func (a *Agent) wait(p *agentProc) {
+  p.cmd.Wait()
+  ps := p.cmd.ProcessState
+  e := &ExitStatus{Pid:ps.Pid(), Code:ps.ExitCode(), At:time.Now()}
+  e.UptimeS = e.At.Sub(p.started).Seconds()
+  if ws,ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+    e.Signal = ws.Signal().String()
+  }
+  a.mu.Lock()
+  e.Expected = p.expected
+  a.exit = e
+  if a.proc==p {
+    a.proc = nil
+  }
+  a.mu.Unlock()
+  if !e.Expected {
+    clog.Warn("server ended", "node", a.cfg.Node, "exit", e.String())
+  }
+  close(p.done)
+}
+
+//the process, marked as ended by the agent; nil if there is none
+func (a *Agent) ending() *agentProc {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  if a.proc!=nil {
+    a.proc.expected = true
+  }
+  return a.proc
+}
+
+//kill the server, and wait until it has exited
+func (a *Agent) Kill() (AgentStatus,error) {
+  p := a.ending()
+  if p==nil {
+    return a.Status(),fmt.Errorf("server %d is not running", a.cfg.Node)
+  }
+  if err := p.cmd.Process.Kill(); err!=nil {
+    clog.Warn("kill failed", "node", a.cfg.Node, "err", err)
+  }
+  <-p.done
+  return a.Status(),nil
+}
+
+//stop the server with the stop command, then kill it if it has not exited
+//after StopTimeout; the process is followed until it has exited either way
+func (a *Agent) Stop() (AgentStatus,error) {
+  p := a.ending()
+  if p==nil {
+    return a.Status(),fmt.Errorf("server %d is not running", a.cfg.Node)
+  }
+  var msg string
+  if len(a.cfg.StopCommand)==0 {
+    p.cmd.Process.Kill()
+  }else{
+    out,err := exec.Command(a.cfg.StopCommand[0], a.cfg.StopCommand[1:]...).CombinedOutput()
+    if err!=nil {
+      msg = fmt.Sprintf("%s failed: %v", a.cfg.StopCommand[0], err)
+    }else{
+      msg = strings.TrimSpace(string(out))
+    }
+  }
+  select {
+    case <-p.done:
+    case <-time.After(a.cfg.StopTimeout):
+      p.cmd.Process.Kill()
+      <-p.done
+      if msg!="" {
+        msg += "; "
+      }
+      msg += fmt.Sprintf("killed after %v", a.cfg.StopTimeout)
+  }
+  st := a.Status()
+  st.Message = msg
+  return st,nil
+}
+
+//the last n lines of the log
+func (a *Agent) Logs(n int) (string,error) {
+  if a.cfg.Log=="" {
+    return "",errors.New("no log")
+  }
+  return tailFile(a.cfg.Log, n)
+}
+
+func tailFile(fn string, n int) (string,error) {
+  f,err := os.Open(fn)
+  if err!=nil {
+    return "",err
+  }
+  defer f.Close()
+  //the lines are in the last 64 KB, unless they are long ones
+  const chunk = 64<<10
+  st,err := f.Stat()
+  if err!=nil {
+    return "",err
+  }
+  off := st.Size()-chunk
+  if off<0 {
+    off = 0
+  }
+  if _,err := f.Seek(off, io.SeekStart); err!=nil {
+    return "",err
+  }
+  data,err := ioutil.ReadAll(f)
+  if err!=nil {
+    return "",err
+  }
+  lines := strings.SplitAfter(string(data), "\n")
+  if len(lines)>0 && lines[len(lines)-1]=="" {
+    lines = lines[:len(lines)-1]
+  }
+  if off>0 && len(lines)>0 {
+    lines = lines[1:] // cut
+  }
+  if n>=0 && len(lines)>n {
+    lines = lines[len(lines)-n:]
+  }
+  return strings.Join(lines, ""),nil
+}
+
+func writeAgentReply(w http.ResponseWriter, st AgentStatus, err error) {
+  if err!=nil {
+    st.Success = "false"
+    st.Message = err.Error()
+  }
+  w.Header().Set("Content-Type", "application/json")
+  enc,_ := json.Marshal(&st)
+  fmt.Fprintf(w, "%s", enc)
+}
+
+//the routes of the agent
+func (a *Agent) Handler() http.Handler {
+  mux := http.NewServeMux()
+  post := func(f func() (AgentStatus,error)) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+      if r.Method!="POST" {
+        w.WriteHeader(http.StatusMethodNotAllowed)
+        writeAgentReply(w, a.Status(), errors.New("POST only"))
+        return
+      }
+      st,err := f()
+      writeAgentReply(w, st, err)
+    }
+  }
+  mux.HandleFunc("/agent/health", func(w http.ResponseWriter, r *http.Request) {
+    writeAgentReply(w, a.Status(), nil)
+  })
+  mux.HandleFunc("/agent/start", post(a.Start))
+  mux.HandleFunc("/agent/stop", post(a.Stop))
+  mux.HandleFunc("/agent/kill", post(a.Kill))
+  mux.HandleFunc("/agent/shutdown", post(func() (AgentStatus,error) {
+    a.Kill()
+    select {
+      case <-a.shutdown:
+      default:
+        close(a.shutdown)
+    }
+    return a.Status(),nil
+  }))
+  mux.HandleFunc("/agent/logs", func(w http.ResponseWriter, r *http.Request) {
+    n,err := strconv.Atoi(r.FormValue("tail"))
+    if err!=nil {
+      n = -1
+    }
+    s,err := a.Logs(n)
+    if err!=nil {
+      w.WriteHeader(http.StatusNotFound)
+      fmt.Fprintf(w, "%s", JsonErr(err.Error()))
+      return
+    }
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    io.WriteString(w, s)
+  })
+  return mux
+}
+
+//the log of node under dir
+func AgentLog(dir string, node int) string {
+  return filepath.Join(dir, fmt.Sprintf("n%02d.log", node))
+}
+
+//The agents of the nodes, as the main tester sees them, which start and
+//stop the servers of the scripts. A stop_server kills with StopByKill,
+//and stops gracefully otherwise, as a shutdown_server does.
+type AgentClients struct {
+  URLs []string // of the agents, by node from 0
+  StopByKill bool
+  Client *http.Client
+}
+
+func (c *AgentClients) client() *http.Client {
+  if c.Client!=nil {
+    return c.Client
+  }
+  return http.DefaultClient
+}
+
+func (c *AgentClients) call(i int, method string, op string) (AgentStatus,error) {
+  var st AgentStatus
+  req,err := http.NewRequest(method, c.URLs[i]+"/agent/"+op, nil)
+  if err!=nil {
+    return st,err
+  }
+  resp,err := c.client().Do(req)
+  if err!=nil {
+    return st,err
+  }
+  defer resp.Body.Close()
+  if err := json.NewDecoder(resp.Body).Decode(&st); err!=nil {
+    return st,fmt.Errorf("agent %d: malformed reply: %v", i+1, err)
+  }
+  if st.Success!="true" {
+    return st,fmt.Errorf("agent %d: %s", i+1, st.Message)
+  }
+  return st,nil
+}
+
+func (c *AgentClients) Health(i int) (AgentStatus,error) {
+  return c.call(i, "GET", "health")
+}
+
+func (c *AgentClients) Start(i int) (AgentStatus,error) {
+  return c.call(i, "POST", "start")
+}
+
+func (c *AgentClients) Stop(i int) (AgentStatus,error) {
+  return c.call(i, "POST", "stop")
+}
+
+func (c *AgentClients) Kill(i int) (AgentStatus,error) {
+  return c.call(i, "POST", "kill")
+}
+
+func (c *AgentClients) Shutdown(i int) (AgentStatus,error) {
+  return c.call(i, "POST", "shutdown")
+}
+
+//the last n lines of the log of server i
+func (c *AgentClients) Logs(i int, n int) (string,error) {
+  resp,err := c.client().Get(c.URLs[i]+"/agent/logs?tail="+strconv.Itoa(n))
+  if err!=nil {
+    return "",err
+  }
+  s := DecodeStr(resp)
+  if resp.StatusCode!=http.StatusOK {
+    return "",fmt.Errorf("agent %d: %s", i+1, s)
+  }
+  return s,nil
+}
+
+//for RunScript
+func (c *AgentClients) StartServer(i int) (string,error) {
+  st,err := c.Start(i)
+  if err!=nil {
+    return "",err
+  }
+  return fmt.Sprintf("Server %d started, pid %d", i+1, st.Pid),nil
+}
+
+//for RunScript
+func (c *AgentClients) StopServer(i int, op string) (string,error) {
+  var st AgentStatus
+  var err error
+  if op=="kill_server" || op=="stop_server" && c.StopByKill {
+    st,err = c.Kill(i)
+  }else{
+    st,err = c.Stop(i)
+  }
+  if err!=nil {
+    return "",err
+  }
+  msg := fmt.Sprintf("Server %d ended, %v", i+1, st.Exit)
+  if st.Message!="" {
+    msg += " ("+st.Message+")"
+  }
+  return msg,nil
+}
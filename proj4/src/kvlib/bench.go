@@ -0,0 +1,547 @@
+package kvlib
+
+import(
+  "crypto/tls"
+  "encoding/csv"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "math/rand"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+//Benchmarks of a key-value service, for bin/kvbench. Each client sends a
+//request and waits for its reply before the next (a closed loop), or, at a
+//target rate, sends them on a schedule of its own; a late request then
+//counts from when it should have been sent, so that a stalled server is
+//not hidden by the requests that wait for it. The keys are loaded first,
+//and a request is a get, or else an update, of a key drawn uniformly or
+//by a zipfian law. Latencies go to a Histogram per kind of request, and
+//the requests done in each interval make the throughput over time.
+
+const(
+  BenchKV = "kv" // /kv/get, /kv/update and /kv/insert, of proj3 and kvpaxos
+  BenchREST = "rest" // /v1/keys through httpclient, kvpaxos only
+)
+
+type BenchConfig struct {
+  Servers []string // base URLs; client c starts at c%len(Servers)
+  API string
+  Token string
+  TLS *tls.Config
+  Clients int
+  Reads float64 // the fraction of gets
+  Keys int
+  Zipf float64 // the exponent of a zipfian law, >1; 0 for uniform
+  ValueSize int
+  Warmup time.Duration // not measured
+  Duration time.Duration
+  Rate float64 // requests per second of all clients; 0 for a closed loop
+  Interval time.Duration // of the throughput over time
+  Timeout time.Duration
+  Seed int64
+  Label string // names the run in the output
+}
+
+//latencies are in microseconds, up to an hour
+const benchHighest = int64(time.Hour/time.Microsecond)
+
+var benchOps = []string{"get", "update"}
+
+type BenchOp struct {
+  Op string
+  Count int64
+  Errors int64
+  Latency *Histogram // of the requests that succeeded
+}
+
+//the requests done in an interval, by op
+type BenchSample struct {
+  End time.Duration // since the measure began
+  Ops map[string]int64
+}
+
+type BenchResult struct {
+  Config BenchConfig
+  Loaded int
+  LoadErrors int
+  Elapsed time.Duration // of the measure
+  Ops []*BenchOp // by benchOps, then "total"
+  Series []BenchSample
+}
+
+func (c *BenchConfig) check() error {
+  switch {
+    case len(c.Servers)==0:
+      return errors.New("no server")
+    case c.API!=BenchKV && c.API!=BenchREST:
+      return fmt.Errorf("the api is %s or %s, not %q", BenchKV, BenchREST, c.API)
+    case c.Clients<1 || c.Keys<1 || c.ValueSize<0:
+      return errors.New("clients and keys should be positive, and the value size not negative")
+    case c.Reads<0 || c.Reads>1:
+      return errors.New("the fraction of reads is in [0,1]")
+    case c.Zipf!=0 && c.Zipf<=1:
+      return errors.New("the zipfian exponent should be above 1")
+    case c.Duration<=0 || c.Interval<=0 || c.Warmup<0 || c.Rate<0:
+      return errors.New("the duration and the interval should be positive")
+  }
+  return nil
+}
+
+//the requests of a client
+type benchClient interface {
+  get(key string) error
+  update(key string, value string) error
+  load(key string, value string) error // insert, or update if it exists
+}
+
+//the API of proj3, kept by kvpaxos
+type kvBenchClient struct {
+  server string
+  token string
+  client *http.Client
+}
+
+func (c *kvBenchClient) call(method string, op string, form url.Values) error {
+  u := c.server+"/kv/"+op
+  var body io.Reader
+  if method=="GET" {
+    u += "?"+form.Encode()
+  }else{
+    body = strings.NewReader(form.Encode())
+  }
+  req,err := http.NewRequest(method, u, body)
+  if err!=nil {
+    return err
+  }
+  if body!=nil {
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  }
+  if c.token!="" {
+    req.Header.Set("Authorization", "Bearer "+c.token)
+  }
+  resp,err := c.client.Do(req)
+  if err!=nil {
+    return err
+  }
+  data,err := ioutil.ReadAll(resp.Body)
+  resp.Body.Close()
+  if err!=nil {
+    return err
+  }
+  var r MsgResponse
+  if err := json.Unmarshal(data, &r); err!=nil {
+    return fmt.Errorf("malformed reply %q", data)
+  }
+  if r.Success!="true" {
+    return fmt.Errorf("%s failed: %s", op, r.Message)
+  }
+  return nil
+}
+
+func (c *kvBenchClient) get(key string) error {
+  return c.call("GET", "get", url.Values{"key":{key}})
+}
+
+func (c *kvBenchClient) update(key string, value string) error {
+  return c.call("POST", "update", url.Values{"key":{key}, "value":{value}})
+}
+
+func (c *kvBenchClient) load(key string, value string) error {
+  if c.call("POST", "insert", url.Values{"key":{key}, "value":{value}})==nil {
+    return nil
+  }
+  return c.update(key, value)
+}
+
+type restBenchClient struct {
+  ck Client
+}
+
+func (c *restBenchClient) get(key string) error {
+  _,_,err := c.ck.Get(key)
+  return err
+}
+
+func (c *restBenchClient) update(key string, value string) error {
+  _,err := c.ck.Update(key, value)
+  return err
+}
+
+func (c *restBenchClient) load(key string, value string) error {
+  err := c.ck.Insert(key, value)
+  if errors.Is(err, ErrExists) {
+    return c.update(key, value)
+  }
+  return err
+}
+
+func benchKey(i int) string {
+  return fmt.Sprintf("bench%06d", i)
+}
+
+//the values written by a client, of the same size, each told apart by
+//its number
+type benchValues struct {
+  pad string
+  prefix string
+  n int
+}
+
+func (v *benchValues) next() string {
+  v.n++
+  s := v.prefix+strconv.Itoa(v.n)+"."
+  if len(s)>=len(v.pad) {
+    return s[:len(v.pad)]
+  }
+  return s+v.pad[len(s):]
+}
+
+func newBenchValues(rng *rand.Rand, client int, size int) *benchValues {
+  const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+  pad := make([]byte, size)
+  for i := range pad {
+    pad[i] = letters[rng.Intn(len(letters))]
+  }
+  return &benchValues{pad:string(pad), prefix:strconv.Itoa(client)+"."}
+}
+
+func (cfg *BenchConfig) clients() []benchClient {
+  transport := &http.Transport{TLSClientConfig:cfg.TLS, MaxIdleConnsPerHost:cfg.Clients}
+  hc := &http.Client{Transport:transport, Timeout:cfg.Timeout}
+  var cs []benchClient
+  for c := 0; c<cfg.Clients; c++ {
+    h := c%len(cfg.Servers)
+    if cfg.API==BenchKV {
+      cs = append(cs, &kvBenchClient{server:cfg.Servers[h], token:cfg.Token, client:hc})
+      continue
+    }
+    ck := newClient(append(append([]string(nil), cfg.Servers[h:]...), cfg.Servers[:h]...),
+      ClientOptions{Token:cfg.Token, TLS:cfg.TLS, Timeout:cfg.Timeout})
+    cs = append(cs, &restBenchClient{ck})
+  }
+  return cs
+}
+
+//what a client measured
+type benchClientResult struct {
+  ops map[string]*BenchOp
+  series []map[string]int64 // by interval
+}
+
+func RunBench(cfg BenchConfig) (*BenchResult,error) {
+  if err := cfg.check(); err!=nil {
+    return nil,err
+  }
+  res := &BenchResult{Config:cfg}
+  cs := cfg.clients()
+
+  //load every key, each client its share
+  var wg sync.WaitGroup
+  var mu sync.Mutex
+  for c := range cs {
+    wg.Add(1)
+    go func(c int){
+      defer wg.Done()
+      values := newBenchValues(rand.New(rand.NewSource(cfg.Seed-int64(c)-1)), c, cfg.ValueSize)
+      for k := c; k<cfg.Keys; k += len(cs) {
+        err := cs[c].load(benchKey(k), values.next())
+        mu.Lock()
+        if err!=nil {
+          res.LoadErrors++
+        }else{
+          res.Loaded++
+        }
+        mu.Unlock()
+      }
+    }(c)
+  }
+  wg.Wait()
+
+  start := time.Now()
+  measured := start.Add(cfg.Warmup)
+  end := measured.Add(cfg.Duration)
+  results := make([]*benchClientResult, len(cs))
+  for c := range cs {
+    wg.Add(1)
+    go func(c int){
+      defer wg.Done()
+      results[c] = benchClientRun(&cfg, c, cs[c], start, measured, end)
+    }(c)
+  }
+  wg.Wait()
+  res.Elapsed = cfg.Duration
+
+  total := &BenchOp{Op:"total", Latency:NewHistogram(benchHighest, 3)}
+  for _,op := range benchOps {
+    o := &BenchOp{Op:op, Latency:NewHistogram(benchHighest, 3)}
+    for _,r := range results {
+      o.Count += r.ops[op].Count
+      o.Errors += r.ops[op].Errors
+      o.Latency.Merge(r.ops[op].Latency)
+    }
+    total.Count += o.Count
+    total.Errors += o.Errors
+    total.Latency.Merge(o.Latency)
+    res.Ops = append(res.Ops, o)
+  }
+  res.Ops = append(res.Ops, total)
+
+  n := int((cfg.Duration+cfg.Interval-1)/cfg.Interval)
+  for i := 0; i<n; i++ {
+    s := BenchSample{End:time.Duration(i+1)*cfg.Interval, Ops:make(map[string]int64)}
+    if s.End>cfg.Duration {
+      s.End = cfg.Duration
+    }
+    for _,r := range results {
+      if i<len(r.series) {
+        for op,k := range r.series[i] {
+          s.Ops[op] += k
+        }
+      }
+    }
+    res.Series = append(res.Series, s)
+  }
+  return res,nil
+}
+
+func benchClientRun(cfg *BenchConfig, c int, cl benchClient, start time.Time, measured time.Time, end time.Time) *benchClientResult {
+  rng := rand.New(rand.NewSource(cfg.Seed+int64(c)))
+  values := newBenchValues(rng, c, cfg.ValueSize)
+  var zipf *rand.Zipf
+  if cfg.Zipf>1 && cfg.Keys>1 {
+    zipf = rand.NewZipf(rng, cfg.Zipf, 1, uint64(cfg.Keys-1))
+  }
+  r := &benchClientResult{ops:make(map[string]*BenchOp)}
+  for _,op := range benchOps {
+    r.ops[op] = &BenchOp{Op:op, Latency:NewHistogram(benchHighest, 3)}
+  }
+  var period time.Duration
+  if cfg.Rate>0 {
+    period = time.Duration(float64(time.Second)*float64(cfg.Clients)/cfg.Rate)
+  }
+  //the clients of a rate start apart, not all at once
+  next := start.Add(period*time.Duration(c)/time.Duration(cfg.Clients))
+  for {
+    var began time.Time
+    if period>0 {
+      //a client behind its schedule stops at the end all the same, the
+      //requests it could not send lost to its throughput
+      if !next.Before(end) || !time.Now().Before(end) {
+        break
+      }
+      if d := time.Until(next); d>0 {
+        time.Sleep(d)
+      }
+      began = next
+      next = next.Add(period)
+    }else{
+      began = time.Now()
+      if !began.Before(end) {
+        break
+      }
+    }
+    var key string
+    if zipf!=nil {
+      key = benchKey(int(zipf.Uint64()))
+    }else{
+      key = benchKey(rng.Intn(cfg.Keys))
+    }
+    op := "update"
+    var err error
+    if rng.Float64()<cfg.Reads {
+      op = "get"
+      err = cl.get(key)
+    }else{
+      err = cl.update(key, values.next())
+    }
+    done := time.Now()
+    if done.Before(measured) || began.Before(measured) {
+      continue
+    }
+    o := r.ops[op]
+    if err!=nil {
+      o.Errors++
+    }else{
+      o.Count++
+      o.Latency.Record(int64(done.Sub(began)/time.Microsecond))
+    }
+    if i := int(done.Sub(measured)/cfg.Interval); done.Before(end) && err==nil {
+      for len(r.series)<=i {
+        r.series = append(r.series, make(map[string]int64))
+      }
+      r.series[i][op]++
+    }
+  }
+  return r
+}
+
+//the quantiles of the outputs
+var BenchQuantiles = []float64{0.5, 0.75, 0.9, 0.95, 0.99, 0.999, 0.9999, 1}
+
+func ms(us float64) float64 {
+  return float64(int64(us+0.5))/1000
+}
+
+type benchLatency struct {
+  Quantile float64 `json:"quantile"`
+  Ms float64 `json:"ms"`
+}
+
+type benchOpJSON struct {
+  Op string `json:"op"`
+  Count int64 `json:"count"`
+  Errors int64 `json:"errors"`
+  OpsPerSec float64 `json:"ops_per_sec"`
+  MeanMs float64 `json:"mean_ms"`
+  MinMs float64 `json:"min_ms"`
+  MaxMs float64 `json:"max_ms"`
+  Latency []benchLatency `json:"latency"`
+}
+
+type benchSampleJSON struct {
+  EndS float64 `json:"end_s"`
+  Ops map[string]int64 `json:"ops"`
+  OpsPerSec float64 `json:"ops_per_sec"`
+}
+
+func (r *BenchResult) opsPerSec(n int64, d time.Duration) float64 {
+  if d<=0 {
+    return 0
+  }
+  return float64(int64(float64(n)/d.Seconds()*10+0.5))/10
+}
+
+func (r *BenchResult) WriteJSON(w io.Writer) error {
+  cfg := r.Config
+  out := struct {
+    Label string `json:"label"`
+    Config map[string]interface{} `json:"config"`
+    Loaded int `json:"loaded"`
+    LoadErrors int `json:"load_errors"`
+    DurationS float64 `json:"duration_s"`
+    Ops []benchOpJSON `json:"ops"`
+    Series []benchSampleJSON `json:"series"`
+  }{Label:cfg.Label, Loaded:r.Loaded, LoadErrors:r.LoadErrors, DurationS:r.Elapsed.Seconds()}
+  dist := "uniform"
+  if cfg.Zipf>1 {
+    dist = fmt.Sprintf("zipfian %g", cfg.Zipf)
+  }
+  out.Config = map[string]interface{}{"servers":cfg.Servers, "api":cfg.API, "clients":cfg.Clients,
+    "reads":cfg.Reads, "keys":cfg.Keys, "distribution":dist, "value_size":cfg.ValueSize,
+    "warmup":cfg.Warmup.String(), "duration":cfg.Duration.String(), "rate":cfg.Rate, "seed":cfg.Seed}
+  for _,o := range r.Ops {
+    j := benchOpJSON{Op:o.Op, Count:o.Count, Errors:o.Errors, OpsPerSec:r.opsPerSec(o.Count, r.Elapsed),
+      MeanMs:ms(o.Latency.Mean()), MinMs:ms(float64(o.Latency.Min())), MaxMs:ms(float64(o.Latency.Max()))}
+    for _,q := range BenchQuantiles {
+      j.Latency = append(j.Latency, benchLatency{q, ms(float64(o.Latency.Quantile(q)))})
+    }
+    out.Ops = append(out.Ops, j)
+  }
+  prev := time.Duration(0)
+  for _,s := range r.Series {
+    var n int64
+    for _,k := range s.Ops {
+      n += k
+    }
+    out.Series = append(out.Series, benchSampleJSON{s.End.Seconds(), s.Ops, r.opsPerSec(n, s.End-prev)})
+    prev = s.End
+  }
+  enc := json.NewEncoder(w)
+  enc.SetIndent("", "  ")
+  return enc.Encode(&out)
+}
+
+func quantileName(q float64) string {
+  if q==1 {
+    return "max"
+  }
+  return "p"+strings.Replace(strconv.FormatFloat(q*100, 'f', -1, 64), ".", "", 1)
+}
+
+//a row by op, under a header if header
+func (r *BenchResult) WriteCSV(w io.Writer, header bool) error {
+  cw := csv.NewWriter(w)
+  if header {
+    row := []string{"label", "op", "count", "errors", "ops_per_sec", "mean_ms", "min_ms"}
+    for _,q := range BenchQuantiles {
+      row = append(row, quantileName(q)+"_ms")
+    }
+    cw.Write(row)
+  }
+  f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+  for _,o := range r.Ops {
+    row := []string{r.Config.Label, o.Op, strconv.FormatInt(o.Count, 10), strconv.FormatInt(o.Errors, 10),
+      f(r.opsPerSec(o.Count, r.Elapsed)), f(ms(o.Latency.Mean())), f(ms(float64(o.Latency.Min())))}
+    for _,q := range BenchQuantiles {
+      row = append(row, f(ms(float64(o.Latency.Quantile(q)))))
+    }
+    cw.Write(row)
+  }
+  cw.Flush()
+  return cw.Error()
+}
+
+//the throughput over time, a row by interval
+func (r *BenchResult) WriteSeriesCSV(w io.Writer, header bool) error {
+  cw := csv.NewWriter(w)
+  if header {
+    cw.Write(append(append([]string{"label", "end_s"}, benchOps...), "ops_per_sec"))
+  }
+  prev := time.Duration(0)
+  for _,s := range r.Series {
+    row := []string{r.Config.Label, strconv.FormatFloat(s.End.Seconds(), 'f', -1, 64)}
+    var n int64
+    for _,op := range benchOps {
+      row = append(row, strconv.FormatInt(s.Ops[op], 10))
+      n += s.Ops[op]
+    }
+    row = append(row, strconv.FormatFloat(r.opsPerSec(n, s.End-prev), 'f', -1, 64))
+    prev = s.End
+    cw.Write(row)
+  }
+  cw.Flush()
+  return cw.Error()
+}
+
+func (r *BenchResult) WriteText(w io.Writer) {
+  cfg := r.Config
+  if cfg.Label!="" {
+    fmt.Fprintf(w, "%s: ", cfg.Label)
+  }
+  fmt.Fprintf(w, "%d clients, %d keys, %g%% reads, %v", cfg.Clients, cfg.Keys, cfg.Reads*100, r.Elapsed)
+  if cfg.Rate>0 {
+    fmt.Fprintf(w, " at %g/s", cfg.Rate)
+  }
+  fmt.Fprintf(w, "; %d keys loaded, %d failed\n", r.Loaded, r.LoadErrors)
+  fmt.Fprintf(w, "%-8s %9s %7s %10s %9s", "op", "count", "errors", "ops/s", "mean")
+  for _,q := range BenchQuantiles {
+    fmt.Fprintf(w, " %9s", quantileName(q))
+  }
+  fmt.Fprintf(w, "   (ms)\n")
+  for _,o := range r.Ops {
+    fmt.Fprintf(w, "%-8s %9d %7d %10.1f %9.3f", o.Op, o.Count, o.Errors, r.opsPerSec(o.Count, r.Elapsed), ms(o.Latency.Mean()))
+    for _,q := range BenchQuantiles {
+      fmt.Fprintf(w, " %9.3f", ms(float64(o.Latency.Quantile(q))))
+    }
+    fmt.Fprintln(w)
+  }
+  fmt.Fprintf(w, "throughput (ops/s):")
+  prev := time.Duration(0)
+  for _,s := range r.Series {
+    var n int64
+    for _,k := range s.Ops {
+      n += k
+    }
+    fmt.Fprintf(w, " %.0f", r.opsPerSec(n, s.End-prev))
+    prev = s.End
+  }
+  fmt.Fprintln(w)
+}
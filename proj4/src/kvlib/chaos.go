@@ -0,0 +1,495 @@
+package kvlib
+
+import(
+  "fmt"
+  "math/rand"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+//Randomized chaos runs, for bin/kvchaos. A seed decides everything that
+//is up to us: the ops of every client, and a schedule of node kills,
+//restarts and partitions that always leaves a majority up and connected.
+//The clients run at once against a cluster while the schedule is played,
+//and their history is checked for linearizability. A violation is told
+//as a script of TestUnit, made of the ops that violate it and the faults
+//around them.
+
+type ChaosConfig struct {
+  Seed int64
+  Servers int
+  Clients int
+  Ops int // per client
+  Keys int
+  Faults int // kills, restarts, partitions and heals
+  NoKills bool // partitions only
+  Gap time.Duration // between faults, on average
+  Timeout time.Duration // of a request to a server
+}
+
+func (c ChaosConfig) withDefaults() ChaosConfig {
+  def := func(v *int, d int){
+    if *v<=0 {
+      *v = d
+    }
+  }
+  def(&c.Servers, 3)
+  def(&c.Clients, 4)
+  def(&c.Ops, 50)
+  def(&c.Keys, 5)
+  if c.Faults<0 {
+    c.Faults = 0
+  }
+  if c.Gap<=0 {
+    c.Gap = 500*time.Millisecond
+  }
+  if c.Timeout<=0 {
+    c.Timeout = 3*time.Second
+  }
+  return c
+}
+
+//the flags of bin/kvchaos that give the same run
+func (c ChaosConfig) Flags() string {
+  c = c.withDefaults()
+  f := fmt.Sprintf("-seed %d -clients %d -ops %d -keys %d -faults %d -gap %v",
+    c.Seed, c.Clients, c.Ops, c.Keys, c.Faults, c.Gap)
+  if c.NoKills {
+    f += " -kills=false"
+  }
+  return f
+}
+
+type ChaosEventKind int
+
+const(
+  ChaosKill ChaosEventKind = iota
+  ChaosRestart
+  ChaosPartition
+  ChaosHeal
+)
+
+//a fault, or its end; nodes count from 0
+type ChaosEvent struct {
+  At time.Duration // since the run began
+  Kind ChaosEventKind
+  Node int // of a kill or a restart
+  Sets [][]int // of a partition
+  Err string // if it could not be applied
+}
+
+//the instruction of TestUnit doing it
+func (e ChaosEvent) String() string {
+  switch e.Kind {
+    case ChaosKill:
+      return fmt.Sprintf("kill_server %d", e.Node+1)
+    case ChaosRestart:
+      return fmt.Sprintf("start_server %d", e.Node+1)
+    case ChaosPartition:
+      var sets []string
+      for _,set := range e.Sets {
+        var s []string
+        for _,n := range set {
+          s = append(s, fmt.Sprint(n+1))
+        }
+        sets = append(sets, strings.Join(s, " "))
+      }
+      return "Partition "+strings.Join(sets, " / ")
+  }
+  return "Heal"
+}
+
+//an op of a client
+type ChaosStep struct {
+  Kind OpKind
+  Key string
+  Value string
+}
+
+var chaosScriptOps = map[OpKind]string{OpGet:"Get", OpInsert:"Put", OpUpdate:"Update", OpDelete:"Delete"}
+
+func (s ChaosStep) String() string {
+  switch s.Kind {
+    case OpInsert, OpUpdate:
+      return fmt.Sprintf("%s %s %s", chaosScriptOps[s.Kind], s.Key, s.Value)
+  }
+  return fmt.Sprintf("%s %s", chaosScriptOps[s.Kind], s.Key)
+}
+
+type ChaosPlan struct {
+  Config ChaosConfig
+  Events []ChaosEvent
+  Steps [][]ChaosStep // by client
+}
+
+//the plan of a seed; the same config always gives the same plan
+func NewChaosPlan(cfg ChaosConfig) *ChaosPlan {
+  cfg = cfg.withDefaults()
+  p := &ChaosPlan{Config:cfg}
+  rng := rand.New(rand.NewSource(cfg.Seed))
+  seeds := make([]int64, cfg.Clients)
+  for c := range seeds {
+    seeds[c] = rng.Int63()
+  }
+  p.Events = chaosSchedule(cfg, rng)
+  //only the ops a script can do; values are unique, so that a read tells
+  //which write it saw
+  kinds := []OpKind{OpGet, OpInsert, OpUpdate, OpDelete}
+  for c := 0; c<cfg.Clients; c++ {
+    crng := rand.New(rand.NewSource(seeds[c]))
+    steps := make([]ChaosStep, cfg.Ops)
+    for i := range steps {
+      steps[i] = ChaosStep{Kind:kinds[crng.Intn(len(kinds))], Key:fmt.Sprintf("k%d", crng.Intn(cfg.Keys)+1)}
+      if steps[i].Kind==OpInsert || steps[i].Kind==OpUpdate {
+        steps[i].Value = fmt.Sprintf("%d.%d", c+1, i)
+      }
+    }
+    p.Steps = append(p.Steps, steps)
+  }
+  return p
+}
+
+//cfg.Faults events, then whatever brings every node back; at most a
+//minority is ever killed or cut off
+func chaosSchedule(cfg ChaosConfig, rng *rand.Rand) []ChaosEvent {
+  n := cfg.Servers
+  f := (n-1)/2
+  var events []ChaosEvent
+  var down []int
+  var minority []int // of the partition, if any
+  var at time.Duration
+  isDown := func(i int) bool {
+    for _,d := range down {
+      if d==i {
+        return true
+      }
+    }
+    return false
+  }
+  for len(events)<cfg.Faults {
+    at += cfg.Gap/2+time.Duration(rng.Int63n(int64(cfg.Gap)))
+    var kinds []ChaosEventKind
+    if !cfg.NoKills && len(down)+len(minority)<f {
+      kinds = append(kinds, ChaosKill)
+    }
+    if len(down)>0 {
+      kinds = append(kinds, ChaosRestart)
+    }
+    if minority==nil && len(down)<f {
+      kinds = append(kinds, ChaosPartition)
+    }
+    if minority!=nil {
+      kinds = append(kinds, ChaosHeal)
+    }
+    if len(kinds)==0 {
+      break // a single node
+    }
+    e := ChaosEvent{At:at, Kind:kinds[rng.Intn(len(kinds))]}
+    switch e.Kind {
+      case ChaosKill:
+        var up []int
+        for i := 0; i<n; i++ {
+          if !isDown(i) {
+            up = append(up, i)
+          }
+        }
+        e.Node = up[rng.Intn(len(up))]
+        down = append(down, e.Node)
+      case ChaosRestart:
+        k := rng.Intn(len(down))
+        e.Node = down[k]
+        down = append(down[:k], down[k+1:]...)
+      case ChaosPartition:
+        //a minority of the living nodes, cut off from the others
+        var up []int
+        for i := 0; i<n; i++ {
+          if !isDown(i) {
+            up = append(up, i)
+          }
+        }
+        rng.Shuffle(len(up), func(i, j int){ up[i],up[j] = up[j],up[i] })
+        minority = append([]int(nil), up[:1+rng.Intn(f-len(down))]...)
+        sort.Ints(minority)
+        var rest []int
+        for i := 0; i<n; i++ {
+          if !contains(minority, i) {
+            rest = append(rest, i)
+          }
+        }
+        e.Sets = [][]int{minority, rest}
+      case ChaosHeal:
+        minority = nil
+    }
+    events = append(events, e)
+  }
+  at += cfg.Gap
+  if minority!=nil {
+    events = append(events, ChaosEvent{At:at, Kind:ChaosHeal})
+  }
+  sort.Ints(down)
+  for _,d := range down {
+    events = append(events, ChaosEvent{At:at, Kind:ChaosRestart, Node:d})
+  }
+  return events
+}
+
+func contains(s []int, v int) bool {
+  for _,x := range s {
+    if x==v {
+      return true
+    }
+  }
+  return false
+}
+
+//the home server of a client, to which a script sends its ops
+func (p *ChaosPlan) home(client int) int {
+  return client%p.Config.Servers
+}
+
+//the plan as a script of TestUnit, in place of a run: each round is a
+//block of one op per client, and the faults come between the rounds in
+//the order of their times
+func (p *ChaosPlan) Script() string {
+  var b strings.Builder
+  cfg := p.Config
+  fmt.Fprintf(&b, "# bin/kvchaos %s\n", cfg.Flags())
+  end := cfg.Gap
+  if len(p.Events)>0 {
+    end = p.Events[len(p.Events)-1].At
+  }
+  next := 0
+  for i := 0; i<cfg.Ops; i++ {
+    for ; next<len(p.Events) && p.Events[next].At<=end*time.Duration(i)/time.Duration(cfg.Ops); next++ {
+      writeEvent(&b, p.Events[next], cfg.Gap)
+    }
+    b.WriteString("Block\n")
+    for c := range p.Steps {
+      fmt.Fprintf(&b, "Switch %d\n%v\n", p.home(c)+1, p.Steps[c][i])
+    }
+    b.WriteString("Endblock\n")
+  }
+  for ; next<len(p.Events); next++ {
+    writeEvent(&b, p.Events[next], cfg.Gap)
+  }
+  return b.String()
+}
+
+//an event, and time for the nodes to see it out of a block
+func writeEvent(b *strings.Builder, e ChaosEvent, gap time.Duration){
+  fmt.Fprintf(b, "%v\n", e)
+  if gap>0 && (e.Kind==ChaosKill || e.Kind==ChaosRestart) {
+    fmt.Fprintf(b, "Sleep %d\n", gap/time.Millisecond)
+  }
+}
+
+//what a run does to the nodes; Partition(nil) heals
+type ChaosCluster interface {
+  URL(i int) string
+  Kill(i int) error
+  Restart(i int) error
+  Partition(sets [][]int) error
+}
+
+type ChaosResult struct {
+  Plan *ChaosPlan
+  Ops []HistOp
+  Events []ChaosEvent // as played, At since the history began
+  Linearizable bool
+  Violation []HistOp
+}
+
+//run the plan against the cluster, whose nodes are all up and connected
+func RunChaos(p *ChaosPlan, cluster ChaosCluster) *ChaosResult {
+  cfg := p.Config
+  res := &ChaosResult{Plan:p}
+  hist := NewHistory()
+  var urls []string
+  for i := 0; i<cfg.Servers; i++ {
+    urls = append(urls, cluster.URL(i))
+  }
+
+  done := make(chan bool)
+  var wg sync.WaitGroup
+  for c := range p.Steps {
+    wg.Add(1)
+    go func(c int){
+      defer wg.Done()
+      //starting at its home, on to the others while it is down
+      h := p.home(c)
+      ck := newClient(append(append([]string(nil), urls[h:]...), urls[:h]...), ClientOptions{Timeout:cfg.Timeout})
+      for _,s := range p.Steps[c] {
+        hist.Do(c+1, ck, s.Kind, s.Key, s.Value)
+      }
+    }(c)
+  }
+  go func(){
+    wg.Wait()
+    close(done)
+  }()
+
+  //the faults, until the clients are done; the cluster is then brought
+  //back whole, as at the end of the schedule
+  var played []ChaosEvent
+  var down []int
+  var cut bool
+  apply := func(e ChaosEvent){
+    var err error
+    switch e.Kind {
+      case ChaosKill:
+        err = cluster.Kill(e.Node)
+        down = append(down, e.Node)
+      case ChaosRestart:
+        err = cluster.Restart(e.Node)
+        for k,d := range down {
+          if d==e.Node {
+            down = append(down[:k], down[k+1:]...)
+            break
+          }
+        }
+      case ChaosPartition:
+        err = cluster.Partition(e.Sets)
+        cut = true
+      case ChaosHeal:
+        err = cluster.Partition(nil)
+        cut = false
+    }
+    e.At = time.Since(hist.start)
+    if err!=nil {
+      e.Err = err.Error()
+      clog.Warn("chaos event failed", "event", e.String(), "err", err)
+    }
+    played = append(played, e)
+  }
+  start := time.Now()
+  finished := false
+  for _,e := range p.Events {
+    select {
+      case <-done:
+        finished = true
+      case <-time.After(time.Until(start.Add(e.At))):
+    }
+    if finished {
+      break
+    }
+    apply(e)
+  }
+  if cut {
+    apply(ChaosEvent{Kind:ChaosHeal})
+  }
+  for len(down)>0 {
+    apply(ChaosEvent{Kind:ChaosRestart, Node:down[0]})
+  }
+  <-done
+
+  res.Ops = hist.Ops()
+  res.Events = played
+  res.Linearizable,res.Violation = CheckLinearizable(res.Ops)
+  return res
+}
+
+//a script of TestUnit that replays the violation: the nodes down and the
+//partition when its first op was called, then its ops and the faults in
+//between, in the order of their times; ops that overlapped run in a block
+func (r *ChaosResult) Reproducer() string {
+  var b strings.Builder
+  cfg := r.Plan.Config
+  fmt.Fprintf(&b, "# bin/kvchaos %s\n", cfg.Flags())
+  if r.Linearizable {
+    b.WriteString("# linearizable, nothing to reproduce\n")
+    return b.String()
+  }
+  ops := append([]HistOp(nil), r.Violation...)
+  sort.SliceStable(ops, func(i, j int) bool { return ops[i].Call<ops[j].Call })
+  fmt.Fprintf(&b, "# %d ops of key %q violate linearizability\n", len(ops), ops[0].Key)
+  from := ops[0].Call
+  to := from
+  for _,op := range ops {
+    if op.Return!=Never && op.Return>to {
+      to = op.Return
+    }
+    if op.Call>to {
+      to = op.Call
+    }
+  }
+
+  //the state at from
+  down := make(map[int]bool)
+  var part *ChaosEvent
+  i := 0
+  for ; i<len(r.Events) && r.Events[i].At<from; i++ {
+    e := r.Events[i]
+    switch e.Kind {
+      case ChaosKill:
+        down[e.Node] = true
+      case ChaosRestart:
+        delete(down, e.Node)
+      case ChaosPartition:
+        part = &r.Events[i]
+      case ChaosHeal:
+        part = nil
+    }
+  }
+  for n := 0; n<cfg.Servers; n++ {
+    if down[n] {
+      fmt.Fprintf(&b, "kill_server %d\n", n+1)
+    }
+  }
+  if part!=nil {
+    fmt.Fprintf(&b, "%v\n", *part)
+  }
+
+  //the ops and the events up to to, by time; an op opens a block if the
+  //next one is called before it, or any other op of the block, returns
+  type item struct {
+    at time.Duration
+    op *HistOp
+    ev *ChaosEvent
+  }
+  var items []item
+  for k := range ops {
+    items = append(items, item{at:ops[k].Call, op:&ops[k]})
+  }
+  for ; i<len(r.Events) && r.Events[i].At<=to; i++ {
+    items = append(items, item{at:r.Events[i].At, ev:&r.Events[i]})
+  }
+  sort.SliceStable(items, func(i, j int) bool { return items[i].at<items[j].at })
+  var open time.Duration = -1 // the last return of the block, if in one
+  for k,it := range items {
+    if it.ev!=nil {
+      fmt.Fprintf(&b, "%v\n", *it.ev)
+      continue
+    }
+    op := it.op
+    if open<0 {
+      for _,later := range items[k+1:] {
+        if later.op!=nil {
+          if later.op.Call<op.Return {
+            b.WriteString("Block\n")
+            open = op.Return
+          }
+          break
+        }
+      }
+    }else if op.Return>open {
+      open = op.Return
+    }
+    fmt.Fprintf(&b, "Switch %d\n%v\n", r.Plan.home(op.Client-1)+1, ChaosStep{op.Kind, op.Key, op.Value})
+    if open>=0 {
+      end := true
+      for _,later := range items[k+1:] {
+        if later.op!=nil {
+          end = later.op.Call>=open
+          break
+        }
+      }
+      if end {
+        b.WriteString("Endblock\n")
+        open = -1
+      }
+    }
+  }
+  return b.String()
+}
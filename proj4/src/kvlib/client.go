@@ -0,0 +1,53 @@
+package kvlib
+
+import(
+  "crypto/tls"
+  "errors"
+  "time"
+
+  "faultnet"
+)
+
+//The kvpaxos servers, as the tester, the chaos runs and the benchmarks
+//reach them. kvpaxos/httpclient sets NewClient once it is imported, so
+//that kvlib does not depend on kvpaxos; a binary that runs scripts, chaos
+//or benchmarks imports it, if only for that.
+
+//the failures that clients tell apart, by the error code of the server
+var(
+  ErrNotFound=errors.New("key not found")
+  ErrExists=errors.New("key exists")
+  ErrMismatch=errors.New("value mismatch")
+  ErrUnavailable=errors.New("no server available") // wrapped, test with errors.Is
+)
+
+//what kvlib needs of a client of the servers; kvpaxos/httpclient.Clerk
+type Client interface {
+  Get(key string) (string,int,error)
+  Insert(key string, value string) error
+  Put(key string, value string) (string,error)
+  Update(key string, value string) (string,error)
+  Delete(key string) (string,error)
+  CountKey() (int,error)
+  Dump() (map[string]string,error)
+  Faults() (string,faultnet.Report,error)
+  SetFaults(f faultnet.Faults) error
+}
+
+//the options of a new client; zero values leave the defaults of the client
+type ClientOptions struct {
+  Token string // bearer token of /kv/* and /v1/keys/*
+  TLS *tls.Config // to talk HTTPS
+  Timeout time.Duration // of a request
+  Retries int // rounds over all servers before giving up
+}
+
+//a client of the servers at urls, tried in turn from the first
+var NewClient func(urls []string, o ClientOptions) Client
+
+func newClient(urls []string, o ClientOptions) Client {
+  if NewClient==nil {
+    panic("kvlib: no client of the servers; import kvpaxos/httpclient")
+  }
+  return NewClient(urls,o)
+}
@@ -0,0 +1,113 @@
+package kvlib
+
+import(
+  "encoding/json"
+  "errors"
+  "net/http"
+  "sort"
+  "strconv"
+)
+
+//Streaming of /kvman/dump, in key order. The reply is written as it goes
+//(chunked), either as one JSON object {"key":"value",...}, as before, or
+//with format=jsonl as one {"key":..,"value":..} per line. A page starts
+//after the key given in after and holds at most limit keys; if more keys
+//follow, the header X-Next-After gives the after of the next page.
+
+const DumpFlushEvery = 1000 // keys written between flushes
+
+type DumpParams struct {
+  After string
+  Limit int // 0 for no limit
+  Lines bool // JSON lines instead of one object
+  Base64 bool // values as base64, for binary values
+}
+
+type dumpLine struct {
+  Key string `json:"key"`
+  Value interface{} `json:"value"`
+}
+
+func ParseDumpParams(r *http.Request) (DumpParams,error){
+  var p DumpParams
+  p.After = r.FormValue("after")
+  if l := r.FormValue("limit"); l!="" {
+    n,err := strconv.Atoi(l)
+    if err!=nil || n<=0 {
+      return p,errors.New("limit should be a positive number")
+    }
+    p.Limit = n
+  }
+  switch r.FormValue("format") {
+    case "jsonl":
+      p.Lines = true
+    case "", "json":
+    default:
+      return p,errors.New("format should be json or jsonl")
+  }
+  switch r.FormValue("encoding") {
+    case "base64":
+      p.Base64 = true
+    case "":
+    default:
+      return p,errors.New("encoding should be base64, or not given")
+  }
+  return p,nil
+}
+
+//write the page of p out of keys, which are sorted; get gives the value
+//of a key as of the dump, and whether it exists
+func WriteDump(w http.ResponseWriter, p DumpParams, keys []string, get func(string)(string,bool)){
+  i := sort.SearchStrings(keys, p.After)
+  if i<len(keys) && keys[i]==p.After && p.After!="" {
+    i++
+  }
+  //the page is chosen first, to give X-Next-After before the body
+  var page []string
+  for ; i<len(keys) && (p.Limit==0 || len(page)<p.Limit); i++ {
+    if _,ok := get(keys[i]); ok {
+      page = append(page, keys[i])
+    }
+  }
+  for ; p.Limit>0 && i<len(keys); i++ {
+    if _,ok := get(keys[i]); ok {
+      w.Header().Set("X-Next-After", page[len(page)-1])
+      break
+    }
+  }
+  if p.Lines {
+    w.Header().Set("Content-Type", "application/x-ndjson")
+  }else{
+    w.Header().Set("Content-Type", "application/json")
+  }
+  flusher,_ := w.(http.Flusher)
+  if !p.Lines {
+    w.Write([]byte("{"))
+  }
+  for n,k := range page {
+    v,_ := get(k)
+    var value interface{} = v
+    if p.Base64 {
+      value = []byte(v)
+    }
+    if p.Lines {
+      enc,_ := json.Marshal(&dumpLine{k,value})
+      w.Write(append(enc,'\n'))
+    }else{
+      ek,_ := json.Marshal(k)
+      ev,_ := json.Marshal(value)
+      if n>0 {
+        w.Write([]byte(","))
+      }
+      w.Write(ek)
+      w.Write([]byte(":"))
+      w.Write(ev)
+    }
+    if flusher!=nil && (n+1)%DumpFlushEvery==0 {
+      flusher.Flush()
+    }
+  }
+  if !p.Lines {
+    w.Write([]byte("}"))
+  }
+}
@@ -0,0 +1,160 @@
+package kvlib
+
+import(
+  "math"
+  "math/bits"
+)
+
+//A histogram of latencies after HdrHistogram: values from 1 up to a
+//highest trackable one are counted in buckets that double in size, each
+//split in sub-buckets fine enough to keep a given number of significant
+//digits, so that a quantile is off by at most one part in 10^digits
+//whatever its magnitude. Values above the highest are counted as it.
+
+type Histogram struct {
+  highest int64
+  subHalfMag uint // log2 of the sub-buckets in half a bucket
+  subCount int64
+  subHalf int64
+  subMask int64
+  counts []int64
+  total int64
+  min int64
+  max int64
+  sum float64
+}
+
+//a histogram of values in [1,highest], to digits significant digits (1-5)
+func NewHistogram(highest int64, digits int) *Histogram {
+  if digits<1 {
+    digits = 1
+  }else if digits>5 {
+    digits = 5
+  }
+  if highest<2 {
+    highest = 2
+  }
+  h := &Histogram{highest:highest, min:math.MaxInt64}
+  single := int64(2*math.Pow10(digits)) // the largest value counted one by one
+  subMag := uint(math.Ceil(math.Log2(float64(single))))
+  h.subHalfMag = subMag-1
+  h.subCount = 1<<subMag
+  h.subHalf = h.subCount/2
+  h.subMask = h.subCount-1
+  buckets := 1
+  for untracked := h.subCount; untracked<=highest; untracked <<= 1 {
+    buckets++
+    if untracked>math.MaxInt64/2 {
+      break
+    }
+  }
+  h.counts = make([]int64, int64(buckets+1)*h.subHalf)
+  return h
+}
+
+func (h *Histogram) bucketOf(v int64) (int,int64) {
+  b := 64-bits.LeadingZeros64(uint64(v|h.subMask))-int(h.subHalfMag+1)
+  return b,v>>uint(b)
+}
+
+func (h *Histogram) index(v int64) int {
+  b,sub := h.bucketOf(v)
+  return int(int64(b+1)<<h.subHalfMag+sub-h.subHalf)
+}
+
+//the lowest value counted at index i, and the size of its range
+func (h *Histogram) valueAt(i int) (int64,int64) {
+  b := i>>h.subHalfMag-1
+  sub := int64(i)&(h.subHalf-1)+h.subHalf
+  if b<0 {
+    sub -= h.subHalf
+    b = 0
+  }
+  return sub<<uint(b),1<<uint(b)
+}
+
+func (h *Histogram) Record(v int64) {
+  h.RecordN(v, 1)
+}
+
+func (h *Histogram) RecordN(v int64, n int64) {
+  if v<1 {
+    v = 1
+  }else if v>h.highest {
+    v = h.highest
+  }
+  h.counts[h.index(v)] += n
+  h.total += n
+  h.sum += float64(v)*float64(n)
+  if v<h.min {
+    h.min = v
+  }
+  if v>h.max {
+    h.max = v
+  }
+}
+
+//add the counts of o, made with the same highest and digits
+func (h *Histogram) Merge(o *Histogram) {
+  for i,c := range o.counts {
+    h.counts[i] += c
+  }
+  h.total += o.total
+  h.sum += o.sum
+  if o.min<h.min {
+    h.min = o.min
+  }
+  if o.max>h.max {
+    h.max = o.max
+  }
+}
+
+func (h *Histogram) Count() int64 {
+  return h.total
+}
+
+func (h *Histogram) Mean() float64 {
+  if h.total==0 {
+    return 0
+  }
+  return h.sum/float64(h.total)
+}
+
+func (h *Histogram) Min() int64 {
+  if h.total==0 {
+    return 0
+  }
+  return h.min
+}
+
+func (h *Histogram) Max() int64 {
+  return h.max
+}
+
+//the value below which a fraction q of the values lie, as the highest
+//value of its sub-bucket; 0 if empty
+func (h *Histogram) Quantile(q float64) int64 {
+  if h.total==0 {
+    return 0
+  }
+  if q>=1 {
+    return h.max
+  }
+  want := int64(math.Ceil(q*float64(h.total)))
+  if want<1 {
+    want = 1
+  }
+  var seen int64
+  for i,c := range h.counts {
+    seen += c
+    if seen>=want {
+      low,size := h.valueAt(i)
+      v := low+size-1
+      if v>h.max {
+        v = h.max
+      }
+      return v
+    }
+  }
+  return h.max
+}
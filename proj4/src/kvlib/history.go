@@ -0,0 +1,158 @@
+package kvlib
+
+import(
+  "errors"
+  "fmt"
+  "math"
+  "strings"
+  "sync"
+  "time"
+)
+
+//Histories of client operations, for CheckLinearizable. Every operation is
+//recorded with the time it was invoked, the time its reply came back and
+//the reply; an operation that got no reply may or may not have taken
+//effect, and is recorded as pending forever.
+
+type OpKind int
+
+const(
+  OpGet OpKind = iota
+  OpInsert
+  OpUpdate
+  OpPut
+  OpDelete
+)
+
+var opKindNames = []string{"Get", "Insert", "Update", "Put", "Delete"}
+
+func (k OpKind) String() string {
+  if k<0 || int(k)>=len(opKindNames) {
+    return fmt.Sprintf("OpKind(%d)", int(k))
+  }
+  return opKindNames[k]
+}
+
+type Outcome int
+
+const(
+  OutcomeOk Outcome = iota
+  OutcomeFailed // the key was missing, or existed for an insert
+  OutcomeUnknown // no reply, or an error that says nothing of the key
+)
+
+// returned by operations still pending, or that never got a reply
+const Never = time.Duration(math.MaxInt64)
+
+type HistOp struct {
+  Client int
+  Kind OpKind
+  Key string
+  Value string // the value written by Insert, Update and Put
+  Call time.Duration // since the history began
+  Return time.Duration // Never if the outcome is unknown
+  Outcome Outcome
+  Output string // the value got, or the old value of Update, Put and Delete
+}
+
+func (op HistOp) String() string {
+  var b strings.Builder
+  fmt.Fprintf(&b, "client %d: %v(%q", op.Client, op.Kind, op.Key)
+  if op.Kind==OpInsert || op.Kind==OpUpdate || op.Kind==OpPut {
+    fmt.Fprintf(&b, ", %q", op.Value)
+  }
+  b.WriteString(") -> ")
+  switch op.Outcome {
+    case OutcomeOk:
+      if op.Kind==OpInsert {
+        b.WriteString("ok")
+      }else{
+        fmt.Fprintf(&b, "ok %q", op.Output)
+      }
+    case OutcomeFailed:
+      b.WriteString("failed")
+    default:
+      b.WriteString("unknown")
+  }
+  ret := "never"
+  if op.Return!=Never {
+    ret = op.Return.String()
+  }
+  fmt.Fprintf(&b, "  [%v, %s]", op.Call, ret)
+  return b.String()
+}
+
+type History struct {
+  mu sync.Mutex
+  start time.Time
+  ops []HistOp
+}
+
+func NewHistory() *History {
+  return &History{start:time.Now()}
+}
+
+//record the invocation of an operation; the id is given to End
+func (h *History) Begin(client int, kind OpKind, key string, value string) int {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  h.ops = append(h.ops, HistOp{Client:client, Kind:kind, Key:key, Value:value,
+    Call:time.Since(h.start), Return:Never, Outcome:OutcomeUnknown})
+  return len(h.ops)-1
+}
+
+//record the reply of operation id, as returned by a Client
+func (h *History) End(id int, output string, err error) {
+  now := time.Since(h.start)
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  op := &h.ops[id]
+  switch {
+    case err==nil:
+      op.Outcome = OutcomeOk
+      op.Output = output
+    case errors.Is(err, ErrNotFound) || errors.Is(err, ErrExists):
+      op.Outcome = OutcomeFailed
+    default:
+      return // left pending
+  }
+  op.Return = now
+}
+
+//run an operation with ck, recording it
+func (h *History) Do(client int, ck Client, kind OpKind, key string, value string) (string,error) {
+  id := h.Begin(client, kind, key, value)
+  var output string
+  var err error
+  switch kind {
+    case OpGet:
+      output,_,err = ck.Get(key)
+    case OpInsert:
+      err = ck.Insert(key, value)
+    case OpUpdate:
+      output,err = ck.Update(key, value)
+    case OpPut:
+      output,err = ck.Put(key, value)
+    case OpDelete:
+      output,err = ck.Delete(key)
+    default:
+      err = fmt.Errorf("unknown op %v", kind)
+  }
+  h.End(id, output, err)
+  return output,err
+}
+
+//a copy of the operations so far
+func (h *History) Ops() []HistOp {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  return append([]HistOp(nil), h.ops...)
+}
+
+func FormatHistory(ops []HistOp) string {
+  var b strings.Builder
+  for _,op := range ops {
+    fmt.Fprintf(&b, "  %v\n", op)
+  }
+  return b.String()
+}
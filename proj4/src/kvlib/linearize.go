@@ -0,0 +1,257 @@
+package kvlib
+
+import(
+  "encoding/binary"
+  "sort"
+)
+
+//A linearizability checker for histories of the key-value service, after
+//Porcupine: the algorithm of Wing & Gong with the state cache of Lowe.
+//Keys are independent, so the history is checked key by key. The model of
+//a key is whether it exists and its value:
+//  Insert  ok if the key is missing, which it then holds; failed otherwise
+//  Update  ok with the old value if the key exists; failed otherwise
+//  Put     ok with the old value, or "" if missing, always
+//  Delete  ok with the old value if the key exists; failed otherwise
+//  Get     ok with the value if the key exists; failed otherwise
+//An operation of unknown outcome takes effect as above, but any output is
+//accepted; as it never returns, it may also take effect after everything
+//else, that is not at all.
+
+type kvState struct {
+  present bool
+  value string
+}
+
+func step(s kvState, op *HistOp) (kvState,bool) {
+  unknown := op.Outcome==OutcomeUnknown
+  ok := op.Outcome==OutcomeOk
+  failed := op.Outcome==OutcomeFailed
+  switch op.Kind {
+    case OpGet:
+      if unknown || (ok && s.present && op.Output==s.value) || (failed && !s.present) {
+        return s,true
+      }
+    case OpInsert:
+      if !s.present && (ok || unknown) {
+        return kvState{true, op.Value},true
+      }
+      if s.present && (failed || unknown) {
+        return s,true
+      }
+    case OpUpdate:
+      if s.present && (unknown || (ok && op.Output==s.value)) {
+        return kvState{true, op.Value},true
+      }
+      if !s.present && (failed || unknown) {
+        return s,true
+      }
+    case OpPut:
+      if unknown || (ok && op.Output==s.value) {
+        return kvState{true, op.Value},true
+      }
+    case OpDelete:
+      if s.present && (unknown || (ok && op.Output==s.value)) {
+        return kvState{},true
+      }
+      if !s.present && (failed || unknown) {
+        return s,true
+      }
+  }
+  return s,false
+}
+
+//a call or a return, in a list ordered by time
+type event struct {
+  op int
+  ret bool
+  match *event // the return of a call
+  prev *event
+  next *event
+}
+
+func eventList(ops []HistOp) *event {
+  events := make([]*event, 0, 2*len(ops))
+  for i := range ops {
+    call := &event{op:i}
+    call.match = &event{op:i, ret:true}
+    events = append(events, call, call.match)
+  }
+  at := func(e *event) int64 {
+    if e.ret {
+      return int64(ops[e.op].Return)
+    }
+    return int64(ops[e.op].Call)
+  }
+  //at the same time, calls go first, as if concurrent
+  sort.SliceStable(events, func(i, j int) bool {
+    if at(events[i])!=at(events[j]) {
+      return at(events[i])<at(events[j])
+    }
+    return !events[i].ret && events[j].ret
+  })
+  head := &event{op:-1}
+  last := head
+  for _,e := range events {
+    last.next = e
+    e.prev = last
+    last = e
+  }
+  return head
+}
+
+//take a call and its return out of the list
+func lift(call *event) {
+  call.prev.next = call.next
+  if call.next!=nil {
+    call.next.prev = call.prev
+  }
+  ret := call.match
+  ret.prev.next = ret.next
+  if ret.next!=nil {
+    ret.next.prev = ret.prev
+  }
+}
+
+//put them back, in the reverse order of lift
+func unlift(call *event) {
+  ret := call.match
+  ret.prev.next = ret
+  if ret.next!=nil {
+    ret.next.prev = ret
+  }
+  call.prev.next = call
+  if call.next!=nil {
+    call.next.prev = call
+  }
+}
+
+type bitset []uint64
+
+func (b bitset) set(i int) { b[i/64] |= 1<<uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1<<uint(i%64) }
+
+//the cache key of the ops linearized so far and the state they lead to
+func cacheKey(b bitset, s kvState) string {
+  buf := make([]byte, 8*len(b)+1, 8*len(b)+1+len(s.value))
+  for i,w := range b {
+    binary.LittleEndian.PutUint64(buf[8*i:], w)
+  }
+  if s.present {
+    buf[8*len(b)] = 1
+  }
+  return string(append(buf, s.value...))
+}
+
+//whether the operations, all on one key, are linearizable
+func linearizable(ops []HistOp) bool {
+  type frame struct {
+    call *event
+    state kvState
+  }
+  head := eventList(ops)
+  done := make(bitset, (len(ops)+63)/64)
+  seen := make(map[string]bool)
+  var stack []frame
+  var s kvState
+  e := head.next
+  for head.next!=nil {
+    if !e.ret {
+      if next,ok := step(s, &ops[e.op]); ok {
+        done.set(e.op)
+        if k := cacheKey(done, next); !seen[k] {
+          seen[k] = true
+          stack = append(stack, frame{e, s})
+          s = next
+          lift(e)
+          e = head.next
+          continue
+        }
+        done.clear(e.op)
+      }
+      e = e.next
+      continue
+    }
+    //an op returned before any of the pending ones could be linearized
+    if len(stack)==0 {
+      return false
+    }
+    f := stack[len(stack)-1]
+    stack = stack[:len(stack)-1]
+    done.clear(f.call.op)
+    s = f.state
+    unlift(f.call)
+    e = f.call.next
+  }
+  return true
+}
+
+//the operations on each key, in the order given; gets of unknown outcome
+//say nothing and are left out
+func byKey(ops []HistOp) (map[string][]HistOp,[]string) {
+  m := make(map[string][]HistOp)
+  var keys []string
+  for _,op := range ops {
+    if op.Kind==OpGet && op.Outcome==OutcomeUnknown {
+      continue
+    }
+    if _,found := m[op.Key]; !found {
+      keys = append(keys, op.Key)
+    }
+    m[op.Key] = append(m[op.Key], op)
+  }
+  sort.Strings(keys)
+  return m,keys
+}
+
+//the ops called up to the call of ops[n-1], in the order of their calls,
+//as they stood then: those yet to return are pending
+func prefix(ops []HistOp, n int) []HistOp {
+  at := ops[n-1].Call
+  p := append([]HistOp(nil), ops[:n]...)
+  for i := range p {
+    if p[i].Return>at {
+      p[i].Return,p[i].Outcome,p[i].Output = Never,OutcomeUnknown,""
+    }
+  }
+  return p
+}
+
+//a violating sub-history that any linearization of ops would linearize
+//too: the shortest violating prefix, less the reads and failed ops (which
+//leave the state as it is) that are not needed to violate it. Leaving out
+//a write could make a violation of what was not one.
+func minimize(ops []HistOp) []HistOp {
+  sorted := append([]HistOp(nil), ops...)
+  sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Call<sorted[j].Call })
+  cur := sorted
+  for n := 1; n<=len(sorted); n++ {
+    if p := prefix(sorted, n); !linearizable(p) {
+      cur = p
+      break
+    }
+  }
+  for i := 0; i<len(cur); {
+    if cur[i].Kind==OpGet || cur[i].Outcome==OutcomeFailed {
+      trial := append(append([]HistOp(nil), cur[:i]...), cur[i+1:]...)
+      if !linearizable(trial) {
+        cur = trial
+        continue
+      }
+    }
+    i++
+  }
+  return cur
+}
+
+//whether the history is linearizable; if not, a minimal violating
+//sub-history of the first key found not to be
+func CheckLinearizable(ops []HistOp) (bool,[]HistOp) {
+  m,keys := byKey(ops)
+  for _,k := range keys {
+    if !linearizable(m[k]) {
+      return false,minimize(m[k])
+    }
+  }
+  return true,nil
+}
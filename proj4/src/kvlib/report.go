@@ -0,0 +1,180 @@
+package kvlib
+
+import(
+  "encoding/json"
+  "encoding/xml"
+  "fmt"
+  "io"
+  "sort"
+  "strings"
+  "time"
+)
+
+//The report of a run of the tester: a case by script, with its time, the
+//instructions that failed, and, for a failed case, the state of the
+//servers, the ends of their logs and the output of the script. It is
+//written as JSON, or as JUnit XML for CI.
+
+type CaseReport struct {
+  Name string `json:"name"`
+  Passed bool `json:"passed"`
+  Start time.Time `json:"start"`
+  DurationS float64 `json:"duration_s"`
+  Failures []string `json:"failures,omitempty"`
+  Servers []AgentStatus `json:"servers,omitempty"` // after the case
+  Logs map[string]string `json:"logs,omitempty"` // by node, of a failed case
+  Output string `json:"output,omitempty"` // of a failed case
+}
+
+type TestReport struct {
+  Suite string `json:"suite"`
+  Start time.Time `json:"start"`
+  DurationS float64 `json:"duration_s"`
+  Total int `json:"total"`
+  Passed int `json:"passed"`
+  Failed int `json:"failed"`
+  Cases []*CaseReport `json:"cases"`
+}
+
+func NewTestReport(suite string) *TestReport {
+  return &TestReport{Suite:suite, Start:time.Now(), Cases:[]*CaseReport{}}
+}
+
+//the report of a script run from start, with its output and fail as
+//returned by RunScript
+func NewCaseReport(name string, start time.Time, output string, fail int) *CaseReport {
+  c := &CaseReport{Name:name, Start:start, DurationS:time.Since(start).Seconds(), Passed:fail==0}
+  if !c.Passed {
+    c.Failures = ScriptFailures(output)
+    c.Output = output
+  }
+  return c
+}
+
+func (r *TestReport) Add(c *CaseReport) {
+  r.Cases = append(r.Cases, c)
+  r.Total++
+  if c.Passed {
+    r.Passed++
+  }else{
+    r.Failed++
+  }
+  r.DurationS = time.Since(r.Start).Seconds()
+}
+
+//the parts of the output of a script that failed it: each instruction
+//whose result was a fatal error, with that result, and the errors of the
+//script and of the history
+func ScriptFailures(output string) []string {
+  var fs []string
+  for i,part := range strings.Split(output, "\nInstruction: ") {
+    if !strings.Contains(part, "FATAL ERROR!!!") {
+      continue
+    }
+    //up to the last fatal error, what follows is of the next steps
+    part = part[:strings.LastIndex(part, "FATAL ERROR!!!")]
+    var lines []string
+    for _,l := range strings.Split(part, "\n") {
+      if l=="" || l=="FATAL ERROR!!!" {
+        continue
+      }
+      lines = append(lines, l)
+    }
+    if i>0 {
+      lines[0] = "Instruction: "+lines[0]
+    }else if len(lines)>0 && strings.HasPrefix(lines[0], "Testing ") {
+      lines = lines[1:] // the header
+    }
+    fs = append(fs, strings.Join(lines, "\n"))
+  }
+  return fs
+}
+
+func (r *TestReport) WriteJSON(w io.Writer) error {
+  enc := json.NewEncoder(w)
+  enc.SetIndent("", "  ")
+  return enc.Encode(r)
+}
+
+type junitFailure struct {
+  Message string `xml:"message,attr"`
+  Type string `xml:"type,attr"`
+  Text string `xml:",cdata"`
+}
+
+type junitText struct {
+  Text string `xml:",cdata"`
+}
+
+type junitCase struct {
+  Name string `xml:"name,attr"`
+  Classname string `xml:"classname,attr"`
+  Time string `xml:"time,attr"`
+  Failure *junitFailure `xml:"failure,omitempty"`
+  SystemOut *junitText `xml:"system-out,omitempty"`
+  SystemErr *junitText `xml:"system-err,omitempty"`
+}
+
+type junitSuite struct {
+  Name string `xml:"name,attr"`
+  Tests int `xml:"tests,attr"`
+  Failures int `xml:"failures,attr"`
+  Errors int `xml:"errors,attr"`
+  Time string `xml:"time,attr"`
+  Timestamp string `xml:"timestamp,attr"`
+  Cases []junitCase `xml:"testcase"`
+}
+
+type junitSuites struct {
+  XMLName xml.Name `xml:"testsuites"`
+  Tests int `xml:"tests,attr"`
+  Failures int `xml:"failures,attr"`
+  Time string `xml:"time,attr"`
+  Suites []junitSuite `xml:"testsuite"`
+}
+
+func seconds(s float64) string {
+  return fmt.Sprintf("%.3f", s)
+}
+
+//the report as JUnit XML, a testcase by script; the logs of the servers
+//of a failed case go to its system-err
+func (r *TestReport) WriteJUnit(w io.Writer) error {
+  suite := junitSuite{Name:r.Suite, Tests:r.Total, Failures:r.Failed, Time:seconds(r.DurationS),
+    Timestamp:r.Start.Format("2006-01-02T15:04:05")}
+  for _,c := range r.Cases {
+    jc := junitCase{Name:c.Name, Classname:r.Suite, Time:seconds(c.DurationS)}
+    if !c.Passed {
+      msg := "failed"
+      if len(c.Failures)>0 {
+        msg = strings.SplitN(c.Failures[0], "\n", 2)[0]
+      }
+      jc.Failure = &junitFailure{Message:msg, Type:"FAIL", Text:strings.Join(c.Failures, "\n\n")}
+      jc.SystemOut = &junitText{c.Output}
+      var nodes []string
+      for n := range c.Logs {
+        nodes = append(nodes, n)
+      }
+      sort.Strings(nodes)
+      var b strings.Builder
+      for _,n := range nodes {
+        fmt.Fprintf(&b, "=== %s\n%s", n, c.Logs[n])
+      }
+      if b.Len()>0 {
+        jc.SystemErr = &junitText{b.String()}
+      }
+    }
+    suite.Cases = append(suite.Cases, jc)
+  }
+  out := junitSuites{Tests:r.Total, Failures:r.Failed, Time:seconds(r.DurationS), Suites:[]junitSuite{suite}}
+  if _,err := io.WriteString(w, xml.Header); err!=nil {
+    return err
+  }
+  enc := xml.NewEncoder(w)
+  enc.Indent("", "  ")
+  if err := enc.Encode(&out); err!=nil {
+    return err
+  }
+  _,err := io.WriteString(w, "\n")
+  return err
+}
@@ -0,0 +1,280 @@
+package kvlib
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+)
+
+// The language of the *.test scripts run by TestUnit, one instruction per
+// line; a # starts a comment, and a value with spaces is written in double
+// quotes, with the escapes of Go. $name or ${name} is replaced by a
+// variable, and $$ by a $.
+//
+//   Put key value, Update key value, Delete key, Get key
+//                      requests to the current server, checked against the
+//                      results of the requests before them
+//   ExpectGet key value
+//                      the current server has value at key
+//   ExpectFail op args...
+//                      the current server refuses Put, Update, Delete or Get
+//   CountKey [n]       the number of keys is n, or as expected
+//   Dump               the keys and values are as expected
+//   Switch n           later requests go to server n
+//   Sleep ms
+//   Block ... Endblock the requests in between run at once; the results
+//                      are checked at Endblock
+//   Loop var from to ... Endloop
+//                      repeat, with var from from to to
+//   Set var value
+//   Partition 1 / 2 3  cut the links between the sets of servers (faultnet)
+//   Heal               end the partition
+//   start_server n, stop_server n
+//                      through the tester of server n; stop_server stops as
+//                      set by stop_by_kill in test.conf
+//   kill_server n      kill -9
+//   shutdown_server n  stop gracefully, with bin/stop_server
+
+type Instr struct {
+    Line int
+    Op string
+    Args []string
+    Body []*Instr // of Block and Loop
+}
+
+type ScriptError struct {
+    File string
+    Line int
+    Msg string
+}
+
+func (e *ScriptError) Error() string {
+    return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// the number of arguments of each instruction; -1 for any number
+var scriptOps = map[string][2]int{
+    "Put": {2, 2},
+    "Update": {2, 2},
+    "Delete": {1, 1},
+    "Get": {1, 1},
+    "ExpectGet": {2, 2},
+    "ExpectFail": {2, 3},
+    "CountKey": {0, 1},
+    "Dump": {0, 0},
+    "Switch": {1, 1},
+    "Sleep": {1, 1},
+    "Block": {0, 0},
+    "Endblock": {0, 0},
+    "Loop": {3, 3},
+    "Endloop": {0, 0},
+    "Set": {2, 2},
+    "Partition": {3, -1},
+    "Heal": {0, 0},
+    "start_server": {1, 1},
+    "stop_server": {1, 1},
+    "kill_server": {1, 1},
+    "shutdown_server": {1, 1},
+}
+
+// what may not take place among the concurrent requests of a block
+var notInBlock = map[string]bool{
+    "Block": true, "Sleep": true, "ExpectGet": true, "ExpectFail": true,
+    "CountKey": true, "Dump": true,
+}
+
+// the tokens of a line, unquoted
+func splitLine(line string) ([]string, error) {
+    var toks []string
+    for {
+        line = strings.TrimLeft(line, " \t\r")
+        if line == "" || line[0] == '#' {
+            return toks, nil
+        }
+        if line[0] == '"' {
+            q, err := strconv.QuotedPrefix(line)
+            if err != nil {
+                return nil, fmt.Errorf("unterminated or bad quoted value %s", line)
+            }
+            line = line[len(q):]
+            if line != "" && !strings.ContainsAny(line[:1], " \t\r#") {
+                return nil, fmt.Errorf("no space after the quoted value %s", q)
+            }
+            v, _ := strconv.Unquote(q)
+            toks = append(toks, v)
+            continue
+        }
+        end := strings.IndexAny(line, " \t\r")
+        if end < 0 {
+            end = len(line)
+        }
+        tok := line[:end]
+        if strings.Contains(tok, "\"") {
+            return nil, fmt.Errorf("stray quote in %s", tok)
+        }
+        toks = append(toks, tok)
+        line = line[end:]
+    }
+}
+
+// an argument that should be a number, unless it is left to a variable
+func checkNumber(arg string, min int) error {
+    if strings.Contains(arg, "$") {
+        return nil
+    }
+    n, err := strconv.Atoi(arg)
+    if err != nil || n < min {
+        return fmt.Errorf("%q should be a number of at least %d", arg, min)
+    }
+    return nil
+}
+
+func checkArgs(op string, args []string) error {
+    n := scriptOps[op]
+    if len(args) < n[0] || (n[1] >= 0 && len(args) > n[1]) {
+        if n[0] == n[1] {
+            return fmt.Errorf("%s takes %d arguments, not %d", op, n[0], len(args))
+        }
+        return fmt.Errorf("%s takes at least %d arguments, not %d", op, n[0], len(args))
+    }
+    switch op {
+        case "Sleep", "CountKey":
+            for _, a := range args {
+                if err := checkNumber(a, 0); err != nil {
+                    return err
+                }
+            }
+        case "Switch", "start_server", "stop_server", "kill_server", "shutdown_server":
+            return checkNumber(args[0], 1)
+        case "Loop":
+            if err := checkName(args[0]); err != nil {
+                return err
+            }
+            for _, a := range args[1:] {
+                if err := checkNumber(a, -1<<31); err != nil {
+                    return err
+                }
+            }
+        case "Set":
+            return checkName(args[0])
+        case "ExpectFail":
+            switch args[0] {
+                case "Put", "Update":
+                    if len(args) != 3 {
+                        return fmt.Errorf("ExpectFail %s takes 2 arguments", args[0])
+                    }
+                case "Delete", "Get":
+                    if len(args) != 2 {
+                        return fmt.Errorf("ExpectFail %s takes 1 argument", args[0])
+                    }
+                default:
+                    return fmt.Errorf("ExpectFail takes Put, Update, Delete or Get, not %s", args[0])
+            }
+        case "Partition":
+            sets, err := partitionSets(args)
+            if err != nil {
+                return err
+            }
+            if len(sets) < 2 {
+                return fmt.Errorf("a partition has at least two sets, separated by /")
+            }
+    }
+    return nil
+}
+
+func checkName(name string) error {
+    if name == "" || strings.IndexFunc(name, func(r rune) bool {
+        return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+    }) >= 0 {
+        return fmt.Errorf("%q is not a variable name", name)
+    }
+    return nil
+}
+
+// "1 / 2 3" -> [[1] [2 3]]
+func partitionSets(args []string) ([][]string, error) {
+    sets := [][]string{nil}
+    for _, a := range args {
+        if a == "/" {
+            sets = append(sets, nil)
+            continue
+        }
+        if err := checkNumber(a, 1); err != nil {
+            return nil, err
+        }
+        sets[len(sets)-1] = append(sets[len(sets)-1], a)
+    }
+    for _, s := range sets {
+        if len(s) == 0 {
+            return nil, fmt.Errorf("a set of the partition is empty")
+        }
+    }
+    return sets, nil
+}
+
+// parse a script; fn names it in errors
+func ParseScript(r io.Reader, fn string) ([]*Instr, error) {
+    type open struct {
+        ins *Instr
+        body []*Instr
+    }
+    stack := []open{{}}
+    sc := bufio.NewScanner(r)
+    sc.Buffer(make([]byte, 64*1024), 1<<20)
+    line := 0
+    fail := func(l int, format string, a ...interface{}) error {
+        return &ScriptError{fn, l, fmt.Sprintf(format, a...)}
+    }
+    for sc.Scan() {
+        line++
+        toks, err := splitLine(sc.Text())
+        if err != nil {
+            return nil, fail(line, "%v", err)
+        }
+        if len(toks) == 0 {
+            continue
+        }
+        ins := &Instr{Line: line, Op: toks[0], Args: toks[1:]}
+        if _, found := scriptOps[ins.Op]; !found {
+            return nil, fail(line, "unknown instruction %q", ins.Op)
+        }
+        if err := checkArgs(ins.Op, ins.Args); err != nil {
+            return nil, fail(line, "%v", err)
+        }
+        for _, o := range stack[1:] {
+            if o.ins.Op == "Block" && notInBlock[ins.Op] {
+                return nil, fail(line, "%s in the block of line %d", ins.Op, o.ins.Line)
+            }
+        }
+        top := &stack[len(stack)-1]
+        switch ins.Op {
+            case "Block", "Loop":
+                stack = append(stack, open{ins: ins})
+                continue
+            case "Endblock", "Endloop":
+                want := "Block"
+                if ins.Op == "Endloop" {
+                    want = "Loop"
+                }
+                if top.ins == nil || top.ins.Op != want {
+                    return nil, fail(line, "%s without %s", ins.Op, want)
+                }
+                top.ins.Body = top.body
+                done := top.ins
+                stack = stack[:len(stack)-1]
+                stack[len(stack)-1].body = append(stack[len(stack)-1].body, done)
+                continue
+        }
+        top.body = append(top.body, ins)
+    }
+    if err := sc.Err(); err != nil {
+        return nil, fail(line, "%v", err)
+    }
+    if len(stack) > 1 {
+        o := stack[len(stack)-1].ins
+        return nil, fail(o.Line, "%s without End%s", o.Op, strings.ToLower(o.Op))
+    }
+    return stack[0].body, nil
+}
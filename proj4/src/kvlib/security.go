@@ -0,0 +1,125 @@
+package kvlib
+
+import(
+  "crypto/tls"
+  "crypto/x509"
+  "fmt"
+  "io/ioutil"
+)
+
+//TLS and tokens, from settings.conf. Every entry is optional:
+//  http_tls_cert, http_tls_key   serve HTTPS instead of HTTP
+//  http_tls_ca                   CA of the HTTPS servers, for clients
+//                                (the system roots if empty)
+//  rpc_tls_cert, rpc_tls_key,    mutual TLS between the paxos peers;
+//  rpc_tls_ca                    all three, or none
+//  rpc_tls_server_name           the name in the certificates of the peers
+//                                (default kvpaxos), since they are dialed
+//                                by address
+//  kv_token, kvman_token         bearer tokens of /kv/* and /kvman/*
+
+const DefaultTLSServerName = "kvpaxos"
+
+func loadCA(file string) (*x509.CertPool,error){
+  pem,err := ioutil.ReadFile(file)
+  if err!=nil {
+    return nil,err
+  }
+  pool := x509.NewCertPool()
+  if !pool.AppendCertsFromPEM(pem) {
+    return nil,fmt.Errorf("no certificate found in %s", file)
+  }
+  return pool,nil
+}
+
+//both or none of cert and key
+func loadCert(conf map[string]string, prefix string) (*tls.Certificate,error){
+  cert,key := conf[prefix+"_cert"],conf[prefix+"_key"]
+  if cert=="" && key=="" {
+    return nil,nil
+  }
+  if cert=="" || key=="" {
+    return nil,fmt.Errorf("%s_cert and %s_key go together", prefix, prefix)
+  }
+  c,err := tls.LoadX509KeyPair(cert,key)
+  if err!=nil {
+    return nil,err
+  }
+  return &c,nil
+}
+
+func UseHTTPS(conf map[string]string) bool {
+  return conf["http_tls_cert"]!=""
+}
+
+//"https" or "http"
+func HTTPScheme(conf map[string]string) string {
+  if UseHTTPS(conf) {
+    return "https"
+  }
+  return "http"
+}
+
+//the config of the HTTPS listener, or nil for plain HTTP
+func HTTPServerTLS(conf map[string]string) (*tls.Config,error){
+  c,err := loadCert(conf,"http_tls")
+  if c==nil {
+    return nil,err
+  }
+  return &tls.Config{Certificates:[]tls.Certificate{*c}, MinVersion:tls.VersionTLS12},nil
+}
+
+//the config of an HTTPS client, or nil for plain HTTP
+func HTTPClientTLS(conf map[string]string) (*tls.Config,error){
+  if !UseHTTPS(conf) {
+    return nil,nil
+  }
+  cfg := &tls.Config{MinVersion:tls.VersionTLS12}
+  if conf["http_tls_ca"]!="" {
+    pool,err := loadCA(conf["http_tls_ca"])
+    if err!=nil {
+      return nil,err
+    }
+    cfg.RootCAs=pool
+  }
+  return cfg,nil
+}
+
+//the configs of the RPC listener, which wants a certificate from every
+//caller, and of the callers, or nil for plain RPC
+func PeerTLS(conf map[string]string) (server *tls.Config, client *tls.Config, err error){
+  c,err := loadCert(conf,"rpc_tls")
+  if err!=nil {
+    return nil,nil,err
+  }
+  if c==nil {
+    if conf["rpc_tls_ca"]!="" {
+      return nil,nil,fmt.Errorf("rpc_tls_ca without rpc_tls_cert")
+    }
+    return nil,nil,nil
+  }
+  if conf["rpc_tls_ca"]=="" {
+    return nil,nil,fmt.Errorf("rpc_tls_cert without rpc_tls_ca, peers cannot be verified")
+  }
+  pool,err := loadCA(conf["rpc_tls_ca"])
+  if err!=nil {
+    return nil,nil,err
+  }
+  name := conf["rpc_tls_server_name"]
+  if name=="" {
+    name=DefaultTLSServerName
+  }
+  server = &tls.Config{
+    Certificates:[]tls.Certificate{*c},
+    ClientCAs:pool,
+    ClientAuth:tls.RequireAndVerifyClientCert,
+    MinVersion:tls.VersionTLS12,
+  }
+  client = &tls.Config{
+    Certificates:[]tls.Certificate{*c},
+    RootCAs:pool,
+    ServerName:name,
+    MinVersion:tls.VersionTLS12,
+  }
+  return server,client,nil
+}
@@ -0,0 +1,582 @@
+package kvlib
+
+import(
+  "bytes"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "reflect"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "kvlog"
+)
+
+//The settings of a cluster, conf/settings.conf: its nodes, in one list,
+//and the options of its servers.
+//
+//  {
+//    "nodes": [
+//      {"host": "127.0.0.1", "port": 30101, "rpc_port": 40101, "agent_port": 3087},
+//      {"host": "127.0.0.1", "port": 30102, "rpc_port": 40102, "agent_port": 3088},
+//      {"host": "127.0.0.1", "port": 30103, "rpc_port": 40103, "agent_port": 3089}
+//    ],
+//    "log_level": "info"
+//  }
+//
+//Node i, from 0, is n%02d of i+1, as in bin/start_server n01. A setting
+//that is left out has its default; numbers and booleans may be written as
+//strings too. The flat format of Project 3/4 is read as well: nservers,
+//and nXX, port_nXX and RPC_port_nXX for each node (port and RPCport for
+//all of them unless use_different_port is true).
+//
+//A setting is overridden by the environment variable KVPAXOS_ and its
+//name in capitals, e.g. KVPAXOS_LOG_LEVEL=debug, then by -set name=value
+//(see ConfigFlags); the value of nodes is then a JSON list.
+
+const DefaultSettingsFile="conf/settings.conf"
+
+type NodeConfig struct {
+  Host string `json:"host"`
+  Port int `json:"port"` // of the HTTP server
+  RPCPort int `json:"rpc_port"` // of the paxos RPCs
+  AgentPort int `json:"agent_port,omitempty"` // of the agent of bin/test; none if 0
+}
+
+type Config struct {
+  Nodes []NodeConfig `json:"nodes"`
+  RPCMethod string `json:"rpc_method"` // tcp
+  VersionRetention int `json:"version_retention"` // in log indices
+  MaxValueSize int `json:"max_value_size"` // in bytes
+  DrainTimeoutMs int `json:"drain_timeout_ms"` // of the requests in flight, on a shutdown
+  HTTPTLSCert string `json:"http_tls_cert"` // see security.go
+  HTTPTLSKey string `json:"http_tls_key"`
+  HTTPTLSCA string `json:"http_tls_ca"`
+  RPCTLSCert string `json:"rpc_tls_cert"`
+  RPCTLSKey string `json:"rpc_tls_key"`
+  RPCTLSCA string `json:"rpc_tls_ca"`
+  RPCTLSServerName string `json:"rpc_tls_server_name"`
+  KVToken string `json:"kv_token"`
+  KVManToken string `json:"kvman_token"`
+  LogLevel string `json:"log_level"` // as in kvlog.SetLevels, e.g. paxos=debug,info
+  LogFormat string `json:"log_format"` // text or json
+
+  File string `json:"-"` // where it was read from
+}
+
+func DefaultConfig() *Config {
+  return &Config{RPCMethod:"tcp",MaxValueSize:1<<20,DrainTimeoutMs:5000,LogLevel:"info",LogFormat:"text"}
+}
+
+//the settings of the file fn, with the overrides of the environment
+func LoadConfig(fn string) (*Config,error){
+  return loadConfig(fn,nil)
+}
+
+//the settings of data, without overrides; name is for the errors
+func ParseConfig(data []byte, name string) (*Config,error){
+  raw,err:=readSettings(data,name)
+  if err!=nil {
+    return nil,err
+  }
+  return decodeConfig(raw,name)
+}
+
+func loadConfig(fn string, sets []string) (*Config,error){
+  data,err:=ioutil.ReadFile(fn)
+  if err!=nil {
+    return nil,err
+  }
+  raw,err:=readSettings(data,fn)
+  if err!=nil {
+    return nil,err
+  }
+  fields:=settingFields(reflect.TypeOf(Config{}))
+  for name,f:=range fields {
+    if v,ok:=os.LookupEnv("KVPAXOS_"+strings.ToUpper(name)); ok {
+      raw[name]=textSetting(f.Type,v)
+    }
+  }
+  for _,s:=range sets {
+    i:=strings.Index(s,"=")
+    if i<0 {
+      return nil,fmt.Errorf("-set %s: not name=value",s)
+    }
+    f,ok:=fields[s[:i]]
+    if !ok {
+      return nil,fmt.Errorf("-set %s: no setting %q",s,s[:i])
+    }
+    raw[s[:i]]=textSetting(f.Type,s[i+1:])
+  }
+  cfg,err:=decodeConfig(raw,fn)
+  if err!=nil {
+    return nil,err
+  }
+  cfg.File=fn
+  return cfg,nil
+}
+
+func decodeConfig(raw map[string]json.RawMessage, name string) (*Config,error){
+  cfg:=DefaultConfig()
+  errs:=decodeSettings(reflect.ValueOf(cfg).Elem(),raw,"")
+  if len(errs)==0 {
+    errs=cfg.check()
+  }
+  if len(errs)>0 {
+    return nil,fmt.Errorf("%s: %s",name,strings.Join(errs,"; "))
+  }
+  return cfg,nil
+}
+
+var legacyNodeKey=regexp.MustCompile(`^(n|port_n|RPC_port_n)\d\d$`)
+
+//the settings of a file, with the flat format of Project 3/4 made into nodes
+func readSettings(data []byte, name string) (map[string]json.RawMessage,error){
+  var raw map[string]json.RawMessage
+  if err:=json.Unmarshal(data,&raw); err!=nil {
+    return nil,fmt.Errorf("%s: %v",name,err)
+  }
+  if _,ok:=raw["nodes"]; ok {
+    return raw,nil
+  }
+  if _,ok:=raw["nservers"]; !ok {
+    return raw,nil // no node, as check says
+  }
+  var flat struct {
+    N int `json:"nservers"`
+    Different bool `json:"use_different_port"`
+  }
+  if errs:=decodeSettings(reflect.ValueOf(&flat).Elem(),map[string]json.RawMessage{
+    "nservers":raw["nservers"],"use_different_port":raw["use_different_port"]},""); len(errs)>0 {
+    return nil,fmt.Errorf("%s: %s",name,strings.Join(errs,"; "))
+  }
+  var nodes []map[string]json.RawMessage
+  for i:=1;i<=flat.N;i++ {
+    id:=fmt.Sprintf("n%02d",i)
+    node:=map[string]json.RawMessage{"host":raw[id],"port":raw["port"],"rpc_port":raw["RPCport"]}
+    if flat.Different {
+      node["port"],node["rpc_port"]=raw["port_"+id],raw["RPC_port_"+id]
+    }
+    for k,v:=range node {
+      if v==nil {
+        delete(node,k) // missing, as check says
+      }
+    }
+    nodes=append(nodes,node)
+  }
+  for k:=range raw {
+    if legacyNodeKey.MatchString(k) || k=="nservers" || k=="use_different_port" || k=="port" || k=="RPCport" {
+      delete(raw,k)
+    }
+  }
+  enc,_:=json.Marshal(nodes)
+  raw["nodes"]=enc
+  return raw,nil
+}
+
+type settingField struct {
+  Index int
+  Type reflect.Type
+}
+
+//the fields of a struct of settings, by their names in JSON
+func settingFields(t reflect.Type) map[string]settingField {
+  fields:=map[string]settingField{}
+  for i:=0;i<t.NumField();i++ {
+    name:=strings.Split(t.Field(i).Tag.Get("json"),",")[0]
+    if name!="" && name!="-" {
+      fields[name]=settingField{i,t.Field(i).Type}
+    }
+  }
+  return fields
+}
+
+//a value given as text, as the JSON of a field of type t
+func textSetting(t reflect.Type, v string) json.RawMessage {
+  if t.Kind()==reflect.String {
+    enc,_:=json.Marshal(v)
+    return enc
+  }
+  return json.RawMessage(v)
+}
+
+//set the fields of the struct v to raw, by name; numbers and booleans
+//may be strings, and a string a number or a boolean
+func decodeSettings(v reflect.Value, raw map[string]json.RawMessage, prefix string) []string {
+  var errs []string
+  fields:=settingFields(v.Type())
+  var names []string
+  for name:=range raw {
+    names=append(names,name)
+  }
+  sort.Strings(names)
+  for _,name:=range names {
+    data:=bytes.TrimSpace(raw[name])
+    if len(data)==0 {
+      continue
+    }
+    f,ok:=fields[name]
+    if !ok {
+      errs=append(errs,fmt.Sprintf("%sunknown setting %q",prefix,name))
+      continue
+    }
+    fv:=v.Field(f.Index)
+    var err error
+    switch fv.Kind() {
+      case reflect.String:
+        var s string
+        if err=json.Unmarshal(data,&s); err!=nil && data[0]!='"' && data[0]!='[' && data[0]!='{' {
+          s,err=string(data),nil
+        }
+        fv.SetString(s)
+      case reflect.Int:
+        var n int
+        if err=json.Unmarshal(unquote(data),&n); err!=nil {
+          err=fmt.Errorf("%s is not an integer",data)
+        }
+        fv.SetInt(int64(n))
+      case reflect.Bool:
+        var b bool
+        if err=json.Unmarshal(unquote(data),&b); err!=nil {
+          err=fmt.Errorf("%s is not true or false",data)
+        }
+        fv.SetBool(b)
+      case reflect.Slice:
+        if fv.Type().Elem().Kind()!=reflect.Struct {
+          if err=json.Unmarshal(data,fv.Addr().Interface()); err!=nil {
+            err=fmt.Errorf("%s is not a list of %s",data,fv.Type().Elem())
+          }
+          break
+        }
+        var elems []map[string]json.RawMessage
+        if err=json.Unmarshal(data,&elems); err!=nil {
+          err=fmt.Errorf("not a list of objects")
+          break
+        }
+        s:=reflect.MakeSlice(fv.Type(),len(elems),len(elems))
+        for i,e:=range elems {
+          errs=append(errs,decodeSettings(s.Index(i),e,fmt.Sprintf("%s%s[%d].",prefix,name,i))...)
+        }
+        fv.Set(s)
+    }
+    if err!=nil {
+      errs=append(errs,fmt.Sprintf("%s%s: %v",prefix,name,err))
+    }
+  }
+  return errs
+}
+
+//the JSON in a string, or data
+func unquote(data []byte) []byte {
+  var s string
+  if json.Unmarshal(data,&s)==nil {
+    return []byte(s)
+  }
+  return data
+}
+
+func validPort(p int) bool {
+  return p>0 && p<65536
+}
+
+//what is wrong with the settings
+func (c *Config) check() []string {
+  var errs []string
+  add:=func(format string, args ...interface{}) {
+    errs=append(errs,fmt.Sprintf(format,args...))
+  }
+  if len(c.Nodes)==0 {
+    add("no node")
+  }
+  used:=map[string]string{} // host:port to what listens
+  for i,n:=range c.Nodes {
+    if n.Host=="" {
+      add("nodes[%d]: no host",i)
+    }
+    for _,p:=range []struct{
+      name string
+      port int
+      needed bool
+    }{{"port",n.Port,true},{"rpc_port",n.RPCPort,true},{"agent_port",n.AgentPort,false}} {
+      if p.port==0 && !p.needed {
+        continue
+      }
+      if !validPort(p.port) {
+        add("nodes[%d].%s: %d is not a port",i,p.name,p.port)
+        continue
+      }
+      addr:=fmt.Sprintf("%s:%d",n.Host,p.port)
+      what:=fmt.Sprintf("nodes[%d].%s",i,p.name)
+      if other,ok:=used[addr]; ok {
+        add("%s: %s is %s already",what,addr,other)
+      }
+      used[addr]=what
+    }
+  }
+  if c.RPCMethod!="tcp" {
+    add("rpc_method: %q, only tcp is supported",c.RPCMethod)
+  }
+  if c.VersionRetention<0 {
+    add("version_retention: %d is negative",c.VersionRetention)
+  }
+  if c.MaxValueSize<0 {
+    add("max_value_size: %d is negative",c.MaxValueSize)
+  }
+  if c.DrainTimeoutMs<0 {
+    add("drain_timeout_ms: %d is negative",c.DrainTimeoutMs)
+  }
+  if (c.HTTPTLSCert=="")!=(c.HTTPTLSKey=="") {
+    add("http_tls_cert and http_tls_key go together")
+  }
+  if (c.RPCTLSCert=="")!=(c.RPCTLSKey=="") || (c.RPCTLSCert=="")!=(c.RPCTLSCA=="") {
+    add("rpc_tls_cert, rpc_tls_key and rpc_tls_ca go together")
+  }
+  if c.LogLevel!="" {
+    for _,part:=range strings.Split(c.LogLevel,",") {
+      if i:=strings.Index(part,"="); i>=0 {
+        part=part[i+1:]
+      }
+      if part=strings.TrimSpace(part); part=="" {
+        continue
+      }
+      if _,err:=kvlog.ParseLevel(part); err!=nil {
+        add("log_level: %v",err)
+      }
+    }
+  }
+  if c.LogFormat!="" && c.LogFormat!="text" && c.LogFormat!="json" {
+    add("log_format: %q is not text or json",c.LogFormat)
+  }
+  return errs
+}
+
+//an error if the settings are wrong, e.g. after they were changed
+func (c *Config) Validate() error {
+  if errs:=c.check(); len(errs)>0 {
+    return errors.New(strings.Join(errs,"; "))
+  }
+  return nil
+}
+
+func (c *Config) N() int {
+  return len(c.Nodes)
+}
+
+//the name of node i, from 0
+func NodeName(i int) string {
+  return fmt.Sprintf("n%02d",i+1)
+}
+
+//the index of the node named n01, or 1, etc.
+func (c *Config) Node(name string) (int,error){
+  s:=name
+  if len(s)==3 && s[0]=='n' {
+    s=s[1:]
+  }
+  i,err:=strconv.Atoi(s)
+  if err!=nil || i<1 {
+    return -1,fmt.Errorf("%q is not a node, such as n01",name)
+  }
+  if i>len(c.Nodes) {
+    return -1,fmt.Errorf("no node %s, of %d",NodeName(i-1),len(c.Nodes))
+  }
+  return i-1,nil
+}
+
+//host:port of the HTTP server of node i
+func (c *Config) HTTPAddr(i int) string {
+  return fmt.Sprintf("%s:%d",c.Nodes[i].Host,c.Nodes[i].Port)
+}
+
+//the base URL of node i
+func (c *Config) URL(i int) string {
+  return HTTPScheme(c.Settings())+"://"+c.HTTPAddr(i)
+}
+
+func (c *Config) URLs() []string {
+  var urls []string
+  for i:=range c.Nodes {
+    urls=append(urls,c.URL(i))
+  }
+  return urls
+}
+
+//host:port of the paxos RPCs of node i
+func (c *Config) RPCAddr(i int) string {
+  return fmt.Sprintf("%s:%d",c.Nodes[i].Host,c.Nodes[i].RPCPort)
+}
+
+func (c *Config) RPCAddrs() []string {
+  var addrs []string
+  for i:=range c.Nodes {
+    addrs=append(addrs,c.RPCAddr(i))
+  }
+  return addrs
+}
+
+//the base URL of the agent of node i, "" if it has none
+func (c *Config) AgentURL(i int) string {
+  if c.Nodes[i].AgentPort==0 {
+    return ""
+  }
+  return fmt.Sprintf("http://%s:%d",c.Nodes[i].Host,c.Nodes[i].AgentPort)
+}
+
+func (c *Config) DrainTimeout() time.Duration {
+  return time.Duration(c.DrainTimeoutMs)*time.Millisecond
+}
+
+//the settings other than the nodes, by name, as the servers, the TLS
+//helpers and kvlog.Configure take them
+func (c *Config) Settings() map[string]string {
+  m:=map[string]string{}
+  v:=reflect.ValueOf(c).Elem()
+  for name,f:=range settingFields(v.Type()) {
+    switch fv:=v.Field(f.Index); fv.Kind() {
+      case reflect.String:
+        m[name]=fv.String()
+      case reflect.Int:
+        m[name]=strconv.Itoa(int(fv.Int()))
+    }
+  }
+  return m
+}
+
+//write the settings to fn, with a list of nodes
+func (c *Config) WriteFile(fn string) error {
+  enc,err:=json.MarshalIndent(c,"","  ")
+  if err!=nil {
+    return err
+  }
+  return ioutil.WriteFile(fn,append(enc,'\n'),0644)
+}
+
+//The settings of bin/test, conf/test.conf. The cluster is the first
+//nservers nodes of the settings, each with its agent_port.
+type TesterConfig struct {
+  NServers int `json:"nservers"` // 0 for every node
+  MainPort int `json:"main_port"` // of /main of the main tester
+  TestTotal int `json:"test_total"`
+  Pre string `json:"pre"` // the directory of the cases
+  Fmt bool `json:"fmt"` // case i is i.test, else cases[i]
+  Cases []string `json:"cases"`
+  WithErrMsg bool `json:"with_err_msg"` // print the output of each case
+  AutoRestartServer bool `json:"auto_restart_server"` // start the servers before each case, and stop them after it
+  StopByKill bool `json:"stop_by_kill"` // the stop_server of a script kills
+}
+
+func DefaultTesterConfig() *TesterConfig {
+  return &TesterConfig{MainPort:3086,Pre:"test/",Fmt:true,WithErrMsg:true,AutoRestartServer:true}
+}
+
+func LoadTesterConfig(fn string) (*TesterConfig,error){
+  data,err:=ioutil.ReadFile(fn)
+  if err!=nil {
+    return nil,err
+  }
+  var raw map[string]json.RawMessage
+  if err:=json.Unmarshal(data,&raw); err!=nil {
+    return nil,fmt.Errorf("%s: %v",fn,err)
+  }
+  tc:=DefaultTesterConfig()
+  errs:=decodeSettings(reflect.ValueOf(tc).Elem(),raw,"")
+  if len(errs)==0 {
+    if tc.NServers<0 {
+      errs=append(errs,fmt.Sprintf("nservers: %d is negative",tc.NServers))
+    }
+    if !validPort(tc.MainPort) {
+      errs=append(errs,fmt.Sprintf("main_port: %d is not a port",tc.MainPort))
+    }
+    if tc.TestTotal<0 {
+      errs=append(errs,fmt.Sprintf("test_total: %d is negative",tc.TestTotal))
+    }
+    if !tc.Fmt && len(tc.Cases)<tc.TestTotal {
+      errs=append(errs,fmt.Sprintf("cases: %d of test_total %d",len(tc.Cases),tc.TestTotal))
+    }
+  }
+  if len(errs)>0 {
+    return nil,fmt.Errorf("%s: %s",fn,strings.Join(errs,"; "))
+  }
+  return tc,nil
+}
+
+//the file of case i, from 0
+func (tc *TesterConfig) Case(i int) string {
+  if tc.Fmt {
+    return tc.Pre+strconv.Itoa(i)+".test"
+  }
+  return tc.Pre+tc.Cases[i]
+}
+
+//The flags of the settings of a command: -conf file, by default
+//$KVPAXOS_CONF or conf/settings.conf, and -set name=value, which may be
+//repeated.
+type ConfigFlags struct {
+  File string
+  Sets []string
+}
+
+type setFlags struct {
+  sets *[]string
+}
+
+func (s setFlags) String() string {
+  if s.sets==nil {
+    return ""
+  }
+  return strings.Join(*s.sets," ")
+}
+
+func (s setFlags) Set(v string) error {
+  *s.sets=append(*s.sets,v)
+  return nil
+}
+
+func NewConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+  cf:=&ConfigFlags{}
+  file:=os.Getenv("KVPAXOS_CONF")
+  if file=="" {
+    file=DefaultSettingsFile
+  }
+  fs.StringVar(&cf.File,"conf",file,"the settings of the cluster")
+  fs.Var(setFlags{&cf.Sets},"set","override a setting, as name=value; may be repeated")
+  return cf
+}
+
+//the settings of the file, with the overrides of the environment, then of
+//-set
+func (cf *ConfigFlags) Load() (*Config,error){
+  return loadConfig(cf.File,cf.Sets)
+}
+
+//the flags, for a command run by this one
+func (cf *ConfigFlags) Args() []string {
+  args:=[]string{"-conf",cf.File}
+  for _,s:=range cf.Sets {
+    args=append(args,"-set",s)
+  }
+  return args
+}
+
+//parse the flags of args, before or after the other arguments, which are
+//returned
+func ParseInterspersed(fs *flag.FlagSet, args []string) ([]string,error){
+  var rest []string
+  for {
+    if err:=fs.Parse(args); err!=nil {
+      return nil,err
+    }
+    args=fs.Args()
+    if len(args)==0 {
+      return rest,nil
+    }
+    rest=append(rest,args[0])
+    args=args[1:]
+  }
+}
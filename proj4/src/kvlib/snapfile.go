@@ -0,0 +1,127 @@
+package kvlib
+
+import(
+  "bufio"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "hash"
+  "io"
+)
+
+//Snapshot files of a kvpaxos cluster, as written by /kvman/snapshot and
+//read by /kvman/restore and bin/kvbackup. A file is JSON lines: a header,
+//one line per key in key order, and a trailer with the number of keys and
+//the SHA-256 of every byte before it.
+//  {"format":"kvpaxos-snapshot/1","index":120,"clock":1760000000000000000}
+//  {"key":"a","value":"MQ==","version":97}
+//  {"count":1,"sha256":"..."}
+
+const SnapFormat = "kvpaxos-snapshot/1"
+
+var ErrSnapChecksum = errors.New("snapshot: checksum mismatch")
+
+type SnapHeader struct {
+  Format string `json:"format"`
+  Index int `json:"index"` // the state after this log index
+  Clock int64 `json:"clock"` // the time of the state, for TTLs
+}
+
+type SnapEntry struct {
+  Key string `json:"key"`
+  Value []byte `json:"value"` // in base64
+  Deadline int64 `json:"deadline,omitempty"` // when the key expires, 0 for never
+  Version int `json:"version"` // log index of the write, in the source cluster
+}
+
+type snapTrailer struct {
+  Count *int `json:"count"`
+  Sha256 string `json:"sha256"`
+}
+
+type SnapWriter struct {
+  w io.Writer
+  sum hash.Hash
+  count int
+}
+
+func NewSnapWriter(w io.Writer, h SnapHeader) (*SnapWriter,error){
+  sw := &SnapWriter{w:w, sum:sha256.New()}
+  h.Format = SnapFormat
+  return sw,sw.line(&h)
+}
+
+func (sw *SnapWriter) line(v interface{}) error {
+  enc,err := json.Marshal(v)
+  if err!=nil {
+    return err
+  }
+  enc = append(enc,'\n')
+  sw.sum.Write(enc)
+  _,err = sw.w.Write(enc)
+  return err
+}
+
+func (sw *SnapWriter) Write(e SnapEntry) error {
+  sw.count++
+  return sw.line(&e)
+}
+
+//write the trailer; the writer below is not closed
+func (sw *SnapWriter) Close() error {
+  enc,_ := json.Marshal(&snapTrailer{&sw.count, hex.EncodeToString(sw.sum.Sum(nil))})
+  _,err := sw.w.Write(append(enc,'\n'))
+  return err
+}
+
+//read a snapshot file, calling fn for every entry; the checksum is only
+//verified at the end, so fn should not act on the entries before
+//ReadSnapshot returns without error
+func ReadSnapshot(r io.Reader, fn func(SnapEntry) error) (SnapHeader,error){
+  var h SnapHeader
+  br := bufio.NewReader(r)
+  sum := sha256.New()
+  next := func() ([]byte,error) {
+    line,err := br.ReadBytes('\n')
+    if err==io.EOF && len(line)>0 {
+      err = nil
+    }
+    return line,err
+  }
+  line,err := next()
+  if err!=nil {
+    return h,fmt.Errorf("snapshot: no header: %w", err)
+  }
+  if err := json.Unmarshal(line,&h); err!=nil || h.Format!=SnapFormat {
+    return h,fmt.Errorf("snapshot: not a %s file", SnapFormat)
+  }
+  sum.Write(line)
+  count := 0
+  for {
+    line,err := next()
+    if err==io.EOF {
+      return h,errors.New("snapshot: truncated, no trailer")
+    }
+    if err!=nil {
+      return h,err
+    }
+    var t snapTrailer
+    if json.Unmarshal(line,&t)==nil && t.Count!=nil {
+      if hex.EncodeToString(sum.Sum(nil))!=t.Sha256 || *t.Count!=count {
+        return h,ErrSnapChecksum
+      }
+      return h,nil
+    }
+    var e SnapEntry
+    if err := json.Unmarshal(line,&e); err!=nil {
+      return h,fmt.Errorf("snapshot: malformed entry %d: %v", count, err)
+    }
+    sum.Write(line)
+    count++
+    if err := fn(e); err!=nil {
+      return h,err
+    }
+  }
+}
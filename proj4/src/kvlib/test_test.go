@@ -0,0 +1,510 @@
+package kvlib
+
+import "testing"
+import "time"
+import "fmt"
+import "strings"
+import "reflect"
+import "os"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "encoding/json"
+import "encoding/xml"
+import "path/filepath"
+import "flag"
+
+func TestCheckLinearizable(t *testing.T) {
+  fmt.Printf("Test: Checker finds a stale read ...\n")
+
+  ms := time.Millisecond
+  stale := []HistOp{
+    {Client: 1, Kind: OpInsert, Key: "a", Value: "1", Call: 0, Return: 1 * ms},
+    {Client: 2, Kind: OpInsert, Key: "b", Value: "1", Call: 0, Return: 2 * ms},
+    {Client: 2, Kind: OpGet, Key: "a", Call: 3 * ms, Return: 4 * ms, Output: "1"},
+    {Client: 1, Kind: OpUpdate, Key: "a", Value: "2", Call: 5 * ms, Return: 6 * ms, Output: "1"},
+    {Client: 3, Kind: OpDelete, Key: "a", Call: 5 * ms, Return: Never, Outcome: OutcomeUnknown},
+    {Client: 2, Kind: OpGet, Key: "a", Call: 7 * ms, Return: 8 * ms, Output: "1"},
+  }
+  ok, sub := CheckLinearizable(stale)
+  if ok {
+    t.Fatalf("a stale read was found linearizable")
+  }
+  // the insert, the update, the delete that may come before the stale get
+  // (which it would not excuse), and the stale get
+  if len(sub) != 4 || sub[0] != stale[0] || sub[1] != stale[3] || sub[2] != stale[4] || sub[3] != stale[5] {
+    t.Fatalf("violation of a stale read:\n%s", FormatHistory(sub))
+  }
+  // read while the update was pending, it is not stale
+  stale[5].Call = 5 * ms
+  if ok, sub := CheckLinearizable(stale); !ok {
+    t.Fatalf("a concurrent read was found stale:\n%s", FormatHistory(sub))
+  }
+  // a write of unknown outcome may have happened, or not
+  unknown := []HistOp{
+    {Client: 1, Kind: OpInsert, Key: "a", Value: "1", Call: 0, Return: Never, Outcome: OutcomeUnknown},
+    {Client: 2, Kind: OpGet, Key: "a", Call: 1 * ms, Return: 2 * ms, Outcome: OutcomeFailed},
+    {Client: 2, Kind: OpGet, Key: "a", Call: 3 * ms, Return: 4 * ms, Output: "1"},
+  }
+  if ok, sub := CheckLinearizable(unknown); !ok {
+    t.Fatalf("a write of unknown outcome was not allowed to happen late:\n%s", FormatHistory(sub))
+  }
+  unknown[1].Call, unknown[1].Return = 5*ms, 6*ms
+  if ok, _ := CheckLinearizable(unknown); ok {
+    t.Fatalf("a key was found missing after it was read")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestParseScript(t *testing.T) {
+  fmt.Printf("Test: Script parse errors ...\n")
+
+  bad := []struct {
+    script string
+    line int
+  }{
+    {"Put a 1\nFrobnicate a\n", 2},
+    {"# comment\n\nGet a b\n", 3},
+    {"Put a \"unterminated\n", 1},
+    {"Block\nPut a 1\nSleep 10\nEndblock\n", 3},
+    {"Loop i 1 3\nPut k$i v\n", 1},
+    {"Endblock\n", 1},
+    {"Switch zero\n", 1},
+    {"Partition 1 2\n", 1},
+    {"ExpectFail Get\n", 1},
+  }
+  for _, b := range bad {
+    _, err := ParseScript(strings.NewReader(b.script), "bad.test")
+    serr, ok := err.(*ScriptError)
+    if !ok || serr.Line != b.line {
+      t.Fatalf("parse error of %q -> %v, expected one at line %d", b.script, err, b.line)
+    }
+  }
+  toks, err := splitLine("Put \"a b\" c\t\"d\\te\"#comment")
+  if err != nil || len(toks) != 4 || toks[1] != "a b" || toks[2] != "c" || toks[3] != "d\te" {
+    t.Fatalf("splitLine -> %q, %v", toks, err)
+  }
+  for _, line := range []string{"Put \"a", "Put \"a\"b", "Put a\"b", "Put \"\\q\""} {
+    if toks, err := splitLine(line); err == nil {
+      t.Fatalf("splitLine(%q) -> %q, expected an error", line, toks)
+    }
+  }
+  prog, err := ParseScript(strings.NewReader("Put \"a key\" \"a \\\"value\\\"\" # comment\nLoop i 1 2\nBlock\nGet $i\nEndblock\nEndloop\n"), "good.test")
+  if err != nil || len(prog) != 2 || prog[0].Args[0] != "a key" || prog[0].Args[1] != "a \"value\"" ||
+    len(prog[1].Body) != 1 || prog[1].Body[0].Op != "Block" || len(prog[1].Body[0].Body) != 1 {
+    t.Fatalf("ParseScript -> %v, %v", prog, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestChaosPlan(t *testing.T) {
+  fmt.Printf("Test: Chaos plans follow the seed ...\n")
+
+  cfg := ChaosConfig{Seed: 42, Servers: 5, Clients: 3, Ops: 20, Faults: 30, Gap: 100 * time.Millisecond}
+  plan := NewChaosPlan(cfg)
+  if !reflect.DeepEqual(plan, NewChaosPlan(cfg)) {
+    t.Fatalf("two plans of seed 42 differ")
+  }
+  cfg.Seed = 43
+  if reflect.DeepEqual(plan.Events, NewChaosPlan(cfg).Events) {
+    t.Fatalf("the faults of seeds 42 and 43 are the same")
+  }
+  // a majority is always up and connected, and the cluster ends whole
+  down := map[int]bool{}
+  var minority []int
+  for _, e := range plan.Events {
+    switch e.Kind {
+      case ChaosKill:
+        down[e.Node] = true
+      case ChaosRestart:
+        delete(down, e.Node)
+      case ChaosPartition:
+        minority = e.Sets[0]
+      case ChaosHeal:
+        minority = nil
+    }
+    if len(down)+len(minority) > 2 {
+      t.Fatalf("%v leaves no majority: %v down, %v cut off", e, down, minority)
+    }
+  }
+  if len(plan.Events) < 30 || len(down) != 0 || minority != nil {
+    t.Fatalf("%d events, ending with %v down and %v cut off", len(plan.Events), down, minority)
+  }
+  if _, err := ParseScript(strings.NewReader(plan.Script()), "chaos.test"); err != nil {
+    t.Fatalf("the script of a plan: %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Chaos reproducer of a stale read ...\n")
+
+  ms := time.Millisecond
+  stale := []HistOp{
+    {Client: 1, Kind: OpInsert, Key: "k1", Value: "1.0", Call: 0, Return: 1 * ms},
+    {Client: 2, Kind: OpInsert, Key: "k2", Value: "2.0", Call: 0, Return: 2 * ms},
+    {Client: 1, Kind: OpUpdate, Key: "k1", Value: "1.1", Call: 5 * ms, Return: 6 * ms, Output: "1.0"},
+    {Client: 2, Kind: OpUpdate, Key: "k1", Value: "2.1", Call: 5 * ms, Return: 9 * ms, Output: "1.1"},
+    {Client: 3, Kind: OpGet, Key: "k1", Call: 7 * ms, Return: 8 * ms, Output: "1.0"},
+  }
+  res := &ChaosResult{Plan: NewChaosPlan(ChaosConfig{Seed: 1, Clients: 3}), Ops: stale,
+    Events: []ChaosEvent{
+      {At: 1 * ms, Kind: ChaosPartition, Sets: [][]int{{2}, {0, 1}}},
+      {At: 2 * ms, Kind: ChaosKill, Node: 0},
+      {At: 3 * ms, Kind: ChaosHeal},
+      {At: 6 * ms, Kind: ChaosRestart, Node: 0},
+    }}
+  res.Linearizable, res.Violation = CheckLinearizable(stale)
+  rep := res.Reproducer()
+  want := "# bin/kvchaos -seed 1 -clients 3 -ops 50 -keys 5 -faults 0 -gap 500ms\n" +
+    "# 4 ops of key \"k1\" violate linearizability\n" +
+    "Switch 1\nPut k1 1.0\nPartition 3 / 1 2\nkill_server 1\nHeal\n" +
+    "Block\nSwitch 1\nUpdate k1 1.1\nSwitch 2\nUpdate k1 2.1\nstart_server 1\nSwitch 3\nGet k1\nEndblock\n"
+  if rep != want {
+    t.Fatalf("reproducer:\n%s\nexpected:\n%s", rep, want)
+  }
+  if _, err := ParseScript(strings.NewReader(rep), "repro.test"); err != nil {
+    t.Fatalf("the reproducer: %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestHistogram(t *testing.T) {
+  fmt.Printf("Test: Latency histogram quantiles ...\n")
+
+  h := NewHistogram(3600*1000*1000, 3)
+  for v := int64(1); v <= 10000; v++ {
+    h.Record(v)
+  }
+  for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+    want := int64(q * 10000)
+    if got := h.Quantile(q); got < want || float64(got-want) > 0.001*float64(want) {
+      t.Fatalf("quantile %g of 1..10000 is %d, expected %d to 0.1%%", q, got, want)
+    }
+  }
+  if h.Count() != 10000 || h.Min() != 1 || h.Max() != 10000 || h.Quantile(1) != 10000 || h.Mean() != 5000.5 {
+    t.Fatalf("count %d, min %d, max %d, mean %g", h.Count(), h.Min(), h.Max(), h.Mean())
+  }
+  o := NewHistogram(3600*1000*1000, 3)
+  o.RecordN(2000000, 10000)
+  h.Merge(o)
+  if got := h.Quantile(0.75); got < 2000000 || got > 2002000 {
+    t.Fatalf("quantile 0.75 of the merged histograms is %d, expected 2000000", got)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestAgent(t *testing.T) {
+  dir, err := ioutil.TempDir("", "agent")
+  if err != nil {
+    t.Fatalf("TempDir: %v", err)
+  }
+  defer os.RemoveAll(dir)
+  // the port of the "server", which accepts as long as the test runs
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("Listen: %v", err)
+  }
+  defer l.Close()
+  go func() {
+    for {
+      c, err := l.Accept()
+      if err != nil {
+        return
+      }
+      c.Close()
+    }
+  }()
+
+  fmt.Printf("Test: Agent starts, kills and stops a server ...\n")
+
+  a := NewAgent(AgentConfig{Node: 1, Command: []string{"sh", "-c", "echo hello; exec sleep 60"},
+    StopCommand: []string{"true"}, Server: l.Addr().String(), Log: AgentLog(dir, 1),
+    StopTimeout: 200 * time.Millisecond})
+  st, err := a.Start()
+  if err != nil || !st.Running || st.Pid == 0 || !st.Serving || st.Starts != 1 {
+    t.Fatalf("Start -> %+v, %v", st, err)
+  }
+  if _, err := a.Start(); err == nil {
+    t.Fatalf("Start of a running server succeeded")
+  }
+  for i := 0; ; i++ {
+    s, _ := a.Logs(1)
+    if s == "hello\n" {
+      break
+    }
+    if i == 100 {
+      t.Fatalf("the last line of the log is %q", s)
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  pid := st.Pid
+  st, err = a.Kill()
+  if err != nil || st.Running || st.Exit == nil || st.Exit.Pid != pid || st.Exit.Signal == "" || !st.Exit.Expected {
+    t.Fatalf("Kill -> %+v %+v, %v", st, st.Exit, err)
+  }
+  if _, err := a.Kill(); err == nil {
+    t.Fatalf("Kill of a dead server succeeded")
+  }
+  // the stop command does nothing, so it is killed in the end
+  if _, err := a.Start(); err != nil {
+    t.Fatalf("Start again: %v", err)
+  }
+  st, err = a.Stop()
+  if err != nil || st.Running || st.Starts != 2 || st.Exit.Signal == "" || !strings.Contains(st.Message, "killed after") {
+    t.Fatalf("Stop -> %+v %+v, %v", st, st.Exit, err)
+  }
+  if s, _ := a.Logs(-1); strings.Count(s, "sleep 60, start ") != 2 {
+    t.Fatalf("the log of 2 starts:\n%s", s)
+  }
+
+  // a server that ends by itself before it serves
+  free, _ := net.Listen("tcp", "127.0.0.1:0")
+  addr := free.Addr().String()
+  free.Close()
+  b := NewAgent(AgentConfig{Node: 2, Command: []string{"sh", "-c", "exit 3"}, Server: addr})
+  st, err = b.Start()
+  if err == nil || st.Running || st.Exit == nil || st.Exit.Code != 3 || st.Exit.Expected {
+    t.Fatalf("Start of a failing server -> %+v %+v, %v", st, st.Exit, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Agent over HTTP ...\n")
+
+  srv := httptest.NewServer(a.Handler())
+  defer srv.Close()
+  agents := &AgentClients{URLs: []string{srv.URL}, StopByKill: true}
+  if st, err := agents.Health(0); err != nil || st.Node != 1 || st.Running || st.Starts != 2 {
+    t.Fatalf("Health -> %+v, %v", st, err)
+  }
+  resp, err := http.Get(srv.URL + "/agent/start")
+  if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+    t.Fatalf("GET /agent/start -> %v, %v", resp, err)
+  }
+  resp.Body.Close()
+  if msg, err := agents.StartServer(0); err != nil || !strings.Contains(msg, "Server 1 started, pid") {
+    t.Fatalf("StartServer -> %q, %v", msg, err)
+  }
+  if s, err := agents.Logs(0, 2); err != nil || !strings.Contains(s, "sleep 60, start 3") {
+    t.Fatalf("Logs -> %q, %v", s, err)
+  }
+  if msg, err := agents.StopServer(0, "stop_server"); err != nil || !strings.Contains(msg, "ended by signal") {
+    t.Fatalf("StopServer -> %q, %v", msg, err)
+  }
+  if _, err := agents.Stop(0); err == nil {
+    t.Fatalf("Stop of a dead server succeeded")
+  }
+  if _, err := agents.Shutdown(0); err != nil {
+    t.Fatalf("Shutdown: %v", err)
+  }
+  select {
+  case <-a.Done():
+  default:
+    t.Fatalf("the agent is not done after a shutdown")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Test reports in JSON and JUnit XML ...\n")
+
+  out := "Testing b.test..\n\n\nInstruction: Put a 1\nResult: success\nInsertion success.\n\n" +
+    "Instruction: ExpectGet a 2\nResult: success, value \"1\"\nExpected value \"2\".\nFATAL ERROR!!!\n" +
+    "History linearizable.\n\nTerminating.\n"
+  fails := ScriptFailures(out)
+  if len(fails) != 1 || fails[0] != "Instruction: ExpectGet a 2\nResult: success, value \"1\"\nExpected value \"2\"." {
+    t.Fatalf("ScriptFailures -> %q", fails)
+  }
+  if fails := ScriptFailures("Testing c.test..\n\nParse error: c.test:1: no instruction x\nFATAL ERROR!!!\n"); len(fails) != 1 || fails[0] != "Parse error: c.test:1: no instruction x" {
+    t.Fatalf("ScriptFailures of a parse error -> %q", fails)
+  }
+  r := NewTestReport("kvpaxos")
+  r.Add(NewCaseReport("a.test", time.Now(), "Testing a.test..\n\nTerminating.\n", 0))
+  c := NewCaseReport("b.test", time.Now(), out, 1)
+  c.Logs = map[string]string{"n01": "a log\n"}
+  r.Add(c)
+  if r.Total != 2 || r.Passed != 1 || r.Failed != 1 || c.Passed || c.Output != out {
+    t.Fatalf("report %+v of case %+v", r, c)
+  }
+
+  var b1 strings.Builder
+  if err := r.WriteJSON(&b1); err != nil {
+    t.Fatalf("WriteJSON: %v", err)
+  }
+  var js TestReport
+  if err := json.Unmarshal([]byte(b1.String()), &js); err != nil || js.Failed != 1 || len(js.Cases) != 2 ||
+    js.Cases[1].Failures[0] != fails[0] || js.Cases[0].Output != "" {
+    t.Fatalf("the JSON report (%v):\n%s", err, b1.String())
+  }
+
+  var b2 strings.Builder
+  if err := r.WriteJUnit(&b2); err != nil {
+    t.Fatalf("WriteJUnit: %v", err)
+  }
+  var ju struct {
+    Tests int `xml:"tests,attr"`
+    Failures int `xml:"failures,attr"`
+    Suites []struct {
+      Name string `xml:"name,attr"`
+      Cases []struct {
+        Name string `xml:"name,attr"`
+        Failure *struct {
+          Message string `xml:"message,attr"`
+          Text string `xml:",chardata"`
+        } `xml:"failure"`
+        SystemOut string `xml:"system-out"`
+        SystemErr string `xml:"system-err"`
+      } `xml:"testcase"`
+    } `xml:"testsuite"`
+  }
+  if err := xml.Unmarshal([]byte(b2.String()), &ju); err != nil || ju.Tests != 2 || ju.Failures != 1 ||
+    len(ju.Suites) != 1 || len(ju.Suites[0].Cases) != 2 {
+    t.Fatalf("the JUnit report (%v):\n%s", err, b2.String())
+  }
+  jc := ju.Suites[0].Cases
+  if jc[0].Failure != nil || jc[1].Failure == nil || jc[1].Failure.Message != "Instruction: ExpectGet a 2" ||
+    jc[1].Failure.Text != fails[0] || jc[1].SystemOut != out || jc[1].SystemErr != "=== n01\na log\n" {
+    t.Fatalf("the JUnit report:\n%s", b2.String())
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// the settings of the repository
+func settings(t *testing.T) *Config {
+  conf, err := LoadConfig("../../conf/settings.conf")
+  if err != nil {
+    t.Fatalf("settings: %v", err)
+  }
+  return conf
+}
+
+func TestSettings(t *testing.T) {
+  fmt.Printf("Test: Settings with a list of nodes ...\n")
+
+  conf := settings(t)
+  if conf.N() != 5 || conf.URL(1) != "http://127.0.0.1:30102" || conf.RPCAddr(2) != "127.0.0.1:40103" ||
+    conf.AgentURL(0) != "http://127.0.0.1:3087" || conf.DrainTimeout() != 5*time.Second {
+    t.Fatalf("settings.conf -> %+v", conf)
+  }
+  for name, want := range map[string]int{"n02": 1, "2": 1, "n05": 4} {
+    if i, err := conf.Node(name); err != nil || i != want {
+      t.Fatalf("Node(%q) -> %d, %v", name, i, err)
+    }
+  }
+  for _, name := range []string{"n06", "0", "x", "n1"} {
+    if _, err := conf.Node(name); err == nil {
+      t.Fatalf("Node(%q) of 5 nodes succeeded", name)
+    }
+  }
+  if s := conf.Settings(); s["max_value_size"] != "1048576" || s["log_level"] != "info" || s["kv_token"] != "" {
+    t.Fatalf("Settings() -> %v", s)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Settings in the flat format ...\n")
+
+  conf, err := ParseConfig([]byte(`{"nservers":"3", "use_different_port":"true", "port":"30100", "RPCport":"40100",
+    "n01":"a", "n02":"b", "n03":"c", "n04":"d", "port_n01":"1", "port_n02":"2", "port_n03":"3",
+    "RPC_port_n01":"11", "RPC_port_n02":"12", "RPC_port_n03":"13", "rpc_method":"tcp", "max_value_size":"100"}`), "flat")
+  if err != nil || conf.N() != 3 || conf.HTTPAddr(2) != "c:3" || conf.RPCAddr(0) != "a:11" || conf.MaxValueSize != 100 {
+    t.Fatalf("the flat format -> %+v, %v", conf, err)
+  }
+  conf, err = ParseConfig([]byte(`{"nservers":2, "port":30100, "RPCport":40100, "n01":"a", "n02":"b"}`), "flat")
+  if err != nil || conf.HTTPAddr(1) != "b:30100" || conf.RPCAddr(1) != "b:40100" || conf.LogLevel != "info" {
+    t.Fatalf("the flat format with one port -> %+v, %v", conf, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Wrong settings are refused with their errors ...\n")
+
+  for data, want := range map[string]string{
+    `{}`: "x: no node",
+    `{"nodes":[{"host":"a","port":1,"rpc_port":1}]}`: "nodes[0].rpc_port: a:1 is nodes[0].port already",
+    `{"nodes":[{"host":"a","port":1,"rpc_port":2},{"host":"b","port":1,"rpc_port":2}]}`: "",
+    `{"nodes":[{"port":70000,"rpc_port":"two"}]}`: "x: nodes[0].rpc_port: \"two\" is not an integer",
+    `{"nodes":[{"host":"a","port":70000,"rpc_port":2}]}`: "nodes[0].port: 70000 is not a port",
+    `{"nodes":[{"host":"a","port":1,"rpc_port":2}], "nservers":3}`: "unknown setting \"nservers\"",
+    `{"nodes":[{"host":"a","port":1,"rpc_port":2,"ip":"b"}]}`: "nodes[0].unknown setting \"ip\"",
+    `{"nodes":[{"host":"a","port":1,"rpc_port":2}], "http_tls_cert":"c"}`: "http_tls_cert and http_tls_key go together",
+    `{"nodes":[{"host":"a","port":1,"rpc_port":2}], "log_level":"paxos=loud"}`: "log_level:",
+    `{"nodes":[{"host":"a","port":1,"rpc_port":2}], "log_format":"xml", "rpc_method":"udp"}`:
+      "x: rpc_method: \"udp\", only tcp is supported; log_format: \"xml\" is not text or json",
+    `{"nodes":[{"host":"a","port":1,"rpc_port":2}], "drain_timeout_ms":-1}`: "drain_timeout_ms: -1 is negative",
+  } {
+    _, err := ParseConfig([]byte(data), "x")
+    if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+      t.Fatalf("%s -> %v, expected %q", data, err, want)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Settings overridden by the environment and -set ...\n")
+
+  dir := t.TempDir()
+  fn := filepath.Join(dir, "settings.conf")
+  if err := settings(t).WriteFile(fn); err != nil {
+    t.Fatalf("WriteFile: %v", err)
+  }
+  if conf, err := LoadConfig(fn); err != nil || !reflect.DeepEqual(conf.Nodes, settings(t).Nodes) || conf.File != fn {
+    t.Fatalf("the settings written -> %+v, %v", conf, err)
+  }
+  os.Setenv("KVPAXOS_LOG_LEVEL", "debug")
+  os.Setenv("KVPAXOS_MAX_VALUE_SIZE", "10")
+  defer os.Unsetenv("KVPAXOS_LOG_LEVEL")
+  defer os.Unsetenv("KVPAXOS_MAX_VALUE_SIZE")
+  fs := flag.NewFlagSet("x", flag.ContinueOnError)
+  cf := NewConfigFlags(fs)
+  args, err := ParseInterspersed(fs, []string{"-conf", fn, "n02", "-set", "max_value_size=20",
+    "-set", `nodes=[{"host":"h","port":1,"rpc_port":2}]`, "last"})
+  if err != nil || !reflect.DeepEqual(args, []string{"n02", "last"}) {
+    t.Fatalf("ParseInterspersed -> %v, %v", args, err)
+  }
+  conf, err = cf.Load()
+  if err != nil || conf.LogLevel != "debug" || conf.MaxValueSize != 20 || conf.N() != 1 || conf.URL(0) != "http://h:1" {
+    t.Fatalf("Load with overrides -> %+v, %v", conf, err)
+  }
+  want := []string{"-conf", fn, "-set", "max_value_size=20", "-set", `nodes=[{"host":"h","port":1,"rpc_port":2}]`}
+  if !reflect.DeepEqual(cf.Args(), want) {
+    t.Fatalf("Args() -> %v", cf.Args())
+  }
+  for _, set := range []string{"size=1", "max_value_size", "max_value_size=big"} {
+    cf.Sets = []string{set}
+    if _, err := cf.Load(); err == nil {
+      t.Fatalf("-set %s succeeded", set)
+    }
+  }
+  os.Setenv("KVPAXOS_LOG_LEVEL", "loud")
+  cf.Sets = nil
+  if _, err := cf.Load(); err == nil || !strings.Contains(err.Error(), "log_level") {
+    t.Fatalf("KVPAXOS_LOG_LEVEL=loud -> %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Settings of the tester ...\n")
+
+  tc, err := LoadTesterConfig("../../conf/test.conf")
+  if err != nil || tc.NServers != 3 || tc.Case(2) != "test/2.test" {
+    t.Fatalf("test.conf -> %+v, %v", tc, err)
+  }
+  fn = filepath.Join(dir, "test.conf")
+  ioutil.WriteFile(fn, []byte(`{"test_total":"2", "fmt":"false", "cases":["a.test","b.test"], "stop_by_kill":true}`), 0644)
+  tc, err = LoadTesterConfig(fn)
+  if err != nil || tc.Case(1) != "test/b.test" || !tc.StopByKill || !tc.AutoRestartServer || tc.MainPort != 3086 {
+    t.Fatalf("%s -> %+v, %v", fn, tc, err)
+  }
+  ioutil.WriteFile(fn, []byte(`{"test_total":3, "fmt":false, "cases":["a.test"]}`), 0644)
+  if _, err := LoadTesterConfig(fn); err == nil || !strings.Contains(err.Error(), "cases: 1 of test_total 3") {
+    t.Fatalf("too few cases -> %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -4,472 +4,681 @@ import (
     "fmt"
     "os"
     //"os/exec"
-    "net/http"
-    "net/url"
+    "errors"
     "time"
     "strconv"
-
+    "strings"
 )
 
+// a client of a single server, which gives up at once if it is down
+func serverClerk(addr string) Client {
+    return newClient([]string{addr}, ClientOptions{Retries: 1})
+}
+
+// whether the server replied, successfully or not
+func replied(err error) bool {
+    return !errors.Is(err, ErrUnavailable)
+}
+
+func describe(value string, err error) string {
+    if err != nil {
+        return fmt.Sprintf("error: %v", err)
+    }
+    return fmt.Sprintf("success, value %q", value)
+}
+
 
 
-func checkDump(t map[string]string, d map[string]interface{}) int {
+func checkDump(t map[string]string, d map[string]string) int {
     if len(t) != len(d) {
         return 1
     }
     for k, v := range t {
-        if d[k] != v {
+        if w, ok := d[k]; !ok || w != v {
             return 1
         }
     }
     return 0
 }
 
+// the report of a linearizability check of the history so far; a violation
+// fails the test, and is only reported once
+func checkHistory(hist *History, fail *int, violated *bool) string {
+    if *violated {
+        return ""
+    }
+    ok, sub := CheckLinearizable(hist.Ops())
+    if ok {
+        return "History linearizable.\n"
+    }
+    *violated = true
+    *fail = 1
+    return fmt.Sprintf("History not linearizable, %d ops of key %q violate it:\n%s"+
+        "FATAL ERROR!!!\n", len(sub), sub[0].Key, FormatHistory(sub))
+}
+
+// starts and stops the servers of a script, numbered from 0: the agents
+// of test/test.go (see AgentClients), or a cluster of this process
+type ScriptServers interface {
+    StartServer(i int) (string, error)
+    // op is stop_server, kill_server or shutdown_server
+    StopServer(i int, op string) (string, error)
+}
+
+// the state of a script being run by RunScript
+type unitRun struct {
+    fn string
+    addr []string
+    servers ScriptServers
+    r string
+    fail int
+    table map[string]string // the expected database
+    alive []int
+    livingServer int
+    srv_cur int
+    clerks []Client
+    vars map[string]string
+    nodes []string // the RPC address of each server, once known
+    partition [][]string // of RPC addresses, while partitioned
+
+    // every op, checked for linearizability after each block and at the end;
+    // client 0 runs the ops out of blocks, and each op in a block has a
+    // client of its own
+    hist *History
+    clients int
+    violated bool
+
+    // within a block
+    inBlock int
+    ch chan int
+    ent chan string
+    cnt int
+}
+
+// the script fn, its servers started and killed by the agents at
+// tester_addr (see test/test.go)
 func TestUnit(addr []string, tester_addr []string, fn string, auto_restart bool) (r string, fail int) {
-    f, _ := os.Open(fn)
-    defer f.Close()
-    table := make(map[string]string)
-    // var tableBlock map[string]int
-    var s [4]string
+    return RunScript(addr, &AgentClients{URLs: tester_addr, StopByKill: true}, fn, auto_restart)
+}
+
+// run the script fn against the servers at addr, started and stopped by
+// servers; with auto_restart they are all up at first
+func RunScript(addr []string, servers ScriptServers, fn string, auto_restart bool) (r string, fail int) {
     nservers := len(addr)
-    var srv_cur, livingServer int
-    livingServer = 0
-    var alive [3]int = [3]int{0,0,0}
+    u := &unitRun{fn: fn, addr: addr, servers: servers}
+    u.table = make(map[string]string)
+    u.alive = make([]int, nservers)
+    u.clerks = make([]Client, nservers)
+    for i := range u.clerks {
+        u.clerks[i] = serverClerk(addr[i])
+    }
+    u.vars = make(map[string]string)
+    u.nodes = make([]string, nservers)
+    u.hist = NewHistory()
     if auto_restart{
-      livingServer = nservers
-      for i:=0;i<3;i++ {
-        alive[i] = 1
+      u.livingServer = nservers
+      for i:=0;i<nservers;i++ {
+        u.alive[i] = 1
       }
-      fmt.Println("auto_restart server!")
+      clog.Info("servers restarted automatically")
     }
-    var inBlock, cnt /*, cins */ int
-    inBlock = 0
-    var ch chan int
-    // var ins chan [4]string
-    var ent chan string
-    r += fmt.Sprintf("Testing %s..\n\n", fn)
+    u.r += fmt.Sprintf("Testing %s..\n\n", fn)
 
-    for {
-        l, _ := fmt.Fscanln(f, &s[0], &s[1], &s[2], &s[3])
-        if l==0{
-          r += fmt.Sprintf("\nTerminating.\n")
-          return
-        }
+    f, err := os.Open(fn)
+    if err != nil {
+        return u.r + fmt.Sprintf("Cannot open the test: %v\nFATAL ERROR!!!\n", err), 1
+    }
+    prog, err := ParseScript(f, fn)
+    f.Close()
+    if err != nil {
+        return u.r + fmt.Sprintf("Parse error: %v\nFATAL ERROR!!!\n", err), 1
+    }
+    if err := u.run(prog); err != nil {
+        u.r += fmt.Sprintf("\nScript error: %v\nFATAL ERROR!!!\n", err)
+        u.fail = 1
+    }
+    u.r += checkHistory(u.hist, &u.fail, &u.violated)
+    u.r += fmt.Sprintf("\nTerminating.\n")
+    return u.r, u.fail
+}
 
-        for i := 0; i < l; i++ {
-            if i != 0 {
-                r += fmt.Sprintf(" %v", s[i])
-            } else {
-                r += fmt.Sprintf("\nInstruction: %v", s[i])
+func isNameByte(c byte) bool {
+    return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// s with its variables replaced
+func (u *unitRun) expand(s string) (string, error) {
+    if !strings.Contains(s, "$") {
+        return s, nil
+    }
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        if s[i] != '$' {
+            b.WriteByte(s[i])
+            continue
+        }
+        if i+1 < len(s) && s[i+1] == '$' {
+            b.WriteByte('$')
+            i++
+            continue
+        }
+        var name string
+        if i+1 < len(s) && s[i+1] == '{' {
+            end := strings.IndexByte(s[i+2:], '}')
+            if end < 0 {
+                return "", fmt.Errorf("unterminated ${ in %q", s)
+            }
+            name = s[i+2 : i+2+end]
+            i += 2 + end
+        } else {
+            j := i + 1
+            for j < len(s) && isNameByte(s[j]) {
+                j++
             }
+            name = s[i+1 : j]
+            i = j - 1
         }
-        for i := l; i < 4; i++ {
-            s[i] = ""
+        v, found := u.vars[name]
+        if !found {
+            return "", fmt.Errorf("undefined variable %q", name)
         }
-        r += fmt.Sprintf("\nResult: ")
-        switch s[0] {
-            case "Put":
-                if inBlock == 1 {
-                    // tableBlock[s[1]] = 1
-                    cnt++
-                    ent <- s[1]
-                    /*
-                    if _, ok := table[s[1]]; ok == false {
-                        cins++
-                        ins <- s
-                    }
-                    */
-                    go func(s [4]string) {
-                        resp, err := http.PostForm(addr[srv_cur] + "/kv/insert", url.Values{"key": {s[1]}, "value": {s[2]}})
-
-                        if err == nil {
-                            res := DecodeJson(resp)
-                            if res["success"] == "true" {
+        b.WriteString(v)
+    }
+    return b.String(), nil
+}
 
-                            }
-                        } else {
+// a server number of an argument, 1 for the first
+func (u *unitRun) server(arg string) (int, error) {
+    n, err := strconv.Atoi(arg)
+    if err != nil || n < 1 || n > len(u.addr) {
+        return 0, fmt.Errorf("no server %q, there are %d", arg, len(u.addr))
+    }
+    return n, nil
+}
 
-                        }
-                        ch <- 0
+func (u *unitRun) run(prog []*Instr) error {
+    for _, ins := range prog {
+        a := make([]string, len(ins.Args))
+        for i, arg := range ins.Args {
+            v, err := u.expand(arg)
+            if err != nil {
+                return &ScriptError{u.fn, ins.Line, err.Error()}
+            }
+            a[i] = v
+        }
+        u.r += fmt.Sprintf("\nInstruction: %v", ins.Op)
+        for _, v := range a {
+            if v == "" || strings.ContainsAny(v, " \t\r\n\"#") {
+                v = strconv.Quote(v)
+            }
+            u.r += fmt.Sprintf(" %v", v)
+        }
+        u.r += fmt.Sprintf("\nResult: ")
+        if err := u.exec(ins, a); err != nil {
+            if _, ok := err.(*ScriptError); !ok {
+                err = &ScriptError{u.fn, ins.Line, err.Error()}
+            }
+            return err
+        }
+    }
+    return nil
+}
 
-                    }(s)
-                    break
-                }
-                resp, err := http.PostForm(addr[srv_cur] + "/kv/insert", url.Values{"key": {s[1]}, "value": {s[2]}})
-                if alive[srv_cur] == 0 {
-                    if err == nil {
-                        r += fmt.Sprintf("A dead server replying. What the hell?\n")
-                        fail = 1
-                    } else {
-                        r += fmt.Sprintf("Expected error.\n")
-                    }
-                    break
+// run one instruction, whose arguments a are expanded; requests out of a
+// block are checked against the expected database at once
+func (u *unitRun) exec(ins *Instr, a []string) error {
+    r := &u.r
+    fail := &u.fail
+    table := u.table
+    clerks := u.clerks
+    alive := u.alive
+    srv_cur := u.srv_cur
+    hist := u.hist
+    switch ins.Op {
+        case "Put":
+            if u.inBlock == 1 {
+                u.fire("Put", a)
+                break
+            }
+            _, err := hist.Do(0, clerks[srv_cur], OpInsert, a[0], a[1])
+            if alive[srv_cur] == 0 {
+                if replied(err) {
+                    *r += fmt.Sprintf("A dead server replying. What the hell?\n")
+                    *fail = 1
+                } else {
+                    *r += fmt.Sprintf("Expected error.\n")
                 }
+                break
+            }
+            if replied(err) {
+                *r += fmt.Sprintf("%v\n", describe("", err))
                 if err == nil {
-                    res := DecodeJson(resp)
-                    r += fmt.Sprintf("%v\n", res)
-                    if res["success"] == "true" {
-                        if _, ok := table[s[1]]; ok == false {
-                            r += fmt.Sprintf("Insertion success.\n")
-                            table[s[1]] = s[2]
-                        } else {
-                            r += fmt.Sprintf("Unexpected insertion success.\n")
-                            r += fmt.Sprintf("FATAL ERROR!!!\n")
-                            fail = 1
-                        }
-                    } else if _, ok := table[s[1]]; ok == false {
-                        r += fmt.Sprintf("Unexpected insertion failure.\n")
-                        r += fmt.Sprintf("FATAL ERROR!!!\n")
-                        fail = 1
+                    if _, ok := table[a[0]]; ok == false {
+                        *r += fmt.Sprintf("Insertion success.\n")
+                        table[a[0]] = a[1]
                     } else {
-                        r += fmt.Sprintf("Expected insertion failure.\n")
+                        *r += fmt.Sprintf("Unexpected insertion success.\n")
+                        *r += fmt.Sprintf("FATAL ERROR!!!\n")
+                        *fail = 1
                     }
+                } else if _, ok := table[a[0]]; ok == false {
+                    *r += fmt.Sprintf("Unexpected insertion failure.\n")
+                    *r += fmt.Sprintf("FATAL ERROR!!!\n")
+                    *fail = 1
                 } else {
-                    r += fmt.Sprintf("Error occurred.\n")
+                    *r += fmt.Sprintf("Expected insertion failure.\n")
                 }
-            case "Update":
-                if inBlock == 1 {
-                    // tableBlock[s[1]] = 1
-                    cnt++
-                    ent <- s[1]
-                    /*
-                    if _, ok := table[s[1]]; ok == true {
-                        cins++
-                        ins <- s
-                    }
-                    */
-                    go func(s [4]string) {
-                        resp, err := http.PostForm(addr[srv_cur] + "/kv/update", url.Values{"key": {s[1]}, "value": {s[2]}})
-
-                        if err == nil {
-                            res := DecodeJson(resp)
-                            if res["success"] == "true" {
-
-
-                            }
-                        } else {
-
-                        }
-                        ch <- 0
-
-                    }(s)
-                    break
+            } else {
+                *r += fmt.Sprintf("Error occurred.\n")
+            }
+        case "Update":
+            if u.inBlock == 1 {
+                u.fire("Update", a)
+                break
+            }
+            old, err := hist.Do(0, clerks[srv_cur], OpUpdate, a[0], a[1])
+            if alive[srv_cur] == 0 {
+                if replied(err) {
+                    *r += fmt.Sprintf("A dead server replying. What the hell?\n")
+                    *fail = 1
+                } else {
+                    *r += fmt.Sprintf("Expected error.\n")
                 }
-                resp, err := http.PostForm(addr[srv_cur] + "/kv/update", url.Values{"key": {s[1]}, "value": {s[2]}})
-                if alive[srv_cur] == 0 {
-                    if err == nil {
-                        r += fmt.Sprintf("A dead server replying. What the hell?\n")
-                        fail = 1
+                break
+            }
+            if replied(err) {
+                *r += fmt.Sprintf("%v\n", describe(old, err))
+                if err == nil {
+                    if _, ok := table[a[0]]; ok == true {
+                        *r += fmt.Sprintf("Updating Success.\n")
+                        table[a[0]] = a[1]
                     } else {
-                        r += fmt.Sprintf("Expected error.\n")
+                        *r += fmt.Sprintf("Unexpected updating success.\n")
+                        *r += fmt.Sprintf("FATAL ERROR!!!\n")
+                        *fail = 1
                     }
-                    break
+                } else if _, ok := table[a[0]]; ok == false {
+                        *r += fmt.Sprintf("Expected updating failure.\n")
+                } else {
+                    *r += fmt.Sprintf("Unexpected updating failure.\n")
+                    *r += fmt.Sprintf("FATAL ERROR!!!\n")
+                    *fail = 1
                 }
+            } else {
+                *r += fmt.Sprintf("Error occurred.\n")
+            }
+        case "Delete":
+            if u.inBlock == 1 {
+                u.fire("Delete", a)
+                break
+            }
+            old, err := hist.Do(0, clerks[srv_cur], OpDelete, a[0], "")
+            if alive[srv_cur] == 0 {
+                if replied(err) {
+                    *r += fmt.Sprintf("A dead server replying. What the hell?\n")
+                    *fail = 1
+                } else {
+                    *r += fmt.Sprintf("Expected error.\n")
+                }
+                break
+            }
+            if replied(err) {
+                *r += fmt.Sprintf("%v\n", describe(old, err))
                 if err == nil {
-                    res := DecodeJson(resp)
-                    r += fmt.Sprintf("%v\n", res)
-                    if res["success"] == "true" {
-                        if _, ok := table[s[1]]; ok == true {
-                            r += fmt.Sprintf("Updating Success.\n")
-                            table[s[1]] = s[2]
+                    if _, ok := table[a[0]]; ok == true {
+                        *r += fmt.Sprintf("Deleting success.\n")
+                        if old == table[a[0]] {
+                            *r += fmt.Sprintf("Correct value deleted.\n")
                         } else {
-                            r += fmt.Sprintf("Unexpected updating success.\n")
-                            r += fmt.Sprintf("FATAL ERROR!!!\n")
-                            fail = 1
+                            *r += "Incorrect value deleted.\n"+
+                                 "FATAL ERROR!!!\n"
+                            *fail = 1
                         }
-                    } else if _, ok := table[s[1]]; ok == false {
-                            r += fmt.Sprintf("Expected updating failure.\n")
+                        delete(table, a[0])
                     } else {
-                        r += fmt.Sprintf("Unexpected updating failure.\n")
-                        r += fmt.Sprintf("FATAL ERROR!!!\n")
-                        fail = 1
+                        *r += "Unexpected deleting success.\n"+
+                             "FATAL ERROR!!!\n"
+                        *fail = 1
                     }
+                } else if _, ok := table[a[0]]; ok == true {
+                    *r += "Unexpected deleting failure.\n"+
+                         "FATAL ERROR!!!\n"
+                    *fail = 1
                 } else {
-                    r += fmt.Sprintf("Error occurred.\n")
+                    *r += "Expected deleting failure.\n"
                 }
-            case "Delete":
-                if inBlock == 1 {
-                    // tableBlock[s[1]] = 1
-                    cnt++
-                    ent <- s[1]
-                    /*
-                    if _, ok := table[s[1]]; ok == true{
-                        cins++
-                        ins <- s
-                    }
-                    */
-                    go func(s [4]string) {
-                        resp, err := http.PostForm(addr[srv_cur] + "/kv/delete", url.Values{"key": {s[1]}})
-
-                        if err == nil {
-                            res := DecodeJson(resp)
-                            if res["success"] == "true" {
-
-                            }
-                        } else {
-
-                        }
-                        ch <- 0
+            } else {
+                *r += fmt.Sprintf("Error occurred.\n")
+            }
+        case "Get":
+            if u.inBlock == 1 {
+                u.fire("Get", a)
+                break
+            }
+            value, err := hist.Do(0, clerks[srv_cur], OpGet, a[0], "")
 
-                    }(s)
-                    break
-                }
-                resp, err := http.PostForm(addr[srv_cur] + "/kv/delete", url.Values{"key": {s[1]}})
-                if alive[srv_cur] == 0 {
-                    if err == nil {
-                        r += fmt.Sprintf("A dead server replying. What the hell?\n")
-                        fail = 1
-                    } else {
-                        r += fmt.Sprintf("Expected error.\n")
-                    }
-                    break
+            if alive[srv_cur] == 0 {
+                if replied(err) {
+                    *r += fmt.Sprintf("A dead server replying. What the hell?\n")
+                    *fail = 1
+                } else {
+                    *r += fmt.Sprintf("Expected error.\n")
                 }
+                break
+            }
+            if !replied(err) {
+                *r += "Error occurred.\n"
+            }else{
+                *r += fmt.Sprintf("%v\n", describe(value, err))
                 if err == nil {
-                    res := DecodeJson(resp)
-                    r += fmt.Sprintf("%v\n", res)
-                    if res["success"] == "true" {
-                        if _, ok := table[s[1]]; ok == true {
-                            r += fmt.Sprintf("Deleting success.\n")
-                            if res["value"] == table[s[1]] {
-                                r += fmt.Sprintf("Correct value deleted.\n")
-                            } else {
-                                r += "Incorrect value deleted.\n"+
-                                     "FATAL ERROR!!!\n"
-                                fail = 1
-                            }
-                            delete(table, s[1])
+                    if _, ok := table[a[0]]; ok == false {
+                        *r += "Unexpected getting success.\n"
+                        *fail = 1
+                    } else {
+                        *r += "Getting success.\n"
+                        if value == table[a[0]] {
+                            *r += "Got correct value.\n"
                         } else {
-                            r += "Unexpected deleting success.\n"+
+                            *r += "Got incorrect value.\n"+
                                  "FATAL ERROR!!!\n"
-                            fail = 1
+                            *fail = 1
                         }
-                    } else if _, ok := table[s[1]]; ok == true {
-                        r += "Unexpected deleting failure.\n"+
-                             "FATAL ERROR!!!\n"
-                        fail = 1
-                    } else {
-                        r += "Expected deleting failure.\n"
                     }
+                } else if _, ok := table[a[0]]; ok == true {
+                    *r += "Unexpected getting failure.\n"+
+                         "FATAL ERROR!!!\n"
+                    *fail = 1
                 } else {
-                    r += fmt.Sprintf("Error occurred.\n")
+                    *r += "Expected getting failure.\n"
+                }
+            }
+        case "ExpectGet":
+            value, err := hist.Do(0, clerks[srv_cur], OpGet, a[0], "")
+            *r += fmt.Sprintf("%v\n", describe(value, err))
+            if err != nil || value != a[1] {
+                *r += fmt.Sprintf("Expected value %q.\n", a[1])+
+                     "FATAL ERROR!!!\n"
+                *fail = 1
+            } else {
+                *r += "Got the expected value.\n"
+            }
+        case "ExpectFail":
+            kind := map[string]OpKind{"Put": OpInsert, "Update": OpUpdate, "Delete": OpDelete, "Get": OpGet}[a[0]]
+            value := ""
+            if len(a) > 2 {
+                value = a[2]
+            }
+            out, err := hist.Do(0, clerks[srv_cur], kind, a[1], value)
+            *r += fmt.Sprintf("%v\n", describe(out, err))
+            if err == nil || !replied(err) {
+                *r += "Expected a failure.\n"+
+                     "FATAL ERROR!!!\n"
+                *fail = 1
+            } else {
+                *r += "Failed as expected.\n"
+            }
+        case "CountKey":
+            want := len(table)
+            if len(a) > 0 {
+                want, _ = strconv.Atoi(a[0])
+            }
+            n, err := clerks[srv_cur].CountKey()
+            if err != nil {
+                *r += fmt.Sprintf("error: %v\n", err)+
+                     "FATAL ERROR!!!\n"
+                *fail = 1
+            } else if n != want {
+                *r += fmt.Sprintf("%d keys, expected %d.\n", n, want)+
+                     "FATAL ERROR!!!\n"
+                *fail = 1
+            } else {
+                *r += fmt.Sprintf("%d keys, as expected.\n", n)
+            }
+        case "Dump":
+            d, err := clerks[srv_cur].Dump()
+            if err != nil {
+                *r += fmt.Sprintf("error: %v\n", err)+
+                     "FATAL ERROR!!!\n"
+                *fail = 1
+            } else if checkDump(table, d) != 0 {
+                *r += fmt.Sprintf("Dump of %d keys differs from the %d expected.\n", len(d), len(table))+
+                     "FATAL ERROR!!!\n"
+                *fail = 1
+            } else {
+                *r += fmt.Sprintf("Dump of %d keys as expected.\n", len(d))
+            }
+        case "Sleep":
+            t, _ := strconv.Atoi(a[0])
+            time.Sleep(time.Duration(t) * time.Millisecond)
+            *r += fmt.Sprintf("Slept for %v milliseconds.\n", t)
+        case "Block":
+            u.inBlock = 1
+            // tableBlock = make(map[string]int)
+            u.ch = make(chan int, 10000)
+            u.ent = make(chan string, 10000)
+            u.cnt = 0
+            *r += "Entering a block.\n"
+            if err := u.run(ins.Body); err != nil {
+                return err
+            }
+            *r += "\nInstruction: Endblock\nResult: "
+            u.endBlock()
+        case "Loop":
+            from, _ := strconv.Atoi(a[1])
+            to, _ := strconv.Atoi(a[2])
+            *r += fmt.Sprintf("Looping over %s from %d to %d.\n", a[0], from, to)
+            old, defined := u.vars[a[0]]
+            for i := from; i <= to; i++ {
+                u.vars[a[0]] = strconv.Itoa(i)
+                if err := u.run(ins.Body); err != nil {
+                    return err
                 }
-            case "Get":
-                if inBlock == 1 {
-                    // tableBlock[s[1]] = 1
-                    cnt++
-                    ent <- s[1]
-                    go func(s [4]string) {
-                        resp, err := http.Get(addr[srv_cur] + "/kv/get?key=" + s[1])
+            }
+            if defined {
+                u.vars[a[0]] = old
+            } else {
+                delete(u.vars, a[0])
+            }
+            *r += "\nInstruction: Endloop\nResult: Loop done.\n"
+        case "Set":
+            u.vars[a[0]] = a[1]
+            *r += fmt.Sprintf("%s = %q\n", a[0], a[1])
+        case "Switch":
+            tmp, err := u.server(a[0])
+            if err != nil {
+                return err
+            }
+            u.srv_cur = tmp - 1
+            *r += fmt.Sprintf("Switch to Server: %d\n", u.srv_cur)
+        case "Partition", "Heal":
+            return u.setPartition(ins.Op, a)
+        case "start_server":
+          clog.Debug("start_server", "line", ins.Line, "args", a)
+            t, err := u.server(a[0])
+            if err != nil {
+                return err
+            }
+            if alive[t - 1] == 0 {
 
-                        if err == nil {
-                            res := DecodeJson(resp)
-                            if res["success"] == "true" {
-                                if _, ok := table[s[1]]; ok == false {
-                                    //ch <- 1
-                                } else {
-                                    if res["value"] == table[s[1]] {
-                                        //ch <- 0
-                                    } else {
-                                        //ch <- 1
-                                    }
-                                }
-                            } else if _, ok := table[s[1]]; ok == true {
-                                //ch <- 1
-                            } else {
-                                //ch <- 0
-                            }
-                        } else {
+                msg, err := u.servers.StartServer(t-1)
+                if err != nil{
+                  clog.Warn("start_server failed", "server", t, "err", err)
+                  *r += "Error occured.\n"
+                }else{
+                  *r += fmt.Sprintf("%s\n",msg)
+                  u.livingServer++
+                  alive[t - 1] = 1
+                  // a new server may know no faults
+                  if u.partition != nil {
+                      u.applyPartition(t-1)
+                  }
+                }
 
-                        }
-                        ch <- 0
+                //exec.Run(exec.Command("bin/start_server", fmt.Sprintf("%v", t)))
+            }
+        case "stop_server", "kill_server", "shutdown_server":
+          clog.Debug(ins.Op, "line", ins.Line, "args", a)
+            t, err := u.server(a[0])
+            if err != nil {
+                return err
+            }
+            if alive[t - 1] == 1 {
+              //time.Sleep(time.Millisecond*1500)
+                msg, err := u.servers.StopServer(t-1, ins.Op)
 
-                    }(s)
-                    break
+                if err != nil{
+                  clog.Warn(ins.Op+" failed", "server", t, "err", err)
+                  *r += "Error occured.\n"
                 }else{
-                resp, err := http.Get(addr[srv_cur] + "/kv/get?key=" + s[1])
+                  *r += fmt.Sprintf("%s\n",msg)
+                  u.livingServer--
+                  alive[t - 1] = 0
+                }
+                //exec.Run(exec.Command("bin/stop_server", fmt.Sprintf("%v", t)))
+            }else{
+              *r += "Not started yet!\n"
+            }
+    }
+    return nil
+}
 
-                if alive[srv_cur] == 0 {
+// fire a request of a block, whose result is checked at its end
+func (u *unitRun) fire(op string, a []string) {
+    kind := map[string]OpKind{"Put": OpInsert, "Update": OpUpdate, "Delete": OpDelete, "Get": OpGet}[op]
+    value := ""
+    if len(a) > 1 {
+        value = a[1]
+    }
+    u.cnt++
+    u.ent <- a[0]
+    u.clients++
+    go func(key string, srv int, client int) {
+        u.hist.Do(client, serverClerk(u.addr[srv]), kind, key, value)
+        u.ch <- 0
+    }(a[0], u.srv_cur, u.clients)
+}
+
+// wait for the requests of the block, and read back the keys they touched
+// from every living server, which should agree
+func (u *unitRun) endBlock() {
+    r := &u.r
+    fail := &u.fail
+    table := u.table
+    cnt := u.cnt
+    *r += fmt.Sprintf("Leaving a block of %v legal instructions.\n", cnt)
+    for i := 0; i < cnt; i++ {
+        <-u.ch
+    }
+    for i := 0; i < cnt; i++ {
+        k := <-u.ent
+        res := "SOMETHINGYOUDONTUSEASAVALUE" // Well, you may safely use it as a value, whatever.
+        succ := -1
+        for j := 0; j < len(u.addr); j++ {
+            if u.alive[j] == 1 {
+                value, err := u.hist.Do(0, u.clerks[j], OpGet, k, "")
+                if !replied(err) {
+                    *r += fmt.Sprintf("An error occured.\n")
+                    // r += fmt.Sprintf("FATAL ERROR!!!\n")
+                    // fail = 1
+                } else {
+                    *r += fmt.Sprintf("%v\n", describe(value, err))
                     if err == nil {
-                        r += fmt.Sprintf("A dead server replying. What the hell?\n")
-                        fail = 1
-                    } else {
-                        r += fmt.Sprintf("Expected error.\n")
-                    }
-                    break
-                }
-                if err != nil {
-                    r += "Error occurred.\n"
-                }else{
-                    res := DecodeJson(resp)
-                    r += fmt.Sprintf("%v\n", res)
-                    if res["success"] == "true" {
-                        if _, ok := table[s[1]]; ok == false {
-                            r += "Unexpected getting success.\n"
-                            fail = 1
+                        if succ == -1 {
+                            *r += fmt.Sprintf("Getting success.\n")
+                            succ = 1
+                            res = value
+                            table[k] = res
+                        } else if succ == 0 {
+                            *r += fmt.Sprintf("Inconsistent getting success.\n")
+                            *r += fmt.Sprintf("FATAL ERROR!!!\n")
+                            *fail = 1
                         } else {
-                            r += "Getting success.\n"
-                            if res["value"] == table[s[1]] {
-                                r += "Got correct value.\n"
+                            if value == res {
+                                *r += fmt.Sprintf("Consistent value.\n")
                             } else {
-                                r += "Got incorrect value.\n"+
-                                     "FATAL ERROR!!!\n"
-                                fail = 1
+                                *r += fmt.Sprintf("Inconsistent values.\n")
+                                *r += fmt.Sprintf("FATAL ERROR!!!\n")
+                                *fail = 1
                             }
                         }
-                    } else if _, ok := table[s[1]]; ok == true {
-                        r += "Unexpected getting failure.\n"+
-                             "FATAL ERROR!!!\n"
-                        fail = 1
                     } else {
-                        r += "Expected getting failure.\n"
-                    }
-                }
-              }
-            /*
-            case "Exec":
-                if inBlock == 0 {
-
-                } else {
-                    r += fmt.Sprintf("Illegal instruction: Exec in a block.\n")
-                }
-            */
-            case "Sleep":
-                if inBlock == 0 {
-                    t, _ := strconv.Atoi(s[1])
-                    time.Sleep(time.Duration(t) * time.Millisecond)
-                    r += fmt.Sprintf("Slept for %v milliseconds.\n", t)
-                } else {
-                    r += "Illegal instruction: Sleep in a block.\n"
-                }
-            case "Block":
-                inBlock = 1
-                // tableBlock = make(map[string]int)
-                ch = make(chan int, 10000)
-                // ins = make(chan [4]string, 10000)
-                ent = make(chan string, 10000)
-                cnt = 0
-                // cins = 0
-                r += "Entering a block.\n"
-            case "Endblock":
-                r += fmt.Sprintf("Leaving a block of %v legal instructions.\n", cnt)
-                for i := 0; i < cnt; i++ {
-                    <-ch
-                }
-                for i := 0; i < cnt; i++ {
-                    k := <-ent
-                    res := "SOMETHINGYOUDONTUSEASAVALUE" // Well, you may safely use it as a value, whatever.
-                    succ := -1
-                    for j := 0; j < 3; j++ {
-                        if alive[j] == 1 {
-                            resp, err := http.Get(addr[j] + "/kv/get?key=" + k)
-                            if err != nil {
-                                r += fmt.Sprintf("An error occured.\n")
-                                // r += fmt.Sprintf("FATAL ERROR!!!\n")
-                                // fail = 1
-                            } else {
-                                t := DecodeJson(resp)
-                                r += fmt.Sprintf("%v\n", t)
-                                if t["success"] == "true" {
-                                    if succ == -1 {
-                                        r += fmt.Sprintf("Getting success.\n")
-                                        succ = 1
-                                        res = t["value"].(string)
-                                        table[k] = res
-                                    } else if succ == 0 {
-                                        r += fmt.Sprintf("Inconsistent getting success.\n")
-                                        r += fmt.Sprintf("FATAL ERROR!!!\n")
-                                        fail = 1
-                                    } else {
-                                        if t["value"].(string) == res {
-                                            r += fmt.Sprintf("Consistent value.\n")
-                                        } else {
-                                            r += fmt.Sprintf("Inconsistent values.\n")
-                                            r += fmt.Sprintf("FATAL ERROR!!!\n")
-                                            fail = 1
-                                        }
-                                    }
-                                } else {
-                                    if succ == -1 {
-                                        r += fmt.Sprintf("Getting failure.\n")
-                                        succ = 0
-                                    } else if succ == 0 {
-                                        r += fmt.Sprintf("Consistent getting failure.\n")
-                                    } else {
-                                        r += fmt.Sprintf("Inconsistent getting failure.\n")
-                                        r += fmt.Sprintf("FATAL ERROR!!!\n")
-                                        fail = 1
-                                    }
-                                }
-                            }
+                        if succ == -1 {
+                            *r += fmt.Sprintf("Getting failure.\n")
+                            succ = 0
+                        } else if succ == 0 {
+                            *r += fmt.Sprintf("Consistent getting failure.\n")
+                        } else {
+                            *r += fmt.Sprintf("Inconsistent getting failure.\n")
+                            *r += fmt.Sprintf("FATAL ERROR!!!\n")
+                            *fail = 1
                         }
                     }
-                    if _, ok := table[k]; succ == 0 && ok == true {
-                        delete(table, k)
-                    }
-                }
-                /*
-                for i := 0; i < cnt; i++ {
-                    if v := <-ch; v != 0 {
-                        r += "Something went wrong in the block.\n"+
-                             "FATAL ERROR!!!\n"
-                        fail = 1
-                    }
-                }
-                for i := 0; i < cins; i++ {
-                    s = <-ins
-                    switch s[0] {
-                        case "Insert", "Update":
-                            table[s[1]] = s[2]
-                        case "Remove":
-                            delete(table, s[1])
-                    }
                 }
-                */
-                inBlock = 0
-            case "Switch":
-                tmp, _ := strconv.Atoi(s[1])
-                srv_cur = tmp - 1
-                r += fmt.Sprintf("Switch to Server: %d\n", srv_cur)
-            case "start_server":
-              fmt.Println("start_server")
-                t, _ := strconv.Atoi(s[1])
-                if alive[t - 1] == 0 {
+            }
+        }
+        if _, ok := table[k]; succ == 0 && ok == true {
+            delete(table, k)
+        }
+    }
+    u.inBlock = 0
+    *r += checkHistory(u.hist, fail, &u.violated)
+}
 
-                    resp, err := http.Get(tester_addr[t-1] + "/test/start_server")
-                    if err != nil{
-                      fmt.Println(err)
-                      r += "Error occured.\n"
-                    }else{
-                      r += fmt.Sprintf("%s\n",DecodeStr(resp))
-                      time.Sleep(time.Millisecond*500)
-                      livingServer++
-                      alive[t - 1] = 1
-                    }
+// the RPC address of server i, which each server tells at /kvman/faults
+func (u *unitRun) node(i int) (string, error) {
+    if u.nodes[i] == "" {
+        node, _, err := u.clerks[i].Faults()
+        if err != nil {
+            return "", fmt.Errorf("the address of server %d is unknown: %v", i+1, err)
+        }
+        u.nodes[i] = node
+    }
+    return u.nodes[i], nil
+}
 
-                    //exec.Run(exec.Command("bin/start_server", fmt.Sprintf("%v", t)))
-                }
-            case "stop_server":
-              fmt.Println("stop_server")
-                t, _ := strconv.Atoi(s[1])
-                if alive[t - 1] == 1 {
-                  //time.Sleep(time.Millisecond*1500)
-                    resp, err := http.Get(tester_addr[t-1] + "/test/stop_server")
+// set the partition of server i, leaving its other faults
+func (u *unitRun) applyPartition(i int) error {
+    _, rep, err := u.clerks[i].Faults()
+    if err == nil {
+        rep.Faults.Partition = u.partition
+        err = u.clerks[i].SetFaults(rep.Faults)
+    }
+    return err
+}
 
-                    if err != nil{
-                      fmt.Println(err)
-                      r += "Error occured.\n"
-                    }else{
-                      r += fmt.Sprintf("%s\n",DecodeStr(resp))
-                      livingServer--
-                      alive[t - 1] = 0
-                    }
-                    //exec.Run(exec.Command("bin/stop_server", fmt.Sprintf("%v", t)))
-                }else{
-                  r += "Not started yet!\n"
+// Partition 1 / 2 3, or Heal, on every living server
+func (u *unitRun) setPartition(op string, a []string) error {
+    u.partition = nil
+    if op == "Partition" {
+        sets, _ := partitionSets(a)
+        for _, set := range sets {
+            var p []string
+            for _, arg := range set {
+                n, err := u.server(arg)
+                if err != nil {
+                    return err
+                }
+                node, err := u.node(n-1)
+                if err != nil {
+                    return err
                 }
-            default:
-                fmt.Println("For Debug: Unrecognised instruction.")
-                r += "Unrecognised instruction.\n"
+                p = append(p, node)
+            }
+            u.partition = append(u.partition, p)
+        }
+    }
+    for i := range u.addr {
+        if u.alive[i] == 0 {
+            continue
         }
+        if err := u.applyPartition(i); err != nil {
+            u.r += fmt.Sprintf("Server %d: error: %v\n", i+1, err)
+        }
+    }
+    if op == "Partition" {
+        u.r += fmt.Sprintf("Partitioned into %v.\n", a)
+    } else {
+        u.r += "Healed.\n"
     }
+    return nil
 }
@@ -0,0 +1,222 @@
+package kvlog
+
+//
+// Leveled, structured logging shared by paxos, kvpaxos and kvlib.
+// Every subsystem ("paxos", "kvpaxos", "http", "kvlib") has a level of its
+// own, which may be changed at runtime; a line carries the subsystem,
+// fields such as node and seq, and is written as key=value pairs or as
+// a JSON object.
+//
+// log := kvlog.New("paxos").With("node", me)
+// log.Debug("prepare sent", "seq", seq, "to", peer)
+//
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+type Level int
+
+const (
+  LevelDebug Level = iota
+  LevelInfo
+  LevelWarn
+  LevelError
+  LevelOff
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "off"}
+
+func (l Level) String() string {
+  if l < LevelDebug || l > LevelOff {
+    return strconv.Itoa(int(l))
+  }
+  return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+  for i, n := range levelNames {
+    if strings.EqualFold(s, n) {
+      return Level(i), nil
+    }
+  }
+  return LevelInfo, fmt.Errorf("unknown log level %q, want one of %s", s, strings.Join(levelNames, ", "))
+}
+
+const (
+  FormatText = "text" // ts=.. level=info sub=paxos msg="..." node=0
+  FormatJSON = "json"
+)
+
+var (
+  mu sync.Mutex
+  defaultLevel = LevelInfo
+  levels = map[string]Level{} // overrides of defaultLevel, by subsystem
+  format = FormatText
+  out io.Writer = os.Stderr
+)
+
+// the name of the default level, in SetLevel and Levels
+const Default = "*"
+
+// set the level of sub, or the default level if sub is "" or Default
+func SetLevel(sub string, l Level) {
+  mu.Lock()
+  defer mu.Unlock()
+  if sub == "" || sub == Default {
+    defaultLevel = l
+  } else {
+    levels[sub] = l
+  }
+}
+
+// the level of sub, which is the default level unless set apart
+func GetLevel(sub string) Level {
+  mu.Lock()
+  defer mu.Unlock()
+  if l, found := levels[sub]; found {
+    return l
+  }
+  return defaultLevel
+}
+
+// the default level under Default, and the subsystems set apart from it
+func Levels() map[string]string {
+  mu.Lock()
+  defer mu.Unlock()
+  r := map[string]string{Default: defaultLevel.String()}
+  for sub, l := range levels {
+    r[sub] = l.String()
+  }
+  return r
+}
+
+func GetFormat() string {
+  mu.Lock()
+  defer mu.Unlock()
+  return format
+}
+
+func SetFormat(f string) error {
+  if f != FormatText && f != FormatJSON {
+    return fmt.Errorf("unknown log format %q, want %s or %s", f, FormatText, FormatJSON)
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  format = f
+  return nil
+}
+
+func SetOutput(w io.Writer) {
+  mu.Lock()
+  defer mu.Unlock()
+  out = w
+}
+
+// "debug", or "paxos=debug,kvpaxos=warn" with an optional bare default
+func SetLevels(spec string) error {
+  for _, part := range strings.Split(spec, ",") {
+    part = strings.TrimSpace(part)
+    if part == "" {
+      continue
+    }
+    sub := ""
+    if i := strings.Index(part, "="); i >= 0 {
+      sub, part = part[:i], part[i+1:]
+    }
+    l, err := ParseLevel(part)
+    if err != nil {
+      return err
+    }
+    SetLevel(sub, l)
+  }
+  return nil
+}
+
+// apply log_level (as in SetLevels) and log_format of settings.conf
+func Configure(conf map[string]string) error {
+  if err := SetLevels(conf["log_level"]); err != nil {
+    return err
+  }
+  if conf["log_format"] != "" {
+    return SetFormat(conf["log_format"])
+  }
+  return nil
+}
+
+type Logger struct {
+  sub string
+  fields []interface{} // key, value, ...
+}
+
+func New(sub string) *Logger {
+  return &Logger{sub: sub}
+}
+
+// a logger adding the key-value pairs kv to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+  f := make([]interface{}, 0, len(l.fields)+len(kv))
+  f = append(f, l.fields...)
+  return &Logger{sub: l.sub, fields: append(f, kv...)}
+}
+
+// whether a line at level would be written; to skip preparing costly fields
+func (l *Logger) Enabled(level Level) bool {
+  return level >= GetLevel(l.sub) && level < LevelOff
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+  if !l.Enabled(level) {
+    return
+  }
+  fields := append(append([]interface{}{}, l.fields...), kv...)
+  if len(fields)%2 == 1 {
+    fields = append(fields, "(missing)")
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  ts := time.Now().Format(time.RFC3339Nano)
+  if format == FormatJSON {
+    line := map[string]interface{}{"ts": ts, "level": level.String(), "sub": l.sub, "msg": msg}
+    for i := 0; i < len(fields); i += 2 {
+      v := fields[i+1]
+      if e, ok := v.(error); ok {
+        v = e.Error()
+      }
+      line[fmt.Sprint(fields[i])] = v
+    }
+    enc, err := json.Marshal(line)
+    if err != nil {
+      enc, _ = json.Marshal(map[string]string{"ts": ts, "level": level.String(), "sub": l.sub, "msg": msg, "logerror": err.Error()})
+    }
+    fmt.Fprintf(out, "%s\n", enc)
+    return
+  }
+  var b strings.Builder
+  fmt.Fprintf(&b, "ts=%s level=%s sub=%s msg=%s", ts, level, l.sub, quote(msg))
+  for i := 0; i < len(fields); i += 2 {
+    fmt.Fprintf(&b, " %v=%s", fields[i], quote(fmt.Sprint(fields[i+1])))
+  }
+  fmt.Fprintln(out, b.String())
+}
+
+// s as is if it is a plain word, quoted otherwise
+func quote(s string) string {
+  if s == "" || strings.ContainsAny(s, " =\"\t\n\\") {
+    return strconv.Quote(s)
+  }
+  return s
+}
+
@@ -0,0 +1,78 @@
+package kvlog
+
+import "testing"
+import "strings"
+import "errors"
+import "encoding/json"
+import "os"
+import "reflect"
+import "fmt"
+
+func TestLevels(t *testing.T) {
+  defer func() {
+    mu.Lock()
+    defaultLevel, levels = LevelInfo, map[string]Level{}
+    mu.Unlock()
+  }()
+
+  fmt.Printf("Test: Levels of the subsystems ...\n")
+
+  if err := SetLevels("warn, paxos=debug,kvpaxos=ERROR"); err != nil {
+    t.Fatalf("SetLevels: %v", err)
+  }
+  want := map[string]string{Default: "warn", "paxos": "debug", "kvpaxos": "error"}
+  if l := Levels(); !reflect.DeepEqual(l, want) {
+    t.Fatalf("Levels() -> %v, expected %v", l, want)
+  }
+  if GetLevel("http") != LevelWarn || !New("paxos").Enabled(LevelDebug) || New("http").Enabled(LevelInfo) {
+    t.Fatalf("http at %v, paxos at %v", GetLevel("http"), GetLevel("paxos"))
+  }
+  for _, spec := range []string{"loud", "paxos=", "paxos=debug,kvpaxos=verbose"} {
+    if err := SetLevels(spec); err == nil || !strings.Contains(err.Error(), "unknown log level") {
+      t.Fatalf("SetLevels(%q) -> %v", spec, err)
+    }
+  }
+  SetLevel("paxos", LevelOff)
+  if New("paxos").Enabled(LevelError) || LevelOff.String() != "off" || Level(7).String() != "7" {
+    t.Fatalf("paxos is off, but writes errors")
+  }
+  if err := Configure(map[string]string{"log_level": "info", "log_format": "xml"}); err == nil {
+    t.Fatalf("log_format xml was accepted")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestFormats(t *testing.T) {
+  var b strings.Builder
+  SetOutput(&b)
+  defer SetOutput(os.Stderr)
+  defer SetFormat(FormatText)
+
+  fmt.Printf("Test: Lines as text and JSON ...\n")
+
+  log := New("kvlib").With("node", 2)
+  log.Info("a plain message", "key", "a b", "value", "", "seq")
+  log.Debug("not written")
+  line := b.String()
+  if i := strings.Index(line, " "); i < 0 || !strings.HasPrefix(line, "ts=") ||
+    line[i:] != " level=info sub=kvlib msg=\"a plain message\" node=2 key=\"a b\" value=\"\" seq=(missing)\n" {
+    t.Fatalf("text line %q", line)
+  }
+
+  b.Reset()
+  if err := SetFormat(FormatJSON); err != nil {
+    t.Fatalf("SetFormat: %v", err)
+  }
+  log.Warn("failed", "err", errors.New("no luck"), "seq", 3)
+  var l map[string]interface{}
+  if err := json.Unmarshal([]byte(b.String()), &l); err != nil {
+    t.Fatalf("not JSON: %q", b.String())
+  }
+  if l["level"] != "warn" || l["sub"] != "kvlib" || l["msg"] != "failed" || l["node"] != 2.0 ||
+    l["err"] != "no luck" || l["seq"] != 3.0 || l["ts"] == nil {
+    t.Fatalf("JSON line %q", b.String())
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -1,24 +1,25 @@
 package kvpaxos
 
 import (
-  "net/rpc"
   //"net/url"
   //"net/http"
-  "fmt"
   //"strconv"
   "math/rand"
   "time"
   //"kvlib"
+  "paxos"
+  "kvlog"
 )
 
+var clog = kvlog.New("kvpaxos")
+
 
 type Clerk struct {
   servers []string
   // You will have to modify this struct.
-  myID int
-  opCnt int
+  myID int64 // session
+  opCnt int // sequence number of the next op
 }
-var ck_cnt=10
 
 var Use_httpRequest = 0
 
@@ -30,9 +31,8 @@ func MakeClerk(servers []string) *Clerk {
   //time.Sleep(11)
   //rand.Seed( time.Now().UTC().UnixNano())
   //ck.myID = rand.Int()
-  ck.myID=ck_cnt
-  ck_cnt+=1
-  ck.opCnt=0
+  ck.myID=nrand()
+  ck.opCnt=1
     // fmt.Printf("Client %d created\n",ck.myID);
   return ck
 }
@@ -58,7 +58,7 @@ func call(srv string, rpcname string, args interface{}, reply interface{}) bool
     if RPC_Use_TCP==1 {
       nw = "tcp"
     }
-    c, errx := rpc.Dial(nw, srv)
+    c, errx := paxos.Dial(nw, srv) // over TLS, if the peers use it
 
 
   if errx != nil {
@@ -71,34 +71,10 @@ func call(srv string, rpcname string, args interface{}, reply interface{}) bool
     return true
   }
 
-  fmt.Println(err)
+  clog.Warn("call failed", "server", srv, "rpc", rpcname, "err", err)
   return false
 }
-// no need, implemented in kvlib/testunit.go
-/*
-func request(srv string, op int, args interface{}, reply interface{})bool{
-  pre := "http://"+srv
-  switch op {
-  case PutOp:
-      nargs,_ := args.(PutArgs)
-      resp,err := http.PostForm(pre + "/kv/insert", url.Values{"key": {nargs.Key},
-        "value": {nargs.Value}, "id":{strconv.Itoa(nargs.OpID)}})
-      if err==nil{
-        fmt.Println(err)
-        return false
-      }
-      res := kvlib.DecodeJson(resp)
-      nreply,_:=reply.(*PutReply)
-      nreply.PreviousValue,_ = res["value"].(string)
-      return true
-  case GetOp:
-  case UpdateOp:
-  case DeleteOp:
-  default:
-  }
-  return false
-}
-*/
+// the HTTP counterpart of this Clerk is in kvpaxos/httpclient
 
 //
 // fetch the current value for a key.
@@ -110,7 +86,7 @@ func (ck *Clerk) Get(key string) string {
   var args GetArgs
   var reply GetReply
   //args = GetArgs{Key:key, OpID:rand.Int(), ClientID:ck.myID}
-  args = GetArgs{Key:key, OpID:(ck.opCnt+ck.myID*10000)*1000+rand.Int()%1000, ClientID:ck.myID}
+  args = GetArgs{Key:key, OpID:ck.opCnt, ClientID:ck.myID}
   ck.opCnt+=1
   ok := false
   for !ok {
@@ -136,7 +112,7 @@ func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
   var args PutArgs
   var reply PutReply
   //args = PutArgs{Key:key, Value:value, DoHash:dohash, OpID:rand.Int(), ClientID:ck.myID}
-  args = PutArgs{Key:key, Value:value, DoHash:dohash, OpID:(ck.opCnt+ck.myID*10000)*1000+rand.Int()%1000, ClientID:ck.myID}
+  args = PutArgs{Key:key, Value:value, DoHash:dohash, OpID:ck.opCnt, ClientID:ck.myID}
   ck.opCnt+=1
   ok := false
   for !ok {
@@ -165,3 +141,43 @@ func (ck *Clerk) PutHash(key string, value string) string {
   v := ck.PutExt(key, value, true)
   return v
 }
+
+//
+// apply a transaction atomically.
+// returns the per-step results if every guard held,
+// or the error (e.g. a failed guard) otherwise.
+// keeps trying until it gets an answer.
+//
+func (ck *Clerk) Txn(txn Txn) (Err, []TxnResult) {
+  var args TxnArgs
+  var reply TxnReply
+  args = TxnArgs{Txn:txn, OpID:ck.opCnt, ClientID:ck.myID}
+  ck.opCnt+=1
+  ok := false
+  for !ok {
+    server := rand.Int() % len(ck.servers)
+    ok = call(ck.servers[server], "KVPaxos.Txn", args, &reply)
+    time.Sleep(time.Millisecond*5)
+  }
+  return reply.Err, reply.Results
+}
+
+//
+// wait for writes to key, or to keys starting with prefix, that are
+// decided at or after log index from (-1 for writes yet to come).
+// returns the writes in log order, or none once the server gave up
+// waiting, and reply.Next, from which to go on watching.
+// if the log before from is compacted, reply.Err says so, and
+// reply.Values holds the values of the watched keys as of reply.Next-1.
+//
+func (ck *Clerk) Watch(key string, prefix string, from int) WatchReply {
+  args := WatchArgs{Key:key, Prefix:prefix, From:from}
+  for {
+    var reply WatchReply
+    server := rand.Int() % len(ck.servers)
+    if call(ck.servers[server], "KVPaxos.Watch", args, &reply) {
+      return reply
+    }
+    time.Sleep(time.Millisecond*5)
+  }
+}
@@ -0,0 +1,243 @@
+package cluster
+
+//
+// A kvpaxos cluster in the process of its tests: n servers that talk over
+// unix sockets in a directory of their own and serve HTTP on ports the
+// system picks, with faults of their own (see faultnet), so that clusters
+// run side by side without the ports of settings.conf, bin/start_server
+// or the agents of the tester. A server keeps its port when it is
+// restarted.
+// The RPCs are over unix sockets, whatever kvpaxos.RPC_Use_TCP.
+//
+
+import (
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
+
+  "faultnet"
+  "kvlib"
+  "kvpaxos"
+  "kvpaxos/httpclient"
+)
+
+type Cluster struct {
+  mu sync.Mutex
+  dir string
+  settings map[string]string
+  net *faultnet.Network
+  peers []string // the RPC sockets
+  addrs []string // host:port of each server
+  urls []string
+  kva []*kvpaxos.KVPaxos // nil while down
+}
+
+// n servers, with the tokens, HTTP TLS, version retention and value size of
+// settings, which may be nil
+func Start(n int, settings map[string]string) (*Cluster,error) {
+  if n<1 {
+    return nil,errors.New("no server")
+  }
+  if settings==nil {
+    settings=map[string]string{}
+  }
+  dir,err:=ioutil.TempDir("", "kvcluster")
+  if err!=nil {
+    return nil,err
+  }
+  nw,_:=faultnet.New(faultnet.Faults{})
+  c:=&Cluster{dir:dir, settings:settings, net:nw, kva:make([]*kvpaxos.KVPaxos, n)}
+  for i:=0; i<n; i++ {
+    c.peers=append(c.peers, filepath.Join(dir, fmt.Sprintf("n%02d", i+1)))
+  }
+  for i:=0; i<n; i++ {
+    l,err:=net.Listen("tcp", "127.0.0.1:0")
+    if err!=nil {
+      c.Close()
+      return nil,err
+    }
+    c.addrs=append(c.addrs, l.Addr().String())
+    c.urls=append(c.urls, kvlib.HTTPScheme(settings)+"://"+l.Addr().String())
+    c.start(i, l)
+  }
+  return c,nil
+}
+
+func (c *Cluster) start(i int, l net.Listener) {
+  c.kva[i]=kvpaxos.StartServerWith(c.peers, i, kvpaxos.ServerOptions{Settings:c.settings, HTTP:l, Net:c.net})
+}
+
+func (c *Cluster) N() int {
+  return len(c.peers)
+}
+
+// the base URL of server i, from 0
+func (c *Cluster) URL(i int) string {
+  return c.urls[i]
+}
+
+func (c *Cluster) URLs() []string {
+  return append([]string(nil), c.urls...)
+}
+
+// the RPC address of server i, its name in the faults
+func (c *Cluster) Node(i int) string {
+  return c.peers[i]
+}
+
+// the faults of the RPCs of the cluster, none at first
+func (c *Cluster) Net() *faultnet.Network {
+  return c.net
+}
+
+// the server i, nil while down
+func (c *Cluster) Server(i int) *kvpaxos.KVPaxos {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.kva[i]
+}
+
+// a client of server i alone, with the tokens and TLS of the settings; a
+// Clerk is for one goroutine, so each call makes a new one
+func (c *Cluster) Clerk(i int) *httpclient.Clerk {
+  return c.clerk([]string{c.urls[i]})
+}
+
+// a client of every server, trying server i first
+func (c *Cluster) ClerkAll(i int) *httpclient.Clerk {
+  return c.clerk(append(append([]string(nil), c.urls[i:]...), c.urls[:i]...))
+}
+
+func (c *Cluster) clerk(urls []string) *httpclient.Clerk {
+  ck:=httpclient.MakeClerk(urls)
+  ck.Token=c.settings["kv_token"]
+  ck.AdminToken=c.settings["kvman_token"]
+  if cfg,err:=kvlib.HTTPClientTLS(c.settings); err==nil && cfg!=nil {
+    ck.SetTLS(cfg)
+  }
+  return ck
+}
+
+// kill server i, as by a signal; nothing if it is down
+func (c *Cluster) Kill(i int) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.kva[i]!=nil {
+    c.kva[i].Kill()
+    c.kva[i]=nil
+  }
+  return nil
+}
+
+// shut server i down through /kvman/shutdown, and wait until it is
+func (c *Cluster) Shutdown(i int) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  kv:=c.kva[i]
+  if kv==nil {
+    return nil
+  }
+  ck:=c.Clerk(i)
+  ck.Retries=1
+  if _,err:=ck.Shutdown(); err!=nil {
+    return err
+  }
+  select {
+    case <-kv.Death:
+    case <-time.After(5*time.Second):
+      return fmt.Errorf("server %d did not shut down", i+1)
+  }
+  c.kva[i]=nil
+  return nil
+}
+
+// start server i anew, on its port, with an empty state; a server that is
+// up is killed first
+func (c *Cluster) Restart(i int) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.kva[i]!=nil {
+    c.kva[i].Kill()
+    c.kva[i]=nil
+  }
+  //Kill releases the port before it returns
+  l,err:=net.Listen("tcp", c.addrs[i])
+  if err!=nil {
+    return err
+  }
+  c.start(i, l)
+  return nil
+}
+
+// cut the links between the sets of servers, from 0; nil heals
+func (c *Cluster) Partition(sets [][]int) error {
+  if sets==nil {
+    c.net.Heal()
+    return nil
+  }
+  var p [][]string
+  for _,set:=range sets {
+    var s []string
+    for _,i:=range set {
+      if i<0 || i>=len(c.peers) {
+        return fmt.Errorf("no server %d", i+1)
+      }
+      s=append(s, c.peers[i])
+    }
+    p=append(p, s)
+  }
+  c.net.Partition(p...)
+  return nil
+}
+
+func (c *Cluster) Heal() {
+  c.net.Heal()
+}
+
+// for RunScript, the start_server of a script
+func (c *Cluster) StartServer(i int) (string,error) {
+  if err:=c.Restart(i); err!=nil {
+    return "",err
+  }
+  return fmt.Sprintf("Start Server %d: %s", i+1, c.addrs[i]),nil
+}
+
+// for RunScript, the stop_server, kill_server or shutdown_server of a
+// script; a shutdown goes through /kvman/shutdown
+func (c *Cluster) StopServer(i int, op string) (string,error) {
+  if op=="shutdown_server" {
+    if err:=c.Shutdown(i); err!=nil {
+      return "",err
+    }
+    return fmt.Sprintf("Shutdown Server %d Success!", i+1),nil
+  }
+  c.Kill(i)
+  return fmt.Sprintf("Kill Server %d Success!", i+1),nil
+}
+
+// run a test script of the tester (test/*.test) against the cluster, all
+// its servers up and connected at first; as kvlib.RunScript
+func (c *Cluster) RunScript(fn string) (string,int) {
+  for i:=range c.peers {
+    if c.Server(i)==nil {
+      if err:=c.Restart(i); err!=nil {
+        return fmt.Sprintf("Cannot start server %d: %v\nFATAL ERROR!!!\n", i+1, err),1
+      }
+    }
+  }
+  c.net.Set(faultnet.Faults{})
+  return kvlib.RunScript(c.URLs(), c, fn, true)
+}
+
+// kill every server and remove the sockets
+func (c *Cluster) Close() {
+  for i:=range c.kva {
+    c.Kill(i)
+  }
+  os.RemoveAll(c.dir)
+}
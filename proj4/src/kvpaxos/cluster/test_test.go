@@ -0,0 +1,93 @@
+package cluster
+
+import "testing"
+import "fmt"
+import "errors"
+import "path/filepath"
+import "strings"
+import "time"
+
+import "kvpaxos/httpclient"
+
+func TestCluster(t *testing.T) {
+  t.Parallel()
+  c, err := Start(3, nil)
+  if err != nil {
+    t.Fatalf("Start: %v", err)
+  }
+  defer c.Close()
+
+  fmt.Printf("Test: In-process cluster on ports of its own ...\n")
+
+  if err := c.Clerk(0).Insert("a", "1"); err != nil {
+    t.Fatalf("Insert through server 1: %v", err)
+  }
+  if v, _, err := c.Clerk(2).Get("a"); err != nil || v != "1" {
+    t.Fatalf("Get through server 3 -> %q, %v", v, err)
+  }
+  if node, _, err := c.Clerk(1).Faults(); err != nil || node != c.Node(1) {
+    t.Fatalf("server 2 is %q, %v, expected %q", node, err, c.Node(1))
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Partition, kill and restart ...\n")
+
+  c.Partition([][]int{{0}, {1, 2}})
+  ck := c.Clerk(0)
+  ck.Retries = 1
+  ck.SetTimeout(time.Second)
+  if _, err := ck.Update("a", "2"); err == nil {
+    t.Fatalf("Update through the minority succeeded")
+  }
+  if _, err := c.Clerk(1).Update("a", "3"); err != nil {
+    t.Fatalf("Update through the majority: %v", err)
+  }
+  c.Heal()
+
+  url := c.URL(2)
+  c.Kill(2)
+  ck = c.Clerk(2)
+  ck.Retries = 1
+  ck.SetTimeout(time.Second)
+  if _, _, err := ck.Get("a"); !errors.Is(err, httpclient.ErrUnavailable) {
+    t.Fatalf("Get through a dead server -> %v", err)
+  }
+  if err := c.Restart(2); err != nil {
+    t.Fatalf("Restart: %v", err)
+  }
+  if c.URL(2) != url || c.Server(2) == nil {
+    t.Fatalf("server 3 came back at %s, not %s", c.URL(2), url)
+  }
+  if v, _, err := c.Clerk(2).Get("a"); err != nil || (v != "2" && v != "3") {
+    t.Fatalf("Get through the restarted server -> %q, %v", v, err)
+  }
+  if err := c.Shutdown(1); err != nil || c.Server(1) != nil {
+    t.Fatalf("Shutdown: %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// the scripts of the tester, each against a cluster of its own
+func TestScripts(t *testing.T) {
+  scripts, err := filepath.Glob("../../../test/*.test")
+  if err != nil || len(scripts) == 0 {
+    t.Fatalf("no script in ../../../test: %v", err)
+  }
+  for _, fn := range scripts {
+    fn := fn
+    t.Run(filepath.Base(fn), func(t *testing.T) {
+      t.Parallel()
+      c, err := Start(3, nil)
+      if err != nil {
+        t.Fatalf("Start: %v", err)
+      }
+      defer c.Close()
+      r, fail := c.RunScript(fn)
+      if fail != 0 || !strings.Contains(r, "History linearizable") {
+        t.Fatalf("%s failed:\n%s", fn, r)
+      }
+    })
+  }
+}
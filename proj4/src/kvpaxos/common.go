@@ -3,10 +3,15 @@ package kvpaxos
 import (
   "hash/fnv"
   "strconv"
+  "crypto/rand"
+  "math/big"
 )
 const (
   OK = "OK"
   ErrNoKey = "ErrNoKey"
+  ErrShutdown = "Server: shutting down?"
+  ErrNoAgreement = "Server: no agreement reached in time?"
+  ErrNoVersions = "Get: old versions are not kept, version_retention is 0"
 )
 type Err string
 
@@ -19,7 +24,8 @@ type PutArgs struct {
   // Field names must start with capital letters,
   // otherwise RPC will break.
   OpID int
-  ClientID int
+  ClientID int64
+  TTL int64 // milliseconds until the key expires; 0 means never
 }
 
 type PutReply struct {
@@ -31,12 +37,90 @@ type GetArgs struct {
   Key string
   // You'll have to add definitions here.
   OpID int
-  ClientID int
+  ClientID int64
 }
 
 type GetReply struct {
   Err Err
   Value string
+  Version int // log index of the write that produced Value
+}
+
+// a transaction is applied atomically as one log entry: if every guard
+// holds, all steps are executed in order; otherwise, or if a step other
+// than a get fails, nothing is written.
+type Txn struct {
+  Guards []TxnGuard `json:"if"`
+  Steps []TxnStep `json:"then"`
+}
+
+type TxnGuard struct {
+  Key string `json:"key"`
+  Value string `json:"value"`
+  Absent bool `json:"absent,omitempty"` // the key must not exist, instead of holding Value
+}
+
+type TxnStep struct {
+  Op string `json:"op"` // get, insert (or put), update, delete, cas
+  Key string `json:"key"`
+  Value string `json:"value,omitempty"`
+  Expected string `json:"expected,omitempty"` // for cas
+  Absent bool `json:"absent,omitempty"` // for cas, instead of Expected: the key must not exist
+}
+
+type TxnResult struct {
+  Success bool `json:"success"`
+  Value string `json:"value"`
+  Err Err `json:"error,omitempty"`
+}
+
+type TxnArgs struct {
+  Txn Txn
+  OpID int
+  ClientID int64
+}
+
+type TxnReply struct {
+  Err Err
+  Results []TxnResult // one for each step, if the guards held
+}
+
+// a successful write, as reported by Watch
+type WatchEvent struct {
+  Index int `json:"index"` // position in the paxos log
+  Op string `json:"op"`
+  Key string `json:"key"`
+  Value string `json:"value"` // "" if the key was deleted
+}
+
+type WatchArgs struct {
+  Key string
+  Prefix string
+  From int // -1 to watch only changes that come after the call
+}
+
+type WatchReply struct {
+  Err Err
+  Events []WatchEvent
+  Next int // From of the next call, to continue watching
+  // set, if only empty, when the log before From is compacted: the values
+  // of the watched keys as of Next-1, to watch on from Next
+  Values map[string]string
+}
+
+// random 62-bit id for a client session; unlikely to collide
+// even among clients of different processes
+func nrand() int64 {
+  max := big.NewInt(int64(1) << 62)
+  bigx, _ := rand.Int(rand.Reader, max)
+  x := bigx.Int64()
+  return x
+}
+
+// one-off session of a request with the legacy id field; below 0,
+// where nrand gives none
+func legacySession(id int64) int64 {
+  return -1 - id
 }
 
 func hash(s string) uint32 {
@@ -0,0 +1,613 @@
+package httpclient
+
+//
+// JSON-over-HTTP client of the kvpaxos service, mirroring kvpaxos.Clerk.
+// Every operation carries the session of the Clerk and a sequence number,
+// so it can be retried (on the same or another server) without being
+// executed twice.
+//
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/tls"
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+
+  "faultnet"
+  "kvlib"
+)
+
+// those of kvlib, which tells them apart in the histories of its clients
+var (
+  ErrNotFound = kvlib.ErrNotFound
+  ErrExists = kvlib.ErrExists
+  ErrMismatch = kvlib.ErrMismatch
+  ErrUnavailable = kvlib.ErrUnavailable // wrapped, test with errors.Is
+)
+
+// the clients of the scripts, chaos runs and benchmarks of kvlib
+func init() {
+  kvlib.NewClient=func(urls []string, o kvlib.ClientOptions) kvlib.Client {
+    ck:=MakeClerk(urls)
+    ck.Token=o.Token
+    if o.TLS!=nil {
+      ck.SetTLS(o.TLS)
+    }
+    if o.Timeout>0 {
+      ck.SetTimeout(o.Timeout)
+    }
+    if o.Retries>0 {
+      ck.Retries=o.Retries
+    }
+    return ck
+  }
+}
+
+// an error reported by the server that has no typed counterpart
+type ServerError struct {
+  Status int
+  Code string // machine-readable, e.g. stale_request
+  Message string
+}
+
+func (e *ServerError) Error() string {
+  return fmt.Sprintf("kvpaxos: %s (%d %s)",e.Message,e.Status,e.Code)
+}
+
+// error codes of the /v1 API
+var codeErrs = map[string]error{
+  "not_found": ErrNotFound,
+  "key_exists": ErrExists,
+  "value_mismatch": ErrMismatch,
+}
+
+type errorBody struct {
+  Error struct {
+    Code string `json:"code"`
+    Message string `json:"message"`
+  } `json:"error"`
+}
+
+func parseErr(status int, body []byte) error {
+  var eb errorBody
+  if json.Unmarshal(body,&eb)!=nil || eb.Error.Code=="" {
+    //not from the /v1 API, e.g. a 401 of /kvman/*
+    return &ServerError{status,"",string(body)}
+  }
+  if e,found:=codeErrs[eb.Error.Code]; found {
+    return e
+  }
+  return &ServerError{status,eb.Error.Code,eb.Error.Message}
+}
+
+// A Clerk is not safe for concurrent use, since the ops of a session
+// must be sequential; use one Clerk per goroutine.
+type Clerk struct {
+  servers []string // base URLs, e.g. http://127.0.0.1:30101
+  cur int // the server tried first
+  session string // "" until obtained from a server
+  seq int // sequence number of the latest op
+
+  Retries int // rounds over all servers before giving up
+  Backoff time.Duration // pause between rounds
+  Token string // bearer token of /kv/* and /v1/keys/*, if the servers want one
+  AdminToken string // bearer token of /kvman/*
+  client *http.Client
+}
+
+func MakeClerk(servers []string) *Clerk {
+  ck:=new(Clerk)
+  ck.servers=servers
+  ck.Retries=3
+  ck.Backoff=100*time.Millisecond
+  ck.client=&http.Client{Timeout:30*time.Second} // above the watch timeout of the server
+  return ck
+}
+
+// a client of the servers at urls, with the tokens and the HTTP TLS of the
+// settings cfg
+func MakeClerkFromConfig(cfg *kvlib.Config, urls ...string) (*Clerk,error) {
+  ck:=MakeClerk(urls)
+  ck.Token=cfg.KVToken
+  ck.AdminToken=cfg.KVManToken
+  tlsCfg,err:=kvlib.HTTPClientTLS(cfg.Settings())
+  if err!=nil {
+    return nil,err
+  }
+  if tlsCfg!=nil {
+    ck.SetTLS(tlsCfg)
+  }
+  return ck,nil
+}
+
+func (ck *Clerk) SetTimeout(d time.Duration) {
+  ck.client.Timeout=d
+}
+
+// talk HTTPS with cfg, e.g. to trust the CA of the servers; the base URLs
+// should then start with https://
+func (ck *Clerk) SetTLS(cfg *tls.Config) {
+  ck.client.Transport=&http.Transport{TLSClientConfig:cfg}
+}
+
+// the server the next request goes to first
+func (ck *Clerk) Server() string {
+  return ck.servers[ck.cur]
+}
+
+// send the request to the current server, rotating to the next one whenever
+// a server cannot be reached or cannot reach agreement (503); the decoded
+// JSON reply is left in reply
+func (ck *Clerk) do(method string, path string, query url.Values, body []byte, reply interface{}) error {
+  return ck.doType(method,path,query,body,"application/json",reply)
+}
+
+func (ck *Clerk) doType(method string, path string, query url.Values, body []byte, ctype string, reply interface{}) error {
+  var last error=ErrUnavailable
+  for round:=0;round<ck.Retries;round++ {
+    if round>0 {
+      time.Sleep(ck.Backoff)
+    }
+    for n:=0;n<len(ck.servers);n++ {
+      status,data,err:=ck.request(ck.servers[ck.cur],method,path,query,body,ctype)
+      switch {
+        case err!=nil:
+          last=err
+        case status==http.StatusServiceUnavailable:
+          last=parseErr(status,data)
+        case status>=300:
+          return parseErr(status,data)
+        default:
+          if err:=json.Unmarshal(data,reply); err!=nil {
+            return &ServerError{status,"",fmt.Sprintf("malformed reply: %v",err)}
+          }
+          return nil
+      }
+      ck.cur=(ck.cur+1)%len(ck.servers)
+    }
+  }
+  return fmt.Errorf("%w: %v",ErrUnavailable,last)
+}
+
+func (ck *Clerk) request(server string, method string, path string, query url.Values, body []byte, ctype string) (int,[]byte,error) {
+  req,err:=ck.newRequest(server,method,path,query,body,ctype)
+  if err!=nil {
+    return 0,nil,err
+  }
+  resp,err:=ck.client.Do(req)
+  if err!=nil {
+    return 0,nil,err
+  }
+  data,err:=ioutil.ReadAll(resp.Body)
+  resp.Body.Close()
+  return resp.StatusCode,data,err
+}
+
+func (ck *Clerk) newRequest(server string, method string, path string, query url.Values, body []byte, ctype string) (*http.Request,error) {
+  u:=server+path
+  if len(query)>0 {
+    u+="?"+query.Encode()
+  }
+  var rd io.Reader
+  if body!=nil {
+    rd=bytes.NewReader(body)
+  }
+  req,err:=http.NewRequest(method,u,rd)
+  if err!=nil {
+    return nil,err
+  }
+  if body!=nil {
+    req.Header.Set("Content-Type",ctype)
+  }
+  token:=ck.Token
+  if strings.HasPrefix(path,"/kvman/") {
+    token=ck.AdminToken
+  }
+  if token!="" {
+    req.Header.Set("Authorization","Bearer "+token)
+  }
+  return req,nil
+}
+
+// query arguments of the next op in the session
+func (ck *Clerk) next() (url.Values,error) {
+  if ck.session=="" {
+    var r struct {
+      Session string `json:"session"`
+    }
+    if err:=ck.do("GET","/kv/session",nil,nil,&r); err!=nil {
+      return nil,err
+    }
+    ck.session=r.Session
+  }
+  ck.seq++
+  return url.Values{"session":{ck.session},"seq":{strconv.Itoa(ck.seq)}},nil
+}
+
+type keyReply struct {
+  Value string `json:"value"`
+  Previous string `json:"previous"`
+  Version int `json:"version"`
+  Encoding string `json:"encoding"`
+}
+
+// a write on /v1/keys/key; the value travels as the raw body,
+// so it may hold any bytes
+type keyWrite struct {
+  Value string
+  Expected *string
+  Absent bool
+}
+
+// an op on /v1/keys/key; a nil w sends no body
+func (ck *Clerk) op(method string, key string, w *keyWrite) (keyReply,error) {
+  var r keyReply
+  query,err:=ck.next()
+  if err!=nil {
+    return r,err
+  }
+  var body []byte
+  if w!=nil {
+    body=[]byte(w.Value)
+    if w.Expected!=nil {
+      query.Set("expected",*w.Expected)
+    }
+    if w.Absent {
+      query.Set("absent","true")
+    }
+  }
+  err=ck.doType(method,"/v1/keys/"+url.PathEscape(key),query,body,"application/octet-stream",&r)
+  if err==nil && r.Encoding=="base64" {
+    for _,p:=range []*string{&r.Value,&r.Previous} {
+      dec,derr:=base64.StdEncoding.DecodeString(*p)
+      if derr!=nil {
+        return r,&ServerError{200,"",fmt.Sprintf("malformed base64 in reply: %v",derr)}
+      }
+      *p=string(dec)
+    }
+  }
+  return r,err
+}
+
+// the value of key, and the log index of the write that produced it
+func (ck *Clerk) Get(key string) (string,int,error) {
+  r,err:=ck.op("GET",key,nil)
+  if err!=nil {
+    return "",-1,err
+  }
+  return r.Value,r.Version,nil
+}
+
+// insert a new key
+func (ck *Clerk) Insert(key string, value string) error {
+  _,err:=ck.op("POST",key,&keyWrite{Value:value})
+  return err
+}
+
+// write key, whether it exists or not; returns the old value
+func (ck *Clerk) Put(key string, value string) (string,error) {
+  r,err:=ck.op("PUT",key,&keyWrite{Value:value})
+  return r.Previous,err
+}
+
+// update an existing key; returns the old value
+func (ck *Clerk) Update(key string, value string) (string,error) {
+  r,err:=ck.op("PATCH",key,&keyWrite{Value:value})
+  return r.Previous,err
+}
+
+// replace the value of key if it is expected
+func (ck *Clerk) Cas(key string, expected string, value string) error {
+  _,err:=ck.op("PATCH",key,&keyWrite{Value:value,Expected:&expected})
+  return err
+}
+
+// write key if it does not exist; unlike Insert, it can be part of a
+// sequence of compare-and-swaps
+func (ck *Clerk) CasAbsent(key string, value string) error {
+  _,err:=ck.op("PATCH",key,&keyWrite{Value:value,Absent:true})
+  return err
+}
+
+// delete an existing key; returns the old value
+func (ck *Clerk) Delete(key string) (string,error) {
+  r,err:=ck.op("DELETE",key,nil)
+  return r.Previous,err
+}
+
+// the number of existing keys
+func (ck *Clerk) CountKey() (int,error) {
+  var r struct {
+    Result int `json:"result"`
+  }
+  if err:=ck.do("GET","/kvman/countkey",nil,nil,&r); err!=nil {
+    return 0,err
+  }
+  return r.Result,nil
+}
+
+// all existing key-value pairs
+func (ck *Clerk) Dump() (map[string]string,error) {
+  var r map[string][]byte // sent in base64
+  if err:=ck.do("GET","/kvman/dump",url.Values{"encoding":{"base64"}},nil,&r); err!=nil {
+    return nil,err
+  }
+  d:=make(map[string]string,len(r))
+  for k,v:=range r {
+    d[k]=string(v)
+  }
+  return d,nil
+}
+
+type Pair struct {
+  Key string
+  Value string
+}
+
+// at most limit key-value pairs in key order, starting after the key
+// after (0 and "" for all of them), and the after of the next page, or ""
+// if there is none; the page is read as it streams in
+func (ck *Clerk) DumpPage(after string, limit int) ([]Pair,string,error) {
+  query:=url.Values{"format":{"jsonl"},"encoding":{"base64"}}
+  if after!="" {
+    query.Set("after",after)
+  }
+  if limit>0 {
+    query.Set("limit",strconv.Itoa(limit))
+  }
+  var last error=ErrUnavailable
+  for n:=0;n<len(ck.servers);n++ {
+    pairs,next,err:=ck.dumpPage(ck.servers[ck.cur],query)
+    if err==nil {
+      return pairs,next,nil
+    }
+    if _,ok:=err.(*ServerError); ok {
+      return nil,"",err
+    }
+    last=err
+    ck.cur=(ck.cur+1)%len(ck.servers)
+  }
+  return nil,"",fmt.Errorf("%w: %v",ErrUnavailable,last)
+}
+
+func (ck *Clerk) dumpPage(server string, query url.Values) ([]Pair,string,error) {
+  req,err:=ck.newRequest(server,"GET","/kvman/dump",query,nil,"")
+  if err!=nil {
+    return nil,"",err
+  }
+  resp,err:=ck.client.Do(req)
+  if err!=nil {
+    return nil,"",err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode>=300 || resp.Header.Get("Content-Type")!="application/x-ndjson" {
+    body,_:=ioutil.ReadAll(resp.Body)
+    return nil,"",parseErr(resp.StatusCode,body)
+  }
+  var pairs []Pair
+  dec:=json.NewDecoder(resp.Body)
+  for {
+    var line struct {
+      Key string `json:"key"`
+      Value []byte `json:"value"` // sent in base64
+    }
+    if err:=dec.Decode(&line); err==io.EOF {
+      break
+    }else if err!=nil {
+      return nil,"",err
+    }
+    pairs=append(pairs,Pair{line.Key,string(line.Value)})
+  }
+  return pairs,resp.Header.Get("X-Next-After"),nil
+}
+
+// copy a snapshot file of the database from the current server to w;
+// returns the log index the snapshot was taken at. The file is not
+// verified here, see kvlib.ReadSnapshot.
+func (ck *Clerk) Snapshot(w io.Writer) (int,error) {
+  req,err:=ck.newRequest(ck.Server(),"GET","/kvman/snapshot",nil,nil,"")
+  if err!=nil {
+    return -1,err
+  }
+  resp,err:=ck.client.Do(req)
+  if err!=nil {
+    return -1,err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode>=300 || resp.Header.Get("Content-Type")!="application/x-ndjson" {
+    body,_:=ioutil.ReadAll(resp.Body)
+    return -1,parseErr(resp.StatusCode,body)
+  }
+  var h struct {
+    Index int `json:"index"`
+  }
+  br:=bufio.NewReader(resp.Body)
+  header,err:=br.ReadBytes('\n')
+  if err!=nil || json.Unmarshal(header,&h)!=nil {
+    return -1,&ServerError{resp.StatusCode,"",fmt.Sprintf("malformed snapshot header: %q",header)}
+  }
+  if _,err:=w.Write(header); err!=nil {
+    return -1,err
+  }
+  _,err=io.Copy(w,br)
+  return h.Index,err
+}
+
+// replace the database by the snapshot file read from r, through the
+// current server; returns the log index of the restore and the number of
+// keys restored
+func (ck *Clerk) Restore(r io.Reader) (int,int,error) {
+  query,err:=ck.next()
+  if err!=nil {
+    return -1,0,err
+  }
+  req,err:=ck.newRequest(ck.Server(),"POST","/kvman/restore",query,nil,"")
+  if err!=nil {
+    return -1,0,err
+  }
+  req.Body=ioutil.NopCloser(r) // streamed, chunked
+  req.Header.Set("Content-Type","application/x-ndjson")
+  resp,err:=ck.client.Do(req)
+  if err!=nil {
+    return -1,0,err
+  }
+  body,err:=ioutil.ReadAll(resp.Body)
+  resp.Body.Close()
+  if err!=nil {
+    return -1,0,err
+  }
+  var reply struct {
+    Success string `json:"success"`
+    Message string `json:"message"`
+    Index int `json:"index"`
+    Keys int `json:"keys"`
+  }
+  if json.Unmarshal(body,&reply)!=nil || reply.Success!="true" {
+    return -1,0,&ServerError{resp.StatusCode,"",string(body)}
+  }
+  return reply.Index,reply.Keys,nil
+}
+
+// shut down the current server, which is not rotated away from;
+// returns the reply as it is
+func (ck *Clerk) Shutdown() (string,error) {
+  status,body,err:=ck.request(ck.Server(),"GET","/kvman/shutdown",nil,nil,"")
+  if err==nil && status>=300 {
+    err=parseErr(status,body)
+  }
+  return string(body),err
+}
+
+type faultsReply struct {
+  Success string `json:"success"`
+  Message string `json:"message"`
+  Node string `json:"node"`
+  Faults faultnet.Faults `json:"faults"`
+  Stats map[string]faultnet.Stats `json:"stats"`
+}
+
+// a request of /kvman/* to the current server, which is not rotated away
+// from; reply is left in r, whose success and message are in the reply
+func (ck *Clerk) kvman(method string, path string, query url.Values, body []byte, r interface{}, success *string, message *string) error {
+  status,data,err:=ck.request(ck.Server(),method,path,query,body,"application/json")
+  if err==nil && status>=300 {
+    err=parseErr(status,data)
+  }
+  if err==nil {
+    if jerr:=json.Unmarshal(data,r); jerr!=nil {
+      err=&ServerError{status,"",fmt.Sprintf("malformed reply: %v",jerr)}
+    }else if *success!="true" {
+      err=&ServerError{status,"",*message}
+    }
+  }
+  return err
+}
+
+func (ck *Clerk) faults(method string, body []byte) (string,faultnet.Report,error) {
+  var r faultsReply
+  if err:=ck.kvman(method,"/kvman/faults",nil,body,&r,&r.Success,&r.Message); err!=nil {
+    return "",faultnet.Report{},err
+  }
+  return r.Node,faultnet.Report{Faults:r.Faults,Stats:r.Stats},nil
+}
+
+// the faults injected into the RPCs of the current server, which is not
+// rotated away from: the address it dials from, its faults, and what
+// happened on each link
+func (ck *Clerk) Faults() (string,faultnet.Report,error) {
+  return ck.faults("GET",nil)
+}
+
+// replace the faults of the current server
+func (ck *Clerk) SetFaults(f faultnet.Faults) error {
+  body,err:=json.Marshal(&f)
+  if err!=nil {
+    return err
+  }
+  _,_,err=ck.faults("POST",body)
+  return err
+}
+
+// where the current server is in the log, as of /kvman/status
+type Status struct {
+  Node int `json:"node"` // from 0
+  Peers int `json:"peers"`
+  Max int `json:"max"` // the highest paxos instance it knows of
+  Min int `json:"min"` // the instances below are forgotten
+  Touched int `json:"touched"` // the last instance applied
+  Snapstart int `json:"snapstart"` // the first instance not in the snapshot
+  UptimeS float64 `json:"uptime_s"`
+}
+
+// the status of the current server, which is not rotated away from
+func (ck *Clerk) Status() (Status,error) {
+  var r struct {
+    Success string `json:"success"`
+    Message string `json:"message"`
+    Status
+  }
+  err:=ck.kvman("GET","/kvman/status",nil,nil,&r,&r.Success,&r.Message)
+  return r.Status,err
+}
+
+// a paxos instance, as of /kvman/log
+type LogEntry struct {
+  Seq int `json:"seq"`
+  State string `json:"state"` // decided, undecided or forgotten
+  Op string `json:"op,omitempty"`
+  Key string `json:"key,omitempty"`
+  Value string `json:"value,omitempty"` // cut to its first bytes, see Size
+  Size int `json:"size,omitempty"` // of the value
+  Session int64 `json:"session,omitempty"`
+  OpID int `json:"opid,omitempty"`
+  Timestamp int64 `json:"timestamp,omitempty"` // unix ns, of the proposer
+}
+
+type Log struct {
+  Min int `json:"min"`
+  Max int `json:"max"`
+  Touched int `json:"touched"`
+  Snapstart int `json:"snapstart"`
+  Entries []LogEntry `json:"entries"`
+}
+
+// the instances from to to of the log of the current server, which is not
+// rotated away from; -1 for the last ones the server sends at most
+func (ck *Clerk) Log(from int, to int) (Log,error) {
+  query:=url.Values{}
+  if from>=0 {
+    query.Set("from",strconv.Itoa(from))
+  }
+  if to>=0 {
+    query.Set("to",strconv.Itoa(to))
+  }
+  var r struct {
+    Success string `json:"success"`
+    Message string `json:"message"`
+    Log
+  }
+  err:=ck.kvman("GET","/kvman/log",query,nil,&r,&r.Success,&r.Message)
+  return r.Log,err
+}
+
+// fold the log the current server applied into its snapshot now; returns
+// its first instance not in the snapshot, before and after
+func (ck *Clerk) Compact() (int,int,error) {
+  var r struct {
+    Success string `json:"success"`
+    Message string `json:"message"`
+    From int `json:"from"`
+    To int `json:"to"`
+  }
+  err:=ck.kvman("POST","/kvman/compact",nil,nil,&r,&r.Success,&r.Message)
+  return r.From,r.To,err
+}
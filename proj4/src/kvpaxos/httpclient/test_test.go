@@ -0,0 +1,92 @@
+package httpclient
+
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "errors"
+import "time"
+import "sync"
+import "fmt"
+
+func TestErrors(t *testing.T) {
+  fmt.Printf("Test: Error replies of the servers ...\n")
+
+  for _, e := range []struct {
+    status int
+    body string
+    want error
+  }{
+    {404, `{"error":{"code":"not_found","message":"no key a"}}`, ErrNotFound},
+    {409, `{"error":{"code":"key_exists","message":"a exists"}}`, ErrExists},
+    {409, `{"error":{"code":"value_mismatch","message":"a is 1"}}`, ErrMismatch},
+    {409, `{"error":{"code":"stale_request","message":"seq 1"}}`, &ServerError{409, "stale_request", "seq 1"}},
+    {401, "unauthorized\n", &ServerError{401, "", "unauthorized\n"}},
+  } {
+    err := parseErr(e.status, []byte(e.body))
+    if se, ok := e.want.(*ServerError); ok {
+      if got, ok := err.(*ServerError); !ok || *got != *se {
+        t.Fatalf("parseErr(%d, %s) -> %v, expected %v", e.status, e.body, err, e.want)
+      }
+    } else if err != e.want {
+      t.Fatalf("parseErr(%d, %s) -> %v, expected %v", e.status, e.body, err, e.want)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestRotation(t *testing.T) {
+  fmt.Printf("Test: HTTP client rotates away from unavailable servers ...\n")
+
+  // the second server cannot reach agreement, the third answers
+  var mu sync.Mutex
+  var got []string
+  log := func(s string) {
+    mu.Lock()
+    defer mu.Unlock()
+    got = append(got, s)
+  }
+  busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    log("busy " + r.URL.Path)
+    w.WriteHeader(http.StatusServiceUnavailable)
+    fmt.Fprintf(w, `{"error":{"code":"no_agreement","message":"no agreement"}}`)
+  }))
+  defer busy.Close()
+  good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    log("good " + r.URL.Path + " " + r.URL.RawQuery + " " + r.Header.Get("Authorization"))
+    switch r.URL.Path {
+      case "/kv/session":
+        fmt.Fprintf(w, `{"session":"s1"}`)
+      case "/v1/keys/a":
+        fmt.Fprintf(w, `{"value":"AAE=","version":4,"encoding":"base64"}`)
+    }
+  }))
+  defer good.Close()
+
+  ck := MakeClerk([]string{"http://127.0.0.1:1", busy.URL, good.URL})
+  ck.Token = "t"
+  v, ver, err := ck.Get("a")
+  if err != nil || v != "\x00\x01" || ver != 4 || ck.Server() != good.URL {
+    t.Fatalf("Get(a) -> %q version %v, %v from %v", v, ver, err, ck.Server())
+  }
+  want := []string{"busy /kv/session", "good /kv/session  Bearer t", "good /v1/keys/a seq=1&session=s1 Bearer t"}
+  if fmt.Sprint(got) != fmt.Sprint(want) {
+    t.Fatalf("requests %q, expected %q", got, want)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: HTTP client gives up when no server is up ...\n")
+
+  down := MakeClerk([]string{"http://127.0.0.1:1", busy.URL})
+  down.Backoff = time.Millisecond
+  got = nil
+  if _, _, err := down.Get("b"); !errors.Is(err, ErrUnavailable) {
+    t.Fatalf("Get(b) from servers that are down -> %v, expected %v", err, ErrUnavailable)
+  }
+  if len(got) != down.Retries {
+    t.Fatalf("%d requests to the busy server in %d rounds", len(got), down.Retries)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,181 @@
+package kvpaxos
+
+import (
+  "net/http"
+  "sync"
+  "sort"
+  "strconv"
+  "time"
+  "fmt"
+  "io"
+  )
+
+//the /metrics page, in the Prometheus text exposition format:
+//  kvpaxos_ops_total{type,result}    ops agreed on; result is ok or an
+//                                    error code of the REST service
+//  kvpaxos_agreement_seconds         latency of PaxosAgreementOp, histogram
+//  kvpaxos_agreement_retries         log slots lost to other proposals
+//                                    before an op was decided, histogram
+//  kvpaxos_gc_runs_total             snapshots made by the housekeeper
+//  kvpaxos_paxos_max, _paxos_min,
+//  kvpaxos_touched, kvpaxos_snapstart     gauges of the log
+//  paxos_rpcs_sent_total{peer},
+//  paxos_rpcs_failed_total{peer}     RPCs to the other peers
+
+var (
+  latencyBuckets = []float64{.001,.0025,.005,.01,.025,.05,.1,.25,.5,1,2.5,5,10}
+  retryBuckets = []float64{0,1,2,4,8,16,32}
+)
+
+type histogram struct {
+  bounds []float64
+  counts []uint64 // by bucket, not cumulative; the last one is +Inf
+  sum float64
+  n uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+  return &histogram{bounds:bounds,counts:make([]uint64,len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+  i:=sort.SearchFloat64s(h.bounds,v) // the first bound >= v
+  h.counts[i]++
+  h.sum+=v
+  h.n++
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+  var c uint64
+  for i,b:=range h.bounds {
+    c+=h.counts[i]
+    fmt.Fprintf(w,"%s_bucket{le=\"%s\"} %d\n",name,strconv.FormatFloat(b,'g',-1,64),c)
+  }
+  fmt.Fprintf(w,"%s_bucket{le=\"+Inf\"} %d\n",name,h.n)
+  fmt.Fprintf(w,"%s_sum %s\n",name,strconv.FormatFloat(h.sum,'g',-1,64))
+  fmt.Fprintf(w,"%s_count %d\n",name,h.n)
+}
+
+type opLabel struct {
+  Type string
+  Result string
+}
+
+//guarded by its own lock, not kv.mu, so that /metrics answers while
+//an agreement is stuck
+type metrics struct {
+  mu sync.Mutex
+  ops map[opLabel]uint64
+  latency *histogram
+  retries *histogram
+  gcRuns uint64
+}
+
+func newMetrics() *metrics {
+  m:=new(metrics)
+  m.ops=make(map[opLabel]uint64)
+  m.latency=newHistogram(latencyBuckets)
+  m.retries=newHistogram(retryBuckets)
+  return m
+}
+
+func opResult(e Err) string {
+  if e=="" {
+    return "ok"
+  }
+  if re,found:=restErrors[e]; found {
+    return re.Code
+  }
+  return "error"
+}
+
+func (m *metrics) op(opType int, e Err, d time.Duration) {
+  name:="UNKNOWN"
+  if opType>=0 && opType<len(OpName) {
+    name=OpName[opType]
+  }
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.ops[opLabel{name,opResult(e)}]++
+  m.latency.observe(d.Seconds())
+}
+
+func (m *metrics) retried(n int) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.retries.observe(float64(n))
+}
+
+func (m *metrics) gcRun() {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.gcRuns++
+}
+
+func header(w io.Writer, name string, typ string, help string) {
+  fmt.Fprintf(w,"# HELP %s %s\n# TYPE %s %s\n",name,help,name,typ)
+}
+
+func (kv *KVPaxos) writeMetrics(w io.Writer) {
+  m:=kv.metrics
+  m.mu.Lock()
+  header(w,"kvpaxos_ops_total","counter","Ops agreed on, by type and result.")
+  labels:=make([]opLabel,0,len(m.ops))
+  for l:=range m.ops {
+    labels=append(labels,l)
+  }
+  sort.Slice(labels,func(i,j int) bool {
+    if labels[i].Type!=labels[j].Type {
+      return labels[i].Type<labels[j].Type
+    }
+    return labels[i].Result<labels[j].Result
+  })
+  for _,l:=range labels {
+    fmt.Fprintf(w,"kvpaxos_ops_total{type=%q,result=%q} %d\n",l.Type,l.Result,m.ops[l])
+  }
+  header(w,"kvpaxos_agreement_seconds","histogram","Latency of PaxosAgreementOp.")
+  m.latency.write(w,"kvpaxos_agreement_seconds")
+  header(w,"kvpaxos_agreement_retries","histogram","Log slots lost to other proposals before an op was decided.")
+  m.retries.write(w,"kvpaxos_agreement_retries")
+  header(w,"kvpaxos_gc_runs_total","counter","Snapshots made by the housekeeper.")
+  fmt.Fprintf(w,"kvpaxos_gc_runs_total %d\n",m.gcRuns)
+  m.mu.Unlock()
+
+  //a gauge may be a step behind
+  touched,snapstart:=kv.position()
+  gauges:=[]struct{
+    name string
+    help string
+    value int
+  }{
+    {"kvpaxos_paxos_max","Highest paxos instance known.",kv.px.Max()},
+    {"kvpaxos_paxos_min","Lowest paxos instance not forgotten.",kv.px.Min()},
+    {"kvpaxos_touched","Highest log index this server has used.",touched},
+    {"kvpaxos_snapstart","First log index not in the snapshot.",snapstart},
+  }
+  for _,g:=range gauges {
+    header(w,g.name,"gauge",g.help)
+    fmt.Fprintf(w,"%s %d\n",g.name,g.value)
+  }
+
+  sent,failed:=kv.px.RPCStats()
+  header(w,"paxos_rpcs_sent_total","counter","Paxos RPCs sent, by peer.")
+  for i,n:=range sent {
+    if i!=kv.me {
+      fmt.Fprintf(w,"paxos_rpcs_sent_total{peer=%q} %d\n",kv.peers[i],n)
+    }
+  }
+  header(w,"paxos_rpcs_failed_total","counter","Paxos RPCs that got no reply, by peer.")
+  for i,n:=range failed {
+    if i!=kv.me {
+      fmt.Fprintf(w,"paxos_rpcs_failed_total{peer=%q} %d\n",kv.peers[i],n)
+    }
+  }
+}
+
+func kvMetricsHandlerGC(kv *KVPaxos) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type","text/plain; version=0.0.4")
+    kv.writeMetrics(w)
+  }
+}
@@ -0,0 +1,297 @@
+package kvpaxos
+
+import (
+  "net/http"
+  "encoding/json"
+  "encoding/base64"
+  "unicode/utf8"
+  "io"
+  "io/ioutil"
+  "strconv"
+  "strings"
+  "time"
+  "fmt"
+  )
+
+//the /v1/keys/{key} resource:
+//  GET     read the key (or an old version of it, with ?version=)
+//  PUT     write the key, whether it exists or not
+//  POST    create the key; 409 if it exists
+//  PATCH   overwrite an existing key, or compare-and-swap with "expected"
+//          (or "absent":true, for a key that must not exist)
+//  DELETE  delete an existing key
+//Writes take a JSON body {"value":..,"ttl":..,"expected":..}, the same
+//fields as a form, or the raw value as application/octet-stream with the
+//other fields in the query string. So does GET answer with the raw value,
+//if asked to in Accept. The session and seq of the client go in the query
+//string. JSON replies encode values in base64 (and say so in "encoding")
+//if they are not valid UTF-8.
+//Failures answer with a status code and {"error":{"code":..,"message":..}}.
+
+const (
+  RestPrefix="/v1/keys/"
+  RestTimeout=10*time.Second // a server that cannot reach agreement answers 503 after this
+)
+
+type restError struct {
+  Status int
+  Code string
+}
+
+//the errors of the replayed ops, by their legacy message
+var restErrors = map[Err]restError{
+  "Key Not Found": {http.StatusNotFound,"not_found"},
+  "Put/Insert: key exist?": {http.StatusConflict,"key_exists"},
+  "Update: key not exist?": {http.StatusNotFound,"not_found"},
+  "Delete: key not exist?": {http.StatusNotFound,"not_found"},
+  "CAS: value mismatch?": {http.StatusConflict,"value_mismatch"},
+  "Get: version not reached yet?": {http.StatusNotFound,"version_not_reached"},
+  "Get: version compacted?": {http.StatusGone,"version_compacted"},
+  ErrNoVersions: {http.StatusNotImplemented,"versions_disabled"},
+  "Error: repeated, old request...": {http.StatusConflict,"stale_request"},
+  ErrShutdown: {http.StatusServiceUnavailable,"unavailable"},
+  ErrNoAgreement: {http.StatusServiceUnavailable,"unavailable"},
+}
+
+type RestValue struct {
+  Key string `json:"key"`
+  Value *string `json:"value,omitempty"`
+  Previous *string `json:"previous,omitempty"`
+  Version int `json:"version"`
+  Encoding string `json:"encoding,omitempty"` // base64, if it applies to value and previous
+}
+
+//nil value or previous are left out
+func restValue(key string, value *string, previous *string, version int) *RestValue {
+  rv:=&RestValue{Key:key,Value:value,Previous:previous,Version:version}
+  if (value!=nil && !utf8.ValidString(*value)) || (previous!=nil && !utf8.ValidString(*previous)) {
+    rv.Encoding="base64"
+    for _,p:=range []**string{&rv.Value,&rv.Previous} {
+      if *p!=nil {
+        enc:=base64.StdEncoding.EncodeToString([]byte(**p))
+        *p=&enc
+      }
+    }
+  }
+  return rv
+}
+
+type RestErrorBody struct {
+  Error struct {
+    Code string `json:"code"`
+    Message string `json:"message"`
+  } `json:"error"`
+}
+
+type restWrite struct {
+  Value *string `json:"value"`
+  TTL int64 `json:"ttl"`
+  Expected *string `json:"expected"`
+  Absent bool `json:"absent"`
+}
+
+func restReply(w http.ResponseWriter, status int, body interface{}) {
+  w.Header().Set("Content-Type","application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(body)
+}
+
+func restFail(w http.ResponseWriter, status int, code string, msg string) {
+  var body RestErrorBody
+  body.Error.Code=code
+  body.Error.Message=msg
+  restReply(w,status,&body)
+}
+
+func restFailErr(w http.ResponseWriter, e Err) {
+  re,found:=restErrors[e]
+  if !found {
+    re=restError{http.StatusInternalServerError,"internal"}
+  }
+  restFail(w,re.Status,re.Code,string(e))
+}
+
+//the body of a write, as JSON, as a form or raw. The status is
+//StatusBadRequest or StatusRequestEntityTooLarge, with err.
+func (kv *KVPaxos) parseRestWrite(r *http.Request) (restWrite,int,error) {
+  var a restWrite
+  bad:=http.StatusBadRequest
+  ctype:=r.Header.Get("Content-Type")
+  switch {
+    case strings.HasPrefix(ctype,"application/json"):
+      err:=json.NewDecoder(io.LimitReader(r.Body,int64(2*kv.maxValueSize)+4096)).Decode(&a)
+      if err!=nil {
+        return a,bad,fmt.Errorf("malformed body: %v",err)
+      }
+    case strings.HasPrefix(ctype,"application/octet-stream"):
+      //read one byte more than allowed, to tell a value too large
+      raw,err:=ioutil.ReadAll(io.LimitReader(r.Body,int64(kv.maxValueSize)+1))
+      if err!=nil {
+        return a,bad,fmt.Errorf("cannot read body: %v",err)
+      }
+      if err:=kv.checkValueSize(len(raw)); err!=nil {
+        return a,http.StatusRequestEntityTooLarge,err
+      }
+      v:=string(raw)
+      a.Value=&v
+      fallthrough
+    default:
+      if a.Value==nil {
+        v,err:=kv.formValue(r)
+        if err!=nil {
+          return a,bad,err
+        }
+        a.Value=&v
+      }
+      ttl,ok:=parseTTL(r)
+      if !ok {
+        return a,bad,fmt.Errorf("ttl should be a nonnegative number of milliseconds")
+      }
+      a.TTL=ttl
+      if _,found:=r.Form["expected"]; found {
+        e:=r.FormValue("expected")
+        a.Expected=&e
+      }
+      a.Absent=r.FormValue("absent")=="true"
+  }
+  if a.Value==nil {
+    return a,bad,fmt.Errorf("value not found, please give a value")
+  }
+  if err:=kv.checkValueSize(len(*a.Value)); err!=nil {
+    return a,http.StatusRequestEntityTooLarge,err
+  }
+  if a.TTL<0 {
+    return a,bad,fmt.Errorf("ttl should be a nonnegative number of milliseconds")
+  }
+  return a,0,nil
+}
+
+//agree on op, giving up after RestTimeout; the op may still be decided
+//later, and a retry with the same session and seq will find it
+func (kv *KVPaxos) restAgree(op Op) (Err,string,int) {
+  return kv.agreeWithin(op,RestTimeout)
+}
+
+//agree on op within d. The agreement stops trying at the same deadline,
+//or gives up as soon as it gets kv.mu if it waited for it that long
+func (kv *KVPaxos) agreeWithin(op Op, d time.Duration) (Err,string,int) {
+  type result struct {
+    e Err
+    ret string
+    ver int
+  }
+  deadline:=time.Now().Add(d)
+  done:=make(chan result,1)
+  go func(){
+    e,ret,ver:=kv.agreementBy(op,deadline)
+    done<-result{e,ret,ver}
+  }()
+  select {
+    case r:=<-done:
+      return r.e,r.ret,r.ver
+    case <-time.After(d):
+      return ErrNoAgreement,"",-1
+  }
+}
+
+func kvKeysHandlerGC(kv *KVPaxos) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    key:=strings.TrimPrefix(r.URL.Path,RestPrefix)
+    if key=="" {
+      restFail(w,http.StatusBadRequest,"bad_request","key not found, please give nonempty string")
+      return
+    }
+    if kv.dead {
+      restFailErr(w,ErrShutdown)
+      return
+    }
+    who,seq,err:=requestID(r)
+    if err!=nil {
+      restFail(w,http.StatusBadRequest,"bad_request",err.Error())
+      return
+    }
+    op:=Op{Key:key,Who:who,OpID:seq}
+
+    switch r.Method {
+      case "GET":
+        op.OpType=GetOp
+        if version:=r.URL.Query().Get("version"); version!="" {
+          v,err:=strconv.Atoi(version)
+          if err!=nil || v<0 {
+            restFail(w,http.StatusBadRequest,"bad_request","version should be a nonnegative log index")
+            return
+          }
+          if kv.retention==0 {
+            restFailErr(w,ErrNoVersions)
+            return
+          }
+          op.OpType=HistGetOp
+          op.Version=v
+        }
+        e,val,ver:=kv.restAgree(op)
+        if e!="" {
+          restFailErr(w,e)
+          return
+        }
+        if strings.Contains(r.Header.Get("Accept"),"application/octet-stream") {
+          w.Header().Set("Content-Type","application/octet-stream")
+          w.Header().Set("X-Version",strconv.Itoa(ver))
+          io.WriteString(w,val)
+          return
+        }
+        restReply(w,http.StatusOK,restValue(key,&val,nil,ver))
+      case "DELETE":
+        op.OpType=DeleteOp
+        e,prev,_:=kv.restAgree(op)
+        if e!="" {
+          restFailErr(w,e)
+          return
+        }
+        restReply(w,http.StatusOK,restValue(key,nil,&prev,-1))
+      case "PUT","POST","PATCH":
+        a,status,err:=kv.parseRestWrite(r)
+        if status==http.StatusRequestEntityTooLarge {
+          restFail(w,status,"value_too_large",err.Error())
+          return
+        }
+        if err!=nil {
+          restFail(w,status,"bad_request",err.Error())
+          return
+        }
+        op.Value=*a.Value
+        op.TTL=a.TTL
+        status=http.StatusOK
+        switch {
+          case r.Method=="PUT":
+            op.OpType=NaivePutOp
+          case r.Method=="POST":
+            op.OpType=PutOp
+            status=http.StatusCreated
+          case a.Absent:
+            op.OpType=CasOp
+            op.ExpectAbsent=true
+          case a.Expected!=nil:
+            op.OpType=CasOp
+            op.Expected=*a.Expected
+          default:
+            op.OpType=UpdateOp
+        }
+        e,prev,ver:=kv.restAgree(op)
+        if e!="" {
+          restFailErr(w,e)
+          return
+        }
+        if status==http.StatusCreated {
+          w.Header().Set("Location",RestPrefix+key)
+        }
+        if r.Method=="POST" {
+          restReply(w,status,restValue(key,a.Value,nil,ver))
+        }else{
+          restReply(w,status,restValue(key,a.Value,&prev,ver))
+        }
+      default:
+        w.Header().Set("Allow","GET, PUT, POST, PATCH, DELETE")
+        restFail(w,http.StatusMethodNotAllowed,"method_not_allowed","unsupported method "+r.Method)
+    }
+  }
+}
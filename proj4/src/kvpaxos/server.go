@@ -2,11 +2,15 @@ package kvpaxos
 
 import (
   "net"
+  "crypto/tls"
+  "crypto/subtle"
+  "strings"
   "net/http"
   "net/rpc"
   "sync"
+  "sync/atomic"
   "os"
-  "syscall"
+  "errors"
   "encoding/gob"
   "encoding/json"
   "math/rand"
@@ -14,10 +18,13 @@ import (
   "strconv"
   "fmt"
   "log"
+  "io/ioutil"
 
   "paxos"
   "kvlib"
+  "kvlog"
   "stoppableHTTPlistener"
+  "faultnet"
   )
 
 const (
@@ -26,19 +33,24 @@ const (
   UpdateOp=3
   DeleteOp=4
   NaivePutOp=5
+  CasOp=6
+  TxnOp=7
+  HistGetOp=8
+  RestoreOp=9
   SaveMemThreshold=15
-  Debug=false
+  SessionTimeout=10*time.Minute
+  VersionRetention=0 // default, in log indices; see version_retention in settings.conf
+  MaxValueSize=1<<20 // default, in bytes; see max_value_size in settings.conf
+  MaxRestoreSize=16<<20 // in bytes, of a snapshot file given to /kvman/restore; it travels as one paxos op
+  TransferTimeout=10*time.Minute // for dumps, snapshots and restores, instead of the server timeouts
+  DrainTimeout=5*time.Second // default, of the requests in flight on a shutdown; see drain_timeout_ms in settings.conf
+  MaxLogRange=1000 // instances, of a /kvman/log request
+  MaxLogValue=256 // bytes of a value shown by /kvman/log
   StartHTTP=true
 )
 var (
-  OpName = []string{"NONE","PUT","GET","UPDATE","DELETE","NaivePut"}
+  OpName = []string{"NONE","PUT","GET","UPDATE","DELETE","NaivePut","CAS","TXN","GETV","RESTORE"}
 )
-func DPrintf(format string, a ...interface{}) (n int, err error) {
-  if Debug {
-    log.Printf(format, a...)
-  }
-  return
-}
 
 
 type Op struct {
@@ -48,8 +60,19 @@ type Op struct {
   OpType int // type
   Key string
   Value string
-  Who int
-  OpID int
+  Who int64 // client session; ops of one session are told apart by OpID
+  OpID int // sequence number in the session; 0 if the op is never retried
+  Expected string // CasOp only: the value Key must hold for the swap
+  ExpectAbsent bool // CasOp only: Key must not exist instead
+  Timestamp int64 // proposer's clock (unix ns), drives key expiry
+  TTL int64 // milliseconds after Timestamp until the written key expires; 0 means never
+  Version int // HistGetOp only: the log index to read the key as of
+  //TxnOp carries its JSON-encoded Txn in Value, and no Key
+}
+
+//a and b are the same client request
+func sameOp(a Op, b Op) bool {
+  return a.Who==b.Who && a.OpID==b.OpID
 }
 
 func DeepCompareOps(a Op, b Op) (bool){
@@ -57,12 +80,12 @@ func DeepCompareOps(a Op, b Op) (bool){
   a.Key==b.Key &&
   a.Value==b.Value &&
   a.OpID==b.OpID &&
-  a.Who==b.Who
-}
-
-type ID_Ret_Pair struct {
-  OpID int
-  Ret string
+  a.Who==b.Who &&
+  a.Expected==b.Expected &&
+  a.ExpectAbsent==b.ExpectAbsent &&
+  a.Timestamp==b.Timestamp &&
+  a.TTL==b.TTL &&
+  a.Version==b.Version
 }
 
 type KVPaxos struct {
@@ -76,27 +99,53 @@ type KVPaxos struct {
 
   px_touchedPTR int
 
-  snapshot map[string]string
+  snapshot map[string]entry
   snapstart int
-
-  doneOps map[int]bool
-  latestClientOpResult map[int]ID_Ret_Pair
+  snapclock int64 // the view clock at snapstart
+  snapShared bool // the snapshot and sessions are read by a syncView outside kv.mu
+  touched int64 // px_touchedPTR, as published for position(); atomic
+  snapped int64 // snapstart, as published for position(); atomic
+  retention int // old versions of keys are kept for this many log indices
+  maxValueSize int // in bytes, for values written over HTTP
+
+  sessions map[int64]session // duplicate detection, as of snapstart
+
+  //the database as of px_touchedPTR, kept up with the log for the watches
+  feed *kvView
+  feedNext int // the log index feed applies next
+  watchMu sync.Mutex // guards events, which watches read outside kv.mu
+  events []WatchEvent // the writes from snapstart on, oldest first
+  quit chan struct{} // closed by kill, to end the watches
+  log *kvlog.Logger // the kvpaxos subsystem, with node
+  httpLog *kvlog.Logger // the http subsystem, with node
+  peers []string
+  metrics *metrics
+  net *faultnet.Network // the faults of the RPCs of this server
   //Results map[int]string//for debug only
 
-  HTTPListener *stoppableHTTPlistener.StoppableListener
+  HTTP *stoppableHTTPlistener.Server
+  drainTimeout time.Duration // of the requests in flight, on a shutdown
+  started time.Time
   Death chan int
 }
 
 
 func (kv *KVPaxos) PaxosStatOp() (int,map[string]string) {
-    if Debug{
-        fmt.Printf("Paxos STAT!\n")
-    }
+    st,_:=kv.syncView()
+    tmp2:=st.dump()
+    return len(tmp2),tmp2
+}
+
+//a view of the whole database as of a meaningless op agreed on now, and
+//the log index of that op. The view stays valid after kv.mu is released:
+//its snapshot is left alone by the housekeeper, which makes a new one.
+func (kv *KVPaxos) syncView() (*kvView,int) {
+    kv.log.Debug("stat op")
     kv.mu.Lock(); // Protect px.instances
     defer kv.mu.Unlock();
 
     //need to insert a meaningless OP, in order to sync DB!
-    var myop Op = Op{OpType:GetOp, Key:"", Value:"", OpID:rand.Int(),Who:-1}
+    var myop Op = Op{OpType:GetOp, Key:"", Value:"", Who:nrand(), OpID:0, Timestamp:time.Now().UnixNano()}
     var ID int
     var value interface{}
     var decided bool
@@ -114,7 +163,7 @@ func (kv *KVPaxos) PaxosStatOp() (int,map[string]string) {
               }
               time.Sleep(50*time.Millisecond)
           }
-          if value.(Op).OpID==myop.OpID {//succeeded
+          if sameOp(value.(Op),myop) {//succeeded
           //    if Debug {fmt.Printf("Saw OIDSame but DC fail! %v %v\n",value,myop)}
               break;
           }
@@ -123,51 +172,49 @@ func (kv *KVPaxos) PaxosStatOp() (int,map[string]string) {
           ID++
       }
       kv.px_touchedPTR=ID
+      kv.feedLocked()
     }
 
 
 
-    tmp:=make(map[string]string)
-    for k,v:=range kv.snapshot {
-      tmp[k]=v
-    }
+    st:=kv.newView()
     for i:=kv.snapstart;i<=kv.px_touchedPTR;i++{
         _,value := kv.px.Status(i)
-        v:=value.(Op)
-        tmp[v.Key]=v.Value
-    }
-    var cnt=0
-    tmp2:=make(map[string]string)
-    for k,v:=range tmp {
-      if v!=""{
-       tmp2[k]=v
-       cnt++
-      }
+        st.step(i,value.(Op))
     }
-    return cnt,tmp2
+    kv.snapShared=true
+    return st,kv.px_touchedPTR
 }
 
 func (kv *KVPaxos) PaxosAgreementOp(myop Op) (Err,string) {//return (Err,value)
-    if Debug{
-        fmt.Printf("P/G Step0, OpType:%s\n",OpName[myop.OpType])
-    }
-    if kv.doneOps[myop.OpID] {
-      // Might be the latest op repeated, or an even older one
-      lop,found:=kv.latestClientOpResult[myop.Who]
-      if found {
-        lid:=lop.OpID
-        lr:=lop.Ret
-        if lid==myop.OpID {
-          return "",lr
-        }
-      }
-      return "Error: repeated, old request...","" //should not provide error message, to fall through erroneous ops??
-    }
+  e,ret,_:=kv.PaxosAgreementOpVersion(myop)
+  return e,ret
+}
+
+//as PaxosAgreementOp, also returning the version of myop.Key after myop
+func (kv *KVPaxos) PaxosAgreementOpVersion(myop Op) (Err,string,int) {
+  return kv.agreementBy(myop,time.Time{})
+}
+
+//as PaxosAgreementOpVersion, but giving up with ErrNoAgreement at deadline,
+//unless it is zero
+func (kv *KVPaxos) agreementBy(myop Op, deadline time.Time) (Err,string,int) {
+  start:=time.Now()
+  e,ret,ver:=kv.agree(myop,deadline)
+  kv.metrics.op(myop.OpType,e,time.Since(start))
+  return e,ret,ver
+}
 
+func (kv *KVPaxos) agree(myop Op, deadline time.Time) (Err,string,int) {
+    kv.log.Debug("agreement started", "type", OpName[myop.OpType], "key", myop.Key, "session", myop.Who, "opid", myop.OpID)
     kv.mu.Lock(); // Protect px.instances
     defer kv.mu.Unlock();
-    if Debug {
-        println("P/G Step1")
+    late:=func() bool {
+      return !deadline.IsZero() && time.Now().After(deadline)
+    }
+
+    if myop.Timestamp==0 {
+      myop.Timestamp=time.Now().UnixNano()
     }
 
        //step1: get the agreement!
@@ -177,18 +224,20 @@ func (kv *KVPaxos) PaxosAgreementOp(myop Op) (Err,string) {//return (Err,value)
     var decided bool
 
     //check if there's existing same OP...
+    //a repeat of an op compacted already is decided again, and found to be
+    //a duplicate in the replay, as the session might have expired since
     var sameID=-1
     for i:=kv.snapstart;i<=kv.px_touchedPTR;i++{
       decided,value = kv.px.Status(i)
       if decided {
         //if DeepCompareOps(value.(Op),myop){
-        if value.(Op).OpID==myop.OpID{
+        if sameOp(value.(Op),myop){
           sameID=i
-          if Debug {fmt.Printf("Saw sameID! id%d opid%d sv#%d",sameID,myop.OpID,kv.me)}
+          kv.log.Debug("op found in the log", "seq", sameID, "session", myop.Who, "opid", myop.OpID)
           break
         }
       }else {
-        fmt.Printf("PANIC %v %v\n", value, myop);
+        kv.log.Error("undecided instance below px_touchedPTR", "seq", i, "op", fmt.Sprint(myop))
         panic("Not decided, but before touchPTR??")
       }
     }
@@ -196,12 +245,14 @@ func (kv *KVPaxos) PaxosAgreementOp(myop Op) (Err,string) {//return (Err,value)
       ID=sameID//skip
     }else{
       ID=kv.px_touchedPTR+1
+      first:=ID
+      ours:=false
       //ID=0
-      for !kv.dead {
+      for !kv.dead && !late() {
           kv.px.Start(ID,myop)
           time.Sleep(1)
           var backoff time.Duration=10
-          for !kv.dead {
+          for !kv.dead && !late() {
               decided,value = kv.px.Status(ID)
               if decided {
                   break;
@@ -209,12 +260,17 @@ func (kv *KVPaxos) PaxosAgreementOp(myop Op) (Err,string) {//return (Err,value)
               time.Sleep(time.Millisecond*backoff)
               if backoff<120{backoff*=2}
           }
+          if !decided {//dead, or late
+              break;
+          }
           if DeepCompareOps(value.(Op),myop) {//succeeded
-              if Debug {fmt.Printf("Saw DCSame! %v %v server%d\n",value,myop,kv.me)}
+              kv.log.Debug("op decided", "seq", ID)
+              ours=true
               break;
           }
-          if value.(Op).OpID==myop.OpID {//succeeded
-              if Debug {fmt.Printf("Saw OIDSame but DC fail! %v %v\n",value,myop)}
+          if sameOp(value.(Op),myop) {//succeeded
+              kv.log.Debug("op decided in an earlier attempt", "seq", ID)
+              ours=true
               break;
           }
           var offs uint=uint(ID-kv.px_touchedPTR)
@@ -223,150 +279,92 @@ func (kv *KVPaxos) PaxosAgreementOp(myop Op) (Err,string) {//return (Err,value)
           time.Sleep(time.Duration(rand.Intn(scale*int(time.Millisecond)+1)))
           ID++
       }
+      if kv.dead {
+        return ErrShutdown,"",-1
+      }
+      if !ours {
+        //the op may still be decided at ID, and found there by a retry
+        kv.log.Debug("agreement given up", "seq", ID)
+        return ErrNoAgreement,"",-1
+      }
+      kv.metrics.retried(ID-first)
       kv.px_touchedPTR=ID
+      kv.feedLocked()
     }
 
-    if Debug {fmt.Printf("Decided! %d=%v server%d\n",ID,myop,kv.me)}
-
-    if Debug {
-        println("P/G Step2")
-    }
-
+    kv.log.Debug("agreement reached", "seq", ID, "type", OpName[myop.OpType], "key", myop.Key)
 
-    var latestVal=kv.snapshot[myop.Key]
-    var latestSucc=true
-    var beforeVal=""
 
-    var opsVisited=make(map[int]bool)
+    //step2: replay the log up to our op, on top of the snapshot
+    st:=kv.newView()
+    var e Err
+    var ret string
+    var ver int
 
-    var i int
-    for i=kv.snapstart;i<=ID;i++{
+    for i:=kv.snapstart;i<=ID;i++{
       decided,value = kv.px.Status(i)
       if !decided {
-        fmt.Printf("PANIC %v %v\n", value, myop);
+        kv.log.Error("undecided instance below px_touchedPTR", "seq", i, "op", fmt.Sprint(myop))
         panic("Not decided, but before touchPTR??")
       }
       var op=value.(Op)
-      if Debug{
-        fmt.Printf("Simluate Step%d: %d %s %s\n", i, op.OpType,op.Key,op.Value);
-      }
-
-      if op.Key!=myop.Key{
-        continue
-      }
-
+      kv.log.Debug("replay", "seq", i, "type", OpName[op.OpType], "key", op.Key)
 
-      if opsVisited[op.OpID] {
-          continue
-      }
-      opsVisited[op.OpID]=true
       //do not repeat Ops on unreliable case!
+      oe,oret,over:=st.step(i,op)
 
-      beforeVal=latestVal
-      //this is an op on this key! will update the value!
-      switch op.OpType{
-        case GetOp:
-          latestSucc=(latestVal!="")
-
-        case PutOp:
-          if latestVal!=""{
-            latestSucc=false
-          }else{
-            latestVal=op.Value
-            latestSucc=true
-          }
-
-        case NaivePutOp:
-          latestVal=op.Value
-          latestSucc=true
-
-        case DeleteOp:
-          latestSucc=(latestVal!="")
-          latestVal=""
-
-        case UpdateOp:
-          if latestVal==""{
-            latestSucc=false
-          }else{
-            latestVal=op.Value
-            latestSucc=true
-          }
-      }
-      lm:=len(beforeVal)
-      if lm>100{lm=100}
-      kv.doneOps[op.OpID]=true;//beforeVal[0:lm]
-
-      l,found:=kv.latestClientOpResult[op.Who]
-      if !found || op.OpID>l.OpID { //newer, or not found
-        kv.latestClientOpResult[op.Who]=ID_Ret_Pair{op.OpID, beforeVal}
-      }
-      // should remember the result  if it's the new latest
-
-      if op.OpID==myop.OpID{
+      if sameOp(op,myop){
+        e,ret,ver=oe,oret,over
         break
       }
-         //this result is okay, already
-    }
-
-    //i-=1//should be ID, but may not!
-    //kv.Results[i]=beforeVal
-
-//    if myop.OpType==GetOp {
-//      kv.results[ID]=latestVal
-//    }
-    //all ops simluated!
-    switch myop.OpType{
-      case GetOp:
-        if latestVal==""{
-          return "Key Not Found",""
-        }
-        return "",latestVal
-      case PutOp:
-        if !latestSucc{
-          return "Put/Insert: key exist?",""
-        }
-      case DeleteOp:
-        if !latestSucc{
-          return "Delete: key not exist?",""
-        }
-      case UpdateOp:
-        if !latestSucc{
-          return "Update: key not exist?",""
-        }
-      case NaivePutOp:
     }
-    return "",beforeVal
+    return e,ret,ver
+}
 
+func (kv *KVPaxos) Txn(args *TxnArgs, reply *TxnReply) error {
+  if e:=checkTxn(&args.Txn); e!=""{
+    reply.Err=e
+    return nil
+  }
+  enc,_:=json.Marshal(&args.Txn)
+  e,Value:=kv.PaxosAgreementOp(Op{OpType:TxnOp,Value:string(enc),Who:args.ClientID,OpID:args.OpID})
+  reply.Err=e
+  reply.Results=nil
+  if e==""{
+    json.Unmarshal([]byte(Value),&reply.Results)
+  }
+  return nil
 }
 
 func (kv *KVPaxos) Get(args *GetArgs, reply *GetReply) error {
-  _,Value:=kv.PaxosAgreementOp(Op{GetOp,args.Key,"",args.ClientID,args.OpID})
+  _,Value:=kv.PaxosAgreementOp(Op{OpType:GetOp,Key:args.Key,Who:args.ClientID,OpID:args.OpID})
   reply.Err=""
   reply.Value=Value
   return nil
 }
 
 func (kv *KVPaxos) FormalGet(args *GetArgs, reply *GetReply) error {
-  e,Value:=kv.PaxosAgreementOp(Op{GetOp,args.Key,"",args.ClientID,args.OpID})
+  e,Value,Version:=kv.PaxosAgreementOpVersion(Op{OpType:GetOp,Key:args.Key,Who:args.ClientID,OpID:args.OpID})
   reply.Err=e
   reply.Value=Value
+  reply.Version=Version
   return nil
 }
 
 func (kv *KVPaxos) Put(args *PutArgs, reply *PutReply) error {
   //This function is to be called by RPC tester client only. Will always succeed.
-  e,Value:=kv.PaxosAgreementOp(Op{NaivePutOp,args.Key,args.Value,args.ClientID,args.OpID})
+  e,Value:=kv.PaxosAgreementOp(Op{OpType:NaivePutOp,Key:args.Key,Value:args.Value,Who:args.ClientID,OpID:args.OpID,TTL:args.TTL})
   reply.Err=e
   reply.PreviousValue=Value
   return nil
 }
 
 func (kv *KVPaxos) FormalPut(args *PutArgs, reply *PutReply) error {
-  e,Value:=kv.PaxosAgreementOp(Op{PutOp,args.Key,args.Value,args.ClientID,args.OpID})
+  e,Value:=kv.PaxosAgreementOp(Op{OpType:PutOp,Key:args.Key,Value:args.Value,Who:args.ClientID,OpID:args.OpID,TTL:args.TTL})
   reply.Err=e
   reply.PreviousValue=Value
   if Value!=""{
-    println(Value)
+    kv.log.Error("formal put found a previous value", "key", args.Key, "value", Value)
     panic("Prev Value not empty for formal PUT?")
   }
   return nil
@@ -376,14 +374,16 @@ func (kv *KVPaxos) FormalPut(args *PutArgs, reply *PutReply) error {
 // tell the server to shut itself down.
 // please do not change this function.
 func (kv *KVPaxos) kill() {
-  DPrintf("Kill(%d): die\n", kv.me)
+  kv.log.Info("killed")
   kv.dead = true
+  close(kv.quit)
   kv.l.Close()
   kv.px.Kill()
-  if StartHTTP{
-    println("Stopping HTTP...")
-    kv.HTTPListener.Stop()
-    println("HTTP stopped.")
+  if kv.HTTP!=nil {
+    //the connections are closed, requests in flight or not; the port is
+    //released once Kill returns
+    kv.HTTP.Kill()
+    kv.httpLog.Info("stopped")
   }
   kv.Death<-1
 }
@@ -391,12 +391,25 @@ func (kv *KVPaxos) Kill() {//public wrapper
   kv.kill()
 }
 
+//stop accepting HTTP requests, let those in flight end, for up to the
+//drain timeout, then kill the server
+func (kv *KVPaxos) Shutdown() {
+  if kv.HTTP!=nil {
+    kv.httpLog.Info("draining", "timeout", kv.drainTimeout)
+    if err:=kv.HTTP.Stop(kv.drainTimeout); err!=nil {
+      kv.httpLog.Warn("requests cut off by the shutdown", "err", err)
+    }
+  }
+  kv.kill()
+}
+
 func (kv *KVPaxos) DumpInfo() string {
   r:=""
   r+=fmt.Sprintf("I'm %d\n",kv.me)
   r+=fmt.Sprintf("Max pxID=%d\n",kv.px.Max())
   r+=fmt.Sprintf("Min pxID=%d\n",kv.px.Min())
-  r+=fmt.Sprintf("PTR pxID=%d\n",kv.px_touchedPTR)
+  touched,_:=kv.position()
+  r+=fmt.Sprintf("PTR pxID=%d\n",touched)
 
   ID:=kv.px.Max()
   for i:=0;i<=ID;i++ {
@@ -417,70 +430,106 @@ func (kv *KVPaxos) DumpInfo() string {
 func (kv *KVPaxos) housekeeper() {
   for true{
     if kv.dead {
-      if Debug{println("KVDB dead, housekeeper done") }
+      kv.log.Debug("housekeeper done")
       break
     }
     time.Sleep(time.Millisecond*10)
-    curr:=kv.px_touchedPTR-1
-    mem:=kv.snapstart
-    if Debug {fmt.Printf("hosekeeper #%d, max %d, snap %d... \n",kv.me,curr,mem) }
+    touched,mem:=kv.position()
+    curr:=touched-1
     if(curr-mem> SaveMemThreshold){//start compressing...
-      fmt.Printf("Housekeeper GC#%d starting... %d->%d\n",kv.me,mem,curr);
+      kv.log.Info("snapshot starting", "snapstart", mem, "seq", curr)
       kv.mu.Lock(); // Protect px.instances
         curr-=SaveMemThreshold*10/100+1
         //curr=mem+10
-        if kv.snapstart==0{
-          kv.snapshot=make(map[string]string)
-        }
-        for i:=kv.snapstart;i<curr;i++ {
-          de,op:=kv.px.Status(i)
-          if de==false {
-            break
-          }
-          optt,found:=op.(Op)
-          if found==false{
-              println("Housekeeper error! Not Found type .(Op)")
-              panic("Housekeeper sees undecided op")
-          }
-          k:=optt.Key
-          v:=optt.Value
-          bv:=kv.snapshot[k]
-          switch optt.OpType{
-            case GetOp:
-
-            case PutOp:
-              if bv!=""{
-                //latestSucc=false
-              }else{
-                kv.snapshot[k]=v
-                //latestSucc=true
-              }
-
-            case NaivePutOp:
-              kv.snapshot[k]=v
-              //latestSucc=true
-
-            case DeleteOp:
-              //latestSucc=(latestVal!="")
-              //latestVal=""
-              kv.snapshot[k]=""
-
-            case UpdateOp:
-              if bv==""{
-                //latestSucc=false
-              }else{
-                kv.snapshot[k]=v
-                //latestSucc=true
-              }
-          }
-
-          kv.px.Done(i)
-          kv.snapstart=i+1
-        }
+        kv.compactLocked(curr)
       kv.mu.Unlock();
-      if Debug {fmt.Printf("done!#%d now: max %d, min %d, snap %d...\n",kv.me,kv.px.Max(),kv.px.Min(),kv.snapstart) }
+      kv.metrics.gcRun()
+      if kv.log.Enabled(kvlog.LevelDebug) {
+        _,snapstart:=kv.position()
+        kv.log.Debug("snapshot done", "max", kv.px.Max(), "min", kv.px.Min(), "snapstart", snapstart)
+      }
+    }
+  }
+}
+
+//fold the decided instances from snapstart up to curr, excluded, into the
+//snapshot, and let paxos forget them; under kv.mu
+func (kv *KVPaxos) compactLocked(curr int) {
+  kv.feedLocked()
+  if kv.snapstart==0{
+    kv.snapshot=make(map[string]entry)
+    kv.sessions=make(map[int64]session)
+  }
+  if kv.snapShared {
+    //still read by a dump
+    snap:=make(map[string]entry,len(kv.snapshot))
+    for k,e:=range kv.snapshot {
+      snap[k]=e
+    }
+    kv.snapshot=snap
+    sessions:=make(map[int64]session,len(kv.sessions))
+    for who,ss:=range kv.sessions {
+      sessions[who]=ss
     }
+    kv.sessions=sessions
+    kv.snapShared=false
   }
+  st:=kv.newView()
+  for i:=kv.snapstart;i<curr;i++ {
+    de,op:=kv.px.Status(i)
+    if de==false {
+      break
+    }
+    optt,found:=op.(Op)
+    if found==false{
+        kv.log.Error("housekeeper found a value that is not an Op", "seq", i)
+        panic("Housekeeper sees undecided op")
+    }
+    st.step(i,optt)
+
+    kv.px.Done(i)
+    kv.snapstart=i+1
+  }
+  st.commit(kv.snapstart)
+  kv.snapclock=st.clock
+  kv.publishLocked()
+  kv.refeedLocked()
+}
+
+//publish px_touchedPTR and snapstart to position(); under kv.mu, whenever
+//either moves
+func (kv *KVPaxos) publishLocked() {
+  atomic.StoreInt64(&kv.touched,int64(kv.px_touchedPTR))
+  atomic.StoreInt64(&kv.snapped,int64(kv.snapstart))
+}
+
+//px_touchedPTR and snapstart, without kv.mu, which an agreement may hold
+//for long; either may be a step behind
+func (kv *KVPaxos) position() (int,int) {
+  return int(atomic.LoadInt64(&kv.touched)),int(atomic.LoadInt64(&kv.snapped))
+}
+
+//compact every instance applied so far, without waiting for the
+//housekeeper; returns snapstart before and after
+func (kv *KVPaxos) Compact() (int,int) {
+  kv.mu.Lock()
+  before:=kv.snapstart
+  kv.compactLocked(kv.px_touchedPTR+1)
+  after:=kv.snapstart
+  kv.mu.Unlock()
+  kv.metrics.gcRun()
+  kv.log.Info("compacted", "snapstart", before, "seq", after)
+  return before,after
+}
+
+//optional ttl field, in milliseconds; 0 if not given
+func parseTTL(r *http.Request) (int64,bool) {
+  s:=r.FormValue("ttl")
+  if s=="" {
+    return 0,true
+  }
+  ttl,err:=strconv.ParseInt(s,10,64)
+  return ttl,err==nil && ttl>=0
 }
 
 //HTTP handlers generator; to create a closure for kvpaxos instance
@@ -489,26 +538,83 @@ func kvDumpHandlerGC(kv *KVPaxos) http.HandlerFunc{
     fmt.Fprintf(w, "%s",kv.DumpInfo())
   }
 }
-var globalOpsCnt=0
+
+//the session and sequence number of an HTTP request, given by the client
+//in session and seq. Without a session, a legacy id gets a one-off session
+//of its own, as legacy ids do not increase; without both, the request gets
+//a session of its own and is never retried.
+func requestID(r *http.Request) (int64,int,error) {
+  session:= r.FormValue("session")
+  seq:= r.FormValue("seq")
+  opid:= r.FormValue("id")
+  if session!="" {
+    who,err:=strconv.ParseInt(session,10,64)
+    if err!=nil {
+      return 0,0,errors.New("malformed session")
+    }
+    s,err:=strconv.Atoi(seq)
+    if err!=nil || s<=0 {
+      return 0,0,errors.New("seq should be a positive number with session")
+    }
+    return who,s,nil
+  }
+  if opid!="" {
+    id,err:=strconv.ParseInt(opid,10,64)
+    if err!=nil || id<0 {
+      return 0,0,errors.New("id should be a nonnegative number")
+    }
+    return legacySession(id),1,nil
+  }
+  return nrand(),0,nil
+}
+
+func (kv *KVPaxos) checkValueSize(n int) error {
+  if n>kv.maxValueSize {
+    return fmt.Errorf("value too large: %d bytes, at most %d",n,kv.maxValueSize)
+  }
+  return nil
+}
+
+//the value field of a form, which may be empty but must be given
+func (kv *KVPaxos) formValue(r *http.Request) (string,error) {
+  value:= r.FormValue("value")
+  if _,found:=r.Form["value"]; !found {
+    return "",errors.New("value not found, please give a value")
+  }
+  return value,kv.checkValueSize(len(value))
+}
+
+func kvSessionHandlerGC(kv *KVPaxos) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    //the session string avoids losing precision in javascript
+    fmt.Fprintf(w, "{\"success\":\"true\",\"session\":\"%d\"}",nrand())
+  }
+}
+
 func kvPutHandlerGC(kv *KVPaxos) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     key:= r.FormValue("key")
-    value:= r.FormValue("value")
-    opid:= r.FormValue("id")
-    if value=="" {
-      fmt.Fprintf(w, "%s",kvlib.JsonErr("value not found, please give nonempty string"))
+    value,err:=kv.formValue(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+      return
+    }
+    ttl,ok:=parseTTL(r)
+    if !ok {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr("ttl should be a nonnegative number of milliseconds"))
+      return
+    }
+    who,seq,err:=requestID(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
       return
     }
 
 
-    var args PutArgs = PutArgs{key,value,true,globalOpsCnt+kv.me,-1}
-    globalOpsCnt+=kv.N
+    var args PutArgs = PutArgs{Key:key,Value:value,DoHash:true,OpID:seq,ClientID:who,TTL:ttl}
     var reply PutReply = PutReply{"",""}
-    if opid!="" {
-      args.OpID,_=strconv.Atoi(opid)
-    }
 
-    err:=kv.FormalPut(&args,&reply)
+    err=kv.FormalPut(&args,&reply)
     if err!=nil || reply.Err!=""{
       fmt.Fprintf(w, "%s",kvlib.JsonErr(string(reply.Err)))
       return
@@ -521,19 +627,23 @@ func kvPutHandlerGC(kv *KVPaxos) http.HandlerFunc {
 func kvUpdateHandlerGC(kv *KVPaxos) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     key:= r.FormValue("key")
-    value:= r.FormValue("value")
-    opid:= r.FormValue("id")
-    if value=="" {
-      fmt.Fprintf(w, "%s",kvlib.JsonErr("value not found, please give nonempty string"))
+    value,err:=kv.formValue(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+      return
+    }
+    ttl,ok:=parseTTL(r)
+    if !ok {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr("ttl should be a nonnegative number of milliseconds"))
       return
     }
-    uuid:=globalOpsCnt+kv.me
-    globalOpsCnt+=kv.N
-    if opid!="" {
-      uuid,_=strconv.Atoi(opid)
+    who,seq,err:=requestID(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+      return
     }
 
-    e,value:=kv.PaxosAgreementOp(Op{UpdateOp,key,value,-1,uuid})
+    e,value:=kv.PaxosAgreementOp(Op{OpType:UpdateOp,Key:key,Value:value,Who:who,OpID:seq,TTL:ttl})
 
     if e!=""{
       fmt.Fprintf(w, "%s",kvlib.JsonErr(string(e)))
@@ -546,14 +656,13 @@ func kvDeleteHandlerGC(kv *KVPaxos) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     key:= r.FormValue("key")
     value:= ""
-    opid:= r.FormValue("id")
-    uuid:=globalOpsCnt+kv.me
-    globalOpsCnt+=kv.N
-    if opid!="" {
-      uuid,_=strconv.Atoi(opid)
+    who,seq,err:=requestID(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+      return
     }
 
-    e,value:=kv.PaxosAgreementOp(Op{DeleteOp,key,value,-1,uuid})
+    e,value:=kv.PaxosAgreementOp(Op{OpType:DeleteOp,Key:key,Value:value,Who:who,OpID:seq})
 
     if e!=""{
       fmt.Fprintf(w, "%s",kvlib.JsonErr(string(e)))
@@ -563,24 +672,104 @@ func kvDeleteHandlerGC(kv *KVPaxos) http.HandlerFunc {
   }
 }
 
-func kvGetHandlerGC(kv *KVPaxos) http.HandlerFunc{
+func kvCasHandlerGC(kv *KVPaxos) http.HandlerFunc {
   return func(w http.ResponseWriter, r *http.Request) {
     key:= r.FormValue("key")
-    opid:= r.FormValue("id")
+    expected:= r.FormValue("expected")
+    value,err:=kv.formValue(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+      return
+    }
+    who,seq,err:=requestID(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+      return
+    }
+
+    e,value:=kv.PaxosAgreementOp(Op{OpType:CasOp,Key:key,Value:value,Who:who,OpID:seq,Expected:expected,ExpectAbsent:expected==""})
 
-    var args GetArgs = GetArgs{key,globalOpsCnt+kv.me,-1}
-    globalOpsCnt+=kv.N
-    var reply GetReply = GetReply{"",""}
-    if opid!="" {
-      args.OpID,_=strconv.Atoi(opid)
+    if e!=""{
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(string(e)))
+      return
     }
+    fmt.Fprintf(w, "%s",kvlib.JsonSucc(value))
+  }
+}
 
-    err:=kv.FormalGet(&args,&reply)
-    if err!=nil || reply.Err!=""{
+type txnResponse struct {
+  Success string `json:"success"`
+  Results []TxnResult `json:"results"`
+}
+
+func kvTxnHandlerGC(kv *KVPaxos) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method!="POST" {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr("Txn: please POST the transaction as JSON"))
+      return
+    }
+    who,seq,err:=requestID(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+      return
+    }
+    var args TxnArgs = TxnArgs{Txn:Txn{},OpID:seq,ClientID:who}
+    if err:=json.NewDecoder(r.Body).Decode(&args.Txn); err!=nil{
+      fmt.Fprintf(w, "%s",kvlib.JsonErr("Txn: malformed transaction: "+err.Error()))
+      return
+    }
+    for _,s:=range args.Txn.Steps {
+      if err:=kv.checkValueSize(len(s.Value)); err!=nil {
+        fmt.Fprintf(w, "%s",kvlib.JsonErr("Txn: "+err.Error()))
+        return
+      }
+    }
+
+    var reply TxnReply
+    kv.Txn(&args,&reply)
+    if reply.Err!=""{
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(string(reply.Err)))
+      return
+    }
+    var str,_=json.Marshal(&txnResponse{"true",reply.Results})
+    fmt.Fprintf(w, "%s",str)
+  }
+}
+
+func kvGetHandlerGC(kv *KVPaxos) http.HandlerFunc{
+  return func(w http.ResponseWriter, r *http.Request) {
+    key:= r.FormValue("key")
+    version:= r.FormValue("version")
+    who,seq,err:=requestID(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+      return
+    }
+
+    var args GetArgs = GetArgs{Key:key,OpID:seq,ClientID:who}
+    var reply GetReply = GetReply{"","",-1}
+
+    if version!="" {
+      //read an old version; use PaxosOps directly
+      v,err:=strconv.Atoi(version)
+      if err!=nil || v<0 {
+        fmt.Fprintf(w, "%s",kvlib.JsonErr("version should be a nonnegative log index"))
+        return
+      }
+      if kv.retention==0 {
+        //every version but the latest is already gone
+        fmt.Fprintf(w, "%s",kvlib.JsonErr(ErrNoVersions))
+        return
+      }
+      reply.Err,reply.Value,reply.Version=kv.PaxosAgreementOpVersion(Op{OpType:HistGetOp,Key:key,Who:who,OpID:seq,Version:v})
+    }else{
+      kv.FormalGet(&args,&reply)
+    }
+    if reply.Err!=""{
       fmt.Fprintf(w, "%s",kvlib.JsonErr(string(reply.Err)))
       return
     }
-    fmt.Fprintf(w, "%s",kvlib.JsonSucc(reply.Value))
+    fmt.Fprintf(w, "%s",kvlib.JsonSuccVersion(reply.Value,reply.Version))
   }
 }
 
@@ -595,20 +784,274 @@ func kvmanCountKeyHandlerGC(kv *KVPaxos) http.HandlerFunc{
     fmt.Fprintf(w, "%s",str)
   }
 }
+//streamed in key order, paginated; see kvlib.WriteDump
 func kvmanDumpHandlerGC(kv *KVPaxos) http.HandlerFunc{
   return func(w http.ResponseWriter, r *http.Request) {
-    _,data:=kv.PaxosStatOp()
-    var str,_=json.Marshal(data)
-    fmt.Fprintf(w, "%s",str)
+    p,err:=kvlib.ParseDumpParams(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+      return
+    }
+    http.NewResponseController(w).SetWriteDeadline(time.Now().Add(TransferTimeout))
+    st,_:=kv.syncView()
+    kvlib.WriteDump(w,p,st.keys(),st.get)
+  }
+}
+//the state of the database after the log index of a meaningless op, as a
+//kvlib snapshot file
+func kvmanSnapshotHandlerGC(kv *KVPaxos) http.HandlerFunc{
+  return func(w http.ResponseWriter, r *http.Request) {
+    //a large database takes longer than the WriteTimeout of the server
+    http.NewResponseController(w).SetWriteDeadline(time.Now().Add(TransferTimeout))
+    st,index:=kv.syncView()
+    w.Header().Set("Content-Type","application/x-ndjson")
+    w.Header().Set("Content-Disposition",fmt.Sprintf("attachment; filename=\"kvpaxos-%d.snap\"",index))
+    sw,err:=kvlib.NewSnapWriter(w,kvlib.SnapHeader{Index:index,Clock:st.clock})
+    for _,k:=range st.keys() {
+      if err!=nil {
+        break
+      }
+      if e,_:=st.lookup(k); st.live(e) {
+        err=sw.Write(kvlib.SnapEntry{Key:k,Value:[]byte(e.Value),Deadline:e.Deadline,Version:e.Version})
+      }
+    }
+    if err!=nil {
+      //the client sees a file without trailer
+      kv.log.Warn("snapshot not sent", "seq", index, "err", err)
+      return
+    }
+    sw.Close()
   }
 }
+
+type RestoreResponse struct {
+  Success string `json:"success"`
+  Index int `json:"index"` // the log index of the restore
+  Keys int `json:"keys"`
+}
+
+//replace the database by the snapshot file POSTed, through one RestoreOp
+//in the log, so that every replica applies it at the same index
+func kvmanRestoreHandlerGC(kv *KVPaxos) http.HandlerFunc{
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method!="POST" {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr("Restore: please POST a snapshot file"))
+      return
+    }
+    who,seq,err:=requestID(r)
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+      return
+    }
+    http.NewResponseController(w).SetReadDeadline(time.Now().Add(TransferTimeout))
+    var entries []kvlib.SnapEntry
+    _,err=kvlib.ReadSnapshot(http.MaxBytesReader(w,r.Body,MaxRestoreSize),func(e kvlib.SnapEntry) error {
+      if e.Key=="" {
+        return errors.New("snapshot: empty key")
+      }
+      entries=append(entries,e)
+      return nil
+    })
+    var tooLarge *http.MaxBytesError
+    if errors.As(err,&tooLarge) {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(fmt.Sprintf("Restore: the snapshot is larger than %d bytes",MaxRestoreSize)))
+      return
+    }
+    if err!=nil {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr("Restore: "+err.Error()))
+      return
+    }
+    enc,_:=json.Marshal(entries)
+    e,_,index:=kv.PaxosAgreementOpVersion(Op{OpType:RestoreOp,Value:string(enc),Who:who,OpID:seq})
+    if e!="" {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(string(e)))
+      return
+    }
+    kv.log.Info("restored", "seq", index, "keys", len(entries))
+    enc,_=json.Marshal(&RestoreResponse{Success:"true",Index:index,Keys:len(entries)})
+    fmt.Fprintf(w, "%s",enc)
+  }
+}
+
 func kvmanShutdownHandlerGC(kv *KVPaxos) http.HandlerFunc{
   return func(w http.ResponseWriter, r *http.Request) {
-    defer func(){
-      time.Sleep(1)
-      kv.Kill()
-    }()
-    fmt.Fprintf(w, "{success:\"true\",message:\"The kvpaxos server will shutdown immediately. Please wait for 10ms before the HTTP server detach (and release the listening port).\"}")
+    //this request is drained too, so the shutdown waits for it to end
+    go kv.Shutdown()
+    enc,_:=json.Marshal(&kvlib.MsgResponse{Success:"true",Message:fmt.Sprintf("The kvpaxos server stops accepting now, and shuts down once the requests in flight have ended, or after %v. The listening port is released by the time it exits.", kv.drainTimeout)})
+    fmt.Fprintf(w, "%s",enc)
+  }
+}
+//the log levels of this process, after applying level (as in
+//kvlog.SetLevels, e.g. paxos=debug,kvpaxos=info) and format, if given
+func kvmanLogLevelHandlerGC(kv *KVPaxos) http.HandlerFunc{
+  return func(w http.ResponseWriter, r *http.Request) {
+    if f:=r.FormValue("format"); f!="" {
+      if err:=kvlog.SetFormat(f); err!=nil {
+        fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+        return
+      }
+    }
+    if spec:=r.FormValue("level"); spec!="" {
+      if err:=kvlog.SetLevels(spec); err!=nil {
+        fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+        return
+      }
+      kv.log.Info("log levels changed", "spec", spec)
+    }
+    enc,_:=json.Marshal(&LogLevelResponse{Success:"true",Levels:kvlog.Levels(),Format:kvlog.GetFormat()})
+    fmt.Fprintf(w, "%s",enc)
+  }
+}
+
+type LogLevelResponse struct {
+  Success string `json:"success"`
+  Levels map[string]string `json:"levels"` // by subsystem; kvlog.Default for the others
+  Format string `json:"format"`
+}
+
+//the faults injected into the RPCs of this process (see faultnet); a POST
+//of a faultnet.Faults in JSON replaces them, and a DELETE removes them
+func kvmanFaultsHandlerGC(kv *KVPaxos) http.HandlerFunc{
+  return func(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+      case "POST":
+        body,err:=ioutil.ReadAll(http.MaxBytesReader(w,r.Body,1<<20))
+        if err==nil {
+          err=kv.net.SetJSON(body)
+        }
+        if err!=nil {
+          fmt.Fprintf(w, "%s",kvlib.JsonErr(err.Error()))
+          return
+        }
+        kv.log.Warn("faults injected", "faults", string(body))
+      case "DELETE":
+        kv.net.Set(faultnet.Faults{})
+        kv.log.Info("faults removed")
+    }
+    rep:=kv.net.Report()
+    enc,_:=json.Marshal(&FaultsResponse{"true",kv.peers[kv.me],rep.Faults,rep.Stats})
+    fmt.Fprintf(w, "%s",enc)
+  }
+}
+
+type FaultsResponse struct {
+  Success string `json:"success"`
+  Node string `json:"node"` // the from of the links of this node
+  Faults faultnet.Faults `json:"faults"`
+  Stats map[string]faultnet.Stats `json:"stats"` // by link
+}
+
+type StatusResponse struct {
+  Success string `json:"success"`
+  Node int `json:"node"` // from 0
+  Peers int `json:"peers"`
+  Max int `json:"max"` // of px.Max
+  Min int `json:"min"` // of px.Min; the instances below are forgotten
+  Touched int `json:"touched"` // the last instance applied
+  Snapstart int `json:"snapstart"` // the first instance not in the snapshot
+  UptimeS float64 `json:"uptime_s"`
+}
+
+//the positions of this server in the log; read without kv.mu, since an
+//agreement may hold it for long
+func kvmanStatusHandlerGC(kv *KVPaxos) http.HandlerFunc{
+  return func(w http.ResponseWriter, r *http.Request) {
+    touched,snapstart:=kv.position()
+    enc,_:=json.Marshal(&StatusResponse{Success:"true",Node:kv.me,Peers:kv.N,Max:kv.px.Max(),Min:kv.px.Min(),
+      Touched:touched,Snapstart:snapstart,UptimeS:time.Since(kv.started).Seconds()})
+    fmt.Fprintf(w, "%s",enc)
+  }
+}
+
+type LogEntry struct {
+  Seq int `json:"seq"`
+  State string `json:"state"` // decided, undecided, or forgotten below Min
+  Op string `json:"op,omitempty"`
+  Key string `json:"key,omitempty"`
+  Value string `json:"value,omitempty"` // its first MaxLogValue bytes
+  Size int `json:"size,omitempty"` // of the value
+  Session int64 `json:"session,omitempty"`
+  OpID int `json:"opid,omitempty"`
+  Timestamp int64 `json:"timestamp,omitempty"` // unix ns, of the proposer
+}
+
+type LogResponse struct {
+  Success string `json:"success"`
+  Min int `json:"min"`
+  Max int `json:"max"`
+  Touched int `json:"touched"`
+  Snapstart int `json:"snapstart"`
+  Entries []LogEntry `json:"entries"`
+}
+
+//the paxos instances from from to to, included, as this server knows
+//them; the last MaxLogRange up to Max by default
+func kvmanLogHandlerGC(kv *KVPaxos) http.HandlerFunc{
+  return func(w http.ResponseWriter, r *http.Request) {
+    min,max:=kv.px.Min(),kv.px.Max()
+    from,to:=max-MaxLogRange+1,max
+    if from<0 {
+      from=0
+    }
+    for name,p:=range map[string]*int{"from":&from,"to":&to} {
+      if s:=r.FormValue(name); s!="" {
+        n,err:=strconv.Atoi(s)
+        if err!=nil || n<0 {
+          fmt.Fprintf(w, "%s",kvlib.JsonErr(name+" should be a log index"))
+          return
+        }
+        *p=n
+      }
+    }
+    if r.FormValue("to")=="" && r.FormValue("from")!="" {
+      to=from+MaxLogRange-1
+      if to>max {
+        to=max
+      }
+    }
+    if to-from>=MaxLogRange {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr(fmt.Sprintf("at most %d instances at once", MaxLogRange)))
+      return
+    }
+    touched,snapstart:=kv.position()
+    rep:=LogResponse{Success:"true",Min:min,Max:max,Touched:touched,Snapstart:snapstart,Entries:[]LogEntry{}}
+    for i:=from;i<=to;i++ {
+      e:=LogEntry{Seq:i,State:"undecided"}
+      de,v:=kv.px.Status(i)
+      if i<min {
+        e.State="forgotten"
+      }else if op,ok:=v.(Op); de && ok {
+        e.State="decided"
+        e.Op,e.Key,e.Session,e.OpID,e.Timestamp=OpName[op.OpType],op.Key,op.Who,op.OpID,op.Timestamp
+        e.Value,e.Size=op.Value,len(op.Value)
+        if len(e.Value)>MaxLogValue {
+          e.Value=e.Value[:MaxLogValue]
+        }
+      }
+      rep.Entries=append(rep.Entries,e)
+    }
+    enc,_:=json.Marshal(&rep)
+    fmt.Fprintf(w, "%s",enc)
+  }
+}
+
+type CompactResponse struct {
+  Success string `json:"success"`
+  From int `json:"from"` // snapstart before
+  To int `json:"to"` // and after
+  Min int `json:"min"` // of px.Min, after; it moves once every peer is done
+}
+
+//fold the log applied so far into the snapshot now
+func kvmanCompactHandlerGC(kv *KVPaxos) http.HandlerFunc{
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method!="POST" {
+      fmt.Fprintf(w, "%s",kvlib.JsonErr("Compact: please POST"))
+      return
+    }
+    from,to:=kv.Compact()
+    enc,_:=json.Marshal(&CompactResponse{Success:"true",From:from,To:to,Min:kv.px.Min()})
+    fmt.Fprintf(w, "%s",enc)
   }
 }
 //end HTTP handlers
@@ -619,15 +1062,71 @@ var kvHandlerGCs = map[string]func(*KVPaxos)http.HandlerFunc{
   "get": kvGetHandlerGC,
   "delete":kvDeleteHandlerGC,
   "update":kvUpdateHandlerGC,
+  "cas":kvCasHandlerGC,
+  "txn":kvTxnHandlerGC,
+  "watch":kvWatchHandlerGC,
+  "session":kvSessionHandlerGC,
 }
 var kvmanHandlerGCs = map[string]func(*KVPaxos)http.HandlerFunc{
   "countkey": kvmanCountKeyHandlerGC,
   "dump": kvmanDumpHandlerGC,
   "shutdown": kvmanShutdownHandlerGC,
+  "loglevel": kvmanLogLevelHandlerGC,
+  "faults": kvmanFaultsHandlerGC,
+  "snapshot": kvmanSnapshotHandlerGC,
+  "restore": kvmanRestoreHandlerGC,
+  "status": kvmanStatusHandlerGC,
+  "log": kvmanLogHandlerGC,
+  "compact": kvmanCompactHandlerGC,
+}
+
+//a handler that answers 401 unless the request carries
+//"Authorization: Bearer <token>"; an empty token lets everyone in
+func requireToken(token string, h http.HandlerFunc) http.HandlerFunc {
+  if token=="" {
+    return h
+  }
+  want:=[]byte("Bearer "+token)
+  return func(w http.ResponseWriter, r *http.Request) {
+    if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")),want)==1 {
+      h(w,r)
+      return
+    }
+    w.Header().Set("WWW-Authenticate","Bearer")
+    if strings.HasPrefix(r.URL.Path,RestPrefix) {
+      restFail(w,http.StatusUnauthorized,"unauthorized","missing or wrong bearer token")
+      return
+    }
+    w.WriteHeader(http.StatusUnauthorized)
+    fmt.Fprintf(w, "%s",kvlib.JsonErr("missing or wrong bearer token"))
+  }
 }
 
 var RPC_Use_TCP int = 0
 
+//settings.conf; if empty, conf/settings.conf or, for the tests,
+//../../conf/settings.conf
+var SettingsPath = ""
+
+//the settings, or the defaults if there are none and they are not needed
+func readSettings(needed bool) *kvlib.Config {
+  confname:=SettingsPath
+  if confname=="" {
+    confname = kvlib.DefaultSettingsFile
+    if _,err:=os.Stat(confname); err!=nil && os.IsNotExist(err){
+      confname = "../../" + confname;
+    }
+  }
+  if _,err:=os.Stat(confname); err!=nil && !needed {
+    return kvlib.DefaultConfig()
+  }
+  cfg,err:=kvlib.LoadConfig(confname)
+  if err!=nil {
+    log.Fatal("settings: ", err)
+  }
+  return cfg
+}
+
 //
 // servers[] contains the ports of the set of
 // servers that will cooperate via Paxos to
@@ -635,6 +1134,46 @@ var RPC_Use_TCP int = 0
 // me is the index of the current server in servers[].
 //
 func StartServer(servers []string, me int) *KVPaxos {
+  return StartServerConfig(readSettings(StartHTTP), servers, me)
+}
+
+//StartServer with the settings cfg, in which me serves HTTP on the port
+//of its node if StartHTTP
+func StartServerConfig(cfg *kvlib.Config, servers []string, me int) *KVPaxos {
+  conf:=cfg.Settings()
+  if err:=kvlog.Configure(conf); err!=nil {
+    kvlog.New("kvpaxos").With("node", me).Warn("bad log settings", "err", err)
+  }
+  //the peers and the clerks of this process dial with rpcTLS
+  rpcTLS,peerTLS,err:=kvlib.PeerTLS(conf)
+  if err!=nil {
+    log.Fatal("rpc tls: ", err)
+  }
+  paxos.RPC_TLS=peerTLS
+  opts:=ServerOptions{Settings:conf, RPCTLS:rpcTLS}
+
+  if StartHTTP{
+    if me>=cfg.N() {
+      log.Fatalf("no node %s in the settings, of %d", kvlib.NodeName(me), cfg.N())
+    }
+    opts.HTTP,err=net.Listen("tcp", ":"+strconv.Itoa(cfg.Nodes[me].Port))
+    if err!=nil {
+      panic(err)
+    }
+  }
+  return StartServerWith(servers, me, opts)
+}
+
+//what StartServer takes from settings.conf and the globals of the
+//process, for servers that share a process with others
+type ServerOptions struct {
+  Settings map[string]string // tokens, HTTP TLS, retention, value size and drain timeout
+  HTTP net.Listener // served if not nil
+  RPCTLS *tls.Config // of the RPC listener, if not nil
+  Net *faultnet.Network // the faults of the RPCs, faultnet.Default if nil
+}
+
+func StartServerWith(servers []string, me int, opts ServerOptions) *KVPaxos {
   if RPC_Use_TCP == 1{
     paxos.RPC_Use_TCP = 1
   }
@@ -644,66 +1183,78 @@ func StartServer(servers []string, me int) *KVPaxos {
 
   kv := new(KVPaxos)
   kv.me = me
-  kv.N = len(servers) //used for universal incrementation of HTTP request OpIDs
+  kv.log = kvlog.New("kvpaxos").With("node", me)
+  kv.httpLog = kvlog.New("http").With("node", me)
+  kv.N = len(servers)
   kv.px_touchedPTR=-1 //0 is untouched at the beginning!
   kv.snapstart=0
-  kv.snapshot=make(map[string]string)
-
-  kv.doneOps=make(map[int]bool)
-  kv.latestClientOpResult=make(map[int]ID_Ret_Pair)
+  kv.publishLocked()
+  kv.snapshot=make(map[string]entry)
+  kv.retention=VersionRetention
+  kv.maxValueSize=MaxValueSize
+  kv.drainTimeout=DrainTimeout
+  kv.started=time.Now()
+
+  kv.sessions=make(map[int64]session)
+  kv.peers=servers
+  kv.metrics=newMetrics()
   kv.Death=make(chan int,2)
+  kv.quit=make(chan struct{})
+  kv.net=opts.Net
+  if kv.net==nil {
+    kv.net=faultnet.Default
+  }
 
-  go kv.housekeeper()
   // Your initialization code here.
 
-  if StartHTTP{
+  conf:=opts.Settings
+  if conf==nil {
+    conf=map[string]string{}
+  }
+  if r,err:=strconv.Atoi(conf["version_retention"]); err==nil && r>=0 {
+    kv.retention=r
+  }
+  if m,err:=strconv.Atoi(conf["max_value_size"]); err==nil && m>=0 {
+    kv.maxValueSize=m
+  }
+  if d,err:=strconv.Atoi(conf["drain_timeout_ms"]); err==nil && d>=0 {
+    kv.drainTimeout=time.Duration(d)*time.Millisecond
+  }
 
-    //HTTP initialization
-    //wait for a while, since previous server hasn't timed out on TCP!
-    time.Sleep(time.Millisecond*11)
+  if opts.HTTP!=nil {
 
+    //HTTP initialization
     serveMux := http.NewServeMux()
 
-
-
+    kvToken,kvmanToken:=conf["kv_token"],conf["kvman_token"]
     for key,val := range kvHandlerGCs{
-      serveMux.HandleFunc("/kv/"+key, val(kv))
+      serveMux.HandleFunc("/kv/"+key, requireToken(kvToken,val(kv)))
     }
     for key,val := range kvmanHandlerGCs{
-      serveMux.HandleFunc("/kvman/"+key, val(kv))
+      serveMux.HandleFunc("/kvman/"+key, requireToken(kvmanToken,val(kv)))
     }
-    serveMux.HandleFunc("/", kvDumpHandlerGC(kv))
-
-    confname := "conf/settings.conf"
+    serveMux.HandleFunc(RestPrefix, requireToken(kvToken,kvKeysHandlerGC(kv)))
+    serveMux.HandleFunc("/metrics", requireToken(kvmanToken,kvMetricsHandlerGC(kv)))
+    //the log is for administrators
+    serveMux.HandleFunc("/", requireToken(kvmanToken,kvDumpHandlerGC(kv)))
 
-    if _,err:=os.Stat(confname); err!=nil && os.IsNotExist(err){
-      confname = "../../" + confname;
+    httpTLS,err:=kvlib.HTTPServerTLS(conf)
+    if err!=nil {
+      log.Fatal("http tls: ", err)
     }
-
-    conf:= kvlib.ReadJson(confname)
-    listenPort:=kvlib.Find_Port(me,conf)
     s := &http.Server{
-      //Addr: ":"+strconv.Itoa(listenPort),
       Handler: serveMux,
       ReadTimeout: 1 * time.Second,
       WriteTimeout: 30 * time.Second,
       MaxHeaderBytes: 1<<20,
+      TLSConfig: httpTLS,
     }
 
-    originalListener, err := net.Listen("tcp", ":"+strconv.Itoa(listenPort))
+    kv.httpLog.Info("serving", "addr", opts.HTTP.Addr().String(), "tls", httpTLS!=nil)
+    kv.HTTP,err=stoppableHTTPlistener.Serve(s, opts.HTTP, httpTLS!=nil)
     if err!=nil {
       panic(err)
     }
-    sl, err := stoppableHTTPlistener.New(originalListener)
-    if err!=nil {
-      panic(err)
-    }
-    kv.HTTPListener=sl
-    go func(){
-      fmt.Printf("Starting HTTP server: %d\n",listenPort)
-      s.Serve(sl)
-      //will be stopped by housekeeper!
-    }()
 
   }
 
@@ -714,8 +1265,10 @@ func StartServer(servers []string, me int) *KVPaxos {
   rpcs := rpc.NewServer()
   rpcs.Register(kv)
 
-  kv.px = paxos.Make(servers, me, rpcs)
-  fmt.Println("len is:", len(servers))
+  kv.px = paxos.MakeNet(servers, me, rpcs, kv.net)
+  //once kv.px and the settings it compacts by are set
+  go kv.housekeeper()
+  kv.log.Info("started", "peers", len(servers))
   os.Remove(servers[me])
   var socktype="unix"
   if RPC_Use_TCP==1{socktype="tcp"} // This is to help running servers between different machines!
@@ -724,6 +1277,11 @@ func StartServer(servers []string, me int) *KVPaxos {
   if e != nil {
     log.Fatal("listen error: ", e);
   }
+  if opts.RPCTLS!=nil {
+    //the handshake, with the certificate of the caller, takes place on
+    //the first read of ServeConn
+    l = tls.NewListener(l, opts.RPCTLS)
+  }
   kv.l = l
 
 
@@ -739,11 +1297,9 @@ func StartServer(servers []string, me int) *KVPaxos {
           conn.Close()
         } else if kv.unreliable && (rand.Int63() % 1000) < 200 {
           // process the request but force discard of reply.
-          c1 := conn.(*net.UnixConn)
-          f, _ := c1.File()
-          err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+          err := paxos.CloseWrite(conn)
           if err != nil {
-            fmt.Printf("shutdown: %v\n", err)
+            kv.log.Error("shutdown", "err", err)
           }
           go rpcs.ServeConn(conn)
         } else {
@@ -753,7 +1309,7 @@ func StartServer(servers []string, me int) *KVPaxos {
         conn.Close()
       }
       if err != nil && kv.dead == false {
-        fmt.Printf("KVPaxos(%v) accept: %v\n", me, err.Error())
+        kv.log.Error("accept failed", "err", err)
         kv.kill()
       }
     }
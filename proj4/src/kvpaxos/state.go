@@ -0,0 +1,443 @@
+package kvpaxos
+
+import (
+  "encoding/json"
+  "fmt"
+  "sort"
+  "time"
+
+  "kvlib"
+)
+
+var TxnStepOps = map[string]int{
+  "get": GetOp,
+  "insert": PutOp,
+  "put": PutOp,
+  "update": UpdateOp,
+  "delete": DeleteOp,
+  "cas": CasOp,
+}
+
+//a value in the database, or a tombstone once the key is deleted
+type entry struct {
+  Value string
+  Tombstone bool
+  Deadline int64 // the key expires once the log clock reaches it; 0 means never
+  Version int // the log index of the write
+  History []entry // older versions still inside the retention window, oldest first
+}
+
+//the latest op of a client session, and what it returned
+type session struct {
+  Seq int // high-water mark: ops of the session up to Seq are done
+  Err Err
+  Ret string
+  Version int
+  Seen int64 // log clock at the latest op; the session expires SessionTimeout after
+}
+
+//kvView is the database as seen after replaying part of the log on top of
+//the snapshot. Writes are kept aside in dirty, so that replaying never
+//touches kv.snapshot unless commit() is called (by the housekeeper).
+//
+//clock is the largest Op.Timestamp replayed so far. Expiry is judged
+//against it rather than the local time, so every replica expires a key
+//at the same position of the log. The same holds for client sessions,
+//kept in sessions/dirtySessions alike.
+type kvView struct {
+  base map[string]entry
+  dirty map[string]entry
+  sessions map[int64]session
+  dirtySessions map[int64]session
+  clock int64
+  retention int // how many log indices old versions are kept for
+  onWrite func(op Op, val string) // if set, called for every successful write
+}
+
+func (kv *KVPaxos) newView() *kvView {
+  return &kvView{kv.snapshot, make(map[string]entry), kv.sessions, make(map[int64]session),
+    kv.snapclock, kv.retention, nil}
+}
+
+func (v *kvView) live(e entry) bool {
+  return !e.Tombstone && (e.Deadline==0 || e.Deadline>v.clock)
+}
+
+func (v *kvView) lookup(key string) (entry,bool) {
+  e,found:=v.dirty[key]
+  if !found {
+    e,found=v.base[key]
+  }
+  return e,found
+}
+
+//the value of key, and whether it exists
+func (v *kvView) get(key string) (string,bool) {
+  e,found:=v.lookup(key)
+  if !found || !v.live(e) {
+    return "",false
+  }
+  return e.Value,true
+}
+
+//the current version of key, -1 if it does not exist
+func (v *kvView) version(key string) int {
+  e,found:=v.lookup(key)
+  if !found || !v.live(e) {
+    return -1
+  }
+  return e.Version
+}
+
+//the value of key as of log index version, and the version of that value.
+//Expiry is not taken into account, as the log clock of old indices is not kept.
+//The version is -1 if the key did not exist then.
+func (v *kvView) getAt(key string, version int) (string,int) {
+  e,found:=v.lookup(key)
+  if !found {
+    return "",-1
+  }
+  h:=e.History
+  for k:=len(h);e.Version>version;k-- {
+    if k==0 {
+      return "",-1
+    }
+    e=h[k-1]
+  }
+  if e.Tombstone {
+    return "",-1
+  }
+  return e.Value,e.Version
+}
+
+func (v *kvView) set(key string, val string, tombstone bool, deadline int64, version int) {
+  old,found:=v.lookup(key)
+  var h []entry
+  if found && v.retention>0 {
+    //copy, the history may be shared with the snapshot
+    h=make([]entry,len(old.History),len(old.History)+1)
+    copy(h,old.History)
+    h=append(h,entry{old.Value,old.Tombstone,old.Deadline,old.Version,nil})
+  }
+  v.dirty[key]=entry{val,tombstone,deadline,version,h}
+}
+
+//the session who, unless it does not exist or has expired
+func (v *kvView) session(who int64) (session,bool) {
+  s,found:=v.dirtySessions[who]
+  if !found {
+    s,found=v.sessions[who]
+  }
+  if found && s.Seen+int64(SessionTimeout)<v.clock {
+    return session{},false
+  }
+  return s,found
+}
+
+//whether op was done before in its session;
+//if so, returns what the client of op got back
+func (v *kvView) duplicate(op Op) (bool,Err,string,int) {
+  if op.OpID==0 {
+    return false,"","",-1
+  }
+  s,found:=v.session(op.Who)
+  if !found || op.OpID>s.Seq {
+    return false,"","",-1
+  }
+  if op.OpID<s.Seq {
+    return true,"Error: repeated, old request...","",-1
+  }
+  return true,s.Err,s.Ret,s.Version
+}
+
+//apply op, decided at log index i, unless it is a duplicate,
+//and record the result in its session
+func (v *kvView) step(i int, op Op) (Err,string,int) {
+  if op.Timestamp>v.clock {
+    v.clock=op.Timestamp
+  }
+  if dup,e,ret,ver:=v.duplicate(op); dup {
+    return e,ret,ver
+  }
+  e,ret,ver:=v.apply(i,op)
+  if op.OpID!=0 {
+    v.dirtySessions[op.Who]=session{op.OpID,e,ret,ver,v.clock}
+  }
+  return e,ret,ver
+}
+
+//write back into the snapshot, which now ends right before log index upto.
+//Versions that were overwritten before the retention window are dropped,
+//and so are deleted and expired keys once they have no version left in it,
+//and expired sessions.
+func (v *kvView) commit(upto int) {
+  for k,e:=range v.dirty {
+    v.base[k]=e
+  }
+  for who,s:=range v.dirtySessions {
+    v.sessions[who]=s
+  }
+  for who:=range v.sessions {
+    if _,found:=v.session(who); !found {
+      delete(v.sessions,who)
+    }
+  }
+  v.dirtySessions=make(map[int64]session)
+  for k,e:=range v.base {
+    drop:=0
+    for drop<len(e.History) {
+      next:=e.Version
+      if drop+1<len(e.History) {
+        next=e.History[drop+1].Version
+      }
+      if next>upto-v.retention {
+        break
+      }
+      drop++
+    }
+    if drop>0 {
+      e.History=e.History[drop:]
+      v.base[k]=e
+    }
+    if !v.live(e) && len(e.History)==0 && e.Version<=upto-v.retention {
+      delete(v.base,k)
+    }
+  }
+  v.dirty=make(map[string]entry)
+}
+
+//the keys of the view, sorted, including those that no longer exist
+func (v *kvView) keys() []string {
+  r:=make([]string,0,len(v.base)+len(v.dirty))
+  for k:=range v.base {
+    r=append(r,k)
+  }
+  for k:=range v.dirty {
+    if _,found:=v.base[k]; !found {
+      r=append(r,k)
+    }
+  }
+  sort.Strings(r)
+  return r
+}
+
+//all existing key-value pairs
+func (v *kvView) dump() map[string]string {
+  r:=make(map[string]string)
+  for k:=range v.base {
+    if val,ok:=v.get(k); ok {
+      r[k]=val
+    }
+  }
+  for k:=range v.dirty {
+    if val,ok:=v.get(k); ok {
+      r[k]=val
+    }
+  }
+  return r
+}
+
+//simulate op on cur, the value of op.Key before it, and whether the key
+//existed; returns the value after op, whether the key exists after op,
+//and whether op succeeded.
+func applyOp(cur string, exists bool, op Op) (string,bool,bool) {
+  switch op.OpType{
+    case GetOp:
+      return cur,exists,exists
+    case PutOp:
+      if exists{
+        return cur,exists,false
+      }
+      return op.Value,true,true
+    case NaivePutOp:
+      return op.Value,true,true
+    case DeleteOp:
+      return "",false,exists
+    case UpdateOp:
+      if !exists{
+        return cur,exists,false
+      }
+      return op.Value,true,true
+    case CasOp:
+      if op.ExpectAbsent==exists || (exists && cur!=op.Expected){
+        return cur,exists,false
+      }
+      return op.Value,true,true
+  }
+  return cur,exists,true
+}
+
+//apply op, decided at log index i, to the view;
+//returns what the client of op should get back,
+//and the version of op.Key after op
+func (v *kvView) apply(i int, op Op) (Err,string,int) {
+  if op.Timestamp>v.clock {
+    v.clock=op.Timestamp
+  }
+  switch op.OpType{
+    case TxnOp:
+      e,ret:=v.applyTxn(i,op)
+      return e,ret,i
+    case RestoreOp:
+      return v.applyRestore(i,op),"",i
+    case HistGetOp:
+      if op.Version>i {
+        return "Get: version not reached yet?","",-1
+      }
+      if op.Version<i-v.retention {
+        return "Get: version compacted?","",-1
+      }
+      val,ver:=v.getAt(op.Key,op.Version)
+      if ver<0 {
+        return "Key Not Found","",-1
+      }
+      return "",val,ver
+  }
+  beforeVal,beforeExists:=v.get(op.Key)
+  latestVal,latestExists,latestSucc:=applyOp(beforeVal,beforeExists,op)
+  if latestSucc && op.OpType!=GetOp {
+    var deadline int64
+    if op.TTL>0 && latestExists {
+      deadline=op.Timestamp+op.TTL*int64(time.Millisecond)
+    }
+    v.set(op.Key,latestVal,!latestExists,deadline,i)
+    if v.onWrite!=nil {
+      v.onWrite(op,latestVal)
+    }
+  }
+  ver:=v.version(op.Key)
+  switch op.OpType{
+    case GetOp:
+      if !latestSucc{
+        return "Key Not Found","",ver
+      }
+      return "",latestVal,ver
+    case PutOp:
+      if !latestSucc{
+        return "Put/Insert: key exist?","",ver
+      }
+    case DeleteOp:
+      if !latestSucc{
+        return "Delete: key not exist?","",ver
+      }
+    case UpdateOp:
+      if !latestSucc{
+        return "Update: key not exist?","",ver
+      }
+    case CasOp:
+      if !latestSucc{
+        return "CAS: value mismatch?","",ver
+      }
+    case NaivePutOp:
+  }
+  return "",beforeVal,ver
+}
+
+//the returned value is the JSON-encoded []TxnResult
+func (v *kvView) applyTxn(i int, op Op) (Err,string) {
+  var txn Txn
+  if json.Unmarshal([]byte(op.Value),&txn)!=nil {
+    return "Txn: malformed transaction?",""
+  }
+  for _,g:=range txn.Guards {
+    val,exists:=v.get(g.Key)
+    if exists==g.Absent || (exists && val!=g.Value) {
+      return "Txn: guard failed?",""
+    }
+  }
+  //the entries of dirty the steps replace, to undo them all if a write
+  //fails; onWrite hears of the writes once all of them succeeded
+  type saved struct {
+    e entry
+    found bool
+  }
+  undo:=make(map[string]saved)
+  var written []Op
+  var vals []string
+  onWrite:=v.onWrite
+  v.onWrite=func(o Op, val string){
+    written=append(written,o)
+    vals=append(vals,val)
+  }
+  defer func(){ v.onWrite=onWrite }()
+  results:=make([]TxnResult,len(txn.Steps))
+  for k,s:=range txn.Steps {
+    if _,found:=undo[s.Key]; !found {
+      e,found:=v.dirty[s.Key]
+      undo[s.Key]=saved{e,found}
+    }
+    e,val,_:=v.apply(i,Op{OpType:TxnStepOps[s.Op],Key:s.Key,Value:s.Value,Expected:s.Expected,ExpectAbsent:s.Absent})
+    results[k]=TxnResult{e=="",val,e}
+    if e!="" && s.Op!="get" {
+      for key,u:=range undo {
+        if u.found {
+          v.dirty[key]=u.e
+        }else{
+          delete(v.dirty,key)
+        }
+      }
+      return Err(fmt.Sprintf("Txn: step %d, %s of %s, failed, nothing is written: %s",k,s.Op,s.Key,e)),""
+    }
+  }
+  if onWrite!=nil {
+    for j,o:=range written {
+      onWrite(o,vals[j])
+    }
+  }
+  enc,_:=json.Marshal(results)
+  return "",string(enc)
+}
+
+//reject transactions that cannot be applied, before they reach the log
+func checkTxn(txn *Txn) Err {
+  if len(txn.Steps)==0 {
+    return "Txn: no steps?"
+  }
+  for _,s:=range txn.Steps {
+    if _,found:=TxnStepOps[s.Op]; !found {
+      return Err("Txn: unknown op "+s.Op)
+    }
+    if s.Key=="" {
+      return "Txn: key not found, please give nonempty string"
+    }
+  }
+  return ""
+}
+
+//replace the whole database by the snapshot entries in op.Value; every key
+//written gets version i, as versions of the source cluster mean nothing here
+func (v *kvView) applyRestore(i int, op Op) Err {
+  var entries []kvlib.SnapEntry
+  if json.Unmarshal([]byte(op.Value),&entries)!=nil {
+    return "Restore: malformed snapshot?"
+  }
+  restored:=make(map[string]bool,len(entries))
+  for _,e:=range entries {
+    restored[e.Key]=true
+  }
+  for _,k:=range v.keys() {
+    if _,exists:=v.get(k); exists && !restored[k] {
+      v.set(k,"",true,0,i)
+      if v.onWrite!=nil {
+        v.onWrite(Op{OpType:RestoreOp,Key:k},"")
+      }
+    }
+  }
+  for _,e:=range entries {
+    if e.Deadline!=0 && e.Deadline<=v.clock {
+      //expired since the snapshot
+      if _,exists:=v.get(e.Key); exists {
+        v.set(e.Key,"",true,0,i)
+        if v.onWrite!=nil {
+          v.onWrite(Op{OpType:RestoreOp,Key:e.Key},"")
+        }
+      }
+      continue
+    }
+    v.set(e.Key,string(e.Value),false,e.Deadline,i)
+    if v.onWrite!=nil {
+      v.onWrite(Op{OpType:RestoreOp,Key:e.Key},string(e.Value))
+    }
+  }
+  return ""
+}
@@ -7,6 +7,28 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "errors"
+import "kvlib"
+import "kvlog"
+import "kvpaxos/httpclient"
+import "net/http"
+import "encoding/json"
+import "strings"
+import "sync"
+import "paxos"
+import "faultnet"
+import "reflect"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import cryptorand "crypto/rand"
+import "encoding/pem"
+import "io/ioutil"
+import "math/big"
+import "net"
+import "path/filepath"
+import "encoding/csv"
 
 func check(t *testing.T, ck *Clerk, key string, value string) {
   v := ck.Get(key)
@@ -29,6 +51,15 @@ func port(tag string, host int) string {
   return s
 }
 
+// the settings the servers of the tests read
+func settings(t *testing.T) *kvlib.Config {
+  conf, err := kvlib.LoadConfig("../../conf/settings.conf")
+  if err != nil {
+    t.Fatalf("settings: %v", err)
+  }
+  return conf
+}
+
 func cleanup(kva []*KVPaxos) {
   for i := 0; i < len(kva); i++ {
     if kva[i] != nil {
@@ -700,3 +731,1738 @@ func TestManyPartition(t *testing.T) {
     fmt.Printf("  ... Passed\n")
   }
 }
+
+func TestCas(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("cas", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  fmt.Printf("Test: Compare-and-swap ...\n")
+
+  opid := rand.Int()
+  cas := func(srv int, key string, expected string, value string) Err {
+    opid++
+    e, _ := kva[srv].PaxosAgreementOp(Op{OpType:CasOp, Key:key, Value:value, Who:-1, OpID:opid, Expected:expected, ExpectAbsent:expected == ""})
+    return e
+  }
+
+  if e := cas(0, "c", "", "1"); e != "" {
+    t.Fatalf("CAS on absent key with empty expected failed: %v", e)
+  }
+  if e := cas(1, "c", "", "2"); e == "" {
+    t.Fatalf("CAS on existing key with empty expected succeeded")
+  }
+  if e := cas(2, "c", "2", "3"); e == "" {
+    t.Fatalf("CAS with wrong expected value succeeded")
+  }
+  if e := cas(1, "c", "1", "3"); e != "" {
+    t.Fatalf("CAS with right expected value failed: %v", e)
+  }
+  opid++
+  _, v := kva[2].PaxosAgreementOp(Op{OpType:GetOp, Key:"c", Who:-1, OpID:opid})
+  if v != "3" {
+    t.Fatalf("Get(c) -> %v, expected 3", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTxn(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("txn", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Multi-key transactions ...\n")
+
+  ck.Put("k1", "v1")
+
+  move := Txn{
+    Guards: []TxnGuard{{Key:"k1", Value:"v1"}, {Key:"k2", Absent:true}},
+    Steps: []TxnStep{{Op:"insert", Key:"k2", Value:"v1"}, {Op:"delete", Key:"k1"}, {Op:"get", Key:"k3"}},
+  }
+  e, res := ck.Txn(move)
+  if e != "" {
+    t.Fatalf("Txn failed: %v", e)
+  }
+  if len(res) != 3 || !res[0].Success || !res[1].Success || res[1].Value != "v1" || res[2].Success {
+    t.Fatalf("wrong Txn results %v", res)
+  }
+  check(t, ck, "k1", "")
+  check(t, ck, "k2", "v1")
+
+  // the guards no longer hold
+  e, res = ck.Txn(move)
+  if e == "" {
+    t.Fatalf("Txn with failing guard committed: %v", res)
+  }
+  check(t, ck, "k2", "v1")
+
+  // the insert fails once the delete before it took place
+  ck.Put("k3", "v3")
+  e, res = ck.Txn(Txn{Steps: []TxnStep{{Op:"put", Key:"k4", Value:"v4"}, {Op:"delete", Key:"k2"}, {Op:"insert", Key:"k3", Value:"v2"}, {Op:"update", Key:"k3", Value:"v5"}}})
+  if !strings.Contains(string(e), "step 2") {
+    t.Fatalf("Txn with a failing step -> %v %v", e, res)
+  }
+  check(t, ck, "k2", "v1")
+  check(t, ck, "k3", "v3")
+  check(t, ck, "k4", "")
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestTTL(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("ttl", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    // no old versions, which would keep expired keys in the snapshot
+    kva[i].retention = 0
+  }
+
+  fmt.Printf("Test: Keys expire at the same log position ...\n")
+
+  // timestamps are given explicitly, as if written by the proposers,
+  // so that the test does not depend on the local clocks.
+  now := time.Now().UnixNano()
+  opid := rand.Int()
+  do := func(srv int, op Op, ms int64) (Err, string) {
+    opid++
+    op.Who = -1
+    op.OpID = opid
+    op.Timestamp = now + ms*int64(time.Millisecond)
+    return kva[srv].PaxosAgreementOp(op)
+  }
+
+  if e, _ := do(0, Op{OpType:PutOp, Key:"s", Value:"x", TTL:100}, 0); e != "" {
+    t.Fatalf("Put with ttl failed: %v", e)
+  }
+  if _, v := do(1, Op{OpType:GetOp, Key:"s"}, 99); v != "x" {
+    t.Fatalf("Get(s) before deadline -> %v, expected x", v)
+  }
+  if e, v := do(2, Op{OpType:GetOp, Key:"s"}, 100); e == "" {
+    t.Fatalf("Get(s) after deadline -> %v, expected expired", v)
+  }
+  for i := 0; i < nservers; i++ {
+    if cnt, _ := kva[i].PaxosStatOp(); cnt != 0 {
+      t.Fatalf("server %d counts %d keys, expected 0", i, cnt)
+    }
+  }
+  if e, _ := do(1, Op{OpType:PutOp, Key:"s", Value:"y"}, 200); e != "" {
+    t.Fatalf("Put on expired key failed: %v", e)
+  }
+  if _, v := do(0, Op{OpType:GetOp, Key:"s"}, 100000); v != "y" {
+    t.Fatalf("Get(s) -> %v, expected y without ttl", v)
+  }
+
+  // let the housekeeper compact an expired key into the snapshot
+  do(0, Op{OpType:PutOp, Key:"gone", Value:"z", TTL:1}, 100000)
+  for i := 0; i < SaveMemThreshold*2; i++ {
+    do(i % nservers, Op{OpType:GetOp, Key:"s"}, 100001)
+  }
+  time.Sleep(100 * time.Millisecond)
+  for i := 0; i < nservers; i++ {
+    kva[i].mu.Lock()
+    _, found := kva[i].snapshot["gone"]
+    start := kva[i].snapstart
+    kva[i].mu.Unlock()
+    if start > 0 && found {
+      t.Fatalf("server %d keeps an expired key in its snapshot", i)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestWatch(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("watch", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  ck := MakeClerk(kvh)
+
+  fmt.Printf("Test: Watch key changes ...\n")
+
+  ck.Put("other", "1")
+  ck.Put("w", "1")
+  r := ck.Watch("w", "", 0)
+  if r.Err != "" || len(r.Events) != 1 || r.Events[0].Key != "w" || r.Events[0].Value != "1" || r.Next != r.Events[0].Index+1 {
+    t.Fatalf("Watch(w) from the start -> %+v", r)
+  }
+
+  ch := make(chan WatchReply)
+  go func() {
+    //kvh[2] serves no request, and still learns of the writes
+    ch <- MakeClerk([]string{kvh[2]}).Watch("", "p/", r.Next)
+  }()
+  time.Sleep(100 * time.Millisecond)
+  ck.Put("w", "2")
+  MakeClerk([]string{kvh[0]}).Put("p/x", "3")
+
+  select {
+  case r := <-ch:
+    if len(r.Events) != 1 || r.Events[0].Key != "p/x" || r.Events[0].Value != "3" {
+      t.Fatalf("Watch(prefix p/) -> %+v", r)
+    }
+  case <-time.After(10 * time.Second):
+    t.Fatalf("Watch(prefix p/) did not return")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Watch from a compacted log ...\n")
+
+  ck0 := MakeClerk([]string{kvh[0]})
+  for i := 0; i < 5; i++ {
+    ck0.Put("w", strconv.Itoa(10+i))
+  }
+  kva[0].Compact()
+  r = ck0.Watch("w", "", 0)
+  if r.Err == "" || r.Values == nil || r.Values["w"] != "14" || len(r.Values) != 1 || len(r.Events) != 0 {
+    t.Fatalf("Watch(w) from a compacted index -> %+v", r)
+  }
+  go func() {
+    ch <- ck0.Watch("w", "", r.Next)
+  }()
+  time.Sleep(100 * time.Millisecond)
+  ck0.Put("w", "15")
+  select {
+  case r := <-ch:
+    if r.Err != "" || len(r.Events) != 1 || r.Events[0].Value != "15" {
+      t.Fatalf("Watch(w) resumed after compaction -> %+v", r)
+    }
+  case <-time.After(10 * time.Second):
+    t.Fatalf("Watch(w) resumed after compaction did not return")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestVersions(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("versions", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    kva[i].retention = 2 * SaveMemThreshold
+  }
+
+  fmt.Printf("Test: Versioned values ...\n")
+
+  opid := rand.Int()
+  do := func(srv int, op Op) (Err, string, int) {
+    opid++
+    op.Who = -1
+    op.OpID = opid
+    return kva[srv].PaxosAgreementOpVersion(op)
+  }
+
+  _, _, v1 := do(0, Op{OpType:PutOp, Key:"a", Value:"1"})
+  do(1, Op{OpType:UpdateOp, Key:"a", Value:"2"})
+  e, val, v2 := do(2, Op{OpType:GetOp, Key:"a"})
+  if e != "" || val != "2" || v2 <= v1 {
+    t.Fatalf("Get(a) -> %v %v version %v, expected 2 after version %v", e, val, v2, v1)
+  }
+  if _, val, ver := do(1, Op{OpType:HistGetOp, Key:"a", Version:v2 - 1}); val != "1" || ver != v1 {
+    t.Fatalf("Get(a) at version %v -> %v version %v, expected 1 version %v", v2 - 1, val, ver, v1)
+  }
+  if e, val, _ := do(0, Op{OpType:HistGetOp, Key:"a", Version:v1 - 1}); e == "" {
+    t.Fatalf("Get(a) before it was inserted -> %v", val)
+  }
+
+  // push version v1 out of the retention window; the snapshot must
+  // keep it as long as it is inside
+  compacted := false
+  for i := 0; i < SaveMemThreshold * 4; i++ {
+    e, val, _ := do(i % nservers, Op{OpType:HistGetOp, Key:"a", Version:v1})
+    if e == "" && (val != "1" || compacted) {
+      t.Fatalf("Get(a) at version %v -> %v", v1, val)
+    }
+    compacted = compacted || e != ""
+  }
+  if !compacted {
+    t.Fatalf("version %v never left the retention window", v1)
+  }
+  if _, val, _ := do(2, Op{OpType:GetOp, Key:"a"}); val != "2" {
+    t.Fatalf("Get(a) -> %v, expected 2", val)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestSessions(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("sessions", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+
+  fmt.Printf("Test: Sessions tell apart equal sequence numbers ...\n")
+
+  s1 := nrand()
+  s2 := nrand()
+  kva[0].PaxosAgreementOp(Op{OpType:NaivePutOp, Key:"a", Value:"1", Who:s1, OpID:1})
+  _, prev := kva[1].PaxosAgreementOp(Op{OpType:NaivePutOp, Key:"a", Value:"2", Who:s2, OpID:1})
+  if prev != "1" {
+    t.Fatalf("second session's op was taken as a duplicate: previous value %v, expected 1", prev)
+  }
+
+  // a retry of the latest op of s2 returns the same result, on any server
+  kva[2].PaxosAgreementOp(Op{OpType:GetOp, Key:"a", Who:s1, OpID:2})
+  _, prev = kva[0].PaxosAgreementOp(Op{OpType:NaivePutOp, Key:"a", Value:"2", Who:s2, OpID:1})
+  if prev != "1" {
+    t.Fatalf("retry -> previous value %v, expected 1", prev)
+  }
+  kva[2].PaxosAgreementOp(Op{OpType:NaivePutOp, Key:"a", Value:"1", Who:s1, OpID:1})
+  if _, v := kva[1].PaxosAgreementOp(Op{OpType:GetOp, Key:"a", Who:s1, OpID:3}); v != "2" {
+    t.Fatalf("older op of a session was executed again: Get(a) -> %v, expected 2", v)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Legacy ids need not increase ...\n")
+
+  legacy := func(q string) map[string]interface{} {
+    resp, err := http.Get(settings(t).URL(0) + "/kv/" + q)
+    if err != nil {
+      t.Fatalf("/kv/%v: %v", q, err)
+    }
+    return kvlib.DecodeJson(resp)
+  }
+  if r := legacy("put?key=l&value=5&id=5"); r["success"] != "true" {
+    t.Fatalf("put with id 5 -> %v", r)
+  }
+  if r := legacy("update?key=l&value=3&id=3"); r["success"] != "true" {
+    t.Fatalf("update with id 3 after id 5 -> %v", r)
+  }
+  if r := legacy("put?key=l&value=5&id=5"); r["success"] != "true" || r["value"] != "" {
+    t.Fatalf("retry of id 5 -> %v, expected the result of the first put", r)
+  }
+  if r := legacy("get?key=l"); r["value"] != "3" {
+    t.Fatalf("Get(l) -> %v, expected 3", r)
+  }
+  if r := legacy("put?key=l&value=1&id=-1"); r["success"] != "false" {
+    t.Fatalf("put with id -1 -> %v", r)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Sessions survive compaction ...\n")
+
+  s3 := nrand()
+  seq := 0
+  // decide enough ops to compact the log up to what was decided before
+  fill := func() {
+    upto := 0
+    for i := 0; i < nservers; i++ {
+      if touched, _ := kva[i].position(); touched > upto {
+        upto = touched
+      }
+    }
+    for i := 0; i < SaveMemThreshold * 3; i++ {
+      seq++
+      kva[i % nservers].PaxosAgreementOp(Op{OpType:NaivePutOp, Key:"b", Value:"x", Who:s3, OpID:seq})
+    }
+    for iters := 0; ; iters++ {
+      compacted := true
+      for i := 0; i < nservers; i++ {
+        _, snapstart := kva[i].position()
+        compacted = compacted && snapstart > upto
+      }
+      if compacted {
+        return
+      }
+      if iters > 100 {
+        t.Fatalf("log was not compacted up to %v", upto)
+      }
+      time.Sleep(50 * time.Millisecond)
+    }
+  }
+  fill()
+  for i := 0; i < nservers; i++ {
+    if _, prev := kva[i].PaxosAgreementOp(Op{OpType:NaivePutOp, Key:"a", Value:"2", Who:s2, OpID:1}); prev != "1" {
+      t.Fatalf("retry after compaction -> previous value %v, expected 1", prev)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Sessions expire by the log clock ...\n")
+
+  later := time.Now().Add(2 * SessionTimeout).UnixNano()
+  kva[1].PaxosAgreementOp(Op{OpType:GetOp, Key:"a", Who:s3, OpID:seq + 1, Timestamp:later})
+  seq++
+  if e, v := kva[2].PaxosAgreementOp(Op{OpType:GetOp, Key:"a", Who:s1, OpID:2}); e != "" || v != "2" {
+    t.Fatalf("op of an expired session -> %v %v, expected it to be executed", e, v)
+  }
+  fill()
+  for i := 0; i < nservers; i++ {
+    kva[i].mu.Lock()
+    _, expired := kva[i].sessions[s2]
+    _, active := kva[i].sessions[s3]
+    kva[i].mu.Unlock()
+    if expired {
+      t.Fatalf("server %v kept the expired session", i)
+    }
+    if !active {
+      t.Fatalf("server %v dropped an active session", i)
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestHTTPClient(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("httpclient", i)
+  }
+  conf := settings(t)
+  // a server that is down comes first, to be rotated away from
+  urls := []string{"http://127.0.0.1:1"}
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    urls = append(urls, conf.URL(i))
+  }
+
+  fmt.Printf("Test: HTTP client ...\n")
+
+  ck := httpclient.MakeClerk(urls)
+  if err := ck.Insert("a", "1"); err != nil {
+    t.Fatalf("Insert(a) -> %v", err)
+  }
+  if err := ck.Insert("a", "2"); err != httpclient.ErrExists {
+    t.Fatalf("Insert(a) again -> %v, expected %v", err, httpclient.ErrExists)
+  }
+  if old, err := ck.Update("a", "3"); err != nil || old != "1" {
+    t.Fatalf("Update(a) -> %v %v, expected 1", old, err)
+  }
+  if v, ver, err := ck.Get("a"); err != nil || v != "3" || ver < 0 {
+    t.Fatalf("Get(a) -> %v version %v %v, expected 3", v, ver, err)
+  }
+  if _, err := ck.Update("b", "1"); err != httpclient.ErrNotFound {
+    t.Fatalf("Update(b) -> %v, expected %v", err, httpclient.ErrNotFound)
+  }
+  ck.Insert("b", "2")
+  if n, err := ck.CountKey(); err != nil || n != 2 {
+    t.Fatalf("CountKey() -> %v %v, expected 2", n, err)
+  }
+  if d, err := ck.Dump(); err != nil || len(d) != 2 || d["a"] != "3" || d["b"] != "2" {
+    t.Fatalf("Dump() -> %v %v", d, err)
+  }
+  if err := ck.Cas("b", "1", "3"); err != httpclient.ErrMismatch {
+    t.Fatalf("Cas(b) with a wrong expected value -> %v, expected %v", err, httpclient.ErrMismatch)
+  }
+  if old, err := ck.Put("b", "3"); err != nil || old != "2" {
+    t.Fatalf("Put(b) -> %v %v, expected 2", old, err)
+  }
+  if old, err := ck.Delete("a"); err != nil || old != "3" {
+    t.Fatalf("Delete(a) -> %v %v, expected 3", old, err)
+  }
+  if _, _, err := ck.Get("a"); err != httpclient.ErrNotFound {
+    t.Fatalf("Get(a) after delete -> %v, expected %v", err, httpclient.ErrNotFound)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestREST(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("rest", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+  conf := settings(t)
+  base := conf.URL(0)
+
+  fmt.Printf("Test: REST status codes ...\n")
+
+  do := func(method string, path string, body string) (int, map[string]interface{}) {
+    req, _ := http.NewRequest(method, base + path, strings.NewReader(body))
+    if body != "" {
+      req.Header.Set("Content-Type", "application/json")
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatalf("%v %v: %v", method, path, err)
+    }
+    return resp.StatusCode, kvlib.DecodeJson(resp)
+  }
+  code := func(r map[string]interface{}) interface{} {
+    e, _ := r["error"].(map[string]interface{})
+    return e["code"]
+  }
+
+  if st, r := do("GET", "/v1/keys/k", ""); st != 404 || code(r) != "not_found" {
+    t.Fatalf("GET of a missing key -> %v %v", st, r)
+  }
+  if st, r := do("POST", "/v1/keys/k", `{"value":"1"}`); st != 201 || r["value"] != "1" {
+    t.Fatalf("POST -> %v %v", st, r)
+  }
+  if st, r := do("POST", "/v1/keys/k", `{"value":"2"}`); st != 409 || code(r) != "key_exists" {
+    t.Fatalf("POST of an existing key -> %v %v", st, r)
+  }
+  if st, r := do("PATCH", "/v1/keys/k", `{"value":"2","expected":"0"}`); st != 409 || code(r) != "value_mismatch" {
+    t.Fatalf("PATCH with a wrong expected value -> %v %v", st, r)
+  }
+  if st, r := do("PATCH", "/v1/keys/k", `{"value":"2"}`); st != 200 || r["previous"] != "1" {
+    t.Fatalf("PATCH -> %v %v", st, r)
+  }
+  if st, r := do("PATCH", "/v1/keys/m", `{"value":"2"}`); st != 404 || code(r) != "not_found" {
+    t.Fatalf("PATCH of a missing key -> %v %v", st, r)
+  }
+  if st, r := do("PUT", "/v1/keys/m", `{"value":"3"}`); st != 200 {
+    t.Fatalf("PUT -> %v %v", st, r)
+  }
+  if st, r := do("GET", "/v1/keys/m", ""); st != 200 || r["value"] != "3" {
+    t.Fatalf("GET -> %v %v", st, r)
+  }
+  if st, r := do("DELETE", "/v1/keys/k", ""); st != 200 || r["previous"] != "2" {
+    t.Fatalf("DELETE -> %v %v", st, r)
+  }
+  if st, r := do("DELETE", "/v1/keys/k", ""); st != 404 {
+    t.Fatalf("DELETE of a missing key -> %v %v", st, r)
+  }
+  if st, r := do("PUT", "/v1/keys/m", `{"value":`); st != 400 || code(r) != "bad_request" {
+    t.Fatalf("PUT with a malformed body -> %v %v", st, r)
+  }
+  if st, r := do("OPTIONS", "/v1/keys/m", ""); st != 405 {
+    t.Fatalf("OPTIONS -> %v %v", st, r)
+  }
+  // version_retention is 0 by default
+  if st, r := do("GET", "/v1/keys/m?version=1", ""); st != 501 || code(r) != "versions_disabled" {
+    t.Fatalf("GET of a version without retention -> %v %v", st, r)
+  }
+  if st, r := do("GET", "/kv/get?key=m&version=1", ""); st != 200 || r["success"] != "false" || r["message"] != ErrNoVersions {
+    t.Fatalf("/kv/get of a version without retention -> %v %v", st, r)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: REST agreement without a majority stops at its deadline ...\n")
+
+  var alone []string = make([]string, nservers)
+  for i := 0; i < nservers; i++ {
+    alone[i] = port("rest-alone", i)
+  }
+  lone := StartServerWith(alone, 0, ServerOptions{})
+  defer cleanup([]*KVPaxos{lone})
+  if e, _, _ := lone.agreeWithin(Op{OpType:PutOp, Key:"x", Value:"1", Who:nrand(), OpID:1}, 200 * time.Millisecond); e != ErrNoAgreement {
+    t.Fatalf("agreement without a majority -> %v, expected %v", e, ErrNoAgreement)
+  }
+  // the agreement lets go of kv.mu, rather than retrying on behind the 503
+  free := false
+  for iters := 0; iters < 100 && !free; iters++ {
+    time.Sleep(10 * time.Millisecond)
+    if free = lone.mu.TryLock(); free {
+      lone.mu.Unlock()
+    }
+  }
+  if !free {
+    t.Fatalf("the agreement went on after its deadline")
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Shutdown replies with valid JSON ...\n")
+
+  resp, err := http.Get(base + "/kvman/shutdown")
+  if err != nil {
+    t.Fatalf("shutdown: %v", err)
+  }
+  var msg kvlib.MsgResponse
+  if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil || msg.Success != "true" {
+    t.Fatalf("shutdown -> %v %v", msg, err)
+  }
+  resp.Body.Close()
+  // the port is free once the server is dead
+  select {
+  case <-kva[0].Death:
+  case <-time.After(10 * time.Second):
+    t.Fatalf("the server is not dead after a shutdown")
+  }
+  kva[0] = nil
+  l, err := net.Listen("tcp", strings.TrimPrefix(base, "http://"))
+  if err != nil {
+    t.Fatalf("the port is not released after a shutdown: %v", err)
+  }
+  l.Close()
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestBinaryValues(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("binary", i)
+  }
+  conf := settings(t)
+  var urls []string
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    kva[i].maxValueSize = 1000
+    urls = append(urls, conf.URL(i))
+  }
+  ck := httpclient.MakeClerk(urls)
+
+  fmt.Printf("Test: Empty values are not deletions ...\n")
+
+  if err := ck.Insert("e", ""); err != nil {
+    t.Fatalf("Insert(e, \"\") -> %v", err)
+  }
+  if v, _, err := ck.Get("e"); err != nil || v != "" {
+    t.Fatalf("Get(e) -> %q %v, expected an empty value", v, err)
+  }
+  if err := ck.Insert("e", "1"); err != httpclient.ErrExists {
+    t.Fatalf("Insert(e) over an empty value -> %v, expected %v", err, httpclient.ErrExists)
+  }
+  if err := ck.CasAbsent("e", "1"); err != httpclient.ErrMismatch {
+    t.Fatalf("CasAbsent(e) over an empty value -> %v, expected %v", err, httpclient.ErrMismatch)
+  }
+  if err := ck.Cas("e", "", "1"); err != nil {
+    t.Fatalf("Cas(e) from the empty value -> %v", err)
+  }
+  ck.Delete("e")
+  if _, _, err := ck.Get("e"); err != httpclient.ErrNotFound {
+    t.Fatalf("Get(e) after delete -> %v, expected %v", err, httpclient.ErrNotFound)
+  }
+  if err := ck.CasAbsent("e", ""); err != nil {
+    t.Fatalf("CasAbsent(e) after delete -> %v", err)
+  }
+  if n, err := ck.CountKey(); err != nil || n != 1 {
+    t.Fatalf("CountKey() -> %v %v, expected 1", n, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Binary values ...\n")
+
+  bin := string([]byte{0, 0xff, 0xfe, '\n', 'a', 0x80})
+  if err := ck.Insert("b", bin); err != nil {
+    t.Fatalf("Insert(b) -> %v", err)
+  }
+  if v, _, err := ck.Get("b"); err != nil || v != bin {
+    t.Fatalf("Get(b) -> %q %v, expected %q", v, err, bin)
+  }
+  if old, err := ck.Update("b", "x"); err != nil || old != bin {
+    t.Fatalf("Update(b) -> %q %v, expected %q", old, err, bin)
+  }
+  ck.Put("b", bin)
+  if d, err := ck.Dump(); err != nil || len(d) != 2 || d["b"] != bin || d["e"] != "" {
+    t.Fatalf("Dump() -> %q %v", d, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Values too large are refused ...\n")
+
+  err := ck.Insert("big", strings.Repeat("x", 1001))
+  if se, ok := err.(*httpclient.ServerError); !ok || se.Status != http.StatusRequestEntityTooLarge || se.Code != "value_too_large" {
+    t.Fatalf("Insert of a value too large -> %v", err)
+  }
+  if err := ck.Insert("big", strings.Repeat("x", 1000)); err != nil {
+    t.Fatalf("Insert of the largest value -> %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// a self-signed CA in dir/name-ca.pem, and a certificate it signs for
+// both ends of a connection, in dir/name.pem and dir/name-key.pem
+func makeCerts(t *testing.T, dir string, name string) {
+  write := func(file string, typ string, der []byte) {
+    data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+    if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0600); err != nil {
+      t.Fatalf("write %v: %v", file, err)
+    }
+  }
+  caKey, _ := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+  ca := &x509.Certificate{
+    SerialNumber: big.NewInt(1),
+    Subject: pkix.Name{CommonName: name + " CA"},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    IsCA: true,
+    KeyUsage: x509.KeyUsageCertSign,
+    BasicConstraintsValid: true,
+  }
+  caDER, err := x509.CreateCertificate(cryptorand.Reader, ca, ca, &caKey.PublicKey, caKey)
+  if err != nil {
+    t.Fatalf("CA certificate: %v", err)
+  }
+  ca, _ = x509.ParseCertificate(caDER)
+  key, _ := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+  cert := &x509.Certificate{
+    SerialNumber: big.NewInt(2),
+    Subject: pkix.Name{CommonName: kvlib.DefaultTLSServerName},
+    DNSNames: []string{kvlib.DefaultTLSServerName},
+    IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(time.Hour),
+    KeyUsage: x509.KeyUsageDigitalSignature,
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+  }
+  der, err := x509.CreateCertificate(cryptorand.Reader, cert, ca, &key.PublicKey, caKey)
+  if err != nil {
+    t.Fatalf("certificate: %v", err)
+  }
+  keyDER, _ := x509.MarshalECPrivateKey(key)
+  write(name + "-ca.pem", "CERTIFICATE", caDER)
+  write(name + ".pem", "CERTIFICATE", der)
+  write(name + "-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func TestTLS(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  dir := t.TempDir()
+  makeCerts(t, dir, "node")
+  makeCerts(t, dir, "rogue")
+  conf := settings(t)
+  conf.HTTPTLSCert, conf.HTTPTLSKey, conf.HTTPTLSCA = filepath.Join(dir, "node.pem"), filepath.Join(dir, "node-key.pem"), filepath.Join(dir, "node-ca.pem")
+  conf.RPCTLSCert, conf.RPCTLSKey, conf.RPCTLSCA = conf.HTTPTLSCert, conf.HTTPTLSKey, conf.HTTPTLSCA
+  conf.KVToken = "kv-secret"
+  conf.KVManToken = "kvman-secret"
+  SettingsPath = filepath.Join(dir, "settings.conf")
+  if err := conf.WriteFile(SettingsPath); err != nil {
+    t.Fatalf("WriteFile: %v", err)
+  }
+  defer func() {
+    SettingsPath = ""
+    paxos.RPC_TLS = nil
+  }()
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("tls", i)
+  }
+  var urls []string
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    urls = append(urls, conf.URL(i))
+  }
+
+  fmt.Printf("Test: Mutual TLS between peers ...\n")
+
+  ck := MakeClerk(kvh)
+  ck.Put("a", "x")
+  check(t, ck, "a", "x")
+
+  peerTLS := paxos.RPC_TLS
+  paxos.RPC_TLS = nil
+  args := &GetArgs{Key: "a", OpID: 1, ClientID: nrand()}
+  var reply GetReply
+  if call(kvh[0], "KVPaxos.Get", args, &reply) {
+    t.Fatalf("a plain RPC was served")
+  }
+  _, rogue, err := kvlib.PeerTLS(map[string]string{
+    "rpc_tls_cert": filepath.Join(dir, "rogue.pem"),
+    "rpc_tls_key": filepath.Join(dir, "rogue-key.pem"),
+    "rpc_tls_ca": filepath.Join(dir, "node-ca.pem"),
+  })
+  if err != nil {
+    t.Fatalf("PeerTLS: %v", err)
+  }
+  paxos.RPC_TLS = rogue
+  if call(kvh[0], "KVPaxos.Get", args, &reply) {
+    t.Fatalf("an RPC with a certificate of another CA was served")
+  }
+  paxos.RPC_TLS = peerTLS
+  check(t, ck, "a", "x")
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: HTTPS and bearer tokens ...\n")
+
+  if resp, err := http.Get(strings.Replace(urls[0], "https", "http", 1) + "/kv/session"); err == nil {
+    resp.Body.Close()
+    if resp.StatusCode == 200 {
+      t.Fatalf("plain HTTP was served")
+    }
+  }
+
+  clientTLS, err := kvlib.HTTPClientTLS(conf.Settings())
+  if err != nil {
+    t.Fatalf("HTTPClientTLS: %v", err)
+  }
+  unauthorized := func(err error) bool {
+    var se *httpclient.ServerError
+    return errors.As(err, &se) && se.Status == http.StatusUnauthorized
+  }
+  hc := httpclient.MakeClerk(urls)
+  hc.SetTLS(clientTLS)
+  if err := hc.Insert("b", "y"); !unauthorized(err) {
+    t.Fatalf("Insert without a token -> %v, expected 401", err)
+  }
+  hc.Token = "kvman-secret"
+  if err := hc.Insert("b", "y"); !unauthorized(err) {
+    t.Fatalf("Insert with the kvman token -> %v, expected 401", err)
+  }
+  hc.Token = "kv-secret"
+  if err := hc.Insert("b", "y"); err != nil {
+    t.Fatalf("Insert -> %v", err)
+  }
+  if v, _, err := hc.Get("a"); err != nil || v != "x" {
+    t.Fatalf("Get(a) -> %q %v, expected x", v, err)
+  }
+  if _, err := hc.CountKey(); !unauthorized(err) {
+    t.Fatalf("CountKey without the kvman token -> %v, expected 401", err)
+  }
+  hc.AdminToken = "kv-secret"
+  if _, err := hc.CountKey(); !unauthorized(err) {
+    t.Fatalf("CountKey with the kv token -> %v, expected 401", err)
+  }
+  hc.AdminToken = "kvman-secret"
+  if n, err := hc.CountKey(); err != nil || n != 2 {
+    t.Fatalf("CountKey -> %v %v, expected 2", n, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestMetrics(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("metrics", i)
+  }
+  conf := settings(t)
+  var urls []string
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    urls = append(urls, conf.URL(i))
+  }
+
+  fmt.Printf("Test: Metrics ...\n")
+
+  ck := httpclient.MakeClerk(urls[:1])
+  ck.Insert("a", "1")
+  ck.Insert("a", "2")
+  ck.Get("a")
+  ck.Get("b")
+  for i := 0; i < 2*SaveMemThreshold; i++ {
+    ck.Put("c", strconv.Itoa(i))
+  }
+  time.Sleep(100 * time.Millisecond) // for the housekeeper
+
+  resp, err := http.Get(urls[0] + "/metrics")
+  if err != nil {
+    t.Fatalf("GET /metrics: %v", err)
+  }
+  body, _ := ioutil.ReadAll(resp.Body)
+  resp.Body.Close()
+  metrics := make(map[string]string)
+  for _, line := range strings.Split(string(body), "\n") {
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+    i := strings.LastIndex(line, " ")
+    metrics[line[:i]] = line[i+1:]
+  }
+  for name, want := range map[string]string{
+    `kvpaxos_ops_total{type="PUT",result="ok"}`: "1",
+    `kvpaxos_ops_total{type="PUT",result="key_exists"}`: "1",
+    `kvpaxos_ops_total{type="GET",result="ok"}`: "1",
+    `kvpaxos_ops_total{type="GET",result="not_found"}`: "1",
+    `kvpaxos_ops_total{type="NaivePut",result="ok"}`: strconv.Itoa(2 * SaveMemThreshold),
+    `kvpaxos_agreement_seconds_count`: strconv.Itoa(4 + 2*SaveMemThreshold),
+    `kvpaxos_agreement_seconds_bucket{le="+Inf"}`: strconv.Itoa(4 + 2*SaveMemThreshold),
+  } {
+    if metrics[name] != want {
+      t.Fatalf("%s is %q, expected %s\n%s", name, metrics[name], want, body)
+    }
+  }
+  for _, name := range []string{
+    "kvpaxos_agreement_retries_count", "kvpaxos_gc_runs_total",
+    "kvpaxos_paxos_max", "kvpaxos_snapstart",
+    fmt.Sprintf("paxos_rpcs_sent_total{peer=%q}", kvh[1]),
+  } {
+    if n, err := strconv.Atoi(metrics[name]); err != nil || n <= 0 {
+      t.Fatalf("%s is %q, expected a positive number\n%s", name, metrics[name], body)
+    }
+  }
+  if _, found := metrics[fmt.Sprintf("paxos_rpcs_failed_total{peer=%q}", kvh[2])]; !found {
+    t.Fatalf("no failed RPCs of peer 2\n%s", body)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// log lines, written and read concurrently
+type syncBuffer struct {
+  mu sync.Mutex
+  b strings.Builder
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+  sb.mu.Lock()
+  defer sb.mu.Unlock()
+  return sb.b.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+  sb.mu.Lock()
+  defer sb.mu.Unlock()
+  return sb.b.String()
+}
+
+func TestLogLevel(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("loglevel", i)
+  }
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+  }
+  conf := settings(t)
+  base := conf.URL(0) + "/kvman/loglevel"
+
+  out := &syncBuffer{}
+  kvlog.SetOutput(out)
+  defer func() {
+    kvlog.SetOutput(os.Stderr)
+    kvlog.SetFormat(kvlog.FormatText)
+    kvlog.SetLevels("*=info,paxos=info,kvpaxos=info")
+  }()
+
+  fmt.Printf("Test: Log levels at runtime ...\n")
+
+  get := func(query string) LogLevelResponse {
+    resp, err := http.Get(base + query)
+    if err != nil {
+      t.Fatalf("GET %v: %v", query, err)
+    }
+    var r LogLevelResponse
+    json.NewDecoder(resp.Body).Decode(&r)
+    resp.Body.Close()
+    return r
+  }
+  if r := get("?level=bogus"); r.Success != "false" {
+    t.Fatalf("a bogus level was accepted: %v", r)
+  }
+  if r := get("?level=kvpaxos%3Ddebug&format=json"); r.Success != "true" || r.Levels["kvpaxos"] != "debug" || r.Format != "json" {
+    t.Fatalf("setting kvpaxos=debug -> %v", r)
+  }
+
+  ck := MakeClerk(kvh)
+  ck.Put("a", "x")
+  check(t, ck, "a", "x")
+
+  found := false
+  for _, line := range strings.Split(out.String(), "\n") {
+    if line == "" {
+      continue
+    }
+    var l map[string]interface{}
+    if err := json.Unmarshal([]byte(line), &l); err != nil {
+      t.Fatalf("not JSON: %q", line)
+    }
+    if l["sub"] == "paxos" && l["level"] == "debug" {
+      t.Fatalf("paxos debug line while paxos is at info: %q", line)
+    }
+    if l["sub"] == "kvpaxos" && l["msg"] == "agreement reached" && l["node"] != nil && l["seq"] != nil {
+      found = true
+    }
+  }
+  if !found {
+    t.Fatalf("no debug line of an agreement with node and seq in\n%s", out.String())
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestDumpPages(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("dump", i)
+  }
+  conf := settings(t)
+  var urls []string
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    urls = append(urls, conf.URL(i))
+  }
+  ck := httpclient.MakeClerk(urls)
+
+  fmt.Printf("Test: Dump in pages, in key order ...\n")
+
+  const nkeys = 40
+  for i := 0; i < nkeys; i++ {
+    ck.Insert(fmt.Sprintf("k%03d", i), strconv.Itoa(i))
+  }
+  ck.Put("k005", "\xff\x00")
+  ck.Delete("k010")
+  all, err := ck.Dump()
+  if err != nil || len(all) != nkeys-1 {
+    t.Fatalf("Dump -> %v keys, %v", len(all), err)
+  }
+
+  var got []httpclient.Pair
+  after := ""
+  for pages := 0; ; pages++ {
+    page, next, err := ck.DumpPage(after, 7)
+    if err != nil {
+      t.Fatalf("DumpPage(%q) -> %v", after, err)
+    }
+    if len(page) > 7 || pages > nkeys {
+      t.Fatalf("DumpPage(%q) -> %v pairs", after, len(page))
+    }
+    got = append(got, page...)
+    if next == "" {
+      break
+    }
+    if next != page[len(page)-1].Key {
+      t.Fatalf("next page after %q, expected the last key %q", next, page[len(page)-1].Key)
+    }
+    after = next
+  }
+  if len(got) != len(all) {
+    t.Fatalf("pages hold %v keys, expected %v", len(got), len(all))
+  }
+  for i, p := range got {
+    if i > 0 && got[i-1].Key >= p.Key {
+      t.Fatalf("%q after %q, not in key order", p.Key, got[i-1].Key)
+    }
+    if all[p.Key] != p.Value {
+      t.Fatalf("%q is %q in a page, %q in Dump", p.Key, p.Value, all[p.Key])
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Dump reads a consistent view ...\n")
+
+  st, _ := kva[0].syncView()
+  keys := st.keys()
+  for i := 0; i < 3*SaveMemThreshold; i++ {
+    ck.Put(fmt.Sprintf("k%03d", i%nkeys), "new")
+    ck.Insert(fmt.Sprintf("n%03d", i), "new")
+  }
+  time.Sleep(100 * time.Millisecond) // for the housekeeper
+  if _, snapstart := kva[0].position(); snapstart == 0 {
+    t.Fatalf("no snapshot was taken")
+  }
+  view := st.dump()
+  if len(view) != len(all) || len(st.keys()) != len(keys) {
+    t.Fatalf("the view changed from %v to %v keys", len(all), len(view))
+  }
+  for k, v := range all {
+    if view[k] != v {
+      t.Fatalf("%q changed from %q to %q in the view", k, v, view[k])
+    }
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestBackupRestore(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("backup", i)
+  }
+  conf := settings(t)
+  var urls []string
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    urls = append(urls, conf.URL(i))
+  }
+  cks := make([]*httpclient.Clerk, nservers)
+  for i := range cks {
+    cks[i] = httpclient.MakeClerk(urls[i:i+1])
+  }
+
+  fmt.Printf("Test: Snapshot and restore round trip ...\n")
+
+  for i := 0; i < 2*SaveMemThreshold; i++ {
+    cks[i%nservers].Put(fmt.Sprintf("k%d", i%25), strconv.Itoa(i))
+  }
+  cks[0].Put("bin", "\x00\xff")
+  cks[0].Delete("k3")
+  want, _ := cks[0].Dump()
+
+  var file strings.Builder
+  index, err := cks[1].Snapshot(&file)
+  if err != nil {
+    t.Fatalf("Snapshot -> %v", err)
+  }
+  n := 0
+  h, err := kvlib.ReadSnapshot(strings.NewReader(file.String()), func(e kvlib.SnapEntry) error {
+    if want[e.Key] != string(e.Value) {
+      t.Fatalf("%q is %q in the snapshot, expected %q", e.Key, e.Value, want[e.Key])
+    }
+    n++
+    return nil
+  })
+  if err != nil || n != len(want) || h.Index != index || index < 2*SaveMemThreshold {
+    t.Fatalf("snapshot of %v keys at %v -> %v keys at %v, %v", len(want), index, n, h.Index, err)
+  }
+
+  cks[0].Put("k1", "changed")
+  cks[0].Delete("k2")
+  cks[0].Insert("new", "1")
+
+  corrupt := strings.Replace(file.String(), `"key":"k1"`, `"key":"k9"`, 1)
+  if _, _, err := cks[2].Restore(strings.NewReader(corrupt)); err == nil {
+    t.Fatalf("a corrupt snapshot was restored")
+  }
+  if v, _, _ := cks[0].Get("new"); v != "1" {
+    t.Fatalf("a refused restore changed the database")
+  }
+
+  at, keys, err := cks[2].Restore(strings.NewReader(file.String()))
+  if err != nil || keys != len(want) || at <= index {
+    t.Fatalf("Restore -> %v keys at %v, %v", keys, at, err)
+  }
+  for i := 0; i < nservers; i++ {
+    got, err := cks[i].Dump()
+    if err != nil || len(got) != len(want) {
+      t.Fatalf("server %v holds %v keys after restore, expected %v (%v)", i, len(got), len(want), err)
+    }
+    for k, v := range want {
+      if got[k] != v {
+        t.Fatalf("server %v: %q is %q after restore, expected %q", i, k, got[k], v)
+      }
+    }
+  }
+  if _, _, err := cks[1].Get("new"); err != httpclient.ErrNotFound {
+    t.Fatalf("Get(new) after restore -> %v, expected %v", err, httpclient.ErrNotFound)
+  }
+  if err := cks[1].Insert("new", "2"); err != nil {
+    t.Fatalf("Insert(new) after restore -> %v", err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Restore of expired keys and of a snapshot too large ...\n")
+
+  var exp strings.Builder
+  sw, _ := kvlib.NewSnapWriter(&exp, kvlib.SnapHeader{Format: kvlib.SnapFormat})
+  sw.Write(kvlib.SnapEntry{Key: "k0", Value: []byte("old"), Deadline: 1})
+  sw.Write(kvlib.SnapEntry{Key: "k1", Value: []byte("1")})
+  sw.Close()
+  at, keys, err = cks[0].Restore(strings.NewReader(exp.String()))
+  if err != nil || keys != 2 {
+    t.Fatalf("Restore of an expired key -> %v keys, %v", keys, err)
+  }
+  if _, _, err := cks[0].Get("k0"); err != httpclient.ErrNotFound {
+    t.Fatalf("Get(k0) after the restore of its expired value -> %v", err)
+  }
+  var wr WatchReply
+  kva[0].Watch(&WatchArgs{Key: "k0", From: at}, &wr)
+  if len(wr.Events) != 1 || wr.Events[0] != (WatchEvent{at, "RESTORE", "k0", ""}) {
+    t.Fatalf("watch of an expired key dropped by a restore -> %+v", wr)
+  }
+
+  header := file.String()[:strings.Index(file.String(), "\n")+1]
+  big := header + strings.Repeat(`{"key":"big","value":""}`+"\n", MaxRestoreSize/24+1)
+  if _, _, err := cks[0].Restore(strings.NewReader(big)); err == nil || !strings.Contains(err.Error(), "larger than") {
+    t.Fatalf("Restore of more than %v bytes -> %v", MaxRestoreSize, err)
+  }
+  if v, _, _ := cks[0].Get("k1"); v != "1" {
+    t.Fatalf("a restore too large changed the database")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestLinearizability(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("lin", i)
+  }
+  conf := settings(t)
+  var urls []string
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    urls = append(urls, conf.URL(i))
+  }
+
+  fmt.Printf("Test: Concurrent clients are linearizable ...\n")
+
+  hist := kvlib.NewHistory()
+  const nclients = 6
+  var wg sync.WaitGroup
+  for c := 0; c < nclients; c++ {
+    wg.Add(1)
+    go func(c int) {
+      defer wg.Done()
+      ck := httpclient.MakeClerk(urls[c%nservers : c%nservers+1])
+      kinds := []kvlib.OpKind{kvlib.OpGet, kvlib.OpInsert, kvlib.OpUpdate, kvlib.OpPut, kvlib.OpDelete}
+      for i := 0; i < 25; i++ {
+        kind := kinds[rand.Intn(len(kinds))]
+        hist.Do(c, ck, kind, strconv.Itoa(rand.Intn(3)), fmt.Sprintf("%d.%d", c, i))
+      }
+    }(c)
+  }
+  wg.Wait()
+
+  ops := hist.Ops()
+  if len(ops) != nclients*25 {
+    t.Fatalf("%v ops recorded, expected %v", len(ops), nclients*25)
+  }
+  if ok, sub := kvlib.CheckLinearizable(ops); !ok {
+    t.Fatalf("history not linearizable:\n%s", kvlib.FormatHistory(sub))
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestFaultsHandler(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+  defer faultnet.Default.Set(faultnet.Faults{})
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("faults", i)
+  }
+  conf := settings(t)
+  var urls []string
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    urls = append(urls, conf.URL(i))
+  }
+  faults := func(method string, body string) FaultsResponse {
+    req, _ := http.NewRequest(method, urls[0]+"/kvman/faults", strings.NewReader(body))
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+      t.Fatalf("%s /kvman/faults -> %v", method, err)
+    }
+    defer resp.Body.Close()
+    var r FaultsResponse
+    if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r.Success != "true" {
+      t.Fatalf("%s /kvman/faults -> %+v, %v", method, r, err)
+    }
+    return r
+  }
+
+  fmt.Printf("Test: Faults set over HTTP ...\n")
+
+  if r := faults("GET", ""); r.Node != kvh[0] || r.Faults.Default != (faultnet.Link{}) {
+    t.Fatalf("faults of a new server: %+v", r)
+  }
+  // every decision is certain, so the stats are known whatever the seed
+  // draws: kvh[0] is cut off, and kvh[1] duplicates all it sends to kvh[2]
+  dupLink := faultnet.LinkName(kvh[1], kvh[2])
+  spec := fmt.Sprintf(`{"seed":7,"links":{%q:{"duplicate":1}},"partition":[[%q],[%q,%q]]}`,
+    dupLink, kvh[0], kvh[1], kvh[2])
+  if r := faults("POST", spec); r.Faults.Seed != 7 || len(r.Faults.Links) != 1 || len(r.Faults.Partition) != 2 {
+    t.Fatalf("POST /kvman/faults -> %+v", r)
+  }
+
+  ck1 := httpclient.MakeClerk(urls[1:2])
+  for i := 0; i < 10; i++ {
+    if _, err := ck1.Put("a", strconv.Itoa(i)); err != nil {
+      t.Fatalf("Put through the majority -> %v", err)
+    }
+  }
+  ck0 := httpclient.MakeClerk(urls[0:1])
+  ck0.SetTimeout(time.Second)
+  ck0.Retries = 1
+  if _, _, err := ck0.Get("a"); err == nil {
+    t.Fatalf("Get through the minority succeeded")
+  }
+  r := faults("GET", "")
+  for _, to := range kvh[1:] {
+    if st := r.Stats[faultnet.LinkName(kvh[0], to)]; st.Dialed == 0 {
+      t.Fatalf("%s never dialed %s: %+v", kvh[0], to, r.Stats)
+    }
+  }
+  if st := r.Stats[dupLink]; st.Dialed == 0 {
+    t.Fatalf("%s never dialed %s: %+v", kvh[1], kvh[2], r.Stats)
+  }
+  for name, st := range r.Stats {
+    cut := strings.HasPrefix(name, kvh[0]+">") || strings.HasSuffix(name, ">"+kvh[0])
+    want := faultnet.Stats{Dialed: st.Dialed}
+    if cut {
+      want.Partitioned = st.Dialed
+    } else if name == dupLink {
+      want.Duplicated = st.Dialed
+    }
+    if st != want {
+      t.Fatalf("stats of %s: %+v, want %+v", name, st, want)
+    }
+  }
+
+  // kvh[0] is still trying its Get, so RPCs may be dialed once the stats
+  // start over, but none meets a fault
+  if r := faults("DELETE", ""); !reflect.DeepEqual(r.Faults, faultnet.Faults{}) {
+    t.Fatalf("DELETE /kvman/faults -> %+v", r)
+  } else {
+    for name, st := range r.Stats {
+      if st != (faultnet.Stats{Dialed: st.Dialed}) {
+        t.Fatalf("stats of %s after DELETE: %+v", name, st)
+      }
+    }
+  }
+  ck0.SetTimeout(10 * time.Second)
+  if v, _, err := ck0.Get("a"); err != nil || v != "9" {
+    t.Fatalf("Get after the faults were removed -> %q, %v", v, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestScript(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+  defer faultnet.Default.Set(faultnet.Faults{})
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("script", i)
+  }
+  conf := settings(t)
+  var urls []string
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    urls = append(urls, conf.URL(i))
+  }
+  dir, err := ioutil.TempDir("", "script")
+  if err != nil {
+    t.Fatalf("TempDir: %v", err)
+  }
+  defer os.RemoveAll(dir)
+  run := func(name string, script string) (string, int) {
+    fn := filepath.Join(dir, name)
+    if err := ioutil.WriteFile(fn, []byte(script), 0600); err != nil {
+      t.Fatalf("WriteFile: %v", err)
+    }
+    return kvlib.TestUnit(urls, nil, fn, true)
+  }
+
+  fmt.Printf("Test: Scripts with assertions, loops and partitions ...\n")
+
+  r, fail := run("typo.test", `
+# values with spaces, variables and loops
+Switch 1
+Set greeting "hello world"
+Put hi $greeting
+ExpectGet hi "hello world"
+ExpectFail Put hi again
+ExpectFail Delete nothing
+Loop i 1 5
+  Put key$i value${i}0
+EndLoop_is_not_a_word_here_so_see_below
+`)
+  if fail == 0 || !strings.Contains(r, "typo.test:11: unknown instruction") {
+    t.Fatalf("a bad instruction was run:\n%s", r)
+  }
+
+  r, fail = run("good.test", `
+# values with spaces, variables and loops
+Switch 1
+Set greeting "hello world"
+Put hi $greeting
+ExpectGet hi "hello world"
+ExpectFail Put hi again
+ExpectFail Delete nothing
+Loop i 1 5
+  Put key$i value${i}0
+Endloop
+ExpectGet key3 value30
+CountKey 6
+Block
+  Loop i 1 5
+    Update key$i $$$i
+  Endloop
+Endblock
+Switch 3
+ExpectGet key2 $$2
+Dump
+
+# the majority goes on without server 1
+Partition 1 / 2 3
+Switch 2
+Put cut off
+CountKey
+Heal
+Switch 1
+ExpectGet cut off
+Dump
+`)
+  if fail != 0 {
+    t.Fatalf("script failed:\n%s", r)
+  }
+  for _, want := range []string{"Got the expected value.", "Failed as expected.", "6 keys, as expected.",
+    "Dump of 7 keys as expected.", "Partitioned into [1 / 2 3].", "Healed.", "History linearizable."} {
+    if !strings.Contains(r, want) {
+      t.Fatalf("%q missing from the report:\n%s", want, r)
+    }
+  }
+
+  r, fail = run("wrong.test", "Switch 2\nExpectGet hi wrong\n")
+  if fail == 0 || !strings.Contains(r, "FATAL ERROR") {
+    t.Fatalf("a wrong ExpectGet passed:\n%s", r)
+  }
+  r, fail = run("undefined.test", "Switch 2\nGet $nothing\n")
+  if fail == 0 || !strings.Contains(r, "undefined.test:2: undefined variable") {
+    t.Fatalf("an undefined variable passed:\n%s", r)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+// the servers of a test, as kvlib.RunChaos sees them
+type chaosCluster struct {
+  kva []*KVPaxos
+  kvh []string
+  urls []string
+}
+
+func (c *chaosCluster) URL(i int) string {
+  return c.urls[i]
+}
+
+func (c *chaosCluster) Kill(i int) error {
+  c.kva[i].kill()
+  return nil
+}
+
+func (c *chaosCluster) Restart(i int) error {
+  c.kva[i] = StartServer(c.kvh, i)
+  return nil
+}
+
+func (c *chaosCluster) Partition(sets [][]int) error {
+  var p [][]string
+  for _, set := range sets {
+    var s []string
+    for _, n := range set {
+      s = append(s, c.kvh[n])
+    }
+    p = append(p, s)
+  }
+  faultnet.Default.Partition(p...)
+  return nil
+}
+
+func TestChaos(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Chaos run with partitions is linearizable ...\n")
+
+  const nservers = 3
+  c := &chaosCluster{kva: make([]*KVPaxos, nservers), kvh: make([]string, nservers)}
+  defer cleanup(c.kva)
+  defer faultnet.Default.Set(faultnet.Faults{})
+  for i := 0; i < nservers; i++ {
+    c.kvh[i] = port("chaos", i)
+  }
+  conf := settings(t)
+  for i := 0; i < nservers; i++ {
+    c.kva[i] = StartServer(c.kvh, i)
+    c.urls = append(c.urls, conf.URL(i))
+  }
+
+  plan := kvlib.NewChaosPlan(kvlib.ChaosConfig{Seed: 7, Servers: nservers, Clients: 3, Ops: 20, Keys: 3,
+    Faults: 6, NoKills: true, Gap: 150 * time.Millisecond})
+  res := kvlib.RunChaos(plan, c)
+  if !res.Linearizable {
+    t.Fatalf("history not linearizable:\n%s\n%s", kvlib.FormatHistory(res.Violation), res.Reproducer())
+  }
+  if len(res.Ops) != 3*20 || len(res.Events) == 0 {
+    t.Fatalf("%d ops and %d events played, expected %d ops", len(res.Ops), len(res.Events), 3*20)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestBench(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("bench", i)
+  }
+  conf := settings(t)
+  var urls []string
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    urls = append(urls, conf.URL(i))
+  }
+
+  for _, api := range []string{kvlib.BenchKV, kvlib.BenchREST} {
+    fmt.Printf("Test: Benchmark through the %s API ...\n", api)
+
+    cfg := kvlib.BenchConfig{Servers: urls, API: api, Clients: 3, Reads: 0.5, Keys: 10, ValueSize: 20,
+      Duration: time.Second, Interval: 500 * time.Millisecond, Timeout: 5 * time.Second, Seed: 1, Label: api}
+    if api == kvlib.BenchREST {
+      cfg.Rate = 20
+      cfg.Zipf = 1.5
+    }
+    res, err := kvlib.RunBench(cfg)
+    if err != nil {
+      t.Fatalf("RunBench: %v", err)
+    }
+    if res.Loaded != 10 || res.LoadErrors != 0 {
+      t.Fatalf("%d keys loaded and %d failed, expected 10", res.Loaded, res.LoadErrors)
+    }
+    if len(res.Ops) != 3 || len(res.Series) != 2 {
+      t.Fatalf("%d ops and %d samples, expected 3 and 2", len(res.Ops), len(res.Series))
+    }
+    total := res.Ops[2]
+    if total.Op != "total" || total.Count == 0 || total.Errors != 0 || total.Count != res.Ops[0].Count+res.Ops[1].Count {
+      t.Fatalf("total %+v of get %+v and update %+v", total, res.Ops[0], res.Ops[1])
+    }
+    if total.Latency.Count() != total.Count || total.Latency.Quantile(0.5) <= 0 {
+      t.Fatalf("%d latencies of %d requests, median %dus", total.Latency.Count(), total.Count, total.Latency.Quantile(0.5))
+    }
+
+    var js struct {
+      Label string
+      Ops []struct {
+        Op string
+        Count int64
+        Latency []struct {
+          Quantile float64
+          Ms float64
+        }
+      }
+      Series []struct {
+        Ops map[string]int64
+      }
+    }
+    var b strings.Builder
+    if err := res.WriteJSON(&b); err != nil {
+      t.Fatalf("WriteJSON: %v", err)
+    }
+    if err := json.Unmarshal([]byte(b.String()), &js); err != nil {
+      t.Fatalf("the JSON output: %v\n%s", err, b.String())
+    }
+    if js.Label != api || len(js.Ops) != 3 || js.Ops[2].Count != total.Count ||
+      len(js.Ops[2].Latency) != len(kvlib.BenchQuantiles) || len(js.Series) != 2 {
+      t.Fatalf("the JSON output:\n%s", b.String())
+    }
+
+    b.Reset()
+    if err := res.WriteCSV(&b, true); err != nil {
+      t.Fatalf("WriteCSV: %v", err)
+    }
+    if err := res.WriteCSV(&b, false); err != nil {
+      t.Fatalf("WriteCSV: %v", err)
+    }
+    rows, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+    if err != nil || len(rows) != 1+2*3 || rows[0][0] != "label" || rows[3][1] != "total" ||
+      rows[3][2] != strconv.FormatInt(total.Count, 10) || rows[6][0] != api {
+      t.Fatalf("the CSV output (%v):\n%s", err, b.String())
+    }
+
+    fmt.Printf("  ... Passed\n")
+  }
+}
+
+func TestAdmin(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  const nservers = 3
+  var kva []*KVPaxos = make([]*KVPaxos, nservers)
+  var kvh []string = make([]string, nservers)
+  defer cleanup(kva)
+
+  for i := 0; i < nservers; i++ {
+    kvh[i] = port("admin", i)
+  }
+  conf := settings(t)
+  cks := make([]*httpclient.Clerk, nservers)
+  for i := 0; i < nservers; i++ {
+    kva[i] = StartServer(kvh, i)
+    cks[i] = httpclient.MakeClerk([]string{conf.URL(i)})
+  }
+
+  fmt.Printf("Test: Status and log of a server ...\n")
+
+  for i := 0; i < 4; i++ {
+    cks[0].Put(fmt.Sprintf("k%d", i), strconv.Itoa(i))
+  }
+  big := strings.Repeat("x", 1000)
+  cks[0].Put("big", big)
+  st, err := cks[0].Status()
+  if err != nil || st.Node != 0 || st.Peers != nservers || st.Touched < 4 || st.Max < st.Touched ||
+    st.Min != 0 || st.Snapstart != 0 {
+    t.Fatalf("Status -> %+v, %v", st, err)
+  }
+  l, err := cks[0].Log(-1, -1)
+  if err != nil || len(l.Entries) != l.Max+1 || l.Touched != st.Touched {
+    t.Fatalf("Log -> %+v, %v", l, err)
+  }
+  keys := map[string]int{}
+  for i, e := range l.Entries {
+    if e.Seq != i || e.State != "decided" {
+      t.Fatalf("entry %d of the log: %+v", i, e)
+    }
+    keys[e.Key]++
+    if e.Key == "big" && (e.Size != len(big) || e.Value != big[:MaxLogValue] || e.Session == 0 || e.Timestamp == 0) {
+      t.Fatalf("the entry of big: %+v", e)
+    }
+  }
+  if keys["k0"] != 1 || keys["k3"] != 1 || keys["big"] != 1 {
+    t.Fatalf("the keys of the log: %v", keys)
+  }
+  l, err = cks[0].Log(2, 3)
+  if err != nil || len(l.Entries) != 2 || l.Entries[0].Seq != 2 || l.Entries[1].Seq != 3 {
+    t.Fatalf("Log(2, 3) -> %+v, %v", l, err)
+  }
+  if l, err = cks[0].Log(st.Max+1, st.Max+2); err != nil || len(l.Entries) != 2 || l.Entries[0].State != "undecided" {
+    t.Fatalf("Log after Max -> %+v, %v", l, err)
+  }
+  if _, err := cks[0].Log(0, MaxLogRange); err == nil {
+    t.Fatalf("Log of %d instances succeeded", MaxLogRange+1)
+  }
+
+  fmt.Printf("  ... Passed\n")
+
+  fmt.Printf("Test: Compact on demand ...\n")
+
+  // a server applies the log as it serves requests
+  for i := 0; i < nservers; i++ {
+    cks[i].Put("touch", strconv.Itoa(i))
+  }
+  for i := 0; i < nservers; i++ {
+    st, _ := cks[i].Status()
+    from, to, err := cks[i].Compact()
+    if err != nil || from != 0 || to != st.Touched+1 {
+      t.Fatalf("Compact of server %d at %+v -> %d, %d, %v", i, st, from, to, err)
+    }
+  }
+  // a peer learns that another is done from the agreements it proposes
+  for i := 0; ; i++ {
+    cks[i%nservers].Put("after", strconv.Itoa(i))
+    if st, _ = cks[0].Status(); st.Min > 0 {
+      break
+    }
+    if i == 50 {
+      t.Fatalf("Min still 0 after compacting every server: %+v", st)
+    }
+    time.Sleep(20 * time.Millisecond)
+  }
+  if l, err := cks[0].Log(0, 0); err != nil || l.Entries[0].State != "forgotten" {
+    t.Fatalf("Log of a compacted instance -> %+v, %v", l, err)
+  }
+  for i := 0; i < 4; i++ {
+    if v, _, err := cks[i%nservers].Get(fmt.Sprintf("k%d", i)); err != nil || v != strconv.Itoa(i) {
+      t.Fatalf("Get(k%d) after compacting -> %q, %v", i, v, err)
+    }
+  }
+  if n, err := cks[1].CountKey(); err != nil || n != 7 {
+    t.Fatalf("CountKey after compacting -> %d, %v", n, err)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
@@ -0,0 +1,187 @@
+package kvpaxos
+
+import (
+  "net/http"
+  "encoding/json"
+  "sort"
+  "strings"
+  "strconv"
+  "time"
+  "fmt"
+
+  "kvlib"
+  )
+
+const (
+  WatchHoleWait=500*time.Millisecond // before trying to learn an instance this peer missed
+  WatchMaxWait=20*time.Second // must stay below the WriteTimeout of the HTTP server
+)
+
+func watchMatch(key string, args *WatchArgs) bool {
+  if args.Key=="" && args.Prefix=="" {
+    return true
+  }
+  return (args.Key!="" && key==args.Key) ||
+    (args.Prefix!="" && strings.HasPrefix(key,args.Prefix))
+}
+
+//apply the log up to px_touchedPTR to the feed, and keep its writes for
+//the watches; under kv.mu, whenever px_touchedPTR moves
+func (kv *KVPaxos) feedLocked() {
+  kv.publishLocked()
+  if kv.feed==nil {
+    kv.feed=kv.newView()
+    kv.feedNext=kv.snapstart
+  }
+  var events []WatchEvent
+  for ;kv.feedNext<=kv.px_touchedPTR;kv.feedNext++ {
+    i:=kv.feedNext
+    _,value:=kv.px.Status(i)
+    kv.feed.onWrite=func(o Op, val string){
+      events=append(events,WatchEvent{i,OpName[o.OpType],o.Key,val})
+    }
+    kv.feed.step(i,value.(Op))
+  }
+  kv.feed.onWrite=nil
+  if len(events)>0 {
+    kv.watchMu.Lock()
+    kv.events=append(kv.events,events...)
+    kv.watchMu.Unlock()
+  }
+}
+
+//start the feed over on the snapshot, once compactLocked moved snapstart,
+//so that its writes do not pile up; the writes before snapstart are
+//forgotten. Under kv.mu
+func (kv *KVPaxos) refeedLocked() {
+  kv.feed=kv.newView()
+  for i:=kv.snapstart;i<kv.feedNext;i++ {
+    _,value:=kv.px.Status(i)
+    kv.feed.step(i,value.(Op))
+  }
+  kv.watchMu.Lock()
+  k:=sort.Search(len(kv.events),func(j int) bool { return kv.events[j].Index>=kv.snapstart })
+  kv.events=append([]WatchEvent(nil),kv.events[k:]...)
+  kv.watchMu.Unlock()
+}
+
+//move px_touchedPTR over the instances decided since, without proposing
+//anything; under kv.mu
+func (kv *KVPaxos) catchUpLocked() {
+  for {
+    decided,_:=kv.px.Status(kv.px_touchedPTR+1)
+    if !decided {
+      break
+    }
+    kv.px_touchedPTR++
+  }
+  kv.feedLocked()
+}
+
+//the writes kept from log index from on that args watches
+func (kv *KVPaxos) watched(args *WatchArgs, from int) []WatchEvent {
+  kv.watchMu.Lock()
+  defer kv.watchMu.Unlock()
+  var events []WatchEvent
+  k:=sort.Search(len(kv.events),func(j int) bool { return kv.events[j].Index>=from })
+  for _,ev:=range kv.events[k:] {
+    if watchMatch(ev.Key,args) {
+      events=append(events,ev)
+    }
+  }
+  return events
+}
+
+//wait until some matching write is decided, or until WatchMaxWait is over.
+//The watch sleeps until paxos learns of a decision; it then catches up
+//with the log, and finds the writes in those kept by the feed.
+func (kv *KVPaxos) Watch(args *WatchArgs, reply *WatchReply) error {
+  deadline:=time.NewTimer(WatchMaxWait)
+  defer deadline.Stop()
+  from:=args.From
+  for !kv.dead {
+    decided:=kv.px.Decided() // before catching up, not to miss a decision
+    kv.mu.Lock()
+    kv.catchUpLocked()
+    next:=kv.px_touchedPTR+1
+    if from<0 {
+      from=next
+    }
+    if from<kv.snapstart {
+      //the writes are lost; tell the values instead, to watch on from them
+      reply.Err=Err(fmt.Sprintf("Watch: log before %d is compacted",kv.snapstart))
+      reply.Next=next
+      reply.Values=make(map[string]string)
+      for _,k:=range kv.feed.keys() {
+        if val,ok:=kv.feed.get(k); ok && watchMatch(k,args) {
+          reply.Values[k]=val
+        }
+      }
+      kv.mu.Unlock()
+      return nil
+    }
+    kv.mu.Unlock()
+
+    if events:=kv.watched(args,from); len(events)>0 {
+      reply.Events=events
+      reply.Next=events[len(events)-1].Index+1
+      return nil
+    }
+    var hole <-chan time.Time
+    if next<=kv.px.Max() {
+      //a later instance is decided, but maybe not this one, if we missed
+      //its decision
+      hole=time.After(WatchHoleWait)
+    }
+    select {
+      case <-decided:
+      case <-hole:
+        //proposing a meaningless OP makes paxos tell us the decided value
+        kv.px.Start(next,Op{OpType:GetOp, Key:"", Value:"", Who:nrand(), OpID:0, Timestamp:time.Now().UnixNano()})
+      case <-deadline.C:
+        reply.Next=next
+        return nil
+      case <-kv.quit:
+    }
+  }
+  reply.Err="Watch: server is shutting down"
+  return nil
+}
+
+type watchCompacted struct {
+  Success string `json:"success"`
+  Message string `json:"message"`
+  Next int `json:"next"`
+  Values map[string]string `json:"values"`
+}
+
+func kvWatchHandlerGC(kv *KVPaxos) http.HandlerFunc{
+  return func(w http.ResponseWriter, r *http.Request) {
+    args:=WatchArgs{Key:r.FormValue("key"),Prefix:r.FormValue("prefix"),From:-1}
+    if from:=r.FormValue("from"); from!="" {
+      var err error
+      args.From,err=strconv.Atoi(from)
+      if err!=nil || args.From<0 {
+        fmt.Fprintf(w, "%s\n",kvlib.JsonErr("from should be a nonnegative log index"))
+        return
+      }
+    }
+    var reply WatchReply
+    kv.Watch(&args,&reply)
+    if reply.Values!=nil {
+      w.Header().Set("X-Watch-Next",strconv.Itoa(reply.Next))
+      var str,_=json.Marshal(&watchCompacted{"false",string(reply.Err),reply.Next,reply.Values})
+      fmt.Fprintf(w, "%s\n",str)
+      return
+    }
+    if reply.Err!="" {
+      fmt.Fprintf(w, "%s\n",kvlib.JsonErr(string(reply.Err)))
+      return
+    }
+    w.Header().Set("X-Watch-Next",strconv.Itoa(reply.Next))
+    enc:=json.NewEncoder(w)
+    for i:=range reply.Events {
+      enc.Encode(&reply.Events[i])
+    }
+  }
+}
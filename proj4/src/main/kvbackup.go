@@ -0,0 +1,127 @@
+package main
+
+import(
+  "flag"
+  "fmt"
+  "os"
+  "time"
+
+  // our lib
+  . "kvlib"
+  "kvpaxos/httpclient"
+)
+
+func usage(){
+  fmt.Println("Usage: bin/kvbackup [-conf settings.conf] [-set name=value]... snapshot <n01|n02|...> <file>")
+  fmt.Println("       bin/kvbackup [-conf settings.conf] [-set name=value]... restore <n01|n02|...> <file>")
+  fmt.Println("       bin/kvbackup verify <file>")
+}
+
+func clerk(conf *Config, node int) *httpclient.Clerk {
+  ck,err := httpclient.MakeClerkFromConfig(conf, conf.URL(node))
+  if err!=nil {
+    fmt.Printf("TLS: %s\n", err)
+    os.Exit(1)
+  }
+  ck.SetTimeout(10*time.Minute)
+  ck.Retries = 1
+  return ck
+}
+
+//the header and number of keys of a snapshot file, if its checksum holds
+func verify(file string) (SnapHeader,int,error){
+  f,err := os.Open(file)
+  if err!=nil {
+    return SnapHeader{},0,err
+  }
+  defer f.Close()
+  n := 0
+  h,err := ReadSnapshot(f, func(SnapEntry) error {
+    n++
+    return nil
+  })
+  return h,n,err
+}
+
+func fail(err error){
+  fmt.Printf("Failed: %s\n", err)
+  os.Exit(1)
+}
+
+func main(){
+  cf := NewConfigFlags(flag.CommandLine)
+  flag.Usage = usage
+  args,err := ParseInterspersed(flag.CommandLine, os.Args[1:])
+  if err!=nil || len(args)<2 {
+    usage()
+    os.Exit(2)
+  }
+  switch args[0] {
+    case "verify":
+      h,n,err := verify(args[1])
+      if err!=nil {
+        fail(err)
+      }
+      fmt.Printf("%s: %d keys at log index %d, checksum OK\n", args[1], n, h.Index)
+      return
+    case "snapshot", "restore":
+    default:
+      usage()
+      os.Exit(2)
+  }
+  if len(args)<3 {
+    usage()
+    os.Exit(2)
+  }
+  conf,err := cf.Load()
+  if err!=nil {
+    fail(err)
+  }
+  node,err := conf.Node(args[1])
+  if err!=nil {
+    fail(err)
+  }
+  ck := clerk(conf, node)
+  file := args[2]
+
+  if args[0]=="snapshot" {
+    //written aside, and only kept if it reads back
+    tmp := file+".tmp"
+    f,err := os.Create(tmp)
+    if err!=nil {
+      fail(err)
+    }
+    index,err := ck.Snapshot(f)
+    if cerr := f.Close(); err==nil {
+      err = cerr
+    }
+    if err!=nil {
+      os.Remove(tmp)
+      fail(err)
+    }
+    _,n,err := verify(tmp)
+    if err!=nil {
+      os.Remove(tmp)
+      fail(err)
+    }
+    if err := os.Rename(tmp, file); err!=nil {
+      fail(err)
+    }
+    fmt.Printf("%s: %d keys at log index %d\n", file, n, index)
+    return
+  }
+
+  if _,_,err := verify(file); err!=nil {
+    fail(err)
+  }
+  f,err := os.Open(file)
+  if err!=nil {
+    fail(err)
+  }
+  defer f.Close()
+  index,n,err := ck.Restore(f)
+  if err!=nil {
+    fail(err)
+  }
+  fmt.Printf("Restored %d keys from %s at log index %d\n", n, file, index)
+}
@@ -0,0 +1,138 @@
+package main
+
+import(
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "strings"
+  "time"
+
+  // our lib
+  . "kvlib"
+  _ "kvpaxos/httpclient" // the client of -api rest
+)
+
+func usage(){
+  fmt.Println("Usage: bin/kvbench [-servers url,url,...] [-api kv|rest] [-clients n] [-reads f] [-keys n]")
+  fmt.Println("                   [-zipf s] [-value n] [-warmup d] [-duration d] [-rate n] [-interval d]")
+  fmt.Println("                   [-label name] [-format text|json|csv] [-o file] [-series file.csv]")
+  fmt.Println("                   [-conf settings.conf] [-set name=value]...")
+  flag.PrintDefaults()
+}
+
+func fail(err error){
+  fmt.Fprintf(os.Stderr, "Failed: %s\n", err)
+  os.Exit(1)
+}
+
+//create file, or with appending, add to it without a header if it has
+//something already
+func output(file string, appending bool) (io.WriteCloser,bool,error) {
+  if file=="" {
+    return os.Stdout,true,nil
+  }
+  mode := os.O_CREATE|os.O_WRONLY|os.O_TRUNC
+  if appending {
+    mode = os.O_CREATE|os.O_WRONLY|os.O_APPEND
+  }
+  f,err := os.OpenFile(file, mode, 0644)
+  if err!=nil {
+    return nil,false,err
+  }
+  st,err := f.Stat()
+  if err!=nil {
+    f.Close()
+    return nil,false,err
+  }
+  return f,st.Size()==0,nil
+}
+
+func main(){
+  servers := flag.String("servers", "", "base URLs of the servers, by default those of the settings")
+  cf := NewConfigFlags(flag.CommandLine)
+  api := flag.String("api", BenchKV, "kv for /kv/*, as served by proj3 and kvpaxos, or rest for /v1/keys")
+  clients := flag.Int("clients", 8, "concurrent clients")
+  reads := flag.Float64("reads", 0.9, "the fraction of gets; the rest are updates")
+  keys := flag.Int("keys", 100, "keys, loaded before the run")
+  zipf := flag.Float64("zipf", 0, "draw keys by a zipfian law of this exponent (>1), not uniformly")
+  value := flag.Int("value", 100, "bytes of a value")
+  warmup := flag.Duration("warmup", 0, "time run before the measure")
+  duration := flag.Duration("duration", 10*time.Second, "time measured")
+  rate := flag.Float64("rate", 0, "requests per second of all clients; 0 sends each once the last is done")
+  interval := flag.Duration("interval", time.Second, "interval of the throughput over time")
+  timeout := flag.Duration("timeout", 5*time.Second, "timeout of a request")
+  seed := flag.Int64("seed", 1, "the seed of the keys, ops and values")
+  label := flag.String("label", "", "the name of the run in the output")
+  format := flag.String("format", "text", "text, json or csv")
+  out := flag.String("o", "", "write the output to a file; csv is appended")
+  series := flag.String("series", "", "append the throughput over time to a csv file")
+  flag.Usage = usage
+  flag.Parse()
+  if flag.NArg()>0 {
+    usage()
+    os.Exit(2)
+  }
+
+  cfg := BenchConfig{API:*api, Clients:*clients, Reads:*reads, Keys:*keys, Zipf:*zipf, ValueSize:*value,
+    Warmup:*warmup, Duration:*duration, Rate:*rate, Interval:*interval, Timeout:*timeout, Seed:*seed, Label:*label}
+  if *servers!="" {
+    for _,s := range strings.Split(*servers, ",") {
+      cfg.Servers = append(cfg.Servers, strings.TrimRight(s, "/"))
+    }
+  }else{
+    conf,err := cf.Load()
+    if err!=nil {
+      fail(err)
+    }
+    cfg.Servers = conf.URLs()
+    cfg.Token = conf.KVToken
+    tlsCfg,err := HTTPClientTLS(conf.Settings())
+    if err!=nil {
+      fail(err)
+    }
+    cfg.TLS = tlsCfg
+  }
+  if *format!="text" && *format!="json" && *format!="csv" {
+    usage()
+    os.Exit(2)
+  }
+
+  res,err := RunBench(cfg)
+  if err!=nil {
+    fail(err)
+  }
+  w,header,err := output(*out, *format=="csv")
+  if err!=nil {
+    fail(err)
+  }
+  switch *format {
+    case "json":
+      err = res.WriteJSON(w)
+    case "csv":
+      err = res.WriteCSV(w, header)
+    default:
+      res.WriteText(w)
+  }
+  if w!=os.Stdout {
+    if cerr := w.Close(); err==nil {
+      err = cerr
+    }
+  }
+  if err!=nil {
+    fail(err)
+  }
+  if *series!="" {
+    w,header,err := output(*series, true)
+    if err!=nil {
+      fail(err)
+    }
+    err = res.WriteSeriesCSV(w, header)
+    if cerr := w.Close(); err==nil {
+      err = cerr
+    }
+    if err!=nil {
+      fail(err)
+    }
+  }
+}
@@ -0,0 +1,236 @@
+package main
+
+import(
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "time"
+
+  // our lib
+  . "kvlib"
+  "kvpaxos/httpclient"
+)
+
+func usage(){
+  fmt.Println("Usage: bin/kvchaos [-seed n] [-clients n] [-ops n] [-keys n] [-faults n] [-gap d]")
+  fmt.Println("                   [-kills=false] [-timeout d] [-logs dir] [-o reproducer.test]")
+  fmt.Println("                   [-conf settings.conf] [-set name=value]...")
+  fmt.Println("       bin/kvchaos -script file.test [-seed n] ...")
+  flag.PrintDefaults()
+}
+
+//the nodes of the settings, each a bin/start_server of its own
+type procCluster struct {
+  conf *Config
+  args []string // of bin/start_server, before the node
+  n int
+  logs string
+  procs []*exec.Cmd
+  clerks []*httpclient.Clerk
+  nodes []string // the RPC address of each node, as it tells
+  sets [][]int // the partition, if any
+}
+
+func newProcCluster(conf *Config, args []string, logs string) (*procCluster,error) {
+  n := conf.N()
+  c := &procCluster{conf:conf, args:args, n:n, logs:logs}
+  c.procs = make([]*exec.Cmd, n)
+  c.nodes = make([]string, n)
+  for i := 0; i<n; i++ {
+    ck,err := httpclient.MakeClerkFromConfig(conf, conf.URL(i))
+    if err!=nil {
+      return nil,err
+    }
+    ck.SetTimeout(time.Second)
+    ck.Retries = 1
+    c.clerks = append(c.clerks, ck)
+  }
+  return c,nil
+}
+
+func (c *procCluster) URL(i int) string {
+  return c.conf.URL(i)
+}
+
+func (c *procCluster) start(i int) error {
+  cmd := exec.Command("bin/start_server", append(c.args, NodeName(i))...)
+  var out io.Writer = ioutil.Discard
+  if c.logs!="" {
+    f,err := os.OpenFile(filepath.Join(c.logs, fmt.Sprintf("n%02d.log", i+1)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err!=nil {
+      return err
+    }
+    defer f.Close()
+    out = f
+  }
+  cmd.Stdout,cmd.Stderr = out,out
+  if err := cmd.Start(); err!=nil {
+    return err
+  }
+  c.procs[i] = cmd
+  //up once it tells its RPC address
+  deadline := time.Now().Add(10*time.Second)
+  for {
+    node,_,err := c.clerks[i].Faults()
+    if err==nil {
+      c.nodes[i] = node
+      return nil
+    }
+    if time.Now().After(deadline) {
+      c.Kill(i)
+      return fmt.Errorf("server %d did not come up: %v", i+1, err)
+    }
+    time.Sleep(100*time.Millisecond)
+  }
+}
+
+func (c *procCluster) Kill(i int) error {
+  cmd := c.procs[i]
+  if cmd==nil {
+    return nil
+  }
+  c.procs[i] = nil
+  err := cmd.Process.Kill()
+  cmd.Wait()
+  return err
+}
+
+func (c *procCluster) Restart(i int) error {
+  c.Kill(i)
+  if err := c.start(i); err!=nil {
+    return err
+  }
+  //a new process has no faults
+  if c.sets!=nil {
+    return c.partition(i)
+  }
+  return nil
+}
+
+func (c *procCluster) partition(i int) error {
+  var p [][]string
+  for _,set := range c.sets {
+    var s []string
+    for _,n := range set {
+      s = append(s, c.nodes[n])
+    }
+    p = append(p, s)
+  }
+  _,rep,err := c.clerks[i].Faults()
+  if err==nil {
+    rep.Faults.Partition = p
+    err = c.clerks[i].SetFaults(rep.Faults)
+  }
+  return err
+}
+
+//on every living node; a node dials alone, so each is told
+func (c *procCluster) Partition(sets [][]int) error {
+  c.sets = sets
+  var first error
+  for i := 0; i<c.n; i++ {
+    if c.procs[i]==nil {
+      continue
+    }
+    if err := c.partition(i); err!=nil && first==nil {
+      first = fmt.Errorf("server %d: %v", i+1, err)
+    }
+  }
+  return first
+}
+
+func (c *procCluster) stop(){
+  for i := 0; i<c.n; i++ {
+    c.Kill(i)
+  }
+}
+
+func main(){
+  seed := flag.Int64("seed", time.Now().UnixNano(), "the seed of the ops and the faults")
+  clients := flag.Int("clients", 4, "concurrent clients")
+  ops := flag.Int("ops", 50, "ops of each client")
+  keys := flag.Int("keys", 5, "keys")
+  faults := flag.Int("faults", 10, "kills, restarts, partitions and heals")
+  kills := flag.Bool("kills", true, "kill and restart nodes, besides partitions")
+  gap := flag.Duration("gap", 500*time.Millisecond, "time between faults, on average")
+  timeout := flag.Duration("timeout", 3*time.Second, "timeout of a request to a server")
+  logs := flag.String("logs", "", "a directory for the output of the servers")
+  out := flag.String("o", "", "a file for the reproducer of a violation")
+  script := flag.String("script", "", "write the ops and faults as a test script, and run nothing")
+  cf := NewConfigFlags(flag.CommandLine)
+  flag.Usage = usage
+  flag.Parse()
+  if flag.NArg()>0 {
+    usage()
+    os.Exit(2)
+  }
+
+  conf,err := cf.Load()
+  if err!=nil {
+    fmt.Printf("Failed: %s\n", err)
+    os.Exit(2)
+  }
+  n := conf.N()
+  plan := NewChaosPlan(ChaosConfig{Seed:*seed, Servers:n, Clients:*clients, Ops:*ops, Keys:*keys,
+    Faults:*faults, NoKills:!*kills, Gap:*gap, Timeout:*timeout})
+
+  if *script!="" {
+    if err := ioutil.WriteFile(*script, []byte(plan.Script()), 0644); err!=nil {
+      fmt.Printf("Failed: %s\n", err)
+      os.Exit(1)
+    }
+    fmt.Printf("%s: seed %d\n", *script, *seed)
+    return
+  }
+
+  fmt.Printf("Seed %d, %d servers: bin/kvchaos %s\n", *seed, n, plan.Config.Flags())
+  cluster,err := newProcCluster(conf, cf.Args(), *logs)
+  if err!=nil {
+    fmt.Printf("Failed: %s\n", err)
+    os.Exit(2)
+  }
+  for i := 0; i<n; i++ {
+    if err := cluster.start(i); err!=nil {
+      cluster.stop()
+      fmt.Printf("Failed: %s\n", err)
+      os.Exit(2)
+    }
+  }
+  res := RunChaos(plan, cluster)
+  cluster.stop()
+
+  unknown := 0
+  for _,op := range res.Ops {
+    if op.Outcome==OutcomeUnknown {
+      unknown++
+    }
+  }
+  fmt.Printf("%d ops, %d of unknown outcome, %d faults:\n", len(res.Ops), unknown, len(res.Events))
+  for _,e := range res.Events {
+    if e.Err!="" {
+      fmt.Printf("  %8v %v: %s\n", e.At.Round(time.Millisecond), e, e.Err)
+    }else{
+      fmt.Printf("  %8v %v\n", e.At.Round(time.Millisecond), e)
+    }
+  }
+  if res.Linearizable {
+    fmt.Printf("History linearizable, seed %d.\n", *seed)
+    return
+  }
+  rep := res.Reproducer()
+  fmt.Printf("History not linearizable, seed %d; %d ops of key %q violate it:\n%s",
+    *seed, len(res.Violation), res.Violation[0].Key, FormatHistory(res.Violation))
+  fmt.Printf("\nReproducer:\n%s", rep)
+  if *out!="" {
+    if err := ioutil.WriteFile(*out, []byte(rep), 0644); err!=nil {
+      fmt.Printf("Failed: %s\n", err)
+    }else{
+      fmt.Printf("Written to %s\n", *out)
+    }
+  }
+  os.Exit(1)
+}
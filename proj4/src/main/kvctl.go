@@ -0,0 +1,388 @@
+package main
+
+import(
+  "encoding/json"
+  "flag"
+  "fmt"
+  "os"
+  "strconv"
+  "strings"
+  "text/tabwriter"
+  "time"
+  "unicode/utf8"
+
+  // our lib
+  . "kvlib"
+  "kvpaxos/httpclient"
+)
+
+func usage(){
+  fmt.Println("Usage: bin/kvctl [-conf settings.conf] [-set name=value]... [-node n01] [-json] [-timeout d] <command>")
+  fmt.Println("  status                       the position of every node in the log, and whether it answers")
+  fmt.Println("  get <key>                    the value of a key")
+  fmt.Println("  put <key> <value>            write a key, whether it exists or not")
+  fmt.Println("  update <key> <value>         write an existing key")
+  fmt.Println("  delete <key>                 delete an existing key")
+  fmt.Println("  dump                         every key and value, in key order")
+  fmt.Println("  count                        the number of keys")
+  fmt.Println("  shutdown <n01|...|all>       shut nodes down gracefully")
+  fmt.Println("  compact [n01|...|all]        fold the log applied into the snapshot now, on every node by default")
+  fmt.Println("  log <n01|...> [from [to]]    the paxos instances of a node, the last ones by default")
+  flag.PrintDefaults()
+}
+
+func fail(err error){
+  fmt.Fprintf(os.Stderr, "Failed: %s\n", err)
+  os.Exit(1)
+}
+
+var(
+  conf *Config
+  jsonOut = flag.Bool("json", false, "write JSON rather than tables")
+  node = flag.String("node", "", "the node of get, put, update, delete, dump and count; any of them by default")
+  timeout = flag.Duration("timeout", 10*time.Second, "of a request")
+)
+
+//a client of the nodes, or of the node of -node
+func clerk(nodes ...int) *httpclient.Clerk {
+  var urls []string
+  for _,i := range nodes {
+    urls = append(urls, conf.URL(i))
+  }
+  if len(urls)==0 {
+    urls = conf.URLs()
+  }
+  ck,err := httpclient.MakeClerkFromConfig(conf, urls...)
+  if err!=nil {
+    fail(err)
+  }
+  ck.SetTimeout(*timeout)
+  if len(urls)==1 {
+    ck.Retries = 1
+  }
+  return ck
+}
+
+func dataClerk() *httpclient.Clerk {
+  if *node=="" {
+    return clerk()
+  }
+  i,err := conf.Node(*node)
+  if err!=nil {
+    fail(err)
+  }
+  return clerk(i)
+}
+
+//the nodes named by arg, n01 or all
+func nodes(arg string) []int {
+  if arg=="all" {
+    var all []int
+    for i := range conf.Nodes {
+      all = append(all, i)
+    }
+    return all
+  }
+  i,err := conf.Node(arg)
+  if err!=nil {
+    fail(err)
+  }
+  return []int{i}
+}
+
+func writeJSON(v interface{}){
+  enc := json.NewEncoder(os.Stdout)
+  enc.SetIndent("", "  ")
+  enc.Encode(v)
+}
+
+func table(header ...string) *tabwriter.Writer {
+  w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+  fmt.Fprintln(w, strings.Join(header, "\t"))
+  return w
+}
+
+//s for a table: quoted if it is empty or not plain text, and cut to n
+//runes if n>0
+func cell(s string, n int) string {
+  if !utf8.ValidString(s) || strings.ContainsAny(s, "\t\n\r\"") || s=="" {
+    s = strconv.Quote(s)
+  }
+  if n>0 && utf8.RuneCountInString(s)>n {
+    s = string([]rune(s)[:n-3])+"..."
+  }
+  return s
+}
+
+type nodeStatus struct {
+  Node string `json:"node"`
+  URL string `json:"url"`
+  Up bool `json:"up"`
+  Error string `json:"error,omitempty"`
+  *httpclient.Status
+}
+
+//exits with 1 if a node does not answer
+func status(){
+  var sts []nodeStatus
+  down := 0
+  for i := range conf.Nodes {
+    st := nodeStatus{Node:NodeName(i), URL:conf.URL(i)}
+    s,err := clerk(i).Status()
+    if err!=nil {
+      st.Error = err.Error()
+      down++
+    }else{
+      st.Up,st.Status = true,&s
+    }
+    sts = append(sts, st)
+  }
+  if *jsonOut {
+    writeJSON(sts)
+  }else{
+    w := table("NODE", "URL", "STATE", "MAX", "MIN", "TOUCHED", "SNAPSTART", "UPTIME")
+    for _,st := range sts {
+      if !st.Up {
+        fmt.Fprintf(w, "%s\t%s\tdown\t\t\t\t\t\n", st.Node, st.URL)
+        continue
+      }
+      fmt.Fprintf(w, "%s\t%s\tup\t%d\t%d\t%d\t%d\t%v\n", st.Node, st.URL, st.Max, st.Min, st.Touched, st.Snapstart,
+        time.Duration(st.UptimeS*float64(time.Second)).Round(time.Second))
+    }
+    w.Flush()
+    //the errors are too long for the table
+    for _,st := range sts {
+      if !st.Up {
+        fmt.Printf("%s: %s\n", st.Node, st.Error)
+      }
+    }
+  }
+  if down>0 {
+    os.Exit(1)
+  }
+}
+
+func dump(){
+  ck := dataClerk()
+  kvs := map[string]string{}
+  var w *tabwriter.Writer
+  if !*jsonOut {
+    w = table("KEY", "VALUE")
+  }
+  after := ""
+  for {
+    pairs,next,err := ck.DumpPage(after, 1000)
+    if err!=nil {
+      fail(err)
+    }
+    for _,p := range pairs {
+      if w!=nil {
+        fmt.Fprintf(w, "%s\t%s\n", cell(p.Key, 0), cell(p.Value, 0))
+      }else{
+        kvs[p.Key] = p.Value
+      }
+    }
+    if next=="" {
+      break
+    }
+    after = next
+  }
+  if w!=nil {
+    w.Flush()
+  }else{
+    writeJSON(kvs)
+  }
+}
+
+func compact(arg string){
+  type compacted struct {
+    Node string `json:"node"`
+    From int `json:"from"`
+    To int `json:"to"`
+    Error string `json:"error,omitempty"`
+  }
+  var res []compacted
+  failed := false
+  for _,i := range nodes(arg) {
+    c := compacted{Node:NodeName(i)}
+    var err error
+    if c.From,c.To,err = clerk(i).Compact(); err!=nil {
+      c.Error = err.Error()
+      failed = true
+    }
+    res = append(res, c)
+  }
+  if *jsonOut {
+    writeJSON(res)
+  }else{
+    w := table("NODE", "SNAPSTART", "COMPACTED")
+    for _,c := range res {
+      if c.Error!="" {
+        fmt.Fprintf(w, "%s\tfailed: %s\t\n", c.Node, c.Error)
+      }else{
+        fmt.Fprintf(w, "%s\t%d -> %d\t%d\n", c.Node, c.From, c.To, c.To-c.From)
+      }
+    }
+    w.Flush()
+  }
+  if failed {
+    os.Exit(1)
+  }
+}
+
+func showLog(arg string, bounds []string){
+  i := nodes(arg)
+  if len(i)!=1 {
+    fail(fmt.Errorf("log of one node, not %s", arg))
+  }
+  from,to := -1,-1
+  for j,b := range bounds {
+    n,err := strconv.Atoi(b)
+    if err!=nil || n<0 {
+      fail(fmt.Errorf("%q is not a log index", b))
+    }
+    if j==0 {
+      from = n
+    }else{
+      to = n
+    }
+  }
+  l,err := clerk(i[0]).Log(from, to)
+  if err!=nil {
+    fail(err)
+  }
+  if *jsonOut {
+    writeJSON(l)
+    return
+  }
+  fmt.Printf("%s: max %d, min %d, touched %d, snapstart %d\n", NodeName(i[0]), l.Max, l.Min, l.Touched, l.Snapstart)
+  w := table("SEQ", "STATE", "OP", "KEY", "VALUE", "SIZE", "SESSION", "OPID", "TIME")
+  for _,e := range l.Entries {
+    if e.State!="decided" {
+      fmt.Fprintf(w, "%d\t%s\t\t\t\t\t\t\t\n", e.Seq, e.State)
+      continue
+    }
+    value := cell(e.Value, 32)
+    if e.Size==0 && (e.Op=="GET" || e.Op=="GETV" || e.Op=="DELETE") {
+      value = "" // they have none
+    }
+    fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", e.Seq, e.State, e.Op, cell(e.Key, 24), value,
+      e.Size, e.Session, e.OpID, time.Unix(0, e.Timestamp).Format("15:04:05.000"))
+  }
+  w.Flush()
+}
+
+//the arguments of a command: n of them, and up to opt more
+func need(args []string, n int, opt int){
+  if len(args)<n+1 || len(args)>n+opt+1 {
+    usage()
+    os.Exit(2)
+  }
+}
+
+func main(){
+  cf := NewConfigFlags(flag.CommandLine)
+  flag.Usage = usage
+  args,err := ParseInterspersed(flag.CommandLine, os.Args[1:])
+  if err!=nil || len(args)==0 {
+    usage()
+    os.Exit(2)
+  }
+  conf,err = cf.Load()
+  if err!=nil {
+    fail(err)
+  }
+
+  switch args[0] {
+    case "status":
+      need(args, 0, 0)
+      status()
+    case "get":
+      need(args, 1, 0)
+      v,ver,err := dataClerk().Get(args[1])
+      if err!=nil {
+        fail(err)
+      }
+      if *jsonOut {
+        writeJSON(map[string]interface{}{"key":args[1], "value":v, "version":ver})
+      }else{
+        fmt.Println(v)
+      }
+    case "put", "update":
+      need(args, 2, 0)
+      ck := dataClerk()
+      put := ck.Put
+      if args[0]=="update" {
+        put = ck.Update
+      }
+      prev,err := put(args[1], args[2])
+      if err!=nil {
+        fail(err)
+      }
+      if *jsonOut {
+        writeJSON(map[string]interface{}{"key":args[1], "value":args[2], "previous":prev})
+      }else if prev!="" {
+        fmt.Printf("OK, was %s\n", cell(prev, 0))
+      }else{
+        fmt.Println("OK")
+      }
+    case "delete":
+      need(args, 1, 0)
+      prev,err := dataClerk().Delete(args[1])
+      if err!=nil {
+        fail(err)
+      }
+      if *jsonOut {
+        writeJSON(map[string]interface{}{"key":args[1], "previous":prev})
+      }else{
+        fmt.Printf("OK, was %s\n", cell(prev, 0))
+      }
+    case "dump":
+      need(args, 0, 0)
+      dump()
+    case "count":
+      need(args, 0, 0)
+      n,err := dataClerk().CountKey()
+      if err!=nil {
+        fail(err)
+      }
+      if *jsonOut {
+        writeJSON(map[string]int{"count":n})
+      }else{
+        fmt.Println(n)
+      }
+    case "shutdown":
+      need(args, 1, 0)
+      failed := false
+      res := map[string]string{}
+      for _,i := range nodes(args[1]) {
+        res[NodeName(i)] = "shutting down"
+        if _,err := clerk(i).Shutdown(); err!=nil {
+          res[NodeName(i)] = err.Error()
+          failed = true
+        }
+        if !*jsonOut {
+          fmt.Printf("%s: %s\n", NodeName(i), res[NodeName(i)])
+        }
+      }
+      if *jsonOut {
+        writeJSON(res)
+      }
+      if failed {
+        os.Exit(1)
+      }
+    case "compact":
+      need(args, 0, 1)
+      arg := "all"
+      if len(args)>1 {
+        arg = args[1]
+      }
+      compact(arg)
+    case "log":
+      need(args, 1, 2)
+      showLog(args[1], args[2:])
+    default:
+      usage()
+      os.Exit(2)
+  }
+}
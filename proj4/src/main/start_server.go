@@ -2,12 +2,12 @@
 
 import(
 	//"net/http"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 	"runtime"
-	"strconv"
 
 	// our lib
 	"kvlib"
@@ -15,75 +15,45 @@ import(
 	"kvpaxos"
 )
 
-var (
-	role = kvlib.Det_role()
-)
-
-func RPC_Addr(me int, conf map[string]string) string {
-	id := fmt.Sprintf("n%02d", me+1)
-	ip,ok := conf[id]
-		if !ok {
-			fmt.Println("Failed to find IP :"+id);
-			panic(conf)
-		}
-
-	if conf["use_different_port"] == "true" {
-
-		p,err := strconv.Atoi(conf["RPC_port_"+id])
-			if err != nil {
-				fmt.Printf("Failed to parse : RPC_port_%s : %s\n",id, conf["RPC_port_"+id]);
-				panic(err)
-			}
-		return ip+":"+strconv.Itoa(p)
-
-	}
-	p,err := strconv.Atoi(conf["RPCport"])
-	if err != nil {
-		println("Failed to parse conf[port]")
-		panic(err)
-	}
-	return ip+":"+strconv.Itoa(p)
-
-}
-
 func usage(){
-	fmt.Println("Usage: bin/start_server <n01|n02|...>")
+	fmt.Println("Usage: bin/start_server [-conf settings.conf] [-set name=value]... <n01|n02|...>")
 	os.Exit(1)
 }
 
 func main(){
   kvpaxos.RPC_Use_TCP = 1
 	runtime.GOMAXPROCS(4)
-	conf:=kvlib.ReadJson("conf/settings.conf")
-	nservers,err := strconv.Atoi(conf["nservers"])
-	if err!=nil{
-		fmt.Println("Failed to parse nservers, use default 3")
-		nservers = 3
+	cf := kvlib.NewConfigFlags(flag.CommandLine)
+	flag.Usage = usage
+	args,_ := kvlib.ParseInterspersed(flag.CommandLine, os.Args[1:])
+	conf,err := cf.Load()
+	if err!=nil {
+		fmt.Printf("Failed to read the settings: %s\n", err)
+		os.Exit(1)
 	}
+	nservers := conf.N()
 	var kva []*kvpaxos.KVPaxos = make([]*kvpaxos.KVPaxos, nservers)
-	var kvh []string = make([]string, nservers)
-
-
-
-	for i := 0; i < nservers; i++ {
-		kvh[i] = RPC_Addr(i,conf)
-	}
+	kvh := conf.RPCAddrs()
 
 	stop := make(chan os.Signal)
-	signal.Notify(stop, syscall.SIGINT)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
-	if len(os.Args)>1 {
+	if len(args)>0 {
 		var kva_me *kvpaxos.KVPaxos
-		if role<0{
+		me,err := conf.Node(args[0])
+		if err!=nil || len(args)>1 {
+			if err!=nil {
+				fmt.Println(err)
+			}
 			usage()
 		}else{
-			kva_me = kvpaxos.StartServer(kvh, role-1)
-			fmt.Printf("Serving HTTP, Server ID: %d\n", role)
+			kva_me = kvpaxos.StartServerConfig(conf, kvh, me)
+			fmt.Printf("Serving HTTP, Server ID: %d\n", me+1)
 		}
 		select {
 			case signal := <-stop:
 				fmt.Printf("Got signal:%v\n", signal)
-				kva_me.Kill()
+				kva_me.Shutdown()
 				return
 			case <-kva_me.Death:
 				fmt.Printf("DB killed by other.")
@@ -92,7 +62,7 @@ func main(){
 
 	}else{
 		for i := 0; i < nservers; i++ {
-			kva[i] = kvpaxos.StartServer(kvh, i)
+			kva[i] = kvpaxos.StartServerConfig(conf, kvh, i)
 		}
 		fmt.Printf("Serving HTTP\n")
 
@@ -109,7 +79,7 @@ func main(){
 			select {
 				case signal := <-stop:
 					fmt.Printf("Got signal:%v\n", signal)
-					for i := 0; i < nservers; i++ {kva[i].Kill()}
+					for i := 0; i < nservers; i++ {kva[i].Shutdown()}
 					return
 				case id:=<-agg_death:
 					fmt.Printf("DB#%d killed by other.",id)
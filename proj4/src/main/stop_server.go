@@ -2,55 +2,63 @@ package main
 
 import(
   //"net/http"
+  "flag"
   "fmt"
+  "os"
   "os/exec"
   "strconv"
   "bytes"
-  "net/http"
+  "time"
 
   // our lib
   . "kvlib"
   //. "paxos"
   //. "kvpaxos"
-)
-
-var (
-  role = Det_role()
+  "kvpaxos/httpclient"
 )
 
 func usage(){
-  fmt.Println("Usage: bin/stop_server <n01|n02|...>")
+  fmt.Println("Usage: bin/stop_server [-conf settings.conf] [-set name=value]... <n01|n02|...>")
 }
 
 func main(){
-  if role<0 {
+  cf := NewConfigFlags(flag.CommandLine)
+  flag.Usage = usage
+  args,_ := ParseInterspersed(flag.CommandLine, os.Args[1:])
+  if len(args)!=1 {
     usage()
     return
   }
-  conf := ReadJson("conf/settings.conf")
-  ips := []string{"127.0.0.1",conf["n01"],conf["n02"],conf["n03"]}
-  ports := []string{conf["port"],conf["port_n01"],conf["port_n02"],conf["port_n03"]}
-  if conf["use_different_port"]!="true"{
-    ports[1],ports[2],ports[3] = ports[0],ports[0],ports[0]
+  conf,err := cf.Load()
+  if err!=nil {
+    fmt.Printf("Failed to read the settings: %s\n", err)
+    return
+  }
+  me,err := conf.Node(args[0])
+  if err!=nil {
+    fmt.Println(err)
+    usage()
+    return
   }
 
-      fmt.Printf("Stop Server %d\n", role)
-      addr := fmt.Sprintf("http://%s:%s/kvman/shutdown", ips[role], ports[role])
+      fmt.Printf("Stop Server %d\n", me+1)
+      ck := httpclient.MakeClerk([]string{conf.URL(me)})
+      ck.SetTimeout(5*time.Second)
+      ck.AdminToken = conf.KVManToken
+      if cfg,err := HTTPClientTLS(conf.Settings()); err!=nil {
+        fmt.Printf("TLS: %s\n", err)
+      }else if cfg!=nil {
+        ck.SetTLS(cfg)
+      }
 
-        resp,err := http.Get(addr)
-        if err==nil{
-          res:=DecodeStr(resp)
-          fmt.Println(res)
-          return
-        }
-          resp,err=http.Get(addr)
-          if err==nil{
-            res:=DecodeStr(resp)
+        for try:=0;try<2;try++{
+          if res,err:=ck.Shutdown();err==nil{
             fmt.Println(res)
             return
           }
+        }
            // forced // lsof -t -i:[port]
-            cmd := exec.Command("lsof",[]string{"-t", "-i:"+ports[role]}...);
+            cmd := exec.Command("lsof",[]string{"-t", "-i:"+strconv.Itoa(conf.Nodes[me].Port)}...);
             o,_ := cmd.Output()
             if len(o)<=1 {
               fmt.Println("Fail to get pid")
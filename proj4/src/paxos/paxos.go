@@ -22,13 +22,17 @@ package paxos
 
 import (
   "net"
+  "crypto/tls"
   "net/rpc"
   "log"
   "os"
   "syscall"
   "sync"
+  "sync/atomic"
   "fmt"
   "math/rand"
+  "kvlog"
+  "faultnet"
   "time"
 
   )
@@ -40,15 +44,9 @@ const (
   ACCEPT = "accept"
 )
 
-// debug message setting
-const (
-  DEBUG     = false
-  DEBUG_INI = false
-  DEBUG_PRE = false
-  DEBUG_ACC = false
-  DEBUG_DEC = true
-  DEBUG_ARG = false
-)
+// debug messages go to the "paxos" subsystem of kvlog, at level debug;
+// plog is for call(), which does not know its peer
+var plog = kvlog.New("paxos")
 
 type Paxos struct {
   mu sync.Mutex // lock the paxos server
@@ -64,6 +62,11 @@ type Paxos struct {
   instances map[int]PaxosInstance //active paxos instances
   majority int // the number what majority means (# of server)/2 + 1
   dones []int
+  log *kvlog.Logger // with node
+  rpcSent []int64 // RPCs to each peer, atomic
+  rpcFailed []int64 // those that got no reply
+  net *faultnet.Network // the faults of the RPCs to the peers
+  decidedCh chan struct{} // closed, and replaced, when an instance is decided
 }
 
 type PaxosProposal struct{
@@ -109,6 +112,7 @@ type PaxosReply struct {
   Proposal PaxosProposal
   Sender int // the index of sender in peers
   Done int // piggybacking px.dones[Sender]
+  Promised int // on a REJECT, the number to beat
 }
 
 func (p *PaxosReply) toString() string{
@@ -129,9 +133,7 @@ func (px *Paxos) MakePaxosInstance(seq int) {
   px.mu.Lock(); // Protect px.instances
   defer px.mu.Unlock();
   if _, exists := px.instances[seq]; !exists {
-    if DEBUG && DEBUG_INI{
-      fmt.Printf("%d create new paxos instance[%d]\n",px.me ,seq)
-    }
+    px.log.Debug("instance created", "seq", seq)
     px.instances[seq] = PaxosInstance{decided: false, maxPrepareNum: -1, acceptedProposal: PaxosProposal{PaxosNum: -1, Value: nil}}
     // handle max?
   }
@@ -139,6 +141,35 @@ func (px *Paxos) MakePaxosInstance(seq int) {
 
 
 var RPC_Use_TCP int = 0
+// mutual TLS between the peers, if set: RPC_TLS to dial them,
+// RPC_TLS_Server for the listener of Make (a caller that brings
+// its own rpcs wraps its listener itself)
+var RPC_TLS *tls.Config
+var RPC_TLS_Server *tls.Config
+
+func Dial(nw string, srv string) (*rpc.Client, error) {
+  return DialFrom("", nw, srv)
+}
+
+// Dial, by the peer at from, through the faults of faultnet.Default
+func DialFrom(from string, nw string, srv string) (*rpc.Client, error) {
+  return dialNet(faultnet.Default, from, nw, srv)
+}
+
+// DialFrom, through the faults of n
+func dialNet(n *faultnet.Network, from string, nw string, srv string) (*rpc.Client, error) {
+  conn, err := n.Dial(from, srv, func() (net.Conn, error) {
+    if RPC_TLS == nil {
+      return net.Dial(nw, srv)
+    }
+    return tls.Dial(nw, srv, RPC_TLS)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return rpc.NewClient(conn), nil
+}
+
 //
 // call() sends an RPC to the rpcname handler on server srv
 // with arguments args, waits for the reply, and leaves the
@@ -156,16 +187,28 @@ var RPC_Use_TCP int = 0
 // please do not change this function.
 //
 func call(srv string, name string, args interface{}, reply interface{}) bool {
+  return callFrom("", srv, name, args, reply)
+}
+
+// call(), by the peer at from
+func callFrom(from string, srv string, name string, args interface{}, reply interface{}) bool {
+  return callNet(faultnet.Default, from, srv, name, args, reply)
+}
+
+// callFrom(), through the faults of n
+func callNet(n *faultnet.Network, from string, srv string, name string, args interface{}, reply interface{}) bool {
   nw := "unix"
   if RPC_Use_TCP==1{
     nw = "tcp"
   }
-  c, err := rpc.Dial(nw, srv)
+  c, err := dialNet(n, from, nw, srv)
 
   if err != nil {
-    err1 := err.(*net.OpError)
-    if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-      fmt.Printf("paxos Dial() failed: %v\n", err1)
+    err1, ok := err.(*net.OpError)
+    if err == faultnet.ErrDropped || err == faultnet.ErrPartitioned {
+      plog.Debug("dial failed", "peer", srv, "err", err)
+    } else if !ok || (err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED) {
+      plog.Warn("dial failed", "peer", srv, "err", err)
     }
     return false
   }
@@ -176,7 +219,11 @@ func call(srv string, name string, args interface{}, reply interface{}) bool {
     return true
   }
 
-  fmt.Println(err)
+  if err == faultnet.ErrDropped {
+    plog.Debug("call failed", "peer", srv, "rpc", name, "err", err)
+    return false
+  }
+  plog.Warn("call failed", "peer", srv, "rpc", name, "err", err)
   return false
 }
 
@@ -188,6 +235,27 @@ func call(srv string, name string, args interface{}, reply interface{}) bool {
 // call Status() to find out if/when agreement
 // is reached.
 //
+// call() to peer i, counted in RPCStats
+func (px *Paxos) call(i int, name string, args interface{}, reply interface{}) bool {
+  atomic.AddInt64(&px.rpcSent[i], 1)
+  ok := callNet(px.net, px.peers[px.me], px.peers[i], name, args, reply)
+  if !ok {
+    atomic.AddInt64(&px.rpcFailed[i], 1)
+  }
+  return ok
+}
+
+// the RPCs sent to each peer, and those that failed, by index in peers
+func (px *Paxos) RPCStats() (sent []int64, failed []int64) {
+  sent = make([]int64, len(px.peers))
+  failed = make([]int64, len(px.peers))
+  for i := range px.peers {
+    sent[i] = atomic.LoadInt64(&px.rpcSent[i])
+    failed[i] = atomic.LoadInt64(&px.rpcFailed[i])
+  }
+  return sent, failed
+}
+
 func (px *Paxos) Start(seq int, v interface{}) {
   // Your code here.
   go func() {
@@ -243,31 +311,31 @@ func (px *Paxos) Start(seq int, v interface{}) {
 func (px *Paxos) sendPrepare(seq int, paxosNum int) (bool, PaxosProposal){
 
   proposal := PaxosProposal{PaxosNum: paxosNum, Value: nil} // initialize
-  args := PaxosArgs{Seq: seq, Proposal: proposal, Sender:px.me, Done:px.dones[px.me]}
+  args := PaxosArgs{Seq: seq, Proposal: proposal, Sender:px.me, Done:px.done()}
   replyProposal := PaxosProposal{PaxosNum: -1, Value: nil} // initialize
   reply := PaxosReply{State:REJECT}
   replyNum := 0
 
-  for index, acceptor := range px.peers {
-    if DEBUG && DEBUG_PRE {
-      fmt.Printf("%d send prepare(%d) to %d\n", px.me ,paxosNum, index);
-    }
+  for index := range px.peers {
+    px.log.Debug("prepare sent", "seq", seq, "n", paxosNum, "to", index)
 
     isAccept := false
+    reply.Promised = 0 // not sent when zero
     if index == px.me{
       px.HandlePrepare(&args, &reply)
       isAccept = (reply.State == ACCEPT)
     }else{
-      isAccept = call(acceptor, "Paxos.HandlePrepare", &args, &reply) // true = get reply
+      isAccept = px.call(index, "Paxos.HandlePrepare", &args, &reply) // true = get reply
       if isAccept {
         isAccept = (reply.State == ACCEPT) // true = accept
+        if !isAccept {
+          px.promised(seq, reply.Promised)
+        }
       }
     }
 
     if isAccept {
-      if DEBUG && DEBUG_PRE{
-        fmt.Printf("%d accept prepare number %d from %d\n", index, paxosNum ,px.me )
-      }
+      px.log.Debug("prepare accepted", "seq", seq, "n", paxosNum, "by", index)
       replyNum++
       // get the proposal with largest paxos number
       if reply.Proposal.PaxosNum > replyProposal.PaxosNum{
@@ -284,9 +352,7 @@ func (px *Paxos) sendPrepare(seq int, paxosNum int) (bool, PaxosProposal){
         }
         // end hot fix
     } else {
-      if DEBUG && DEBUG_PRE{
-        fmt.Printf("%d reject prepare number %d from %d\n", index, paxosNum ,px.me )
-      }
+      px.log.Debug("prepare rejected", "seq", seq, "n", paxosNum, "by", index)
     }
   }
   // update max paxosnum?
@@ -295,9 +361,7 @@ func (px *Paxos) sendPrepare(seq int, paxosNum int) (bool, PaxosProposal){
 
 // It is RPC
 func (px *Paxos) HandlePrepare(args *PaxosArgs, reply *PaxosReply) error {
-  if DEBUG && DEBUG_ARG {
-    fmt.Printf("%d HandlePrepare %s\n", px.me, args.toString());
-  }
+  px.log.Debug("prepare received", "seq", args.Seq, "n", args.Proposal.PaxosNum, "from", args.Sender)
   proposal := args.Proposal
   seq := args.Seq
   reply.State = REJECT
@@ -314,41 +378,54 @@ func (px *Paxos) HandlePrepare(args *PaxosArgs, reply *PaxosReply) error {
     px.instances[seq] = obj
     reply.Proposal = px.instances[seq].acceptedProposal
     reply.State = ACCEPT
+  } else {
+    reply.Promised = px.instances[seq].maxPrepareNum
   }
 
   return nil
 }
 
+// a peer rejected a proposal of seq for having promised n; the next
+// number is above it, rather than a step above the last, which could take
+// a peer that was away long behind a proposer that was not
+func (px *Paxos) promised(seq int, n int) {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  obj, ok := px.instances[seq]
+  if ok && n > obj.maxPrepareNum {
+    obj.maxPrepareNum = n
+    px.instances[seq] = obj
+  }
+}
+
 func (px *Paxos) sendAccept(seq int, proposal PaxosProposal) (bool){
 
 
-  args := PaxosArgs{Seq: seq, Proposal: proposal, Sender:px.me, Done:px.dones[px.me]}
+  args := PaxosArgs{Seq: seq, Proposal: proposal, Sender:px.me, Done:px.done()}
   reply := PaxosReply{State:REJECT}
   replyNum := 0
 
-  for index, acceptor := range px.peers {
-    if DEBUG && DEBUG_ACC{
-      fmt.Printf("%d send accept(%s) to %d\n",px.me ,proposal.toString(), index);
-    }
+  for index := range px.peers {
+    px.log.Debug("accept sent", "seq", seq, "n", proposal.PaxosNum, "to", index)
     isAccept := false
+    reply.Promised = 0
     if index == px.me{
       px.HandleAccept(&args, &reply)
       isAccept = (reply.State == ACCEPT)
     }else{
-      isAccept = call(acceptor, "Paxos.HandleAccept", &args, &reply) // true = get reply
+      isAccept = px.call(index, "Paxos.HandleAccept", &args, &reply) // true = get reply
       if isAccept {
         isAccept = (reply.State == ACCEPT)
+        if !isAccept {
+          px.promised(seq, reply.Promised)
+        }
       }
     }
     if isAccept {
-      if DEBUG && DEBUG_ACC{
-        fmt.Printf("%d accept %s from %d\n", index, proposal.toString() ,px.me )
-      }
+      px.log.Debug("proposal accepted", "seq", seq, "n", proposal.PaxosNum, "by", index)
       replyNum++
     } else {
-      if DEBUG && DEBUG_ACC{
-        fmt.Printf("%d reject %s from %d\n", index, proposal.toString() ,px.me )
-      }
+      px.log.Debug("proposal rejected", "seq", seq, "n", proposal.PaxosNum, "by", index)
     }
   }
   return replyNum >= px.majority
@@ -370,37 +447,35 @@ func (px *Paxos) HandleAccept(args *PaxosArgs, reply *PaxosReply) error {
     obj.maxPrepareNum = proposal.PaxosNum
     px.instances[seq] = obj
     reply.State = ACCEPT
+  } else {
+    reply.Promised = obj.maxPrepareNum
+    if obj.acceptedProposal.PaxosNum > reply.Promised {
+      reply.Promised = obj.acceptedProposal.PaxosNum
+    }
   }
   return nil
 }
 
 func (px *Paxos) sendDecide(seq int, proposal PaxosProposal) {
 
-  args := PaxosArgs{Seq: seq, Proposal: proposal, Sender:px.me, Done:px.dones[px.me]}
+  args := PaxosArgs{Seq: seq, Proposal: proposal, Sender:px.me, Done:px.done()}
   reply := PaxosReply{State:REJECT}
 
-  for index, acceptor := range px.peers {
-    if DEBUG && DEBUG_DEC{
-      fmt.Printf("%d send decide(%s) to %d\n",px.me ,proposal.toString(), index);
-    }
+  for index := range px.peers {
+    px.log.Debug("decide sent", "seq", seq, "n", proposal.PaxosNum, "to", index)
     isAccept := false
     if index == px.me{
       px.HandleDecide(&args, &reply)
       isAccept = (reply.State == ACCEPT)
     }else{
-      isAccept = call(acceptor, "Paxos.HandleDecide", &args, &reply) // true = get reply
+      isAccept = px.call(index, "Paxos.HandleDecide", &args, &reply) // true = get reply
       if isAccept {
-        if DEBUG && DEBUG_ACC{
-          fmt.Printf("%d decided %s on instance %d\n", index, proposal.toString() , seq )
-        }
         isAccept = (reply.State == ACCEPT) // true = accept
       }
     }
 
     if isAccept {
-      if DEBUG && DEBUG_ACC{
-        fmt.Printf("%d decided %s on instance %d\n", index, proposal.toString() , seq )
-      }
+      px.log.Debug("decide acknowledged", "seq", seq, "n", proposal.PaxosNum, "by", index)
     }
 
   }
@@ -409,7 +484,6 @@ func (px *Paxos) sendDecide(seq int, proposal PaxosProposal) {
 func (px *Paxos) HandleDecide(args *PaxosArgs, reply *PaxosReply) error {
 
   seq := args.Seq
-  px.dones[args.Sender] = args.Done
   proposal := args.Proposal
   reply.State = REJECT
 
@@ -418,10 +492,15 @@ func (px *Paxos) HandleDecide(args *PaxosArgs, reply *PaxosReply) error {
 
   px.mu.Lock()
   defer px.mu.Unlock()
+  px.dones[args.Sender] = args.Done
 
   // px.instances[seq].acceptedProposal = proposal
   // px.instances[seq].decided = true
   obj := px.instances[seq]
+  if !obj.decided {
+    close(px.decidedCh)
+    px.decidedCh = make(chan struct{})
+  }
   obj.acceptedProposal = proposal
   obj.decided = true
   px.instances[seq] = obj
@@ -438,11 +517,20 @@ func (px *Paxos) HandleDecide(args *PaxosArgs, reply *PaxosReply) error {
 //
 func (px *Paxos) Done(seq int) {
   // Your code here.
+  px.mu.Lock()
+  defer px.mu.Unlock()
   if px.dones[px.me] < seq {
     px.dones[px.me] = seq
   }
 }
 
+// the highest seq passed to Done on this peer, piggybacked on the RPCs
+func (px *Paxos) done() int {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.dones[px.me]
+}
+
 //
 // the application wants to know the
 // highest instance sequence known to
@@ -450,6 +538,8 @@ func (px *Paxos) Done(seq int) {
 //
 func (px *Paxos) Max() int {
   // Your code here.
+  px.mu.Lock()
+  defer px.mu.Unlock()
   max := -1
   for num := range px.instances {
     if num > max{
@@ -508,6 +598,16 @@ func (px *Paxos) Min() int {
   return min + 1
 }
 
+//
+// a channel closed once this peer learns of a decision made after the
+// call, so that the application can wait for the log to grow
+//
+func (px *Paxos) Decided() <-chan struct{} {
+  px.mu.Lock()
+  defer px.mu.Unlock()
+  return px.decidedCh
+}
+
 //
 // the application wants to know whether this
 // peer thinks an instance has been decided,
@@ -543,27 +643,49 @@ func (px *Paxos) Kill() {
   }
 }
 
+// shut the sending side of conn, for unix and tcp alike; the accept
+// loops of Make and kvpaxos use it to lose replies when unreliable
+func CloseWrite(conn net.Conn) error {
+  if tc, ok := conn.(*tls.Conn); ok {
+    conn = tc.NetConn()
+  }
+  cw, ok := conn.(interface{ CloseWrite() error })
+  if !ok {
+    return fmt.Errorf("cannot shut the writes of %T", conn)
+  }
+  return cw.CloseWrite()
+}
+
 //
 // the application wants to create a paxos peer.
 // the ports of all the paxos peers (including this one)
 // are in peers[]. this servers port is peers[me].
 //
 func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
+  return MakeNet(peers, me, rpcs, faultnet.Default)
+}
+
+// Make, with the RPCs to the peers through the faults of n, for the
+// clusters that share a process but not their faults
+func MakeNet(peers []string, me int, rpcs *rpc.Server, n *faultnet.Network) *Paxos {
   px := &Paxos{}
   px.peers = peers
   px.me = me
+  px.net = n
+  px.log = plog.With("node", me)
 
 
   // Your initialization code here.
   px.majority = len(peers)/2+1
   px.instances = map[int]PaxosInstance{}
+  px.decidedCh = make(chan struct{})
   px.dones = make([]int, len(peers))
+  px.rpcSent = make([]int64, len(peers))
+  px.rpcFailed = make([]int64, len(peers))
   for i := range peers {
     px.dones[i] = -1
   }
-  if DEBUG && DEBUG_INI{
-    fmt.Printf("%d majority: %d/%d\n",px.me, px.majority, len(peers))
-  }
+  px.log.Debug("started", "majority", px.majority, "peers", len(peers))
   // End of initialization code
 
   if rpcs != nil {
@@ -586,6 +708,9 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
     if e != nil {
       log.Fatal("listen error: ", e);
     }
+    if RPC_TLS_Server != nil {
+      l = tls.NewListener(l, RPC_TLS_Server)
+    }
     px.l = l
 
     // please do not change any of the following code,
@@ -601,11 +726,9 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
             conn.Close()
           } else if px.unreliable && (rand.Int63() % 1000) < 200 {
             // process the request but force discard of reply.
-            c1 := conn.(*net.UnixConn)
-            f, _ := c1.File()
-            err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
+            err := CloseWrite(conn)
             if err != nil {
-              fmt.Printf("shutdown: %v\n", err)
+              px.log.Error("shutdown", "err", err)
             }
             px.rpcCount++
             go rpcs.ServeConn(conn)
@@ -617,7 +740,7 @@ func Make(peers []string, me int, rpcs *rpc.Server) *Paxos {
           conn.Close()
         }
         if err != nil && px.dead == false {
-          fmt.Printf("Paxos(%v) accept: %v\n", me, err.Error())
+          px.log.Error("accept failed", "err", err)
         }
       }
     }()
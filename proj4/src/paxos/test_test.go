@@ -7,6 +7,7 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "faultnet"
 
 func port(tag string, host int) string {
   s := "/var/tmp/824-"
@@ -580,6 +581,102 @@ func TestOld(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
+//
+// a peer that promised a high number rejects a proposer far below it, and
+// tells it the number to beat, so it takes the proposer one more round
+// rather than a round per number (the proposer of seq 0 at peer 0 steps up
+// by one at a time)
+//
+func TestRenumber(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Rejected proposer renumbers above the promise ...\n")
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("renumber", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  const promise = 1000
+  for i := 1; i < npaxos; i++ {
+    var reply PaxosReply
+    pxa[i].HandlePrepare(&PaxosArgs{Seq: 0, Proposal: PaxosProposal{PaxosNum: promise}, Sender: 3 - i, Done: -1}, &reply)
+    if reply.State != ACCEPT {
+      t.Fatalf("prepare %d at a new peer -> %s", promise, reply.toString())
+    }
+  }
+  var reply PaxosReply
+  pxa[1].HandlePrepare(&PaxosArgs{Seq: 0, Proposal: PaxosProposal{PaxosNum: 5}, Sender: 0, Done: -1}, &reply)
+  if reply.State != REJECT || reply.Promised != promise {
+    t.Fatalf("prepare 5 after %d -> %s, promised %d", promise, reply.toString(), reply.Promised)
+  }
+  reply = PaxosReply{}
+  pxa[1].HandleAccept(&PaxosArgs{Seq: 0, Proposal: PaxosProposal{PaxosNum: 5, Value: 0}, Sender: 0, Done: -1}, &reply)
+  if reply.State != REJECT || reply.Promised != promise {
+    t.Fatalf("accept 5 after %d -> %s, promised %d", promise, reply.toString(), reply.Promised)
+  }
+
+  pxa[0].Start(0, "renumbered")
+  waitn(t, pxa, 0, npaxos)
+
+  sent, _ := pxa[0].RPCStats()
+  if sent[1] > 10 {
+    t.Fatalf("%d RPCs to get above a promise of %d", sent[1], promise)
+  }
+  pxa[1].mu.Lock()
+  n := pxa[1].instances[0].acceptedProposal.PaxosNum
+  pxa[1].mu.Unlock()
+  if n <= promise {
+    t.Fatalf("accepted %d, not above the promise of %d", n, promise)
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
+func TestDecided(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+
+  fmt.Printf("Test: Decided wakes up on a decision ...\n")
+
+  const npaxos = 3
+  var pxa []*Paxos = make([]*Paxos, npaxos)
+  var pxh []string = make([]string, npaxos)
+  defer cleanup(pxa)
+
+  for i := 0; i < npaxos; i++ {
+    pxh[i] = port("decided", i)
+  }
+  for i := 0; i < npaxos; i++ {
+    pxa[i] = Make(pxh, i, nil)
+  }
+
+  ch := pxa[2].Decided()
+  select {
+  case <-ch:
+    t.Fatalf("Decided before any decision")
+  case <-time.After(100 * time.Millisecond):
+  }
+  pxa[0].Start(0, "x")
+  select {
+  case <-ch:
+  case <-time.After(10 * time.Second):
+    t.Fatalf("Decided did not wake up")
+  }
+  waitn(t, pxa, 0, npaxos)
+  if ch2 := pxa[2].Decided(); ch2 == ch {
+    t.Fatalf("Decided after a decision is the channel already closed")
+  }
+
+  fmt.Printf("  ... Passed\n")
+}
+
 //
 // many agreements, with unreliable RPC
 //
@@ -876,3 +973,93 @@ func TestLots(t *testing.T) {
 
   fmt.Printf("  ... Passed\n")
 }
+
+// agreement on seq, started at every peer, under the faults of
+// faultnet.Default
+func agreeAll(t *testing.T, pxa []*Paxos, seq int) {
+  for i := 0; i < len(pxa); i++ {
+    pxa[i].Start(seq, seq*10+i)
+  }
+  waitn(t, pxa, seq, len(pxa))
+}
+
+func TestFaults(t *testing.T) {
+  runtime.GOMAXPROCS(4)
+  defer faultnet.Default.Set(faultnet.Faults{})
+  defer func() { RPC_Use_TCP = 0 }()
+
+  for _, nw := range []string{"unix", "tcp"} {
+    RPC_Use_TCP = 0
+    if nw == "tcp" {
+      RPC_Use_TCP = 1
+    }
+
+    const npaxos = 3
+    var pxa []*Paxos = make([]*Paxos, npaxos)
+    var pxh []string = make([]string, npaxos)
+    for i := 0; i < npaxos; i++ {
+      pxh[i] = port("faults", i)
+    }
+    for i := 0; i < npaxos; i++ {
+      pxa[i] = Make(pxh, i, nil)
+    }
+
+    fmt.Printf("Test: Partition of peer sets, %s ...\n", nw)
+
+    faultnet.Default.Set(faultnet.Faults{Seed: 1})
+    faultnet.Default.Partition([]string{pxh[0]}, []string{pxh[1], pxh[2]})
+    pxa[0].Start(0, "minority")
+    time.Sleep(time.Second)
+    if ndecided(t, pxa, 0) != 0 {
+      t.Fatalf("a minority decided")
+    }
+    pxa[1].Start(1, "majority")
+    waitn(t, pxa, 1, 2)
+    if decided, _ := pxa[0].Status(1); decided {
+      t.Fatalf("a decision crossed the partition")
+    }
+    if st := faultnet.Default.Stats()[faultnet.LinkName(pxh[0], pxh[1])]; st.Partitioned == 0 {
+      t.Fatalf("no RPC from the minority was cut: %+v", st)
+    }
+    faultnet.Default.Heal()
+    pxa[0].Start(1, "late")
+    waitn(t, pxa, 0, npaxos)
+    waitn(t, pxa, 1, npaxos)
+
+    fmt.Printf("  ... Passed\n")
+
+    fmt.Printf("Test: Drops, duplicates, delays and reordering, %s ...\n", nw)
+
+    faultnet.Default.Set(faultnet.Faults{Seed: 42, Default: faultnet.Link{
+      Drop: 0.1, DropReply: 0.1, Duplicate: 0.2, DelayMs: 1, JitterMs: 5, Reorder: 0.1, HoldMs: 20}})
+    for seq := 2; seq < 12; seq++ {
+      agreeAll(t, pxa, seq)
+    }
+    var sum faultnet.Stats
+    for _, st := range faultnet.Default.Stats() {
+      sum.Dropped += st.Dropped
+      sum.RepliesDropped += st.RepliesDropped
+      sum.Duplicated += st.Duplicated
+      sum.Reordered += st.Reordered
+    }
+    if sum.Dropped == 0 || sum.RepliesDropped == 0 || sum.Duplicated == 0 || sum.Reordered == 0 {
+      t.Fatalf("faults missing: %+v", sum)
+    }
+    faultnet.Default.Set(faultnet.Faults{})
+
+    fmt.Printf("  ... Passed\n")
+
+    fmt.Printf("Test: Unreliable accept loop, %s ...\n", nw)
+
+    for i := 0; i < npaxos; i++ {
+      pxa[i].unreliable = true
+    }
+    for seq := 12; seq < 20; seq++ {
+      agreeAll(t, pxa, seq)
+    }
+
+    fmt.Printf("  ... Passed\n")
+
+    cleanup(pxa)
+  }
+}
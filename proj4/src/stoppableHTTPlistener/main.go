@@ -1,27 +1,37 @@
 package stoppableHTTPlistener
 //Acknowledgement: this library is mainly based on @hydrogen18's work
 //https://raw.githubusercontent.com/hydrogen18/stoppableListener/master/listener.go
+//
+//Stop closes the wrapped listener, which ends a blocked Accept at once, so
+//there is no deadline to poll. Any listener can be wrapped, TCP or Unix.
+//Server serves HTTP on one, and drains the requests in flight when it is
+//stopped.
 import (
+	"context"
 	"errors"
 	"net"
+	"net/http"
+	"sync"
 	"time"
 )
 
 type StoppableListener struct {
-	*net.TCPListener          //Wrapped listener
-	stop             chan int //Channel used only to indicate listener should shutdown
+	net.Listener               //Wrapped listener
+	stop         chan struct{} //Closed once the listener should shutdown
+	released     chan struct{} //Closed once the wrapped listener is closed
+	once         sync.Once
+	err          error //of closing the wrapped listener
 }
 
 func New(l net.Listener) (*StoppableListener, error) {
-	tcpL, ok := l.(*net.TCPListener)
-
-	if !ok {
+	if l == nil {
 		return nil, errors.New("Cannot wrap listener")
 	}
 
 	retval := &StoppableListener{}
-	retval.TCPListener = tcpL
-	retval.stop = make(chan int)
+	retval.Listener = l
+	retval.stop = make(chan struct{})
+	retval.released = make(chan struct{})
 
 	return retval, nil
 }
@@ -29,35 +39,110 @@ func New(l net.Listener) (*StoppableListener, error) {
 var StoppedError = errors.New("Listener stopped")
 
 func (sl *StoppableListener) Accept() (net.Conn, error) {
+	newConn, err := sl.Listener.Accept()
 
-	for {
-		//Wait up to one second for a new connection
-		sl.SetDeadline(time.Now().Add(time.Millisecond*10))
+	//Check for the channel being closed; a connection accepted
+	//just before is closed, not left for its client to time out
+	select {
+	case <-sl.stop:
+		if newConn != nil {
+			newConn.Close()
+		}
+		return nil, StoppedError
+	default:
+		//If the channel is still open, continue as normal
+	}
 
-		newConn, err := sl.TCPListener.Accept()
+	return newConn, err
+}
 
-		//Check for the channel being closed
-		select {
-		case <-sl.stop:
-			return nil, StoppedError
-		default:
-			//If the channel is still open, continue as normal
-		}
+//Stop accepting, and close the wrapped listener; the port, or the socket
+//file, is released when Stop returns
+func (sl *StoppableListener) Stop() {
+	sl.once.Do(func() {
+		close(sl.stop)
+		sl.err = sl.Listener.Close()
+		close(sl.released)
+	})
+}
+
+//Close is Stop, for http.Server
+func (sl *StoppableListener) Close() error {
+	sl.Stop()
+	return sl.err
+}
+
+//Released is closed once the wrapped listener is closed, and its port can
+//be listened to again
+func (sl *StoppableListener) Released() <-chan struct{} {
+	return sl.released
+}
 
-		if err != nil {
-			netErr, ok := err.(net.Error)
+//An http.Server on a StoppableListener
+type Server struct {
+	*http.Server
+	Listener *StoppableListener
+	done     chan struct{} //Closed once Serve has returned
+	err      error         //of Serve
+}
 
-			//If this is a timeout, then continue to wait for
-			//new connections
-			if ok && netErr.Timeout() && netErr.Temporary() {
-				continue
-			}
+//Serve s on l in a goroutine of its own, with the TLS of s.TLSConfig if
+//tls is set
+func Serve(s *http.Server, l net.Listener, tls bool) (*Server, error) {
+	sl, err := New(l)
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{Server: s, Listener: sl, done: make(chan struct{})}
+	go func() {
+		var err error
+		if tls {
+			err = s.ServeTLS(sl, "", "") //the certificate is in TLSConfig
+		} else {
+			err = s.Serve(sl)
+		}
+		if err != StoppedError && err != http.ErrServerClosed {
+			srv.err = err
 		}
+		sl.Stop()
+		close(srv.done)
+	}()
+	return srv, nil
+}
 
-		return newConn, err
+//Stop accepting at once, and wait for the requests in flight to end, for
+//up to timeout; those still running then have their connections closed,
+//and context.DeadlineExceeded is returned. The port is released when
+//Stop returns.
+func (srv *Server) Stop(timeout time.Duration) error {
+	srv.Listener.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		srv.Server.Close()
 	}
+	return err
 }
 
-func (sl *StoppableListener) Stop() {
-	close(sl.stop)
+//Kill stops accepting and closes every connection, in flight or not,
+//without waiting for their requests
+func (srv *Server) Kill() {
+	srv.Listener.Stop()
+	srv.Server.Close()
+}
+
+//Done is closed once the server has stopped serving
+func (srv *Server) Done() <-chan struct{} {
+	return srv.done
+}
+
+//the error that ended Serve, other than a stop; after Done
+func (srv *Server) Err() error {
+	return srv.err
+}
+
+//Released is closed once the port is released
+func (srv *Server) Released() <-chan struct{} {
+	return srv.Listener.Released()
 }
@@ -0,0 +1,182 @@
+package stoppableHTTPlistener
+
+import "testing"
+import "context"
+import "fmt"
+import "io/ioutil"
+import "net"
+import "net/http"
+import "os"
+import "path/filepath"
+import "time"
+
+// a handler that answers after d, or at once if d is 0
+func slow(d time.Duration, started chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if started != nil {
+			started <- struct{}{}
+		}
+		time.Sleep(d)
+		fmt.Fprintf(w, "done")
+	})
+}
+
+func get(c *http.Client, url string) (string, error) {
+	resp, err := c.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestListener(t *testing.T) {
+	fmt.Printf("Test: Stop ends Accept at once and releases the port ...\n")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr().String()
+	sl, _ := New(l)
+	accepted := make(chan error)
+	go func() {
+		_, err := sl.Accept()
+		accepted <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	sl.Stop()
+	select {
+	case err := <-accepted:
+		if err != StoppedError {
+			t.Fatalf("Accept after Stop -> %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Accept still blocked after Stop")
+	}
+	select {
+	case <-sl.Released():
+	default:
+		t.Fatalf("not released when Stop returned")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("Accept took %v to end", d)
+	}
+	sl.Stop() // twice is fine
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen again: %v", err)
+	}
+	l.Close()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestServer(t *testing.T) {
+	fmt.Printf("Test: Stop drains the requests in flight ...\n")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	url := "http://" + l.Addr().String()
+	started := make(chan struct{}, 1)
+	srv, err := Serve(&http.Server{Handler: slow(300*time.Millisecond, started)}, l, false)
+	if err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	c := &http.Client{Timeout: 5 * time.Second}
+	res := make(chan string)
+	go func() {
+		s, err := get(c, url)
+		if err != nil {
+			s = err.Error()
+		}
+		res <- s
+	}()
+	<-started
+	stopped := make(chan error)
+	go func() {
+		stopped <- srv.Stop(5 * time.Second)
+	}()
+	<-srv.Released()
+	if _, err := get(&http.Client{Timeout: time.Second}, url); err == nil {
+		t.Fatalf("a request was served after Stop")
+	}
+	if s := <-res; s != "done" {
+		t.Fatalf("the request in flight -> %q", s)
+	}
+	if err := <-stopped; err != nil {
+		t.Fatalf("Stop -> %v", err)
+	}
+	<-srv.Done()
+	if srv.Err() != nil {
+		t.Fatalf("Serve -> %v", srv.Err())
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Stop cuts off the requests after the deadline ...\n")
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	url = "http://" + l.Addr().String()
+	srv, _ = Serve(&http.Server{Handler: slow(2*time.Second, started)}, l, false)
+	go func() {
+		s, err := get(c, url)
+		if err != nil {
+			s = err.Error()
+		}
+		res <- s
+	}()
+	<-started
+	start := time.Now()
+	if err := srv.Stop(100 * time.Millisecond); err != context.DeadlineExceeded {
+		t.Fatalf("Stop of a slow request -> %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Stop took %v", d)
+	}
+	if s := <-res; s == "done" {
+		t.Fatalf("the request in flight ended after its connection was closed")
+	}
+
+	fmt.Printf("  ... Passed\n")
+
+	fmt.Printf("Test: Serve on a Unix socket ...\n")
+
+	dir, err := ioutil.TempDir("", "stoppable")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "http")
+	l, err = net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	srv, _ = Serve(&http.Server{Handler: slow(0, nil)}, l, false)
+	uc := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+	}}}
+	if s, err := get(uc, "http://unix/"); err != nil || s != "done" {
+		t.Fatalf("GET over the socket -> %q, %v", s, err)
+	}
+	if err := srv.Stop(time.Second); err != nil {
+		t.Fatalf("Stop -> %v", err)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Fatalf("the socket is still there after Stop: %v", err)
+	}
+	l, err = net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen again: %v", err)
+	}
+	l.Close()
+
+	fmt.Printf("  ... Passed\n")
+}
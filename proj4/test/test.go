@@ -1,95 +1,35 @@
 package main
 
 import(
+  "context"
+  "encoding/json"
+  "flag"
   "net/http"
   "fmt"
   "os"
-  "os/exec"
   "time"
   "log"
-  "strings"
-  "strconv"
   //our lib
   . "kvlib"
+  _ "kvpaxos/httpclient" // the client of the scripts
 
 )
 
 func usage(){
-  fmt.Println("The main tester calls other remote testers to start/stop server.")
-  fmt.Println("[id]   :    Launch the remote tester of specified id.")
-  fmt.Println("-m     :    Launch the main tester.")
+  fmt.Println("The main tester calls the agents of the nodes to start/stop their servers.")
+  fmt.Println("[id] [-logs dir]   :    Launch the agent of specified id, the output of its server in dir.")
+  fmt.Println("-m [-report file.json] [-junit file.xml]   :    Launch the main tester, and write its report.")
+  fmt.Println("Both take [-conf settings.conf] [-set name=value]... and [-tests test.conf].")
   os.Exit(1)
 }
 
 
 var(
-  role = Det_role()
-  pr *os.Process = nil // keep the kv server process for killing
+  agents *AgentClients
   remaining = 0
   not_forced_to_quit = true
 )
 
-func check_alive_Handler(w http.ResponseWriter, r *http.Request) {
-  fmt.Fprintf(w, "I am alive!")
-  return
-}
-
-func start_server_Handler(w http.ResponseWriter, r *http.Request) {
-  if pr != nil{
-    fmt.Fprintf(w, "Server %d Already Started: %s",role, pr)
-    return
-  }
-  attr := &os.ProcAttr{
-        Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
-    }
-    id := fmt.Sprintf("n%02d", role)
-  pr,_ = os.StartProcess("bin/start_server", []string{"bin/starst_server",id}, attr)
-	//res := CmdStartServer(strconv.Itoa(role))
-	fmt.Fprintf(w, "Start Server %d: %s",role, pr)
-}
-func kill_server_Handler(w http.ResponseWriter, r *http.Request) {
-  fmt.Println("kill handler")
-  if pr==nil{
-    fmt.Fprintf(w, "No server %d process to kill", role)
-    return
-  }
-  err := pr.Kill()
-  if err!=nil{
-    fmt.Fprintf(w, "Kill Server %d Failed: %s", role, err)
-    pr.Kill()
-  }else{
-    fmt.Fprintf(w, "Kill Server %d Success!", role)
-  }
-  pr = nil
-}
-func stop_server_Handler(w http.ResponseWriter, r *http.Request) {
-  fmt.Println("stop handler")
-  var res string
-  id := fmt.Sprintf("n%02d", role)
-  cmd := exec.Command("bin/stop_server", []string{id}...)
-  o,e := cmd.Output()
-
-  if e!=nil || len(o)<=1 {
-    res = "Error"
-  }else{
-    res = strings.Replace(string(o[:]),"\n"," ",-1)
-  }
-  pr = nil
-	fmt.Fprintf(w, "Tester %d Stop Server: %s",role, res)
-}
-func shutdown_Handler(w http.ResponseWriter, r *http.Request){
-  fmt.Fprintf(w, "Goodbye main tester! Tester %d shutdown!", role)
-  if pr!=nil{
-    pr.Kill()
-  }
-  fmt.Printf("Tester %d shutdown!\n", role)
-  go func(){
-    time.Sleep(time.Millisecond*1000) //sleep epsilon
-    os.Exit(role)
-  }()
-  return
-}
-
 func main_Handler(w http.ResponseWriter, r *http.Request){
   key:= r.FormValue("op")
   switch key{
@@ -98,9 +38,7 @@ func main_Handler(w http.ResponseWriter, r *http.Request){
     if val=="true"{
       fmt.Fprintf(w,"Forced to finish!")
       go func(){
-        All_request(Server_addr, "/kvman/shutdown")
-        All_request(Tester_addr, "/test/shutdown")
-        time.Sleep(time.Millisecond * 1000)
+        shutdownAgents()
         os.Exit(0)
       }()
       return
@@ -116,11 +54,10 @@ func main_Handler(w http.ResponseWriter, r *http.Request){
       go func(){
         for pre_remain<=remaining && count>0{
           time.Sleep(time.Millisecond * 5000)
-          fmt.Println(count,"\tWait for current case to finish!\n")
+          fmt.Printf("%d\tWait for current case to finish!\n\n", count)
           count--
         }
-        All_request(Server_addr, "/kvman/shutdown")
-        All_request(Tester_addr, "/test/shutdown")
+        shutdownAgents()
         flag = 1
       }()
 
@@ -142,146 +79,221 @@ func main_Handler(w http.ResponseWriter, r *http.Request){
   }
 }
 
-// run on main tester
-func StartTest(conf map[string]string) string{
-  res := ""
-  // may need to check using the same port
+// the servers, each through its agent, if they are up already
+func serversRunning() bool {
+  running := false
+  for i := range agents.URLs {
+    if st,err := agents.Health(i); err==nil && st.Running {
+      fmt.Printf("Server %d runs already, pid %d\n", i+1, st.Pid)
+      running = true
+    }
+  }
+  return running
+}
 
-  res += fmt.Sprintf("config: \n\t srv01: %s\n\t srv02: %s\n\t srv03: %s\n",
-    Server_addr[0],Server_addr[1],Server_addr[2])
+// run a test case, with the servers started before and stopped after it
+// if auto_restart; a server that ended by itself fails the case
+func runCase(testname string, auto_restart bool) (*CaseReport, string) {
+  start_time := time.Now()
+  var setup []string
+  if auto_restart{
+    for i := range agents.URLs {
+      if _,err := agents.Start(i); err!=nil {
+        setup = append(setup, fmt.Sprintf("Cannot start server %d: %v", i+1, err))
+      }
+    }
+  }
 
-  tot,_ := strconv.Atoi(conf["test_total"])
-  cnt := tot
-  remaining = tot
-  fmt.Println("********************* Start Testing *****************************")
-  var dura_total time.Duration
-  for i := 0; i < tot && not_forced_to_quit ; i++ {
-    testname := conf["pre"]+strconv.Itoa(i)+".test"
-    if conf["fmt"] != "true"{ //no need to specify each test case name
-      testname = conf["pre"]+conf[strconv.Itoa(i)]
+  res, fail := RunScript(Server_addr, agents, testname, auto_restart)
+  c := NewCaseReport(testname, start_time, res, fail)
+  c.Failures = append(setup, c.Failures...)
+  running := make([]bool, len(agents.URLs))
+  for i := range agents.URLs {
+    st,err := agents.Health(i)
+    if err!=nil {
+      c.Failures = append(c.Failures, fmt.Sprintf("Agent %d: %v", i+1, err))
+      continue
     }
-    auto_restart := false
-    if conf["auto_restart_server"]=="true"{
-      All_request(Tester_addr, "/test/start_server")
-      auto_restart = true
-      time.Sleep(time.Millisecond * 1500)
+    if st.Exit!=nil && !st.Exit.Expected && st.Exit.At.After(start_time) {
+      c.Failures = append(c.Failures, fmt.Sprintf("Server %d: %v", i+1, st.Exit))
     }
+    running[i] = st.Running
+    c.Servers = append(c.Servers, st)
+  }
+  if fail!=0 || len(c.Failures)>0 {
+    c.Passed = false
+    c.Output = res
+    c.Logs = map[string]string{}
+    for i := range agents.URLs {
+      if s,err := agents.Logs(i, 50); err==nil {
+        c.Logs[fmt.Sprintf("n%02d", i+1)] = s
+      }
+    }
+  }
 
-
-
-      start_time := time.Now()
-      res, fail := TestUnit(Server_addr, Tester_addr, testname, auto_restart)
-      end_time :=time.Now()
-      var dura time.Duration = end_time.Sub(start_time)
-      dura_total += dura
-      if conf["auto_restart_server"]=="true"{
-        All_request(Tester_addr, "/test/stop_server")
-        time.Sleep(time.Millisecond * 500)
+  if auto_restart{
+    for i := range agents.URLs {
+      if !running[i] {
+        continue
       }
-      if conf["with_err_msg"]=="true"{
-        fmt.Printf("%s", res)
-        if fail == 0 {
-            fmt.Printf("\nTest case %d: success!\n", i)
-        } else {
-            fmt.Printf("\nTest case %d: failed!\n", i)
-        }
-        fmt.Printf("Ellapsed Time: %f secs\n\n", dura.Seconds())
+      if _,err := agents.StopServer(i, "stop_server"); err!=nil {
+        fmt.Printf("Cannot stop server %d: %v\n", i+1, err)
       }
+    }
+  }
+  return c, res
+}
+
+// run on main tester
+func StartTest(tc *TesterConfig) *TestReport{
+  report := NewTestReport("kvpaxos")
 
-      cnt -= fail
-      remaining--
+  fmt.Printf("config: \n")
+  for i := range Server_addr {
+    fmt.Printf("\t srv%02d: %s\n", i+1, Server_addr[i])
+  }
 
+  tot := tc.TestTotal
+  remaining = tot
+  fmt.Println("********************* Start Testing *****************************")
+  for i := 0; i < tot && not_forced_to_quit ; i++ {
+    testname := tc.Case(i)
+
+    c, res := runCase(testname, tc.AutoRestartServer)
+    report.Add(c)
+    if tc.WithErrMsg{
+      fmt.Printf("%s", res)
+      if c.Passed {
+        fmt.Printf("\nTest case %d: success!\n", i)
+      } else {
+        for _,f := range c.Failures {
+          fmt.Printf("\n%s\n", f)
+        }
+        fmt.Printf("\nTest case %d: failed!\n", i)
+      }
+      fmt.Printf("Ellapsed Time: %f secs\n\n", c.DurationS)
+    }
+    remaining--
   }
   fmt.Println("********************* Finish Testing *****************************")
 
-  if cnt == tot {
-    res+="\nSuccess\n"
+  if report.Failed == 0 {
+    fmt.Printf("\nSuccess\n")
   } else {
-    res+="\nFail\n"
+    fmt.Printf("\nFail\n")
+    for _,c := range report.Cases {
+      if !c.Passed {
+        fmt.Printf("  %s\n", c.Name)
+      }
+    }
   }
-  res+= fmt.Sprintf("Total Time: %f mins\n\n", dura_total.Minutes())
-
-  fmt.Println(res)
-
-  return res
+  fmt.Printf("%d/%d passed, Total Time: %f mins\n\n", report.Passed, report.Total, report.DurationS/60)
+  return report
 }
 
-
-func All_request(addr []string, req string){
-  for i:=0;i<len(addr);i++ {
-    resp, err := http.Get(addr[i] +req)
-    if err != nil{
-      fmt.Println(err)
-    }else{
-      fmt.Println(DecodeStr(resp))
+func writeReport(fn string, write func(f *os.File) error) {
+  if fn=="" {
+    return
+  }
+  f,err := os.Create(fn)
+  if err==nil {
+    err = write(f)
+    if e := f.Close(); err==nil {
+      err = e
     }
   }
+  if err!=nil {
+    fmt.Printf("Cannot write the report %s: %v\n", fn, err)
+  }else{
+    fmt.Printf("Report written to %s\n", fn)
+  }
 }
 
-var auxTesterHandlers map[string]http.HandlerFunc = map[string]http.HandlerFunc{
-    "/test":check_alive_Handler,
-    "/test/start_server":start_server_Handler,
-    "/test/stop_server":kill_server_Handler,
-    "/test/shutdown":shutdown_Handler,
-}
-
-var Tester_addr []string = make([]string, 3)
-var Server_addr []string = make([]string, 3)
-
-func mainTesterCheck(addr []string)bool{
-    count := 0
-    for i:=0;i<len(addr);i++{
-      _,err := http.Get(addr[i]+"/test")
-      if err != nil{
-        fmt.Println(err)
-        fmt.Printf("Remote tester %d not alive!\n", i+1)
-      }else{
-        count ++
-      }
+// end every agent, and its server with it
+func shutdownAgents(){
+  for i := range agents.URLs {
+    if _,err := agents.Shutdown(i); err!=nil {
+      fmt.Println(err)
+    }else{
+      fmt.Printf("Agent %d shutdown!\n", i+1)
     }
-    return count >= len(addr)
+  }
 }
 
+var Server_addr []string
 
 func main(){
-  if role < 0{
-    fmt.Printf("role: %d\n", role)
+  fs := flag.NewFlagSet("test", flag.ExitOnError)
+  fs.Usage = usage
+  main_tester := fs.Bool("m", false, "launch the main tester")
+  logs := fs.String("logs", "logs", "the directory of the output of the server (agent)")
+  report_json := fs.String("report", "", "write the report in JSON to this file (main tester)")
+  report_junit := fs.String("junit", "", "write the report in JUnit XML to this file (main tester)")
+  tests := fs.String("tests", "conf/test.conf", "the settings of the tester")
+  cf := NewConfigFlags(fs)
+  args,_ := ParseInterspersed(fs, os.Args[1:])
+  if *main_tester == (len(args)==1) || len(args)>1 {
     usage()
   }
-  if role == 0{
-    fmt.Println("Launch main tester")
-  }else{
-    fmt.Printf("Launch tester %d\n",role)
+  conf,err := cf.Load()
+  if err!=nil {
+    fmt.Println(err)
+    os.Exit(1)
   }
-  conf := ReadJson("conf/test.conf")
-  ips := []string{"127.0.0.1",conf["n01"],conf["n02"],conf["n03"]}
-  ports := []string{conf["port"],conf["port_n01"],conf["port_n02"],conf["port_n03"]}
-  if conf["use_different_port"]!="true"{
-    ports[1],ports[2],ports[3] = ports[0],ports[0],ports[0]
+  tc,err := LoadTesterConfig(*tests)
+  if err!=nil {
+    fmt.Println(err)
+    os.Exit(1)
   }
-  tester_ports := []string{conf["test_port00"],conf["test_port01"],conf["test_port02"],conf["test_port03"]}
-
-  for i:=1;i<=3;i++{
-    Tester_addr[i-1] = fmt.Sprintf("http://%s:%s" ,ips[i],tester_ports[i])
-    Server_addr[i-1] = fmt.Sprintf("http://%s:%s" ,ips[i], ports[i])
+  n := tc.NServers
+  if n == 0{
+    n = conf.N()
+  }
+  if n>conf.N() {
+    fmt.Printf("%s: nservers %d, of %d nodes in %s\n", *tests, n, conf.N(), conf.File)
+    os.Exit(1)
+  }
+  var tester_addr []string
+  for i:=0;i<n;i++{
+    if conf.Nodes[i].AgentPort == 0{
+      fmt.Printf("%s: no agent_port of %s\n", conf.File, NodeName(i))
+      os.Exit(1)
+    }
+    tester_addr = append(tester_addr, conf.AgentURL(i))
+    Server_addr = append(Server_addr, conf.URL(i))
   }
 
-  if role == 0{
-    // check connections with remote testers
-    for i:=0;i<30;i++{
-      if mainTesterCheck(Tester_addr){
-        fmt.Println("All remote testers alive!")
-        fmt.Println("Main tester start testing!")
-        break
-      }else{
+  if *main_tester{
+    fmt.Println("Launch main tester")
+    agents = &AgentClients{URLs:tester_addr, StopByKill:tc.StopByKill,
+      Client:&http.Client{Timeout:time.Minute}}
+    // check connections with the agents
+    alive := false
+    for i:=0;i<30 && !alive;i++{
+      alive = true
+      for j := range agents.URLs {
+        if _,err := agents.Health(j); err!=nil {
+          fmt.Printf("Agent %d not alive: %v\n", j+1, err)
+          alive = false
+        }
+      }
+      if !alive {
         fmt.Println("Main tester wait for another check")
         time.Sleep(time.Millisecond * 2000)
       }
     }
-    defer All_request(Tester_addr, "/test/shutdown") //remember to shutdown remote testers
+    if !alive {
+      fmt.Println("Not all agents alive, giving up!")
+      os.Exit(1)
+    }
+    fmt.Println("All agents alive!")
+    if serversRunning() {
+      fmt.Println("Some servers run already, the results may be off!")
+    }
+    fmt.Println("Main tester start testing!")
 
     s := &http.Server{
-  		Addr: ":"+tester_ports[role],
+  		Addr: fmt.Sprintf(":%d", tc.MainPort),
   		Handler: nil,
   		ReadTimeout: 10 * time.Second,
   		WriteTimeout: 10 * time.Second,
@@ -295,31 +307,59 @@ func main(){
     /* run test cases here !  */
 
 
-    StartTest(conf)
+    report := StartTest(tc)
 
 
     /* all test cases finished ! */
 
-    time.Sleep(time.Millisecond * 2000)
+    writeReport(*report_json, func(f *os.File) error { return report.WriteJSON(f) })
+    writeReport(*report_junit, func(f *os.File) error { return report.WriteJUnit(f) })
+    shutdownAgents()
 
-    fmt.Println("Main tester finished!\n")
+    fmt.Printf("Main tester finished!\n\n")
+    if report.Failed>0 {
+      os.Exit(1)
+    }
 
   }else{
+    me,err := conf.Node(args[0])
+    if err!=nil || me>=n {
+      fmt.Printf("%s: not one of the %d servers of the tester\n", args[0], n)
+      usage()
+    }
+    id := NodeName(me)
+    fmt.Printf("Launch agent %d\n", me+1)
+    // the servers of the tester are a cluster of their own
+    server_args := cf.Args()
+    if n<conf.N() {
+      nodes,_ := json.Marshal(conf.Nodes[:n])
+      server_args = append(server_args, "-set", "nodes="+string(nodes))
+    }
+    if err := os.MkdirAll(*logs, 0755); err!=nil {
+      log.Fatal(err)
+    }
+    agent := NewAgent(AgentConfig{
+      Node: me+1,
+      Command: append(append([]string{"bin/start_server"}, server_args...), id),
+      StopCommand: append(append([]string{"bin/stop_server"}, server_args...), id),
+      Server: conf.HTTPAddr(me),
+      Log: AgentLog(*logs, me+1),
+    })
     s := &http.Server{
-  		Addr: ":"+tester_ports[role],
-  		Handler: nil,
+  		Addr: fmt.Sprintf(":%d", conf.Nodes[me].AgentPort),
+  		Handler: agent.Handler(),
   		ReadTimeout: 10 * time.Second,
-  		WriteTimeout: 10 * time.Second,
   		MaxHeaderBytes: 1<<20,
   	}
-    if conf["stop_by_kill"]!="true"{
-      auxTesterHandlers["/test/stop_server"] = stop_server_Handler
-    }
-
-    for key,val := range auxTesterHandlers{
-      http.HandleFunc(key,val)
-    }
+    go func(){
+      if err := s.ListenAndServe(); err!=http.ErrServerClosed {
+        log.Fatal(err)
+      }
+    }()
 
-    log.Fatal(s.ListenAndServe())
+    <-agent.Done()
+    // the reply to the shutdown is sent before the server closes
+    s.Shutdown(context.Background())
+    fmt.Printf("Agent %d shutdown!\n", me+1)
   }
 }